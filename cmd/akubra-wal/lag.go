@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/config"
+	"github.com/allegro/akubra/internal/akubra/sharding"
+	"github.com/allegro/akubra/internal/akubra/storages"
+	"github.com/allegro/akubra/internal/akubra/transport"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	watchdogConfig "github.com/allegro/akubra/internal/akubra/watchdog/config"
+)
+
+const unknownShard = "<unknown>"
+
+type shardLag struct {
+	shard  string
+	count  int
+	oldest time.Time
+}
+
+// domainRings maps configured domains to rings of their sharding policies
+func domainRings(akubraConf *config.Config) (map[string]sharding.ShardsRingAPI, error) {
+	transportMatcher, err := transport.ConfigureHTTPTransports(akubraConf.Service.Client)
+	if err != nil {
+		return nil, err
+	}
+	ringStorages, err := storages.
+		NewStoragesFactory(transportMatcher, &watchdogConfig.WatchdogConfig{}, nil, nil).
+		InitStorages(akubraConf.Shards, akubraConf.Storages, akubraConf.IgnoredCanonicalizedHeaders)
+	if err != nil {
+		return nil, err
+	}
+	ringFactory := sharding.NewRingFactory(*akubraConf, ringStorages, nil, nil, "")
+	rings := make(map[string]sharding.ShardsRingAPI)
+	for policyName, policy := range akubraConf.ShardingPolicies {
+		ring, err := ringFactory.RegionRing(policyName, *akubraConf, policy)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %s", policyName, err)
+		}
+		for _, domain := range policy.Domains {
+			rings[hostname(domain)] = ring
+		}
+	}
+	return rings, nil
+}
+
+// recordShards names the shards a record has to be replicated within, bucket
+// records concern all shards of the ring
+func recordShards(rings map[string]sharding.ShardsRingAPI, record *watchdog.SQLConsistencyRecord) []string {
+	ring, ok := rings[hostname(record.Domain)]
+	if !ok {
+		return []string{unknownShard}
+	}
+	if record.Operation == string(watchdog.BucketOperation) {
+		var names []string
+		for name := range ring.GetShards() {
+			names = append(names, name)
+		}
+		return names
+	}
+	shard, err := ring.Pick(record.ObjectID)
+	if err != nil {
+		return []string{unknownShard}
+	}
+	return []string{shard.Name()}
+}
+
+func printLag(consistencyLog *watchdog.ConsistencyLog, akubraConf *config.Config) error {
+	rings, err := domainRings(akubraConf)
+	if err != nil {
+		return err
+	}
+	lags := make(map[string]*shardLag)
+	err = consistencyLog.Each(filter, func(record *watchdog.SQLConsistencyRecord) error {
+		for _, shard := range recordShards(rings, record) {
+			lag, ok := lags[shard]
+			if !ok {
+				lag = &shardLag{shard: shard, oldest: record.InsertedAt}
+				lags[shard] = lag
+			}
+			lag.count++
+			if record.InsertedAt.Before(lag.oldest) {
+				lag.oldest = record.InsertedAt
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sorted := make([]*shardLag, 0, len(lags))
+	for _, lag := range lags {
+		sorted = append(sorted, lag)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].oldest.Before(sorted[j].oldest) })
+
+	now := time.Now().UTC()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SHARD\tPENDING\tLAG\tOLDEST")
+	for _, lag := range sorted {
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\n", lag.shard, lag.count, now.Sub(lag.oldest).Round(time.Second),
+			lag.oldest.Format(time.RFC3339))
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/allegro/akubra/internal/akubra/config"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+)
+
+var (
+	app        = kingpin.New("akubra-wal", "Inspects and manages akubra consistency log")
+	configFile = app.
+			Flag("config", "Akubra configuration file path e.g.: \"conf/dev.yaml\"").
+			Short('c').
+			Required().
+			ExistingFile()
+
+	filter = watchdog.RecordFilter{}
+
+	statsCmd = app.Command("stats", "Show pending records grouped by domain, bucket, method and age")
+	lagCmd   = app.Command("lag", "Show the age of the oldest pending record of each shard")
+
+	forceCmd = app.Command("force", "Make matching records due immediately")
+	forceAll = forceCmd.Flag("all", "Allow matching all records").Bool()
+
+	deleteCmd = app.Command("delete", "Delete matching records")
+	deleteAll = deleteCmd.Flag("all", "Allow matching all records").Bool()
+
+	exportCmd    = app.Command("export", "Export matching records as JSON lines")
+	exportOutput = exportCmd.Flag("output", "Output file, stdout by default").Short('o').String()
+
+	importCmd   = app.Command("import", "Import records exported as JSON lines")
+	importInput = importCmd.Flag("input", "Input file, stdin by default").Short('i').String()
+)
+
+func init() {
+	for _, cmd := range []*kingpin.CmdClause{statsCmd, lagCmd, forceCmd, deleteCmd, exportCmd} {
+		cmd.Flag("request-id", "Match the record of a request").StringVar(&filter.RequestID)
+		cmd.Flag("domain", "Match records of a domain").StringVar(&filter.Domain)
+		cmd.Flag("bucket", "Match records of a bucket and its objects").StringVar(&filter.Bucket)
+		cmd.Flag("method", "Match records of a method (PUT or DELETE)").StringVar((*string)(&filter.Method))
+		cmd.Flag("older-than", "Match records inserted earlier than that, e.g. 1h").DurationVar(&filter.OlderThan)
+	}
+}
+
+func main() {
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+	akubraConf := readConfiguration(*configFile)
+	consistencyLog, err := watchdog.OpenConsistencyLog(&akubraConf.Watchdog)
+	if err != nil {
+		log.Fatalf("Failed to open consistency log: %s", err)
+	}
+	defer func() {
+		if err := consistencyLog.Close(); err != nil {
+			log.Printf("Could not close consistency log: %s", err)
+		}
+	}()
+
+	switch command {
+	case statsCmd.FullCommand():
+		err = printStats(consistencyLog)
+	case lagCmd.FullCommand():
+		err = printLag(consistencyLog, &akubraConf)
+	case forceCmd.FullCommand():
+		err = modify(consistencyLog.ForceExecution, "Forced execution of", *forceAll)
+	case deleteCmd.FullCommand():
+		err = modify(consistencyLog.Delete, "Deleted", *deleteAll)
+	case exportCmd.FullCommand():
+		err = export(consistencyLog, *exportOutput)
+	case importCmd.FullCommand():
+		err = importRecords(consistencyLog, *importInput)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %s", command, err)
+	}
+}
+
+func readConfiguration(path string) config.Config {
+	configReadCloser, err := config.ReadConfiguration(path)
+	if err != nil {
+		log.Fatalf("Could not read akubra configuration: %s", err)
+	}
+	defer func() {
+		if err := configReadCloser.Close(); err != nil {
+			log.Println("Could not close config file")
+		}
+	}()
+	akubraConf, err := config.Configure(configReadCloser)
+	if err != nil {
+		log.Fatalf("Improperly configured %s", err)
+	}
+	return akubraConf
+}
+
+func printStats(consistencyLog *watchdog.ConsistencyLog) error {
+	now := time.Now().UTC()
+	groups, err := consistencyLog.Stats(filter, now)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DOMAIN\tBUCKET\tMETHOD\tAGE\tCOUNT\tOLDEST")
+	for _, group := range groups {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%s\n", group.Domain, group.Bucket, group.Method, group.AgeClass,
+			group.Count, now.Sub(group.Oldest).Round(time.Second))
+	}
+	return writer.Flush()
+}
+
+func modify(change func(watchdog.RecordFilter) (int64, error), description string, all bool) error {
+	if filter.IsEmpty() && !all {
+		return fmt.Errorf("no filter given, pass --all to match all records")
+	}
+	count, err := change(filter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %d records\n", description, count)
+	return nil
+}
+
+func export(consistencyLog *watchdog.ConsistencyLog, output string) error {
+	var writer io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	buffered := bufio.NewWriter(writer)
+	encoder := json.NewEncoder(buffered)
+	err := consistencyLog.Each(filter, func(record *watchdog.SQLConsistencyRecord) error {
+		return encoder.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+func importRecords(consistencyLog *watchdog.ConsistencyLog, input string) error {
+	var reader io.Reader = os.Stdin
+	if input != "" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	decoder := json.NewDecoder(reader)
+	imported := 0
+	for {
+		record := &watchdog.SQLConsistencyRecord{}
+		err := decoder.Decode(record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("malformed record after %d imported: %s", imported, err)
+		}
+		if err := consistencyLog.Import(record); err != nil {
+			return fmt.Errorf("failed to import record %s after %d imported: %s", record.RequestID, imported, err)
+		}
+		imported++
+	}
+	fmt.Printf("Imported %d records\n", imported)
+	return nil
+}
+
+func hostname(domain string) string {
+	return strings.Split(domain, ":")[0]
+}
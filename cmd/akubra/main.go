@@ -5,10 +5,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -28,6 +30,7 @@ import (
 	"github.com/allegro/akubra/internal/akubra/privacy"
 	"github.com/allegro/akubra/internal/akubra/regions"
 	"github.com/allegro/akubra/internal/akubra/storages"
+	"github.com/allegro/akubra/internal/akubra/storages/auth"
 	"github.com/allegro/akubra/internal/akubra/transport"
 
 	_ "github.com/lib/pq"
@@ -53,10 +56,8 @@ var (
 			Flag("test-config", "Testing only configuration file from 'config' arg. (app. not starting).").
 			Short('t').
 			Bool()
-)
-
-const (
-	postgresConnStringFormat = "sslmode=disable dbname=:dbname: user=:user: password=:password: host=:host: port=:port: connect_timeout=:conntimeout:"
+	encryptSecretFor = kingpin.Flag("encrypt-secret",
+		"Encrypts the secret read from stdin with the key of the given File CredentialsStore (app. not starting).").String()
 )
 
 func main() {
@@ -72,6 +73,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *encryptSecretFor != "" {
+		encryptSecret(conf, *encryptSecretFor)
+		os.Exit(0)
+	}
+
 	mainlog, err := log.NewDefaultLogger(conf.Logging.Mainlog, "LOG_LOCAL2", false)
 	if err != nil {
 		log.Fatalf("Could not set up main logger: %q", err)
@@ -81,6 +87,7 @@ func main() {
 	log.Printf("Health check endpoint: %s", conf.Service.Server.HealthCheckEndpoint)
 	mainlog.Printf("starting on port %s", conf.Service.Server.Listen)
 
+	crdstore.InitializeSessionStore(conf.Sessions)
 	srv := newService(conf, *configFile)
 	srv.startTechnicalEndpoint()
 	startErr := srv.start()
@@ -89,6 +96,23 @@ func main() {
 	}
 }
 
+// encryptSecret prints the secret read from stdin encrypted for the File CredentialsStore's credentials file
+func encryptSecret(conf config.Config, crdStoreName string) {
+	crdStore, defined := conf.CredentialsStores[crdStoreName]
+	if !defined || crdStore.Type != "File" {
+		log.Fatalf("File CredentialsStore '%s' is not defined", crdStoreName)
+	}
+	secret, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read the secret: %s", err)
+	}
+	encryptedSecret, err := crdstore.EncryptFileSecret(crdStoreName, crdStore.Properties, strings.TrimRight(string(secret), "\r\n"))
+	if err != nil {
+		log.Fatalf("Failed to encrypt the secret: %s", err)
+	}
+	fmt.Println(encryptedSecret)
+}
+
 func readConfiguration() (config.Config, error) {
 	if vault.DefaultClient != nil {
 		return readVaultConfiguration()
@@ -186,6 +210,9 @@ type service struct {
 	handler    http.Handler
 	srv        *http.Server
 	ctx        context.Context
+	// consistencyWatchdog is the watchdog used by the current handler
+	consistencyWatchdog watchdog.ConsistencyWatchdog
+	lagReporter         *watchdog.LagReporter
 }
 
 func (s *service) start() (err error) {
@@ -225,12 +252,16 @@ func (s *service) signalsHandler() {
 				log.Printf("New config is corrupted %s", err)
 				continue
 			}
+			previousWatchdog := s.consistencyWatchdog
 			handler, err := s.createHandler(conf)
 			if err != nil {
 				log.Printf("Handler initialization failure %s", err)
 			}
 			s.handler = handler
 			log.Println("Handler replaced")
+			if previousWatchdog != s.consistencyWatchdog {
+				closeWatchdog(previousWatchdog)
+			}
 		case <-intr:
 			log.Println("Shutting down")
 			err := s.srv.Shutdown(s.ctx)
@@ -261,6 +292,16 @@ func (s *service) createHandler(conf config.Config) (http.Handler, error) {
 
 	watchdogRecordFactory := &watchdog.DefaultConsistencyRecordFactory{}
 	consistencyWatchdog := setupWatchdog(s.config.Watchdog)
+	s.consistencyWatchdog = consistencyWatchdog
+	if s.lagReporter != nil {
+		s.lagReporter.Stop()
+		s.lagReporter = nil
+	}
+	if s.config.Watchdog.Type != "" {
+		if s.lagReporter, err = watchdog.StartLagReporter(&s.config.Watchdog); err != nil {
+			log.Printf("Replication lag metrics are disabled, failed to open the consistency log: %s", err)
+		}
+	}
 
 	storagesFactory := storages.NewStoragesFactory(transportMatcher, &s.config.Watchdog, consistencyWatchdog, watchdogRecordFactory)
 	ignoredSignHeaders := map[string]bool{s.config.Watchdog.ObjectVersionHeaderName: true}
@@ -298,12 +339,21 @@ func (s *service) createHandler(conf config.Config) (http.Handler, error) {
 
 
 
-	regionsDecoratedRT = httphandler.Decorate(regionsDecoratedRT,
+	decorators := []httphandler.Decorator{
 		httphandler.ResponseHeadersStripper(conf.Service.Client.ResponseHeadersToStrip),
 		httphandler.PrivacyFilterChain(conf.Privacy.ShouldDropRequests, conf.Privacy.ViolationErrorCode, basicChain),
 		httphandler.PrivacyContextSupplier(privacyContextSupplier),
-		httphandler.AccessLogging(accessLog),
-	)
+	}
+	sessions := crdstore.GetSessionStore()
+	if sessions != nil {
+		decorators = append(decorators, auth.SessionDecorator(crdstore.DefaultCredentialsStoreName, sessions, ignoredSignHeaders))
+	}
+	decorators = append(decorators, httphandler.AccessLogging(accessLog))
+	if crdstore.DefaultCredentialsStoreName != "" {
+		decorators = append(decorators, auth.PostObjectDecorator(crdstore.DefaultCredentialsStoreName, sessions,
+			conf.Service.Server.BodyMaxSize.SizeInBytes))
+	}
+	regionsDecoratedRT = httphandler.Decorate(regionsDecoratedRT, decorators...)
 
 	handler, err := httphandler.NewHandlerWithRoundTripper(regionsDecoratedRT, conf.Service.Server)
 	if err != nil {
@@ -322,18 +372,39 @@ func setupWatchdog(watchdogConfig watchdogConfig.WatchdogConfig) watchdog.Consis
 		return nil
 	}
 
-	consistencyWatchdog, err := watchdog.CreateSQL("postgres",
-		postgresConnStringFormat,
-		[]string{"user", "password", "dbname", "host", "port", "conntimeout"},
-		&watchdogConfig)
+	var consistencyWatchdog watchdog.ConsistencyWatchdog
+	var err error
+	switch strings.ToLower(watchdogConfig.Type) {
+	case watchdog.EmbeddedWatchdogType:
+		consistencyWatchdog, err = (&watchdog.EmbeddedWatchdogFactory{}).CreateWatchdogInstance(&watchdogConfig)
+	default:
+		consistencyWatchdog, err = watchdog.CreateSQL(&watchdogConfig)
+	}
 
 	if err != nil {
 		log.Fatalf("Failed to create consistencyWatchdog %s", err)
 	}
+	if watchdogConfig.Batching.Enabled {
+		consistencyWatchdog, err = watchdog.NewBatchingWatchdog(consistencyWatchdog, watchdogConfig.Batching)
+		if err != nil {
+			log.Fatalf("Failed to setup consistency log batching %s", err)
+		}
+	}
 
 	return consistencyWatchdog
 }
 
+// closeWatchdog flushes the records of the watchdog replaced on reload
+func closeWatchdog(consistencyWatchdog watchdog.ConsistencyWatchdog) {
+	closer, ok := consistencyWatchdog.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		log.Printf("Failed to close the previous consistency watchdog: %s", err)
+	}
+}
+
 func (s *service) startTechnicalEndpoint() {
 	port := s.config.Service.Server.TechnicalEndpointListen
 	log.Printf("Starting technical HTTP endpoint on port: %q", port)
@@ -342,6 +413,12 @@ func (s *service) startTechnicalEndpoint() {
 		"/configuration/validate",
 		config.ValidateConfigurationHTTPHandler,
 	)
+	if s.config.Watchdog.Type != "" {
+		s.registerDeadLetterHandler(serveMuxHandler)
+	}
+	if sessions := crdstore.GetSessionStore(); sessions != nil {
+		serveMuxHandler.Handle(auth.AssumeRoleEndpointPath, auth.NewAssumeRoleHandler(sessions))
+	}
 	go func() {
 		srv := &http.Server{
 			Addr:           port,
@@ -354,3 +431,14 @@ func (s *service) startTechnicalEndpoint() {
 	}()
 	log.Println("Technical HTTP endpoint is running.")
 }
+
+func (s *service) registerDeadLetterHandler(serveMuxHandler *http.ServeMux) {
+	deadLetterQueue, err := watchdog.OpenDeadLetterQueue(&s.config.Watchdog)
+	if err != nil {
+		log.Printf("Dead-letter endpoints are disabled, failed to open the queue: %s", err)
+		return
+	}
+	deadLetterHandler := watchdog.NewDeadLetterHandler(deadLetterQueue, watchdog.DeadLetterEndpointPath)
+	serveMuxHandler.Handle(watchdog.DeadLetterEndpointPath, deadLetterHandler)
+	serveMuxHandler.Handle(watchdog.DeadLetterEndpointPath+"/", deadLetterHandler)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/alecthomas/kingpin"
 	"github.com/allegro/akubra/internal/akubra/config"
 	"github.com/allegro/akubra/internal/akubra/log"
@@ -21,10 +23,25 @@ var (
 			Short('b').
 			Required().
 			ExistingFile()
+
+	dryRun = kingpin.
+		Flag("dry-run", "Print the tasks planned for the due consistency records as JSON lines, without performing them").
+		Bool()
+
+	syncOwners = kingpin.
+			Flag("sync-owners", "Print the users, access keys and bucket owners differing between the clusters of every region as JSON lines").
+			Bool()
+
+	confirm = kingpin.
+		Flag("confirm", "Create the missing users and keys and relink the buckets found by --sync-owners, requires --sync-owners").
+		Bool()
 )
 
 func main() {
 	kingpin.Parse()
+	if *confirm && !*syncOwners {
+		kingpin.Fatalf("--confirm requires --sync-owners")
+	}
 	configReadCloser, err := config.ReadConfiguration(*akubraConfig)
 	if err != nil {
 		log.Fatal("No akubra configuration provided")
@@ -44,5 +61,17 @@ func main() {
 		log.Fatalf("Improperly configured %s", err)
 	}
 
+	if *dryRun {
+		if err := watchdog.RunDryRun(&akubraConf, &brimConf, os.Stdout); err != nil {
+			log.Fatalf("Dry run failed: %s", err)
+		}
+		return
+	}
+	if *syncOwners {
+		if err := watchdog.RunOwnershipSync(&brimConf, os.Stdout, *confirm); err != nil {
+			log.Fatalf("Ownership sync failed: %s", err)
+		}
+		return
+	}
 	watchdog.RunWatchdogWorker(&akubraConf, &brimConf)
 }
@@ -9,7 +9,10 @@ CREATE TABLE consistency_record
   execution_delay INTERVAL                NOT NULL,
   inserted_at     TIMESTAMPTZ             NOT NULL DEFAULT (CURRENT_TIMESTAMP at time zone 'utc'),
   updated_at      TIMESTAMPTZ             NOT NULL DEFAULT (CURRENT_TIMESTAMP at time zone 'utc'),
-  error           CHARACTER VARYING(1024)          DEFAULT ''
+  error           CHARACTER VARYING(1024)          DEFAULT '',
+  operation       CHARACTER VARYING(8)    NOT NULL DEFAULT 'object',
+  sub_resource    CHARACTER VARYING(16)   NOT NULL DEFAULT '',
+  attempts        BIGINT                  NOT NULL DEFAULT 0
 );
 
 CREATE UNIQUE INDEX consistency_record__domain__object_id__inserted_at
@@ -24,3 +27,23 @@ CREATE INDEX consistency_record__inserted_at
   ON consistency_record
     USING btree (object_version DESC);
 
+CREATE TABLE consistency_dead_letter
+(
+  request_id       CHARACTER(36) PRIMARY KEY,
+  object_version   BIGINT                  NOT NULL,
+  object_id        CHARACTER VARYING(1024) NOT NULL,
+  method           CHARACTER VARYING(8)    NOT NULL,
+  domain           CHARACTER VARYING(254)  NOT NULL,
+  access_key       CHARACTER VARYING(128)  NOT NULL,
+  operation        CHARACTER VARYING(8)    NOT NULL DEFAULT 'object',
+  sub_resource     CHARACTER VARYING(16)   NOT NULL DEFAULT '',
+  attempts         BIGINT                  NOT NULL DEFAULT 0,
+  error            CHARACTER VARYING(1024) NOT NULL DEFAULT '',
+  error_class      CHARACTER VARYING(32)   NOT NULL DEFAULT '',
+  backend          CHARACTER VARYING(254)  NOT NULL DEFAULT '',
+  dead_lettered_at TIMESTAMPTZ             NOT NULL DEFAULT (CURRENT_TIMESTAMP at time zone 'utc')
+);
+
+CREATE INDEX consistency_dead_letter__domain__object_id
+  ON consistency_dead_letter
+    USING btree (domain, object_id);
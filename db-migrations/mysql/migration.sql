@@ -0,0 +1,45 @@
+CREATE TABLE consistency_record
+(
+  object_version BIGINT NOT NULL DEFAULT (CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000 AS SIGNED)),
+  request_id CHAR(36) PRIMARY KEY,
+  object_id VARCHAR(1024) NOT NULL,
+  method VARCHAR(8) NOT NULL,
+  domain VARCHAR(254) NOT NULL,
+  access_key VARCHAR(128) NOT NULL,
+  execution_delay BIGINT NOT NULL,
+  inserted_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+  updated_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+  error VARCHAR(1024) DEFAULT '',
+  operation VARCHAR(8) NOT NULL DEFAULT 'object',
+  sub_resource VARCHAR(16) NOT NULL DEFAULT '',
+  attempts BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX consistency_record__domain__object_id__inserted_at
+  ON consistency_record (domain, object_id(500), object_version);
+
+CREATE INDEX consistency_record__request_id
+  ON consistency_record (request_id);
+
+CREATE INDEX consistency_record__inserted_at
+  ON consistency_record (object_version DESC);
+
+CREATE TABLE consistency_dead_letter
+(
+  request_id CHAR(36) PRIMARY KEY,
+  object_version BIGINT NOT NULL,
+  object_id VARCHAR(1024) NOT NULL,
+  method VARCHAR(8) NOT NULL,
+  domain VARCHAR(254) NOT NULL,
+  access_key VARCHAR(128) NOT NULL,
+  operation VARCHAR(8) NOT NULL DEFAULT 'object',
+  sub_resource VARCHAR(16) NOT NULL DEFAULT '',
+  attempts BIGINT NOT NULL DEFAULT 0,
+  error VARCHAR(1024) NOT NULL DEFAULT '',
+  error_class VARCHAR(32) NOT NULL DEFAULT '',
+  backend VARCHAR(254) NOT NULL DEFAULT '',
+  dead_lettered_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+);
+
+CREATE INDEX consistency_dead_letter__domain__object_id
+  ON consistency_dead_letter (domain, object_id(500));
@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS consistency_record
+(
+  object_version INTEGER NOT NULL DEFAULT (CAST(ROUND((julianday('now') - 2440587.5) * 86400000) AS INTEGER) * 1000),
+  request_id TEXT PRIMARY KEY,
+  object_id TEXT NOT NULL,
+  method TEXT NOT NULL,
+  domain TEXT NOT NULL,
+  access_key TEXT NOT NULL,
+  execution_delay INTEGER NOT NULL,
+  inserted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  error TEXT DEFAULT '',
+  operation TEXT NOT NULL DEFAULT 'object',
+  sub_resource TEXT NOT NULL DEFAULT '',
+  attempts INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS consistency_record__domain__object_id__inserted_at
+  ON consistency_record (domain, object_id, object_version);
+
+CREATE INDEX IF NOT EXISTS consistency_record__request_id
+  ON consistency_record (request_id);
+
+CREATE INDEX IF NOT EXISTS consistency_record__inserted_at
+  ON consistency_record (object_version DESC);
+
+CREATE TABLE IF NOT EXISTS consistency_dead_letter
+(
+  request_id TEXT PRIMARY KEY,
+  object_version INTEGER NOT NULL,
+  object_id TEXT NOT NULL,
+  method TEXT NOT NULL,
+  domain TEXT NOT NULL,
+  access_key TEXT NOT NULL,
+  operation TEXT NOT NULL DEFAULT 'object',
+  sub_resource TEXT NOT NULL DEFAULT '',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '',
+  error_class TEXT NOT NULL DEFAULT '',
+  backend TEXT NOT NULL DEFAULT '',
+  dead_lettered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS consistency_dead_letter__domain__object_id
+  ON consistency_dead_letter (domain, object_id);
@@ -0,0 +1,7 @@
+-- Upgrades PostgreSQL consistency logs created before bucket and sub-resource operations were tracked
+
+ALTER TABLE consistency_record
+  ADD COLUMN IF NOT EXISTS operation CHARACTER VARYING(8) NOT NULL DEFAULT 'object';
+
+ALTER TABLE consistency_record
+  ADD COLUMN IF NOT EXISTS sub_resource CHARACTER VARYING(16) NOT NULL DEFAULT '';
@@ -0,0 +1,25 @@
+-- Upgrades PostgreSQL consistency logs created before failed records were retried with a limit and dead-lettered
+
+ALTER TABLE consistency_record
+  ADD COLUMN IF NOT EXISTS attempts BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS consistency_dead_letter
+(
+  request_id       CHARACTER(36) PRIMARY KEY,
+  object_version   BIGINT                  NOT NULL,
+  object_id        CHARACTER VARYING(1024) NOT NULL,
+  method           CHARACTER VARYING(8)    NOT NULL,
+  domain           CHARACTER VARYING(254)  NOT NULL,
+  access_key       CHARACTER VARYING(128)  NOT NULL,
+  operation        CHARACTER VARYING(8)    NOT NULL DEFAULT 'object',
+  sub_resource     CHARACTER VARYING(16)   NOT NULL DEFAULT '',
+  attempts         BIGINT                  NOT NULL DEFAULT 0,
+  error            CHARACTER VARYING(1024) NOT NULL DEFAULT '',
+  error_class      CHARACTER VARYING(32)   NOT NULL DEFAULT '',
+  backend          CHARACTER VARYING(254)  NOT NULL DEFAULT '',
+  dead_lettered_at TIMESTAMPTZ             NOT NULL DEFAULT (CURRENT_TIMESTAMP at time zone 'utc')
+);
+
+CREATE INDEX IF NOT EXISTS consistency_dead_letter__domain__object_id
+  ON consistency_dead_letter
+    USING btree (domain, object_id);
@@ -80,3 +80,21 @@ func TestShouldIngnoreTheSpecifiedHeadersDuringV2Signing(t *testing.T) {
 	writeCanonicalizedHeaders(buf, &req, map[string]bool{"x-amz-meta-test-header": true})
 	assert.Equal(t, buf.String(), "x-amz-meta-date:123\n")
 }
+
+func TestVerifyPresignedV2(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost:8080/bucket/some/key?uploadId=1&partNumber=2", nil)
+	req = PreSignV2(req, "access", "secret", 3600, nil)
+	req.Header.Del("Expires")
+
+	ok, err := VerifyPresignedV2(req, "secret", nil)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	ok, _ = VerifyPresignedV2(req, "other-secret", nil)
+	assert.False(t, ok)
+
+	query := req.URL.Query()
+	query.Set("Expires", "1")
+	req.URL.RawQuery = query.Encode()
+	ok, _ = VerifyPresignedV2(req, "secret", nil)
+	assert.False(t, ok, "the expiry is signed")
+}
@@ -19,6 +19,7 @@ package s3signer
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"encoding/hex"
 	"net/http"
 	"sort"
@@ -382,3 +383,53 @@ func sanitizeV4DateHeader(req *http.Request, t time.Time) *http.Request {
 	req.Header.Set("x-amz-date", t.Format(iso8601DateFormat))
 	return req
 }
+
+// VerifyPresignedV4 verify if the signature of v4 presigned request is correct, the expiry isn't checked
+func VerifyPresignedV4(req *http.Request, secretAccessKey string) (bool, error) {
+	query := req.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return false, fmt.Errorf("incorrect presigned request algorithm %s", query.Get("X-Amz-Algorithm"))
+	}
+	// Credential = <access key>/<yyyymmdd>/<region>/<service>/aws4_request
+	credential := strings.Split(query.Get("X-Amz-Credential"), "/")
+	if len(credential) != 5 {
+		return false, fmt.Errorf("error while parsing X-Amz-Credential")
+	}
+	t, err := time.Parse(iso8601DateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return false, fmt.Errorf("error while parsing X-Amz-Date")
+	}
+	signature := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+
+	// The request is copied, as the canonical request rewrites the query
+	verifiedReq := *req
+	verifiedURL := *req.URL
+	verifiedURL.RawQuery = query.Encode()
+	verifiedReq.URL = &verifiedURL
+	verifiedReq.Header = req.Header.Clone()
+	hashedPayload := query.Get("X-Amz-Content-Sha256")
+	if hashedPayload == "" {
+		hashedPayload = unsignedPayload
+	}
+	verifiedReq.Header.Set("X-Amz-Content-Sha256", hashedPayload)
+
+	signedHeaders := map[string]struct{}{}
+	for _, name := range strings.Split(query.Get("X-Amz-SignedHeaders"), ";") {
+		signedHeaders[name] = struct{}{}
+	}
+	ignoredHeaders := map[string]bool{}
+	for name := range verifiedReq.Header {
+		if _, ok := signedHeaders[strings.ToLower(name)]; !ok {
+			ignoredHeaders[name] = true
+		}
+	}
+
+	canonicalRequest := getCanonicalRequest(&verifiedReq, ignoredHeaders, false)
+	stringToSign := getStringToSignV4(t, credential[2], credential[3], canonicalRequest)
+	signingKey := getSigningKey(secretAccessKey, credential[2], credential[3], t)
+	if hmac.Equal([]byte(signature), []byte(getSignature(signingKey, stringToSign))) {
+		return true, nil
+	}
+	return false, fmt.Errorf("request signature mismatch")
+}
@@ -82,7 +82,7 @@ func buildRequest(serviceName, region, body string) (*http.Request, io.ReadSeeke
 	req.URL.Opaque = "//example.org/bucket/key-._~,!@#$%^&*()"
 	req.Header.Add("X-Amz-Target", "prefix.Operation")
 	req.Header.Add("Content-Type", "application/x-amz-json-1.0")
-	req.Header.Add("Content-Length", string(len(body)))
+	req.Header.Add("Content-Length", string(rune(len(body))))
 	req.Header.Add("X-Amz-Meta-Other-Header", "some-value=!@#$%^&* (+)")
 	req.Header.Add("X-Amz-Meta-Other-Header_With_Underscore", "some-value=!@#$%^&* (+)")
 	req.Header.Add("X-amz-Meta-Other-Header_With_Underscore", "some-value=!@#$%^&* (+)")
@@ -90,3 +90,23 @@ func buildRequest(serviceName, region, body string) (*http.Request, io.ReadSeeke
 
 	return req, reader
 }
+
+func TestVerifyPresignedV4(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/some/key?versionId=1", nil)
+	req.Header.Set("X-Amz-Meta-Test", "value")
+	req = PreSignV4(req, "access", "secret", "", "us-east-1", "s3", 3600)
+
+	if ok, err := VerifyPresignedV4(req, "secret"); !ok {
+		t.Errorf("presigned request should be verified: %s", err)
+	}
+	if !strings.Contains(req.URL.RawQuery, "X-Amz-Signature=") {
+		t.Errorf("verification should keep the query of the request")
+	}
+	if ok, _ := VerifyPresignedV4(req, "other-secret"); ok {
+		t.Errorf("presigned request shouldn't be verified with other secret")
+	}
+	req.Header.Set("X-Amz-Meta-Test", "changed")
+	if ok, _ := VerifyPresignedV4(req, "secret"); ok {
+		t.Errorf("presigned request with changed signed header shouldn't be verified")
+	}
+}
@@ -2,10 +2,12 @@ package balancing
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/allegro/akubra/internal/akubra/log"
@@ -23,19 +25,17 @@ type ResponseTimeBalancer struct {
 func (balancer *ResponseTimeBalancer) Elect(skipNodes ...Node) (Node, error) {
 	start := time.Now()
 	var elected Node
+	electedWeight := float64(0)
 
 	for _, node := range balancer.Nodes {
 		if !node.IsActive() || inSkipNodes(skipNodes, node) {
 			continue
 		}
 
-		if elected == nil {
-			elected = node
-			continue
-		}
-
-		if nodeWeight(node) < nodeWeight(elected) {
+		weight := nodeWeight(node)
+		if elected == nil || weight < electedWeight {
 			elected = node
+			electedWeight = weight
 		}
 	}
 	if elected == nil {
@@ -75,39 +75,62 @@ var (
 )
 
 func newCallMeter(retention, resolution time.Duration) *CallMeter {
+	return newCallMeterWithTimer(retention, resolution, time.Now)
+}
+
+func newCallMeterWithTimer(retention, resolution time.Duration, now func() time.Time) *CallMeter {
+	start := now()
 	return &CallMeter{
 		retention:  retention,
 		resolution: resolution,
-		histogram:  newTimeHistogram(retention, resolution, time.Now),
-		now:        time.Now,
+		window:     newSlidingWindow(retention, resolution, now),
+		callRate:   newEWMARate(resolution, start),
+		timeRate:   newEWMARate(resolution, start),
+		now:        now,
 	}
 }
 
-func newCallMeterWithTimer(retention, resolution time.Duration, now func() time.Time) *CallMeter {
-	cm := newCallMeter(retention, resolution)
-	cm.now = now
-	cm.histogram = newTimeHistogram(retention, resolution, now)
-	cm.histogram.now = now
-	return cm
-}
-
-// CallMeter implements Node interface
+// CallMeter implements Node interface. Call statistics are aggregated
+// in fixed number of time slots, so memory usage does not depend on
+// request rate. Calls and TimeSpent are exact sums over the last
+// resolution period, which the balancer compares between nodes; EWMA
+// rates decaying with the same period are kept next to them to smooth
+// reported load, they do not replace the window as decayed values would
+// change the meaning of Calls and TimeSpent.
 type CallMeter struct {
 	retention     time.Duration
 	resolution    time.Duration
 	now           func() time.Time
-	histogram     *histogram
+	window        *slidingWindow
+	callRate      ewmaRate
+	timeRate      ewmaRate
 	inActiveSince time.Time
-	statsShiftMx  sync.Mutex
+	mx            sync.Mutex
 }
 
 // UpdateTimeSpent aggregates data about call duration
 func (meter *CallMeter) UpdateTimeSpent(duration time.Duration) {
-	series := meter.histogram.pickSeries(meter.now())
-	if series == nil {
-		return
-	}
-	series.Add(float64(duration), meter.now())
+	now := meter.now()
+	meter.window.add(now, float64(duration))
+	meter.mx.Lock()
+	defer meter.mx.Unlock()
+	meter.callRate.update(now, 1)
+	meter.timeRate.update(now, float64(duration))
+}
+
+// CallRate returns exponentially weighted moving average of calls per second
+func (meter *CallMeter) CallRate() float64 {
+	meter.mx.Lock()
+	defer meter.mx.Unlock()
+	return meter.callRate.at(meter.now())
+}
+
+// TimeSpentRate returns exponentially weighted moving average of time spent
+// in execution per second
+func (meter *CallMeter) TimeSpentRate() float64 {
+	meter.mx.Lock()
+	defer meter.mx.Unlock()
+	return meter.timeRate.at(meter.now())
 }
 
 // Calls returns number of calls in last bucket
@@ -117,169 +140,183 @@ func (meter *CallMeter) Calls() float64 {
 
 // CallsInLastPeriod returns number of calls in last duration
 func (meter *CallMeter) CallsInLastPeriod(period time.Duration) float64 {
-	lastPeriodSeries := meter.histogram.PickLastSeries(period)
-	sum := float64(0)
-	now := meter.now()
-	for _, series := range lastPeriodSeries {
-
-		values := series.ValueRange(now.Add(-period), now)
-		sum += float64(len(values))
-	}
-	return sum
+	calls, _ := meter.window.aggregate(meter.now(), period)
+	return calls
 }
 
 // IsActive aseses if node should be active
 func (meter *CallMeter) IsActive() bool {
+	meter.mx.Lock()
+	defer meter.mx.Unlock()
 	return meter.inActiveSince == time.Time{}
 }
 
 // SetActive sets meter state
 func (meter *CallMeter) SetActive(active bool) {
-	if meter.IsActive() && !active {
+	meter.mx.Lock()
+	defer meter.mx.Unlock()
+	isActive := meter.inActiveSince == time.Time{}
+	if isActive && !active {
 		meter.inActiveSince = meter.now()
 	}
-	if !meter.IsActive() && active {
-		meter.histogram.shiftData(meter.now().Sub(meter.inActiveSince))
+	if !isActive && active {
+		inactivity := meter.now().Sub(meter.inActiveSince)
+		meter.window.shift(inactivity)
+		meter.callRate.shift(inactivity)
+		meter.timeRate.shift(inactivity)
 		meter.inActiveSince = time.Time{}
 	}
 }
 
 // TimeSpent returns float64 repesentation of time spent in execution
 func (meter *CallMeter) TimeSpent() float64 {
-	allSeries := meter.histogram.PickLastSeries(meter.resolution)
-	sum := float64(0)
-	now := meter.now()
-
-	for _, series := range allSeries {
-		series.ValueRangeFun(now.Add(-meter.resolution), now, func(value *timeValue) {
-			sum += value.value
-		})
-	}
-
+	_, sum := meter.window.aggregate(meter.now(), meter.resolution)
 	return sum
 }
 
-type dataSeries struct {
-	data []*timeValue
-	mx   sync.Mutex
+func newEWMARate(period time.Duration, start time.Time) ewmaRate {
+	if period <= 0 {
+		period = time.Second
+	}
+	return ewmaRate{period: period, last: start}
 }
 
-func (series *dataSeries) Add(value float64, dateTime time.Time) {
-	series.mx.Lock()
-	defer series.mx.Unlock()
-	series.data = append(series.data, &timeValue{dateTime, value})
+// ewmaRate is an exponentially weighted moving average of a per second
+// rate of irregular events, values decay with time constant of period
+type ewmaRate struct {
+	period time.Duration
+	rate   float64
+	last   time.Time
 }
 
-func (series *dataSeries) ValueRangeFun(timeStart, timeEnd time.Time, fun func(*timeValue)) {
-	for _, timeVal := range series.data {
-		if (timeStart == timeVal.date || timeStart.Before(timeVal.date)) && timeEnd.After(timeVal.date) {
-			fun(timeVal)
-		}
+func (r *ewmaRate) decay(now time.Time) float64 {
+	elapsed := now.Sub(r.last)
+	if elapsed <= 0 {
+		return 1
 	}
+	return math.Exp(-float64(elapsed) / float64(r.period))
 }
 
-func (series *dataSeries) ValueRange(timeStart, timeEnd time.Time) []float64 {
-	dataRange := []float64{}
-	series.ValueRangeFun(timeStart, timeEnd, func(value *timeValue) {
-		dataRange = append(dataRange, value.value)
-	})
-	return dataRange
+func (r *ewmaRate) update(now time.Time, value float64) {
+	r.rate = r.rate*r.decay(now) + value/r.period.Seconds()
+	if now.After(r.last) {
+		r.last = now
+	}
 }
 
-type timeValue struct {
-	date  time.Time
-	value float64
+func (r *ewmaRate) at(now time.Time) float64 {
+	return r.rate * r.decay(now)
 }
 
-func newTimeHistogram(retention, resolution time.Duration, now func() time.Time) *histogram {
-	return &histogram{
-		t0:         now(),
-		resolution: resolution,
-		retention:  retention,
-		now:        now,
-		mx:         sync.Mutex{},
-	}
+func (r *ewmaRate) shift(duration time.Duration) {
+	r.last = r.last.Add(duration)
 }
 
-type histogram struct {
-	t0         time.Time
-	retention  time.Duration
-	resolution time.Duration
-	data       []*dataSeries
-	now        func() time.Time
-	mx         sync.Mutex
+// slotsPerResolution defines how many slots cover single resolution period,
+// it bounds the error of sliding window queries
+const slotsPerResolution = 10
+
+type timeSlot struct {
+	number int64
+	count  float64
+	sum    float64
 }
 
-func (h *histogram) pickSeries(at time.Time) *dataSeries {
-	h.mx.Lock()
-	defer h.mx.Unlock()
-	idx := h.index(at)
-	if idx < 0 {
-		return nil
+func newSlidingWindow(retention, resolution time.Duration, now func() time.Time) *slidingWindow {
+	width := resolution / slotsPerResolution
+	if width <= 0 {
+		width = 1
 	}
-	if idx >= h.cellsCount() || idx >= len(h.data) {
-		h.unshiftData(at)
-		idx = h.index(at)
+	size := int64(math.Ceil(float64(retention) / float64(width)))
+	if size < slotsPerResolution {
+		size = slotsPerResolution
 	}
-	return h.data[idx]
-}
-
-// PickLastSeries returns slice of dataSeries tracking at least given period of time
-func (h *histogram) PickLastSeries(period time.Duration) []*dataSeries {
-	h.mx.Lock()
-	defer h.mx.Unlock()
-	if period > h.retention {
-		period = h.retention
+	slots := make([]timeSlot, size+2)
+	for idx := range slots {
+		slots[idx].number = -1
+	}
+	return &slidingWindow{
+		t0:        now(),
+		retention: retention,
+		width:     width,
+		slots:     slots,
+		now:       now,
 	}
-	h.unshiftData(h.now())
-	cellsNumber := math.Ceil(float64(period)/float64(h.resolution)) + 1
-	now := h.now()
-	stop := h.index(now) + 1
-	start := int(math.Max(float64(stop-int(cellsNumber)), 0))
-	return h.data[start:stop]
-}
-
-func (h *histogram) index(now time.Time) int {
-	sinceStart := float64(now.Sub(h.t0))
-	idx := math.Floor(sinceStart / float64(h.resolution))
-	return int(idx)
 }
 
-func (h *histogram) cellsCount() int {
-	return int(math.Ceil(float64(h.retention)/float64(h.resolution))) + 1
+// slidingWindow is a ring of time slots holding count and sum of values
+// registered in slot's time span
+type slidingWindow struct {
+	t0        time.Time
+	retention time.Duration
+	width     time.Duration
+	slots     []timeSlot
+	now       func() time.Time
+	mx        sync.Mutex
 }
 
-func (h *histogram) growSeries() {
-	for len(h.data) < h.cellsCount() {
-		h.data = append(h.data, &dataSeries{mx: sync.Mutex{}})
-	}
+func (w *slidingWindow) slotNumber(at time.Time) int64 {
+	return int64(at.Sub(w.t0) / w.width)
 }
 
-func (h *histogram) unshiftData(now time.Time) {
-	idx := h.index(now)
-	shiftSize := idx - len(h.data) + 1
-
-	if shiftSize > 0 && shiftSize < len(h.data) {
-		h.t0 = h.t0.Add(time.Duration(shiftSize) * h.resolution)
-		h.data = h.data[shiftSize:]
+func (w *slidingWindow) add(at time.Time, value float64) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if at.Before(w.t0) {
+		return
 	}
-	if shiftSize > 0 && len(h.data) > 0 && shiftSize >= len(h.data) {
-		h.t0 = now
-		h.data = []*dataSeries{}
+	number := w.slotNumber(at)
+	slot := &w.slots[number%int64(len(w.slots))]
+	if slot.number != number {
+		*slot = timeSlot{number: number}
+	}
+	slot.count++
+	slot.sum += value
+}
+
+// aggregate returns number and sum of values registered in [now-period, now)
+// time range. Slot partially covered by range is accounted proportionally.
+func (w *slidingWindow) aggregate(now time.Time, period time.Duration) (count, sum float64) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if period > w.retention {
+		period = w.retention
+	}
+	end := now.Sub(w.t0)
+	if end <= 0 {
+		return 0, 0
+	}
+	start := end - period
+	first := int64(0)
+	if start > 0 {
+		first = int64(start / w.width)
+	}
+	last := int64(end / w.width)
+	for number := first; number <= last; number++ {
+		slot := w.slots[number%int64(len(w.slots))]
+		slotStart := time.Duration(number) * w.width
+		if slot.number != number || slotStart >= end {
+			continue
+		}
+		ratio := float64(1)
+		if slotStart < start {
+			ratio = float64(slotStart+w.width-start) / float64(w.width)
+		}
+		count += slot.count * ratio
+		sum += slot.sum * ratio
 	}
-	h.growSeries()
+	return count, sum
 }
-func (h *histogram) shiftData(delta time.Duration) {
-	newT0 := h.t0.Add(delta)
-	if newT0.After(h.now()) {
+
+// shift moves all registered values by delta forward in time
+func (w *slidingWindow) shift(delta time.Duration) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	newT0 := w.t0.Add(delta)
+	if newT0.After(w.now()) {
 		return
 	}
-	h.t0 = newT0
-	for _, series := range h.data {
-		for _, value := range series.data {
-			value.date = value.date.Add(delta)
-		}
-	}
+	w.t0 = newT0
 }
 
 // Breaker is interface of citcuit breaker
@@ -292,7 +329,7 @@ func newBreaker(retention int, callTimeLimit time.Duration,
 	timeLimitPercentile, errorRate float64,
 	closeDelay, maxDelay time.Duration) Breaker {
 	return &NodeBreaker{
-		timeData:            newLenLimitCounter(retention),
+		timeData:            newPercentileCounter(retention),
 		failures:            newLenLimitCounter(retention),
 		rate:                errorRate,
 		callTimeLimit:       callTimeLimit,
@@ -398,10 +435,26 @@ func newLenLimitCounter(retention int) *lengthDelimitedCounter {
 	}
 }
 
+func newPercentileCounter(retention int) *lengthDelimitedCounter {
+	counter := newLenLimitCounter(retention)
+	counter.histogram = newLogHistogram()
+	counter.histogram.record(0, len(counter.values))
+	counter.cachedRank = -1
+	return counter
+}
+
+// lengthDelimitedCounter keeps last values in a ring together with their
+// running sum and optionally histogram used for percentile estimation.
+// Last computed percentile is cached until next change, as breakers are
+// asked on every election and updated only on calls.
 type lengthDelimitedCounter struct {
-	values  []float64
-	nextIdx int
-	mx      sync.Mutex
+	values         []float64
+	nextIdx        int
+	sum            float64
+	histogram      *logHistogram
+	cachedRank     int
+	cachedQuantile float64
+	mx             sync.Mutex
 }
 
 // Add acumates new values
@@ -409,32 +462,150 @@ func (counter *lengthDelimitedCounter) Add(value float64) {
 	counter.mx.Lock()
 	defer counter.mx.Unlock()
 	index := counter.nextIdx
+	previous := counter.values[index]
 	counter.values[index] = value
+	counter.sum += value - previous
+	if counter.histogram != nil {
+		counter.histogram.record(previous, -1)
+		counter.histogram.record(value, 1)
+		counter.cachedRank = -1
+	}
 	counter.nextIdx = (counter.nextIdx + 1) % cap(counter.values)
 }
 
 // Sum returns sum of values
 func (counter *lengthDelimitedCounter) Sum() float64 {
-	sum := float64(0)
-	for _, v := range counter.values {
-		sum += v
-	}
-	return sum
+	counter.mx.Lock()
+	defer counter.mx.Unlock()
+	return counter.sum
 }
 
-// Percentile return value for given percentile
+// Percentile return value for given percentile. Result is lower bound of
+// histogram bucket, relative error is limited by histogram precision.
 func (counter *lengthDelimitedCounter) Percentile(percentile float64) float64 {
-	snapshot := make([]float64, len(counter.values))
-	copy(snapshot, counter.values)
-	sort.Float64s(snapshot)
-	pertcentileIndex := int(math.Floor(float64(len(snapshot)) * percentile))
-	return snapshot[pertcentileIndex]
+	counter.mx.Lock()
+	defer counter.mx.Unlock()
+	if counter.histogram == nil {
+		return 0
+	}
+	rank := int(math.Floor(float64(len(counter.values)) * percentile))
+	if rank >= len(counter.values) {
+		rank = len(counter.values) - 1
+	}
+	if rank != counter.cachedRank {
+		counter.cachedQuantile = counter.histogram.valueAtRank(rank)
+		counter.cachedRank = rank
+	}
+	return counter.cachedQuantile
 }
 
 func (counter *lengthDelimitedCounter) Reset() {
+	counter.mx.Lock()
+	defer counter.mx.Unlock()
 	for idx := range counter.values {
 		counter.values[idx] = 0
 	}
+	counter.sum = 0
+	if counter.histogram != nil {
+		counter.histogram.reset()
+		counter.histogram.record(0, len(counter.values))
+		counter.cachedRank = -1
+	}
+}
+
+const (
+	// histogramSubBuckets defines number of linear buckets in each power of
+	// two range, relative precision is 1/histogramSubBuckets
+	histogramSubBuckets = 32
+	// histogramMaxExponent bounds tracked values to 2^histogramMaxExponent,
+	// which for nanoseconds is over 3 days
+	histogramMaxExponent = 48
+)
+
+func newLogHistogram() *logHistogram {
+	return &logHistogram{
+		counts:    make([]int, 1+histogramMaxExponent*histogramSubBuckets),
+		exponents: make([]int, 1+histogramMaxExponent),
+	}
+}
+
+// logHistogram is a fixed size log-linear histogram (HDR like). Besides
+// bucket counts it tracks totals per exponent, so rank lookup visits
+// at most histogramMaxExponent+histogramSubBuckets cells.
+type logHistogram struct {
+	counts    []int
+	exponents []int
+}
+
+func histogramBucket(value float64) int {
+	if value < 1 {
+		return 0
+	}
+	frac, exp := math.Frexp(value)
+	exponent := exp - 1
+	if exponent >= histogramMaxExponent {
+		return histogramMaxExponent * histogramSubBuckets
+	}
+	sub := int((frac*2 - 1) * histogramSubBuckets)
+	return 1 + exponent*histogramSubBuckets + sub
+}
+
+func histogramBucketLowerBound(bucket int) float64 {
+	if bucket == 0 {
+		return 0
+	}
+	exponent := (bucket - 1) / histogramSubBuckets
+	sub := (bucket - 1) % histogramSubBuckets
+	return math.Ldexp(1+float64(sub)/histogramSubBuckets, exponent)
+}
+
+func histogramExponent(bucket int) int {
+	if bucket == 0 {
+		return 0
+	}
+	return 1 + (bucket-1)/histogramSubBuckets
+}
+
+func (h *logHistogram) record(value float64, count int) {
+	bucket := histogramBucket(value)
+	h.counts[bucket] += count
+	h.exponents[histogramExponent(bucket)] += count
+}
+
+// valueAtRank returns lower bound of bucket holding value of given rank
+// in ascending order
+func (h *logHistogram) valueAtRank(rank int) float64 {
+	cumulative := 0
+	for exponent, total := range h.exponents {
+		if cumulative+total <= rank {
+			cumulative += total
+			continue
+		}
+		first, last := 0, 0
+		if exponent > 0 {
+			first = 1 + (exponent-1)*histogramSubBuckets
+			last = first + histogramSubBuckets - 1
+		}
+		if last >= len(h.counts) {
+			last = len(h.counts) - 1
+		}
+		for bucket := first; bucket <= last; bucket++ {
+			cumulative += h.counts[bucket]
+			if cumulative > rank {
+				return histogramBucketLowerBound(bucket)
+			}
+		}
+	}
+	return histogramBucketLowerBound(len(h.counts) - 1)
+}
+
+func (h *logHistogram) reset() {
+	for idx := range h.counts {
+		h.counts[idx] = 0
+	}
+	for idx := range h.exponents {
+		h.exponents[idx] = 0
+	}
 }
 
 type breakerState int
@@ -512,6 +683,8 @@ type MeasuredStorage struct {
 	http.RoundTripper
 	Name           string
 	watcherStarted bool
+	inFlight       int64
+	weight         float64
 }
 
 // RoundTrip implements http.RoundTripper
@@ -519,6 +692,7 @@ func (ms *MeasuredStorage) RoundTrip(req *http.Request) (*http.Response, error)
 	start := time.Now()
 	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
 	log.Debugf("MeasuredStorage %s: Got request id %s\n", ms.Name, reqID)
+	atomic.AddInt64(&ms.inFlight, 1)
 	resp, err := ms.RoundTripper.RoundTrip(req)
 	duration := time.Since(start)
 	success := backendSuccess(resp, err)
@@ -528,9 +702,40 @@ func (ms *MeasuredStorage) RoundTrip(req *http.Request) (*http.Response, error)
 	ms.Node.UpdateTimeSpent(duration)
 	ms.Node.SetActive(!open)
 	reportMetrics(ms.RoundTripper, start, open)
+	reportRates(ms.RoundTripper, ms.Node)
+	if resp == nil || resp.Body == nil {
+		atomic.AddInt64(&ms.inFlight, -1)
+		return resp, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, done: func() { atomic.AddInt64(&ms.inFlight, -1) }}
 	return resp, err
 }
 
+// InFlight returns number of requests which response body was not closed yet
+func (ms *MeasuredStorage) InFlight() int64 {
+	return atomic.LoadInt64(&ms.inFlight)
+}
+
+// Weight returns storage weight used by weighted balancing
+func (ms *MeasuredStorage) Weight() float64 {
+	if ms.weight <= 0 {
+		return 1
+	}
+	return ms.weight
+}
+
+// inFlightBody calls done once body is closed
+type inFlightBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (body *inFlightBody) Close() error {
+	body.once.Do(body.done)
+	return body.ReadCloser.Close()
+}
+
 func backendSuccess(response *http.Response, err error) bool {
 	return err == nil && response != nil && response.StatusCode < 500
 }
@@ -554,11 +759,39 @@ func reportMetrics(rt http.RoundTripper, since time.Time, open bool) {
 	}
 }
 
+// rateNode is implemented by nodes tracking moving average rates
+type rateNode interface {
+	CallRate() float64
+	TimeSpentRate() float64
+}
+
+func reportRates(rt http.RoundTripper, node Node) {
+	b, ok := rt.(*backend.Backend)
+	if !ok {
+		return
+	}
+	rates, ok := node.(rateNode)
+	if !ok {
+		return
+	}
+	prefix := fmt.Sprintf("reqs.backend.%s.balancer", b.Name)
+	metrics.UpdateGauge(prefix+".rate.calls", int64(math.Round(rates.CallRate())))
+	metrics.UpdateGauge(prefix+".rate.time", int64(math.Round(rates.TimeSpentRate())))
+}
+
 // NewBalancerPrioritySet configures prioritized balancers stack
-func NewBalancerPrioritySet(storagesConfig config.Storages, backends map[string]http.RoundTripper) *BalancerPrioritySet {
+func NewBalancerPrioritySet(shardConfig config.Shard, backends map[string]http.RoundTripper) *BalancerPrioritySet {
+	storagesConfig := shardConfig.Storages
 	priorities := make([]int, 0)
 	priotitiesFilter := make(map[int]struct{})
 	priorityStorage := make(map[int][]*MeasuredStorage)
+	maxPriority := 0
+	for _, storageConfig := range storagesConfig {
+		if storageConfig.Priority > maxPriority {
+			maxPriority = storageConfig.Priority
+		}
+	}
+	weighted := shardConfig.Balancing == config.WeightedRandomBalancing
 	for _, storageConfig := range storagesConfig {
 		breaker := newBreaker(storageConfig.BreakerProbeSize,
 			storageConfig.BreakerCallTimeLimit.Duration,
@@ -572,35 +805,46 @@ func NewBalancerPrioritySet(storagesConfig config.Storages, backends map[string]
 		if !ok {
 			log.Fatalf("No defined storage %s\n", storageConfig.Name)
 		}
-		if _, ok := priotitiesFilter[storageConfig.Priority]; !ok {
-			priorities = append(priorities, storageConfig.Priority)
-			priotitiesFilter[storageConfig.Priority] = struct{}{}
+		// Weighted random balancing spreads load over all priorities,
+		// priority affects only node weight
+		priority := storageConfig.Priority
+		if weighted {
+			priority = 0
+		}
+		if _, ok := priotitiesFilter[priority]; !ok {
+			priorities = append(priorities, priority)
+			priotitiesFilter[priority] = struct{}{}
 		}
 
-		mstorage := &MeasuredStorage{Breaker: breaker, Node: Node(meter), RoundTripper: backend, Name: storageConfig.Name}
-		if _, ok := priorityStorage[storageConfig.Priority]; !ok {
-			priorityStorage[storageConfig.Priority] = make([]*MeasuredStorage, 0, 1)
+		mstorage := &MeasuredStorage{
+			Breaker:      breaker,
+			Node:         Node(meter),
+			RoundTripper: backend,
+			Name:         storageConfig.Name,
+			weight:       priorityWeight(storageConfig.Priority, maxPriority),
+		}
+		if _, ok := priorityStorage[priority]; !ok {
+			priorityStorage[priority] = make([]*MeasuredStorage, 0, 1)
 		}
 
-		priorityStorage[storageConfig.Priority] = append(
-			priorityStorage[storageConfig.Priority], mstorage)
+		priorityStorage[priority] = append(
+			priorityStorage[priority], mstorage)
 	}
 	sort.Ints(priorities)
-	bps := &BalancerPrioritySet{balancers: []*ResponseTimeBalancer{}}
+	bps := &BalancerPrioritySet{balancers: []Balancer{}}
 	for _, key := range priorities {
 		nodes := make([]Node, 0)
 		for _, node := range priorityStorage[key] {
 			nodes = append(nodes, Node(node))
 		}
-		balancer := &ResponseTimeBalancer{Nodes: nodes}
-		bps.balancers = append(bps.balancers, balancer)
+		bps.balancers = append(bps.balancers, newBalancer(shardConfig.Balancing, nodes))
 	}
 	return bps
 }
 
 // BalancerPrioritySet selects storage by priority and availability
 type BalancerPrioritySet struct {
-	balancers []*ResponseTimeBalancer
+	balancers []Balancer
 }
 
 // GetMostAvailable returns balancer member
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -193,7 +194,7 @@ func TestCallMeterNoActivity(t *testing.T) {
 
 	callMeter := newCallMeterWithTimer(retention, resolution, timer.now)
 	require.NotNil(t, callMeter)
-	callMeter.histogram.now = timer.now
+	callMeter.window.now = timer.now
 
 	for i := float64(0); i < iterations; i++ {
 		callMeter.UpdateTimeSpent(timeSpent)
@@ -227,12 +228,135 @@ func (timer *mockTimer) advance() {
 	timer.baseTime = timer.baseTime.Add(timer.advanceDur)
 }
 
-func TestHistogramRetention(t *testing.T) {
+func TestSlidingWindowMemoryIsBounded(t *testing.T) {
+	timer := &mockTimer{
+		baseTime:   time.Now(),
+		advanceDur: time.Millisecond}
 	retention := 5 * time.Second
 	resolution := 1 * time.Second
-	hist := newTimeHistogram(retention, resolution, time.Now)
-	series := hist.pickSeries(time.Now())
-	require.NotNil(t, series)
+	callMeter := newCallMeterWithTimer(retention, resolution, timer.now)
+	slotsCount := len(callMeter.window.slots)
+
+	for i := 0; i < 100000; i++ {
+		callMeter.UpdateTimeSpent(time.Millisecond)
+		timer.advance()
+	}
+
+	require.Equal(t, slotsCount, len(callMeter.window.slots))
+	require.InDelta(t, float64(resolution/timer.advanceDur), callMeter.Calls(), float64(1))
+}
+
+func TestCallMeterRatesDecayExponentially(t *testing.T) {
+	timer := &mockTimer{
+		baseTime:   time.Now(),
+		advanceDur: 10 * time.Millisecond}
+	resolution := time.Second
+	callMeter := newCallMeterWithTimer(time.Minute, resolution, timer.now)
+
+	for i := 0; i < 1000; i++ {
+		callMeter.UpdateTimeSpent(time.Millisecond)
+		timer.advance()
+	}
+
+	require.InDelta(t, float64(100), callMeter.CallRate(), float64(1))
+	require.InDelta(t, float64(100*time.Millisecond), callMeter.TimeSpentRate(), float64(time.Millisecond))
+	steadyRate := callMeter.CallRate()
+	timer.baseTime = timer.baseTime.Add(resolution)
+	require.InDelta(t, steadyRate/math.E, callMeter.CallRate(), 0.01)
+
+	callMeter.SetActive(false)
+	timer.baseTime = timer.baseTime.Add(time.Hour)
+	callMeter.SetActive(true)
+	require.InDelta(t, steadyRate/math.E, callMeter.CallRate(), 0.01)
+}
+
+func makeElectBenchmarkBalancer() *ResponseTimeBalancer {
+	nodes := make([]Node, 0, 3)
+	for i := 0; i < 3; i++ {
+		meter := newCallMeter(time.Minute, 5*time.Second)
+		breaker := newBreaker(1000, time.Second, 0.9, 0.1, time.Second, time.Minute)
+		for j := 0; j < 10000; j++ {
+			meter.UpdateTimeSpent(time.Duration(j) * time.Microsecond)
+			breaker.Record(time.Duration(j)*time.Microsecond, true)
+		}
+		nodes = append(nodes, &MeasuredStorage{Node: meter, Breaker: breaker, Name: fmt.Sprintf("node-%d", i)})
+	}
+	return &ResponseTimeBalancer{Nodes: nodes}
+}
+
+func TestCallMeterAndElectDoNotAllocate(t *testing.T) {
+	callMeter := newCallMeter(time.Minute, 5*time.Second)
+	require.Zero(t, testing.AllocsPerRun(1000, func() {
+		callMeter.UpdateTimeSpent(time.Millisecond)
+	}), "UpdateTimeSpent allocates")
+
+	balancer := makeElectBenchmarkBalancer()
+	require.Zero(t, testing.AllocsPerRun(1000, func() {
+		if _, err := balancer.Elect(); err != nil {
+			t.Fatal(err)
+		}
+	}), "Elect allocates")
+}
+
+// nodeMemoryLimit bounds memory of single node's meter and breaker with
+// minute retention, 5s resolution and breaker probe of 1000 calls
+const nodeMemoryLimit = 64 << 10
+
+func nodeMemory(calls int) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	meter := newCallMeter(time.Minute, 5*time.Second)
+	breaker := newBreaker(1000, time.Second, 0.9, 0.1, time.Second, time.Minute)
+	for i := 0; i < calls; i++ {
+		meter.UpdateTimeSpent(time.Duration(i) * time.Microsecond)
+		breaker.Record(time.Duration(i)*time.Microsecond, true)
+	}
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(meter)
+	runtime.KeepAlive(breaker)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestNodeMemoryDoesNotDependOnCallsNumber(t *testing.T) {
+	idle := nodeMemory(0)
+	busy := nodeMemory(100000)
+
+	require.True(t, idle <= nodeMemoryLimit, "node takes %d bytes, limit is %d", idle, nodeMemoryLimit)
+	// small slack covers runtime's own allocations between measurements
+	require.InDelta(t, float64(idle), float64(busy), 1024, "node memory grows with calls")
+}
+
+// electTimeLimitPerNode bounds election cost, so a few nodes are elected
+// in about a microsecond
+const electTimeLimitPerNode = time.Microsecond
+
+func TestElectTimeIsBoundedPerNode(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("timing check skipped in short mode and with race detector")
+	}
+	balancer := makeElectBenchmarkBalancer()
+	result := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := balancer.Elect(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	perNode := time.Duration(result.NsPerOp()) / time.Duration(len(balancer.Nodes))
+	require.True(t, perNode < electTimeLimitPerNode, "election takes %s per node, limit is %s", perNode, electTimeLimitPerNode)
+}
+
+func TestSlidingWindowPartialSlot(t *testing.T) {
+	timer := &mockTimer{baseTime: time.Now()}
+	window := newSlidingWindow(10*time.Second, time.Second, timer.now)
+	window.add(timer.now(), 1)
+	timer.baseTime = timer.baseTime.Add(1050 * time.Millisecond)
+
+	count, sum := window.aggregate(timer.now(), time.Second)
+
+	require.InDelta(t, 0.5, count, 0.0001)
+	require.InDelta(t, 0.5, sum, 0.0001)
 }
 
 func TestBreaker(t *testing.T) {
@@ -340,7 +464,7 @@ func checkOpenFor(t *testing.T, d time.Duration, breaker Breaker, timer *mockTim
 }
 
 func TestPriorityLayersPicker(t *testing.T) {
-	config := config.Storages{
+	storagesConfig := config.Storages{
 		{
 			Name:                           "first-a",
 			Priority:                       0,
@@ -386,7 +510,7 @@ func TestPriorityLayersPicker(t *testing.T) {
 		"first-b": &MockRoundTripper{err: errSecondStorageResponse},
 		"second":  &MockRoundTripper{err: errThirdStorageResponse},
 	}
-	balancerSet := NewBalancerPrioritySet(config, backends)
+	balancerSet := NewBalancerPrioritySet(config.Shard{Storages: storagesConfig}, backends)
 	require.NotNil(t, balancerSet)
 
 	member := balancerSet.GetMostAvailable()
@@ -435,3 +559,62 @@ func TestLengthDelimitedCounter(t *testing.T) {
 	wg.Wait()
 	require.Equal(t, sum, counter.Sum())
 }
+
+func TestPercentileCounter(t *testing.T) {
+	counter := newPercentileCounter(100)
+	for i := 1; i <= 100; i++ {
+		counter.Add(float64(time.Duration(i) * time.Millisecond))
+	}
+
+	require.InEpsilon(t, float64(91*time.Millisecond), counter.Percentile(0.9), 1.0/histogramSubBuckets)
+	require.InEpsilon(t, float64(100*time.Millisecond), counter.Percentile(1), 1.0/histogramSubBuckets)
+
+	for i := 0; i < 50; i++ {
+		counter.Add(0)
+	}
+	require.Equal(t, float64(0), counter.Percentile(0.4))
+	require.InEpsilon(t, float64(51*time.Millisecond), counter.Percentile(0.5), 1.0/histogramSubBuckets)
+
+	counter.Reset()
+	require.Equal(t, float64(0), counter.Percentile(0.99))
+	require.Equal(t, float64(0), counter.Sum())
+}
+
+func TestLengthDelimitedCounterRunningSum(t *testing.T) {
+	counter := newLenLimitCounter(10)
+	for i := 0; i < 25; i++ {
+		counter.Add(float64(i))
+	}
+	require.Equal(t, float64(15+16+17+18+19+20+21+22+23+24), counter.Sum())
+}
+
+func BenchmarkCallMeterUpdateTimeSpent(b *testing.B) {
+	callMeter := newCallMeter(time.Minute, 5*time.Second)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		callMeter.UpdateTimeSpent(time.Millisecond)
+	}
+}
+
+func BenchmarkNodeMemory(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		meter := newCallMeter(time.Minute, 5*time.Second)
+		breaker := newBreaker(1000, time.Second, 0.9, 0.1, time.Second, time.Minute)
+		meter.UpdateTimeSpent(time.Millisecond)
+		breaker.Record(time.Millisecond, true)
+	}
+}
+
+func BenchmarkResponseTimeBalancerElect(b *testing.B) {
+	balancer := makeElectBenchmarkBalancer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := balancer.Elect(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(balancer.Nodes)), "ns/node")
+}
@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package balancing
+
+// raceEnabled reports if tests run with race detector, which slows down
+// timing sensitive checks
+const raceEnabled = true
@@ -0,0 +1,184 @@
+package balancing
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/storages/config"
+)
+
+// Balancer elects one of its nodes
+type Balancer interface {
+	Elect(skipNodes ...Node) (Node, error)
+}
+
+// InFlightCounter is implemented by nodes tracking outstanding requests
+type InFlightCounter interface {
+	InFlight() int64
+}
+
+// WeightedNode is implemented by nodes with static balancing weight
+type WeightedNode interface {
+	Weight() float64
+}
+
+func newBalancer(strategy string, nodes []Node) Balancer {
+	switch strategy {
+	case config.LeastOutstandingBalancing:
+		return &LeastOutstandingBalancer{Nodes: nodes, random: newLockedRandom()}
+	case config.PowerOfTwoChoicesBalancing:
+		return &PowerOfTwoChoicesBalancer{Nodes: nodes, random: newLockedRandom()}
+	case config.WeightedRandomBalancing:
+		return &WeightedRandomBalancer{Nodes: nodes, random: newLockedRandom()}
+	default:
+		return &ResponseTimeBalancer{Nodes: nodes}
+	}
+}
+
+// LeastOutstandingBalancer elects node with the lowest number of in-flight
+// requests, ties are resolved randomly
+type LeastOutstandingBalancer struct {
+	Nodes  []Node
+	random *lockedRandom
+}
+
+// Elect elects node
+func (balancer *LeastOutstandingBalancer) Elect(skipNodes ...Node) (Node, error) {
+	var elected Node
+	electedInFlight := int64(0)
+	ties := 0
+	for _, node := range balancer.Nodes {
+		if !node.IsActive() || inSkipNodes(skipNodes, node) {
+			continue
+		}
+		inFlight := nodeInFlight(node)
+		switch {
+		case elected == nil || inFlight < electedInFlight:
+			elected, electedInFlight, ties = node, inFlight, 1
+		case inFlight == electedInFlight:
+			ties++
+			if balancer.random.Intn(ties) == 0 {
+				elected = node
+			}
+		}
+	}
+	if elected == nil {
+		return nil, ErrNoActiveNodes
+	}
+	return elected, nil
+}
+
+// PowerOfTwoChoicesBalancer picks two random nodes and elects the one with
+// lower average call latency
+type PowerOfTwoChoicesBalancer struct {
+	Nodes  []Node
+	random *lockedRandom
+}
+
+// Elect elects node
+func (balancer *PowerOfTwoChoicesBalancer) Elect(skipNodes ...Node) (Node, error) {
+	candidates := activeNodes(balancer.Nodes, skipNodes)
+	switch len(candidates) {
+	case 0:
+		return nil, ErrNoActiveNodes
+	case 1:
+		return candidates[0], nil
+	}
+	first := balancer.random.Intn(len(candidates))
+	second := balancer.random.Intn(len(candidates) - 1)
+	if second >= first {
+		second++
+	}
+	if averageLatency(candidates[second]) < averageLatency(candidates[first]) {
+		return candidates[second], nil
+	}
+	return candidates[first], nil
+}
+
+// WeightedRandomBalancer elects random node with probability proportional
+// to node weight
+type WeightedRandomBalancer struct {
+	Nodes  []Node
+	random *lockedRandom
+}
+
+// Elect elects node
+func (balancer *WeightedRandomBalancer) Elect(skipNodes ...Node) (Node, error) {
+	candidates := activeNodes(balancer.Nodes, skipNodes)
+	if len(candidates) == 0 {
+		return nil, ErrNoActiveNodes
+	}
+	total := float64(0)
+	for _, node := range candidates {
+		total += nodeStaticWeight(node)
+	}
+	pick := balancer.random.Float64() * total
+	for _, node := range candidates {
+		pick -= nodeStaticWeight(node)
+		if pick < 0 {
+			return node, nil
+		}
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+func activeNodes(nodes, skipNodes []Node) []Node {
+	active := make([]Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.IsActive() && !inSkipNodes(skipNodes, node) {
+			active = append(active, node)
+		}
+	}
+	return active
+}
+
+func nodeInFlight(node Node) int64 {
+	if counter, ok := node.(InFlightCounter); ok {
+		return counter.InFlight()
+	}
+	return 0
+}
+
+func nodeStaticWeight(node Node) float64 {
+	if weighted, ok := node.(WeightedNode); ok {
+		return weighted.Weight()
+	}
+	return 1
+}
+
+func averageLatency(node Node) float64 {
+	calls := node.Calls()
+	if calls == 0 {
+		return 0
+	}
+	return node.TimeSpent() / calls
+}
+
+// priorityWeight maps storage priority to weight, the lowest priority value
+// (most preferred) gets the highest weight
+func priorityWeight(priority, maxPriority int) float64 {
+	return float64(maxPriority - priority + 1)
+}
+
+func newLockedRandom() *lockedRandom {
+	return &lockedRandom{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// lockedRandom is goroutine safe rand.Rand
+type lockedRandom struct {
+	rand *rand.Rand
+	mx   sync.Mutex
+}
+
+func (r *lockedRandom) Intn(n int) int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.rand.Intn(n)
+}
+
+func (r *lockedRandom) Float64() float64 {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.rand.Float64()
+}
@@ -0,0 +1,228 @@
+package balancing
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/storages/config"
+	"github.com/stretchr/testify/require"
+)
+
+func seededRandom() *lockedRandom {
+	return &lockedRandom{rand: rand.New(rand.NewSource(1))}
+}
+
+type simNode struct {
+	*CallMeter
+	latency  time.Duration
+	inFlight int64
+	weight   float64
+	elected  int
+}
+
+func (node *simNode) InFlight() int64 {
+	return node.inFlight
+}
+
+func (node *simNode) Weight() float64 {
+	return node.weight
+}
+
+type pendingCall struct {
+	node   *simNode
+	finish time.Time
+}
+
+// simulateLoad issues requestsPerTick requests every millisecond for given
+// duration and returns share of requests elected per node
+func simulateLoad(t *testing.T, strategy string, latencies []time.Duration, duration time.Duration, requestsPerTick int) []float64 {
+	timer := &mockTimer{baseTime: time.Now(), advanceDur: time.Millisecond}
+	nodes := make([]Node, 0, len(latencies))
+	simNodes := make([]*simNode, 0, len(latencies))
+	for _, latency := range latencies {
+		node := &simNode{
+			CallMeter: newCallMeterWithTimer(10*time.Second, time.Second, timer.now),
+			latency:   latency,
+			weight:    1,
+		}
+		nodes = append(nodes, node)
+		simNodes = append(simNodes, node)
+	}
+	balancer := newBalancer(strategy, nodes)
+	switch b := balancer.(type) {
+	case *LeastOutstandingBalancer:
+		b.random = seededRandom()
+	case *PowerOfTwoChoicesBalancer:
+		b.random = seededRandom()
+	case *WeightedRandomBalancer:
+		b.random = seededRandom()
+	}
+
+	pending := make([]pendingCall, 0)
+	end := timer.now().Add(duration)
+	total := 0
+	for timer.now().Before(end) {
+		stillPending := pending[:0]
+		for _, call := range pending {
+			if call.finish.After(timer.now()) {
+				stillPending = append(stillPending, call)
+				continue
+			}
+			call.node.inFlight--
+			call.node.UpdateTimeSpent(call.node.latency)
+		}
+		pending = stillPending
+		for i := 0; i < requestsPerTick; i++ {
+			elected, err := balancer.Elect()
+			require.NoError(t, err)
+			node := elected.(*simNode)
+			node.elected++
+			node.inFlight++
+			total++
+			pending = append(pending, pendingCall{node: node, finish: timer.now().Add(node.latency)})
+		}
+		timer.advance()
+	}
+
+	shares := make([]float64, 0, len(simNodes))
+	for _, node := range simNodes {
+		shares = append(shares, float64(node.elected)/float64(total))
+	}
+	t.Logf("%s load distribution for latencies %v: %v", strategy, latencies, shares)
+	return shares
+}
+
+func TestLoadDistributionUnderSkewedLatencies(t *testing.T) {
+	latencies := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond}
+	duration := 10 * time.Second
+
+	leastOutstanding := simulateLoad(t, config.LeastOutstandingBalancing, latencies, duration, 2)
+	require.True(t, leastOutstanding[0] > leastOutstanding[1])
+	require.True(t, leastOutstanding[1] > leastOutstanding[2])
+	require.True(t, leastOutstanding[2] < 0.2)
+
+	powerOfTwo := simulateLoad(t, config.PowerOfTwoChoicesBalancing, latencies, duration, 2)
+	require.True(t, powerOfTwo[0] > powerOfTwo[2])
+	require.True(t, powerOfTwo[1] > powerOfTwo[2])
+	require.True(t, powerOfTwo[2] < 1.0/3)
+
+	weightedRandom := simulateLoad(t, config.WeightedRandomBalancing, latencies, duration, 2)
+	for _, share := range weightedRandom {
+		require.InDelta(t, 1.0/3, share, 0.02)
+	}
+
+	responseTime := simulateLoad(t, config.ResponseTimeBalancing, latencies, duration, 2)
+	require.True(t, responseTime[0] > responseTime[2])
+}
+
+func TestLeastOutstandingBalancerElectsLeastLoadedNode(t *testing.T) {
+	busy := &simNode{CallMeter: newCallMeter(time.Second, time.Second), inFlight: 3}
+	idle := &simNode{CallMeter: newCallMeter(time.Second, time.Second), inFlight: 1}
+	balancer := &LeastOutstandingBalancer{Nodes: []Node{busy, idle}, random: seededRandom()}
+
+	elected, err := balancer.Elect()
+	require.NoError(t, err)
+	require.Equal(t, idle, elected)
+
+	elected, err = balancer.Elect(idle)
+	require.NoError(t, err)
+	require.Equal(t, busy, elected)
+
+	_, err = balancer.Elect(idle, busy)
+	require.Equal(t, ErrNoActiveNodes, err)
+}
+
+func TestPowerOfTwoChoicesBalancerPrefersLowerLatency(t *testing.T) {
+	fast := &simNode{CallMeter: newCallMeter(time.Minute, time.Minute)}
+	slow := &simNode{CallMeter: newCallMeter(time.Minute, time.Minute)}
+	fast.UpdateTimeSpent(time.Millisecond)
+	slow.UpdateTimeSpent(time.Second)
+	balancer := &PowerOfTwoChoicesBalancer{Nodes: []Node{slow, fast}, random: seededRandom()}
+
+	for i := 0; i < 10; i++ {
+		elected, err := balancer.Elect()
+		require.NoError(t, err)
+		require.Equal(t, fast, elected)
+	}
+	elected, err := balancer.Elect(fast)
+	require.NoError(t, err)
+	require.Equal(t, slow, elected)
+}
+
+func TestWeightedRandomBalancerRespectsWeights(t *testing.T) {
+	heavy := &simNode{CallMeter: newCallMeter(time.Second, time.Second), weight: priorityWeight(0, 1)}
+	light := &simNode{CallMeter: newCallMeter(time.Second, time.Second), weight: priorityWeight(1, 1)}
+	balancer := &WeightedRandomBalancer{Nodes: []Node{heavy, light}, random: seededRandom()}
+
+	for i := 0; i < 30000; i++ {
+		elected, err := balancer.Elect()
+		require.NoError(t, err)
+		elected.(*simNode).elected++
+	}
+	require.InDelta(t, 2.0, float64(heavy.elected)/float64(light.elected), 0.1)
+}
+
+func TestWeightedRandomPrioritySetSpansAllPriorities(t *testing.T) {
+	storagesConfig := config.Storages{
+		{Name: "first", Priority: 0, BreakerProbeSize: 10, BreakerErrorRate: 0.5, BreakerCallTimeLimitPercentile: 0.9},
+		{Name: "second", Priority: 1, BreakerProbeSize: 10, BreakerErrorRate: 0.5, BreakerCallTimeLimitPercentile: 0.9},
+	}
+	backends := map[string]http.RoundTripper{
+		"first":  &MockRoundTripper{},
+		"second": &MockRoundTripper{},
+	}
+	balancerSet := NewBalancerPrioritySet(config.Shard{Storages: storagesConfig, Balancing: config.WeightedRandomBalancing}, backends)
+	require.Len(t, balancerSet.balancers, 1)
+	balancer := balancerSet.balancers[0].(*WeightedRandomBalancer)
+	require.Len(t, balancer.Nodes, 2)
+	require.Equal(t, float64(2), balancer.Nodes[0].(*MeasuredStorage).Weight())
+	require.Equal(t, float64(1), balancer.Nodes[1].(*MeasuredStorage).Weight())
+}
+
+func TestMeasuredStorageTracksInFlightRequests(t *testing.T) {
+	body := &closeCountingBody{}
+	storage := &MeasuredStorage{
+		Node:         newCallMeter(time.Second, time.Second),
+		Breaker:      makeTestBreaker(),
+		RoundTripper: &bodyRoundTripper{body: body},
+	}
+
+	resp, err := storage.RoundTrip(&http.Request{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), storage.InFlight())
+
+	require.NoError(t, resp.Body.Close())
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, int64(0), storage.InFlight())
+	require.Equal(t, 2, body.closed)
+
+	storage.RoundTripper = &MockRoundTripper{err: fmt.Errorf("connection refused")}
+	_, err = storage.RoundTrip(&http.Request{})
+	require.Error(t, err)
+	require.Equal(t, int64(0), storage.InFlight())
+}
+
+type closeCountingBody struct {
+	closed int
+}
+
+func (body *closeCountingBody) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (body *closeCountingBody) Close() error {
+	body.closed++
+	return nil
+}
+
+type bodyRoundTripper struct {
+	body io.ReadCloser
+}
+
+func (rt *bodyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: rt.body}, nil
+}
@@ -38,6 +38,7 @@ type YamlConfig struct {
 	Shards                      storages.ShardsMap                 `yaml:"Shards"`
 	ShardingPolicies            confregions.ShardingPolicies       `yaml:"ShardingPolicies"`
 	CredentialsStores           crdstoreconfig.CredentialsStoreMap `yaml:"CredentialsStores"`
+	Sessions                    crdstoreconfig.Sessions            `yaml:"Sessions"`
 	Logging                     logconfig.LoggingConfig            `yaml:"Logging"`
 	Metrics                     metrics.Config                     `yaml:"Metrics"`
 	Watchdog                    config.WatchdogConfig              `yaml:"Watchdog"`
@@ -107,8 +108,13 @@ func ValidateConf(conf YamlConfig, enableLogicalValidator bool) (bool, map[strin
 		validRegionsEntries, regionsValidationErrors := conf.RegionsEntryLogicalValidator()
 		validTransportsEntries, transportsValidationErrors := conf.TransportsEntryLogicalValidator()
 		validWatchdogEntries, watchdogValidatorsErrors := conf.WatchdogEntryLogicalValidator()
-		valid = valid && validListenPorts && validRegionsEntries && validTransportsEntries && validWatchdogEntries
-		validationErrors = mergeErrors(validationErrors, portsValidationErrors, regionsValidationErrors, transportsValidationErrors, watchdogValidatorsErrors)
+		validShardsEntries, shardsValidationErrors := conf.ShardsEntryLogicalValidator()
+		validCredentialsStoresEntries, credentialsStoresValidationErrors := conf.CredentialsStoresEntryLogicalValidator()
+		validSessionsEntries, sessionsValidationErrors := conf.SessionsEntryLogicalValidator()
+		valid = valid && validListenPorts && validRegionsEntries && validTransportsEntries && validWatchdogEntries && validShardsEntries &&
+			validCredentialsStoresEntries && validSessionsEntries
+		validationErrors = mergeErrors(validationErrors, portsValidationErrors, regionsValidationErrors, transportsValidationErrors,
+			watchdogValidatorsErrors, shardsValidationErrors, credentialsStoresValidationErrors, sessionsValidationErrors)
 	}
 
 	for propertyName, validatorMessage := range validationErrors {
@@ -11,13 +11,19 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/allegro/akubra/internal/akubra/crdstore"
+	crdstoreconfig "github.com/allegro/akubra/internal/akubra/crdstore/config"
 	confregions "github.com/allegro/akubra/internal/akubra/regions/config"
 	"github.com/allegro/akubra/internal/akubra/storages/config"
+	watchdogconfig "github.com/allegro/akubra/internal/akubra/watchdog/config"
 	set "github.com/deckarep/golang-set"
 )
 
 type fetcherValidator = func(conf map[string]string) error
 
+// minSessionSigningKeyLength is the shortest key accepted to sign session tokens
+const minSessionSigningKeyLength = 32
+
 var fetcherConfigValidators = map[string]fetcherValidator{
 	"fake": fakeFetcherConfigValidator,
 	"http": httpFetcherConfigValidator,
@@ -110,6 +116,22 @@ func (c *YamlConfig) RegionsEntryLogicalValidator() (valid bool, validationError
 	return
 }
 
+// ShardsEntryLogicalValidator checks the correctness of "Shards" part of configuration file
+func (c *YamlConfig) ShardsEntryLogicalValidator() (valid bool, validationErrors map[string][]error) {
+	errList := make([]error, 0)
+	supportedStrategies := set.NewSet()
+	for _, strategy := range config.BalancingStrategies {
+		supportedStrategies.Add(strategy)
+	}
+	for shardName, shardConf := range c.Shards {
+		if shardConf.Balancing != "" && !supportedStrategies.Contains(shardConf.Balancing) {
+			errList = append(errList, fmt.Errorf("Balancing strategy '%s' of shard '%s' is not supported", shardConf.Balancing, shardName))
+		}
+	}
+	validationErrors, valid = prepareErrors(errList, "ShardsEntryLogicalValidator")
+	return
+}
+
 // TransportsEntryLogicalValidator checks the correctness of "Transports" part of configuration file
 func (c *YamlConfig) TransportsEntryLogicalValidator() (valid bool, validationErrors map[string][]error) {
 	errList := make([]error, 0)
@@ -146,7 +168,8 @@ func (c *YamlConfig) ListenPortsLogicalValidator() (valid bool, validationErrors
 func (c YamlConfig) WatchdogEntryLogicalValidator() (valid bool, validationErrors map[string][]error) {
 	errList := make([]error, 0)
 	supportedWatchdogs := map[string][]string{
-		"sql": {"dialect", "user", "password", "dbname", "host", "port", "maxopenconns", "maxidleconns", "connmaxlifetime", "conntimeout"},
+		"sql":      {"dialect", "user", "password", "dbname", "host", "port", "maxopenconns", "maxidleconns", "connmaxlifetime", "conntimeout"},
+		"embedded": {"path"},
 	}
 	if c.Watchdog.Type == "" {
 		return true, validationErrors
@@ -171,6 +194,26 @@ func (c YamlConfig) WatchdogEntryLogicalValidator() (valid bool, validationError
 			errList = append(errList, errors.New(errMsg))
 		}
 	}
+	if strings.ToLower(c.Watchdog.Type) == "sql" {
+		supportedDialects := set.NewSet()
+		for _, dialect := range watchdogconfig.SQLDialects {
+			supportedDialects.Add(dialect)
+		}
+		if dialect, present := c.Watchdog.Props["dialect"]; present && !supportedDialects.Contains(strings.ToLower(dialect)) {
+			errList = append(errList, fmt.Errorf("dialect '%s' of sql watchdog is not supported", dialect))
+		}
+	}
+	if batching := c.Watchdog.Batching; batching.Enabled {
+		if batching.MaxBatchSize < 0 || batching.MaxPendingRecords < 0 || batching.FlushInterval < 0 || batching.GroupCommitWindow < 0 {
+			errList = append(errList, errors.New("watchdog batching values can't be negative"))
+		}
+		if batching.MaxPendingRecords > 0 && batching.MaxPendingRecords < batching.MaxBatchSize {
+			errList = append(errList, errors.New("watchdog batching MaxPendingRecords can't be lower than MaxBatchSize"))
+		}
+	}
+	if c.Watchdog.LagMetricsInterval < 0 {
+		errList = append(errList, errors.New("watchdog LagMetricsInterval can't be negative"))
+	}
 	validationErrors, valid = prepareErrors(errList, "WatchdogEntryLogicalValidator")
 	return
 }
@@ -180,6 +223,7 @@ func (c YamlConfig) CredentialsStoresEntryLogicalValidator() (valid bool, valida
 	errList := make([]error, 0)
 	supportedCredentialsStores := map[string][]string{
 		"Vault": {"Endpoint", "Timeout", "MaxRetries", "PathPrefix"},
+		"File":  {"Path"},
 	}
 	isDefaultCredentialsStoreDefined := false
 	for crdStoreName, crdStore := range c.CredentialsStores {
@@ -200,6 +244,9 @@ func (c YamlConfig) CredentialsStoresEntryLogicalValidator() (valid bool, valida
 				errList = append(errList, fmt.Errorf("CredentialsStore '%s' is missing requried property '%s'", crdStoreName, propName))
 			}
 		}
+		if crdStore.Type == "File" && crdStore.Properties["Path"] != "" {
+			errList = append(errList, credentialsFileStoragesValidator(crdStoreName, crdStore.Properties["Path"], c.Storages)...)
+		}
 	}
 	numberOfStoragesUsingDefaultSignService := countStoragesWithDefaultAuthService(c.Storages)
 	if numberOfStoragesUsingDefaultSignService > 0 && !isDefaultCredentialsStoreDefined {
@@ -212,6 +259,53 @@ func (c YamlConfig) CredentialsStoresEntryLogicalValidator() (valid bool, valida
 	return
 }
 
+// credentialsFileStoragesValidator checks that the storages referenced by the credentials file are defined
+func credentialsFileStoragesValidator(crdStoreName, path string, storages config.StoragesMap) []error {
+	credentialsFile, err := crdstore.ReadCredentialsFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("CredentialsStore '%s' can't read the credentials file: %s", crdStoreName, err)}
+	}
+	errList := make([]error, 0)
+	reported := make(map[string]bool)
+	for accessKey, storageCredentials := range credentialsFile {
+		for storageName := range storageCredentials {
+			if _, defined := storages[storageName]; defined || storageName == "akubra" || reported[storageName] {
+				continue
+			}
+			reported[storageName] = true
+			errList = append(errList, fmt.Errorf("CredentialsStore '%s' has credentials of '%s' for undefined storage '%s'", crdStoreName, accessKey, storageName))
+		}
+	}
+	return errList
+}
+
+// SessionsEntryLogicalValidator validates the temporary credentials config
+func (c YamlConfig) SessionsEntryLogicalValidator() (valid bool, validationErrors map[string][]error) {
+	errList := make([]error, 0)
+	if c.Sessions.SigningKey != "" {
+		if len(c.Sessions.SigningKey) < minSessionSigningKeyLength {
+			errList = append(errList, fmt.Errorf("sessions SigningKey has to be at least %d characters long", minSessionSigningKeyLength))
+		}
+		if c.Sessions.MaxDuration.Duration != 0 && c.Sessions.MaxDuration.Duration < crdstore.MinSessionDuration {
+			errList = append(errList, fmt.Errorf("sessions MaxDuration can't be shorter than %s", crdstore.MinSessionDuration))
+		}
+		if !hasDefaultCredentialsStore(c.CredentialsStores) {
+			errList = append(errList, errors.New("sessions require a default CredentialsStore"))
+		}
+	}
+	validationErrors, valid = prepareErrors(errList, "SessionsEntryLogicalValidator")
+	return
+}
+
+func hasDefaultCredentialsStore(credentialsStores crdstoreconfig.CredentialsStoreMap) bool {
+	for _, crdStore := range credentialsStores {
+		if crdStore.Default {
+			return true
+		}
+	}
+	return false
+}
+
 //PrivacyEntryLogicalValidator validates privacy config
 func (c YamlConfig) PrivacyEntryLogicalValidator() (valid bool, validationErrors map[string][]error) {
 	errList := make([]error, 0)
@@ -3,8 +3,12 @@ package config
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	metadata "github.com/allegro/akubra/internal/akubra/metadata"
@@ -542,6 +546,22 @@ func TestShouldFailWhenWatchdogConfigDoesNotHaveAllOfTheFieldsProvided(t *testin
 	assert.False(t, valid)
 }
 
+func TestShardsBalancingStrategyValidation(t *testing.T) {
+	yamlConfig := YamlConfig{Shards: config2.ShardsMap{
+		"default":     config2.Shard{},
+		"p2c":         config2.Shard{Balancing: config2.PowerOfTwoChoicesBalancing},
+		"weighted":    config2.Shard{Balancing: config2.WeightedRandomBalancing},
+		"outstanding": config2.Shard{Balancing: config2.LeastOutstandingBalancing},
+	}}
+	valid, _ := yamlConfig.ShardsEntryLogicalValidator()
+	assert.True(t, valid)
+
+	yamlConfig.Shards["unknown"] = config2.Shard{Balancing: "RoundRobin"}
+	valid, errList := yamlConfig.ShardsEntryLogicalValidator()
+	assert.False(t, valid)
+	assert.Contains(t, errList["ShardsEntryLogicalValidator"], errors.New("Balancing strategy 'RoundRobin' of shard 'unknown' is not supported"))
+}
+
 func TestCredentialsStoresValidation(t *testing.T) {
 
 	for _, testCase := range []struct {
@@ -768,3 +788,100 @@ func prepareTransportsForEntryLogicalValidatorTest(maxIdleConns, maxIdleConnsPer
 		},
 	}
 }
+
+func TestSQLWatchdogDialectValidation(t *testing.T) {
+	props := map[string]string{"user": "akubra", "password": "secret", "dbname": "akubra", "host": "localhost", "port": "3306",
+		"maxopenconns": "1", "maxidleconns": "1", "connmaxlifetime": "1m", "conntimeout": "5"}
+	yamlConfig := YamlConfig{Watchdog: config.WatchdogConfig{Type: "sql", ObjectVersionHeaderName: "x-amz-meta-version", Props: props}}
+
+	for _, dialect := range config.SQLDialects {
+		props["dialect"] = dialect
+		valid, _ := yamlConfig.WatchdogEntryLogicalValidator()
+		assert.True(t, valid, dialect)
+	}
+
+	props["dialect"] = "oracle"
+	valid, errList := yamlConfig.WatchdogEntryLogicalValidator()
+	assert.False(t, valid)
+	assert.Contains(t, errList["WatchdogEntryLogicalValidator"], errors.New("dialect 'oracle' of sql watchdog is not supported"))
+}
+
+func TestWatchdogBatchingValidation(t *testing.T) {
+	yamlConfig := YamlConfig{Watchdog: config.WatchdogConfig{Type: "embedded", ObjectVersionHeaderName: "x-amz-meta-version",
+		Props: map[string]string{"path": "/tmp/wal.db"}}}
+	yamlConfig.Watchdog.Batching = config.BatchingConfig{Enabled: true, MaxBatchSize: 100, MaxPendingRecords: 1000, FlushInterval: time.Second}
+	valid, _ := yamlConfig.WatchdogEntryLogicalValidator()
+	assert.True(t, valid)
+
+	yamlConfig.Watchdog.Batching.FlushInterval = -time.Second
+	valid, errList := yamlConfig.WatchdogEntryLogicalValidator()
+	assert.False(t, valid)
+	assert.Contains(t, errList["WatchdogEntryLogicalValidator"], errors.New("watchdog batching values can't be negative"))
+
+	yamlConfig.Watchdog.Batching.FlushInterval = time.Second
+	yamlConfig.Watchdog.Batching.MaxPendingRecords = 10
+	valid, errList = yamlConfig.WatchdogEntryLogicalValidator()
+	assert.False(t, valid)
+	assert.Contains(t, errList["WatchdogEntryLogicalValidator"], errors.New("watchdog batching MaxPendingRecords can't be lower than MaxBatchSize"))
+}
+
+func TestWatchdogLagMetricsIntervalValidation(t *testing.T) {
+	yamlConfig := YamlConfig{Watchdog: config.WatchdogConfig{Type: "embedded", ObjectVersionHeaderName: "x-amz-meta-version",
+		Props: map[string]string{"path": "/tmp/wal.db"}, LagMetricsInterval: time.Minute}}
+	valid, _ := yamlConfig.WatchdogEntryLogicalValidator()
+	assert.True(t, valid)
+
+	yamlConfig.Watchdog.LagMetricsInterval = -time.Minute
+	valid, errList := yamlConfig.WatchdogEntryLogicalValidator()
+	assert.False(t, valid)
+	assert.Contains(t, errList["WatchdogEntryLogicalValidator"], errors.New("watchdog LagMetricsInterval can't be negative"))
+}
+
+func TestSessionsValidation(t *testing.T) {
+	yamlConfig := YamlConfig{CredentialsStores: crdStoreConig.CredentialsStoreMap{"store": {Default: true, Type: "Vault"}}}
+	valid, _ := yamlConfig.SessionsEntryLogicalValidator()
+	assert.True(t, valid, "sessions are disabled without a signing key")
+
+	yamlConfig.Sessions = crdStoreConig.Sessions{SigningKey: strings.Repeat("k", 32), MaxDuration: metrics.Interval{Duration: time.Hour}}
+	valid, _ = yamlConfig.SessionsEntryLogicalValidator()
+	assert.True(t, valid)
+
+	yamlConfig.Sessions = crdStoreConig.Sessions{SigningKey: "short", MaxDuration: metrics.Interval{Duration: time.Minute}}
+	yamlConfig.CredentialsStores = nil
+	valid, errList := yamlConfig.SessionsEntryLogicalValidator()
+	assert.False(t, valid)
+	assert.Equal(t, []error{
+		errors.New("sessions SigningKey has to be at least 32 characters long"),
+		errors.New("sessions MaxDuration can't be shorter than 15m0s"),
+		errors.New("sessions require a default CredentialsStore"),
+	}, errList["SessionsEntryLogicalValidator"])
+}
+
+func TestCredentialsFileStoragesValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "credentials.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+access:
+  akubra: {access: access, secret: secret}
+  storage1: {access: a1, secret: s1}
+  storage2: {access: a2, secret: s2}
+`), 0600))
+	yamlConfig := YamlConfig{
+		CredentialsStores: crdStoreConig.CredentialsStoreMap{"file": {Default: true, Type: "File", Properties: map[string]string{"Path": path}}},
+		Storages:          config2.StoragesMap{"storage1": {Type: "S3AuthService"}, "storage2": {Type: "S3AuthService"}},
+	}
+	valid, _ := yamlConfig.CredentialsStoresEntryLogicalValidator()
+	assert.True(t, valid)
+
+	delete(yamlConfig.Storages, "storage2")
+	valid, errList := yamlConfig.CredentialsStoresEntryLogicalValidator()
+	assert.False(t, valid)
+	assert.Equal(t, []error{errors.New("CredentialsStore 'file' has credentials of 'access' for undefined storage 'storage2'")},
+		errList["CredentialsStoresEntryLogicalValidator"])
+
+	yamlConfig.CredentialsStores["file"].Properties["Path"] = filepath.Join(dir, "missing.yaml")
+	valid, _ = yamlConfig.CredentialsStoresEntryLogicalValidator()
+	assert.False(t, valid)
+}
@@ -18,3 +18,12 @@ type CredentialsStore struct {
 
 // CredentialsStoreMap - map of credentialsStores configurations
 type CredentialsStoreMap map[string]CredentialsStore
+
+// Sessions configures the temporary credentials issued by the AssumeRole endpoint
+type Sessions struct {
+	// SigningKey signs the session tokens, temporary credentials are disabled if it's empty. Akubra instances
+	// sharing the key accept each other's session tokens
+	SigningKey string `yaml:"SigningKey"`
+	// MaxDuration limits the lifetime of temporary credentials, 12h by default
+	MaxDuration metrics.Interval `yaml:"MaxDuration"`
+}
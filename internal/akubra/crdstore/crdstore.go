@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"errors"
+	"io"
 
 	"sync"
 	"sync/atomic"
@@ -28,6 +29,7 @@ var DefaultCredentialsStoreName string
 var credentialsStores map[string]*CredentialsStore
 var credentialsStoresFactories = map[credentialsBackendType]credentialsBackendFactory{
 	"Vault": &vaultCredsBackendFactory{},
+	"File":  &fileCredsBackendFactory{},
 }
 
 type credentialsBackendType = string
@@ -48,6 +50,12 @@ type CredentialsBackend interface {
 	FetchCredentials(accessKey string, storageName string) (*CredentialsStoreData, error)
 }
 
+//ChangeNotifyingCredentialsBackend notifies about the credentials it changed, so they aren't served from the cache
+type ChangeNotifyingCredentialsBackend interface {
+	CredentialsBackend
+	OnChange(func(accessKey, storageName string))
+}
+
 // GetInstance - Get crdstore instance by store's name
 func GetInstance(crdBackendName string) (instance *CredentialsStore, err error) {
 	if instance, ok := credentialsStores[crdBackendName]; ok {
@@ -56,8 +64,9 @@ func GetInstance(crdBackendName string) (instance *CredentialsStore, err error)
 	return nil, fmt.Errorf("error credentialsStore `%s` is not defined", crdBackendName)
 }
 
-// InitializeCredentialsStores - Constructor for CredentialsStores
+// InitializeCredentialsStores - Constructor for CredentialsStores, the backends of the previous stores are closed
 func InitializeCredentialsStores(storeMap config.CredentialsStoreMap) {
+	closeCredentialsStores(credentialsStores)
 	credentialsStores = make(map[string]*CredentialsStore)
 
 	for name, cfg := range storeMap {
@@ -72,14 +81,36 @@ func InitializeCredentialsStores(storeMap config.CredentialsStoreMap) {
 		if cfg.Default {
 			DefaultCredentialsStoreName = name
 		}
-		credentialsStores[name] = &CredentialsStore{
+		credentialsStore := &CredentialsStore{
 			cache:              new(syncmap.Map),
 			TTL:                cfg.AuthRefreshInterval.Duration,
 			credentialsBackend: credsBackend,
 		}
+		if notifyingBackend, notifiesChanges := credsBackend.(ChangeNotifyingCredentialsBackend); notifiesChanges {
+			notifyingBackend.OnChange(credentialsStore.Invalidate)
+		}
+		credentialsStores[name] = credentialsStore
 	}
 }
 
+// closeCredentialsStores stops the background work of the backends, such as watching the credentials files
+func closeCredentialsStores(stores map[string]*CredentialsStore) {
+	for name, store := range stores {
+		closer, closable := store.credentialsBackend.(io.Closer)
+		if !closable {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close the previous CredentialsStore '%s': %s", name, err)
+		}
+	}
+}
+
+// Invalidate - Removes the credentials from the cache, so they are fetched from the backend by the next Get
+func (cs *CredentialsStore) Invalidate(accessKey, backend string) {
+	cs.cache.Delete(cs.prepareKey(accessKey, backend))
+}
+
 func (cs *CredentialsStore) prepareKey(accessKey, backend string) string {
 	return fmt.Sprintf(keyPattern, accessKey, backend)
 }
@@ -102,7 +133,7 @@ func (cs *CredentialsStore) updateCache(accessKey, backend, key string, csd *Cre
 	case err == ErrCredentialsNotFound:
 		credentials = &CredentialsStoreData{EOL: time.Now().Add(cs.TTL), err: ErrCredentialsNotFound}
 	default:
-		if csd == nil {
+		if csd == nil || csd.Expired() {
 			credentials = &CredentialsStoreData{EOL: time.Now().Add(cs.TTL), err: err}
 		} else {
 			credentials = &CredentialsStoreData{}
@@ -112,6 +143,9 @@ func (cs *CredentialsStore) updateCache(accessKey, backend, key string, csd *Cre
 		log.Printf("Error while updating cache for key `%s`: `%s`", key, err)
 	}
 	credentials.EOL = time.Now().Add(cs.TTL)
+	if !credentials.Expiration.IsZero() && credentials.Expiration.Before(credentials.EOL) {
+		credentials.EOL = credentials.Expiration
+	}
 	cs.cache.Store(key, credentials)
 	defer cs.lock.Unlock()
 	if credentials.AccessKey == "" {
@@ -134,7 +168,7 @@ func (cs *CredentialsStore) Get(accessKey, backend string) (csd *CredentialsStor
 	}
 	refreshTimeoutDuration := cs.TTL / 100 * (100 - refreshTTLPercent)
 	switch {
-	case csd == nil || csd.AccessKey == "":
+	case csd == nil || csd.AccessKey == "" || csd.Expired():
 		return cs.updateCache(accessKey, backend, key, csd, true)
 	case time.Now().After(csd.EOL):
 		return cs.updateCache(accessKey, backend, key, csd, false)
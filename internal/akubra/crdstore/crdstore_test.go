@@ -134,6 +134,21 @@ func TestShouldUpdateCacheInBackground(t *testing.T) {
 	require.Equal(t, existingCredentials.SecretKey, crd.SecretKey)
 }
 
+func TestShouldRefreshExpiredTemporaryCredentialsBeforeTheirTTL(t *testing.T) {
+	expiredCredentials := &CredentialsStoreData{AccessKey: existingAccess, SecretKey: "secret_1", SessionToken: "token_1",
+		Expiration: time.Now().Add(-time.Second), EOL: time.Now().Add(10 * time.Second)}
+	renewedCredentials := &CredentialsStoreData{AccessKey: existingAccess, SecretKey: "secret_2", SessionToken: "token_2",
+		Expiration: time.Now().Add(5 * time.Second)}
+	cs := prepareCredentialsStore(existingAccess, existingStorage, renewedCredentials, nil)
+	cs.cache.Store(cs.prepareKey(existingAccess, existingStorage), expiredCredentials)
+
+	crd, err := cs.Get(existingAccess, existingStorage)
+
+	require.NoError(t, err)
+	require.Equal(t, "token_2", crd.SessionToken)
+	require.Equal(t, renewedCredentials.Expiration, crd.EOL, "temporary credentials are cached until they expire")
+}
+
 func prepareCredentialsStore(accessKey, storage string, expectedCreds *CredentialsStoreData, err error) *CredentialsStore {
 	credsBackendMock := &credentialsBackendMock{mock.Mock{}}
 	cs := CredentialsStore{
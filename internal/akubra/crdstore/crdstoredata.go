@@ -5,12 +5,20 @@ import (
 	"time"
 )
 
-// CredentialsStoreData - stores single access-secret key pair with EOL(TTL)
+// CredentialsStoreData - stores single access-secret key pair with EOL(TTL), temporary credentials come with
+// a session token and an expiration
 type CredentialsStoreData struct {
-	AccessKey string    `json:"access"`
-	SecretKey string    `json:"secret"`
-	EOL       time.Time `json:"-"`
-	err       error
+	AccessKey    string    `json:"access"`
+	SecretKey    string    `json:"secret"`
+	SessionToken string    `json:"session-token,omitempty"`
+	Expiration   time.Time `json:"expiration"`
+	EOL          time.Time `json:"-"`
+	err          error
+}
+
+// Expired - tells if the credentials are temporary and have expired
+func (csd *CredentialsStoreData) Expired() bool {
+	return !csd.Expiration.IsZero() && !time.Now().Before(csd.Expiration)
 }
 
 // Unmarshal - Unmarshal CredentialsStoreData to json
@@ -0,0 +1,285 @@
+package crdstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	fileEncryptionKeyEnvVarFormat = "CREDS_BACKEND_FILE_%s_key"
+	encryptedSecretPrefix         = "encrypted:"
+	defaultFileReloadInterval     = 5 * time.Second
+)
+
+var requiredFileProps = []string{"Path"}
+
+var errNoEncryptionKey = errors.New("encrypted secret found but no encryption key provided")
+
+// FileCredentials holds the keys of an akubra access key to a single storage, as stored in the credentials file
+type FileCredentials struct {
+	AccessKey    string `yaml:"access"`
+	SecretKey    string `yaml:"secret"`
+	SessionToken string `yaml:"session-token"`
+	Expiration   string `yaml:"expiration"`
+}
+
+// CredentialsFile maps akubra access keys to the keys of every storage, "akubra" holds the akubra keys
+type CredentialsFile map[string]map[string]FileCredentials
+
+type fileCredsBackendFactory struct {
+	credentialsBackendFactory
+}
+
+type fileCredsBackend struct {
+	CredentialsBackend
+	path           string
+	name           string
+	encryptionKey  string
+	reloadInterval time.Duration
+	lock           sync.RWMutex
+	credentials    map[string]map[string]CredentialsStoreData
+	modTime        time.Time
+	size           int64
+	onChange       func(accessKey, storageName string)
+	stopped        chan struct{}
+	stopOnce       sync.Once
+}
+
+// ReadCredentialsFile - reads the YAML or JSON credentials file, secrets are left encrypted
+func ReadCredentialsFile(path string) (CredentialsFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	credentialsFile := CredentialsFile{}
+	if err = yaml.UnmarshalStrict(content, &credentialsFile); err != nil {
+		return nil, fmt.Errorf("malformed credentials file %s: %s", path, err)
+	}
+	return credentialsFile, nil
+}
+
+// EncryptFileSecret - encrypts a secret with the encryption key of the File CredentialsStore
+func EncryptFileSecret(crdStoreName string, props map[string]string, secret string) (string, error) {
+	encryptionKey := fileEncryptionKey(crdStoreName, props)
+	if encryptionKey == "" {
+		return "", fmt.Errorf("no encryption key provided for CredentialsStore '%s'", crdStoreName)
+	}
+	aead, err := newSecretCipher(encryptionKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func (fileFactory *fileCredsBackendFactory) create(crdStoreName string, props map[string]string) (CredentialsBackend, error) {
+	for _, requiredProp := range requiredFileProps {
+		if _, propPresent := props[requiredProp]; !propPresent {
+			return nil, fmt.Errorf("property '%s' is requried to instantiate file credentials backend", requiredProp)
+		}
+	}
+	reloadInterval := defaultFileReloadInterval
+	if interval, intervalPresent := props["ReloadInterval"]; intervalPresent {
+		var err error
+		if reloadInterval, err = time.ParseDuration(interval); err != nil || reloadInterval <= 0 {
+			return nil, fmt.Errorf("ReloadInterval is not parsable: %s", interval)
+		}
+	}
+	backend := &fileCredsBackend{
+		path:           props["Path"],
+		name:           crdStoreName,
+		encryptionKey:  fileEncryptionKey(crdStoreName, props),
+		reloadInterval: reloadInterval,
+		stopped:        make(chan struct{}),
+	}
+	if err := backend.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	go backend.watch()
+	return backend, nil
+}
+
+func fileEncryptionKey(crdStoreName string, props map[string]string) string {
+	if encryptionKey := props["EncryptionKey"]; encryptionKey != "" {
+		return encryptionKey
+	}
+	return os.Getenv(fmt.Sprintf(fileEncryptionKeyEnvVarFormat, crdStoreName))
+}
+
+func (file *fileCredsBackend) FetchCredentials(accessKey string, storageName string) (*CredentialsStoreData, error) {
+	file.lock.RLock()
+	defer file.lock.RUnlock()
+	credentials, found := file.credentials[accessKey][storageName]
+	if !found {
+		return nil, ErrCredentialsNotFound
+	}
+	return &credentials, nil
+}
+
+// OnChange registers the callback notified about every credentials changed by a reload
+func (file *fileCredsBackend) OnChange(onChange func(accessKey, storageName string)) {
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	file.onChange = onChange
+}
+
+// Close stops watching the credentials file, the credentials read so far are still served
+func (file *fileCredsBackend) Close() error {
+	file.stopOnce.Do(func() { close(file.stopped) })
+	return nil
+}
+
+func (file *fileCredsBackend) watch() {
+	ticker := time.NewTicker(file.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-file.stopped:
+			return
+		case <-ticker.C:
+			if err := file.reloadIfChanged(); err != nil {
+				metrics.Mark(fmt.Sprintf("credsStore.%s.invalid", file.name))
+				log.Printf("Failed to reload credentials file of CredentialsStore '%s', keeping the previous credentials: %s", file.name, err)
+			}
+		}
+	}
+}
+
+// reloadIfChanged reads the file again if its modification time or size changed and notifies about
+// the credentials which were added, modified or removed
+func (file *fileCredsBackend) reloadIfChanged() error {
+	fileInfo, err := os.Stat(file.path)
+	if err != nil {
+		return err
+	}
+	file.lock.RLock()
+	unchanged := file.credentials != nil && fileInfo.ModTime().Equal(file.modTime) && fileInfo.Size() == file.size
+	file.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	credentialsFile, err := ReadCredentialsFile(file.path)
+	if err != nil {
+		return err
+	}
+	credentials, err := file.decrypt(credentialsFile)
+	if err != nil {
+		return err
+	}
+
+	file.lock.Lock()
+	previous := file.credentials
+	file.credentials, file.modTime, file.size = credentials, fileInfo.ModTime(), fileInfo.Size()
+	onChange := file.onChange
+	file.lock.Unlock()
+
+	if previous != nil {
+		log.Printf("Credentials file of CredentialsStore '%s' reloaded", file.name)
+	}
+	if onChange != nil {
+		for _, changed := range changedCredentials(previous, credentials) {
+			onChange(changed[0], changed[1])
+		}
+	}
+	return nil
+}
+
+func (file *fileCredsBackend) decrypt(credentialsFile CredentialsFile) (map[string]map[string]CredentialsStoreData, error) {
+	var aead cipher.AEAD
+	credentials := make(map[string]map[string]CredentialsStoreData, len(credentialsFile))
+	for accessKey, storages := range credentialsFile {
+		credentials[accessKey] = make(map[string]CredentialsStoreData, len(storages))
+		for storageName, storageCredentials := range storages {
+			if storageCredentials.AccessKey == "" || storageCredentials.SecretKey == "" {
+				return nil, fmt.Errorf("credentials of '%s' for storage '%s' are incomplete", accessKey, storageName)
+			}
+			csd := CredentialsStoreData{AccessKey: storageCredentials.AccessKey, SecretKey: storageCredentials.SecretKey,
+				SessionToken: storageCredentials.SessionToken}
+			if strings.HasPrefix(csd.SecretKey, encryptedSecretPrefix) {
+				if aead == nil {
+					if file.encryptionKey == "" {
+						return nil, errNoEncryptionKey
+					}
+					var err error
+					if aead, err = newSecretCipher(file.encryptionKey); err != nil {
+						return nil, err
+					}
+				}
+				secret, err := decryptSecret(aead, strings.TrimPrefix(csd.SecretKey, encryptedSecretPrefix))
+				if err != nil {
+					return nil, fmt.Errorf("failed to decrypt secret of '%s' for storage '%s': %s", accessKey, storageName, err)
+				}
+				csd.SecretKey = secret
+			}
+			if storageCredentials.Expiration != "" {
+				expiration, err := time.Parse(time.RFC3339, storageCredentials.Expiration)
+				if err != nil {
+					return nil, fmt.Errorf("expiration of '%s' for storage '%s' is not parsable: %s", accessKey, storageName, err)
+				}
+				csd.Expiration = expiration
+			}
+			credentials[accessKey][storageName] = csd
+		}
+	}
+	return credentials, nil
+}
+
+// newSecretCipher creates the AES-256-GCM cipher of the secrets, keyed with the SHA-256 of the encryption key
+func newSecretCipher(encryptionKey string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(encryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func decryptSecret(aead cipher.AEAD, encryptedSecret string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encryptedSecret)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	return string(secret), err
+}
+
+// changedCredentials lists the access key and storage pairs which differ between the credentials
+func changedCredentials(previous, current map[string]map[string]CredentialsStoreData) [][2]string {
+	var changed [][2]string
+	for accessKey, storages := range previous {
+		for storageName, credentials := range storages {
+			if currentCredentials, found := current[accessKey][storageName]; !found || currentCredentials != credentials {
+				changed = append(changed, [2]string{accessKey, storageName})
+			}
+		}
+	}
+	for accessKey, storages := range current {
+		for storageName := range storages {
+			if _, found := previous[accessKey][storageName]; !found {
+				changed = append(changed, [2]string{accessKey, storageName})
+			}
+		}
+	}
+	return changed
+}
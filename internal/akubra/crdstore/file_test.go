@@ -0,0 +1,170 @@
+package crdstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/crdstore/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/syncmap"
+)
+
+func writeCredentialsFile(t *testing.T, path, content string, modTime time.Time) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func credentialsFileDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "crdstore")
+	require.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestShouldFetchCredentialsFromYAMLFileDecryptingTheSecrets(t *testing.T) {
+	dir, cleanup := credentialsFileDir(t)
+	defer cleanup()
+	props := map[string]string{"Path": filepath.Join(dir, "credentials.yaml"), "EncryptionKey": "file-key", "ReloadInterval": "1h"}
+	encryptedSecret, err := EncryptFileSecret("file", props, "storage-secret")
+	require.NoError(t, err)
+	writeCredentialsFile(t, props["Path"], `
+access:
+  akubra:
+    access: access
+    secret: akubra-secret
+  storage1:
+    access: storage-access
+    secret: `+encryptedSecret+`
+    session-token: token
+    expiration: 2020-03-01T12:00:00Z
+`, time.Now())
+
+	backend, err := (&fileCredsBackendFactory{}).create("file", props)
+	require.NoError(t, err)
+
+	credentials, err := backend.FetchCredentials("access", "akubra")
+	require.NoError(t, err)
+	assert.Equal(t, &CredentialsStoreData{AccessKey: "access", SecretKey: "akubra-secret"}, credentials)
+	credentials, err = backend.FetchCredentials("access", "storage1")
+	require.NoError(t, err)
+	assert.Equal(t, &CredentialsStoreData{AccessKey: "storage-access", SecretKey: "storage-secret", SessionToken: "token",
+		Expiration: time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)}, credentials)
+	_, err = backend.FetchCredentials("access", "storage2")
+	assert.Equal(t, ErrCredentialsNotFound, err)
+}
+
+func TestShouldFetchCredentialsFromJSONFileWithEncryptionKeyFromEnv(t *testing.T) {
+	dir, cleanup := credentialsFileDir(t)
+	defer cleanup()
+	props := map[string]string{"Path": filepath.Join(dir, "credentials.json"), "ReloadInterval": "1h"}
+	require.NoError(t, os.Setenv("CREDS_BACKEND_FILE_json_key", "env-key"))
+	defer func() { _ = os.Unsetenv("CREDS_BACKEND_FILE_json_key") }()
+	encryptedSecret, err := EncryptFileSecret("json", props, "storage-secret")
+	require.NoError(t, err)
+	writeCredentialsFile(t, props["Path"], `{"access": {"storage1": {"access": "storage-access", "secret": "`+encryptedSecret+`"}}}`, time.Now())
+
+	backend, err := (&fileCredsBackendFactory{}).create("json", props)
+	require.NoError(t, err)
+
+	credentials, err := backend.FetchCredentials("access", "storage1")
+	require.NoError(t, err)
+	assert.Equal(t, "storage-secret", credentials.SecretKey)
+}
+
+func TestShouldFailToCreateFileBackendWithInvalidCredentials(t *testing.T) {
+	dir, cleanup := credentialsFileDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "credentials.yaml")
+	encryptedSecret, err := EncryptFileSecret("file", map[string]string{"EncryptionKey": "file-key"}, "secret")
+	require.NoError(t, err)
+
+	for _, testCase := range []struct {
+		content string
+		props   map[string]string
+	}{
+		{"access: {storage1: {access: a, secret: " + encryptedSecret + "}}", map[string]string{"Path": path}},
+		{"access: {storage1: {access: a, secret: " + encryptedSecret + "}}", map[string]string{"Path": path, "EncryptionKey": "other-key"}},
+		{"access: {storage1: {access: a}}", map[string]string{"Path": path}},
+		{"access: {storage1: {access: a, secret: s, unknown: field}}", map[string]string{"Path": path}},
+		{"access: {storage1: {access: a, secret: s}}", map[string]string{}},
+	} {
+		writeCredentialsFile(t, path, testCase.content, time.Now())
+		_, err := (&fileCredsBackendFactory{}).create("file", testCase.props)
+		assert.Error(t, err, testCase.content)
+	}
+}
+
+func TestShouldReloadChangedCredentialsFileAndInvalidateTheChangedCredentials(t *testing.T) {
+	dir, cleanup := credentialsFileDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "credentials.yaml")
+	modTime := time.Now().Add(-time.Hour)
+	writeCredentialsFile(t, path, `
+access:
+  storage1: {access: a1, secret: s1}
+  storage2: {access: a2, secret: s2}
+removed:
+  storage1: {access: a3, secret: s3}
+`, modTime)
+	backend := &fileCredsBackend{path: path, name: "file"}
+	require.NoError(t, backend.reloadIfChanged())
+	credentialsStore := &CredentialsStore{cache: new(syncmap.Map), TTL: time.Hour, credentialsBackend: backend}
+	var changed []string
+	backend.OnChange(func(accessKey, storageName string) {
+		changed = append(changed, accessKey+"/"+storageName)
+		credentialsStore.Invalidate(accessKey, storageName)
+	})
+	credentials, err := credentialsStore.Get("access", "storage1")
+	require.NoError(t, err)
+	require.Equal(t, "s1", credentials.SecretKey)
+
+	require.NoError(t, backend.reloadIfChanged())
+	assert.Empty(t, changed, "unchanged file isn't reloaded")
+
+	writeCredentialsFile(t, path, `
+access:
+  storage1: {access: a1, secret: new-secret}
+  storage2: {access: a2, secret: s2}
+added:
+  storage1: {access: a4, secret: s4}
+`, modTime.Add(time.Minute))
+	require.NoError(t, backend.reloadIfChanged())
+
+	sort.Strings(changed)
+	assert.Equal(t, []string{"access/storage1", "added/storage1", "removed/storage1"}, changed)
+	credentials, err = credentialsStore.Get("access", "storage1")
+	require.NoError(t, err)
+	assert.Equal(t, "new-secret", credentials.SecretKey)
+
+	writeCredentialsFile(t, path, "access: [malformed", modTime.Add(2*time.Minute))
+	assert.Error(t, backend.reloadIfChanged())
+	credentials, err = backend.FetchCredentials("access", "storage2")
+	require.NoError(t, err)
+	assert.Equal(t, "s2", credentials.SecretKey, "previous credentials are kept if the file is malformed")
+}
+
+func TestShouldStopWatchingCredentialsFileOfReinitializedCredentialsStores(t *testing.T) {
+	dir, cleanup := credentialsFileDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "credentials.yaml")
+	writeCredentialsFile(t, path, "access:\n  akubra: {access: a1, secret: s1}\n", time.Now())
+	storeMap := config.CredentialsStoreMap{"file": {Type: "File", Properties: map[string]string{"Path": path, "ReloadInterval": "10ms"}}}
+	defer func() { credentialsStores = nil }()
+
+	InitializeCredentialsStores(storeMap)
+	previous := credentialsStores["file"].credentialsBackend.(*fileCredsBackend)
+	InitializeCredentialsStores(storeMap)
+
+	select {
+	case <-previous.stopped:
+	default:
+		t.Fatal("the previous file backend is still watching the credentials file")
+	}
+	current := credentialsStores["file"].credentialsBackend.(*fileCredsBackend)
+	assert.NotEqual(t, previous, current)
+	require.NoError(t, current.Close())
+}
@@ -0,0 +1,141 @@
+package crdstore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/crdstore/config"
+)
+
+const (
+	// MinSessionDuration is the shortest lifetime of temporary credentials
+	MinSessionDuration = 15 * time.Minute
+	// DefaultSessionMaxDuration is the longest lifetime of temporary credentials if it's not configured
+	DefaultSessionMaxDuration = 12 * time.Hour
+	sessionAccessKeyPrefix    = "ASIA"
+)
+
+var (
+	// ErrInvalidSessionToken - the session token is malformed or it wasn't issued with the signing key
+	ErrInvalidSessionToken = errors.New("invalid session token")
+	// ErrExpiredSessionToken - the temporary credentials of the session token have expired
+	ErrExpiredSessionToken = errors.New("session token expired")
+)
+
+var sessionStore *SessionStore
+
+// Session describes temporary credentials issued on behalf of an akubra access key
+type Session struct {
+	AccessKey       string    `json:"access"`
+	ParentAccessKey string    `json:"parent"`
+	Buckets         []string  `json:"buckets,omitempty"`
+	Expiration      time.Time `json:"expiration"`
+}
+
+// AllowsBucket - tells if the session is scoped to the bucket, sessions without buckets allow all of them
+func (session *Session) AllowsBucket(bucket string) bool {
+	if len(session.Buckets) == 0 {
+		return true
+	}
+	for _, allowed := range session.Buckets {
+		if allowed == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionStore issues and validates session tokens. The tokens are signed and the secret keys are derived from them,
+// so any akubra instance sharing the signing key validates them without a shared state
+type SessionStore struct {
+	signingKey  []byte
+	MaxDuration time.Duration
+}
+
+// NewSessionStore - Constructor for SessionStore
+func NewSessionStore(signingKey string, maxDuration time.Duration) *SessionStore {
+	if maxDuration == 0 {
+		maxDuration = DefaultSessionMaxDuration
+	}
+	return &SessionStore{signingKey: []byte(signingKey), MaxDuration: maxDuration}
+}
+
+// InitializeSessionStore - sets up the session store if a signing key is configured. It's called once at startup,
+// the store isn't replaced on configuration reloads as the handlers and decorators keep referring to it
+func InitializeSessionStore(sessionsConfig config.Sessions) {
+	sessionStore = nil
+	if sessionsConfig.SigningKey != "" {
+		sessionStore = NewSessionStore(sessionsConfig.SigningKey, sessionsConfig.MaxDuration.Duration)
+	}
+}
+
+// GetSessionStore - returns the session store, nil if temporary credentials are disabled
+func GetSessionStore() *SessionStore {
+	return sessionStore
+}
+
+// Issue creates temporary credentials of the parent access key, scoped to the buckets if any are given
+func (store *SessionStore) Issue(parentAccessKey string, buckets []string, duration time.Duration) (*CredentialsStoreData, error) {
+	if duration < MinSessionDuration || duration > store.MaxDuration {
+		return nil, fmt.Errorf("session duration has to be between %s and %s", MinSessionDuration, store.MaxDuration)
+	}
+	randomBytes := make([]byte, 10)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+	session := Session{
+		AccessKey:       sessionAccessKeyPrefix + base32.StdEncoding.EncodeToString(randomBytes),
+		ParentAccessKey: parentAccessKey,
+		Buckets:         buckets,
+		Expiration:      time.Now().Add(duration).UTC().Truncate(time.Second),
+	}
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	return &CredentialsStoreData{
+		AccessKey:    session.AccessKey,
+		SecretKey:    store.secretKeyOf(encodedPayload),
+		SessionToken: encodedPayload + "." + store.sign("token", encodedPayload),
+		Expiration:   session.Expiration,
+	}, nil
+}
+
+// Validate checks the signature and the expiration of the session token, it returns the session with its secret key
+func (store *SessionStore) Validate(sessionToken string) (*Session, string, error) {
+	tokenParts := strings.Split(sessionToken, ".")
+	if len(tokenParts) != 2 || !hmac.Equal([]byte(store.sign("token", tokenParts[0])), []byte(tokenParts[1])) {
+		return nil, "", ErrInvalidSessionToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(tokenParts[0])
+	if err != nil {
+		return nil, "", ErrInvalidSessionToken
+	}
+	session := &Session{}
+	if err := json.Unmarshal(payload, session); err != nil {
+		return nil, "", ErrInvalidSessionToken
+	}
+	if !time.Now().Before(session.Expiration) {
+		return nil, "", ErrExpiredSessionToken
+	}
+	return session, store.secretKeyOf(tokenParts[0]), nil
+}
+
+func (store *SessionStore) secretKeyOf(encodedPayload string) string {
+	return store.sign("secret", encodedPayload)
+}
+
+func (store *SessionStore) sign(purpose, encodedPayload string) string {
+	mac := hmac.New(sha256.New, store.signingKey)
+	_, _ = mac.Write([]byte(purpose + ":" + encodedPayload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,64 @@
+package crdstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldIssueTemporaryCredentialsValidatedBySessionStoresSharingTheKey(t *testing.T) {
+	issuer := NewSessionStore("signing-key", 0)
+
+	credentials, err := issuer.Issue("parent", []string{"bucket"}, time.Hour)
+	require.NoError(t, err)
+	session, secretKey, err := NewSessionStore("signing-key", time.Hour).Validate(credentials.SessionToken)
+
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(credentials.AccessKey, "ASIA"))
+	assert.Equal(t, credentials.SecretKey, secretKey)
+	assert.Equal(t, &Session{AccessKey: credentials.AccessKey, ParentAccessKey: "parent", Buckets: []string{"bucket"},
+		Expiration: credentials.Expiration}, session)
+	assert.True(t, session.AllowsBucket("bucket"))
+	assert.False(t, session.AllowsBucket("other"))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), credentials.Expiration, time.Second)
+}
+
+func TestShouldRejectSessionTokensNotIssuedWithTheKey(t *testing.T) {
+	credentials, err := NewSessionStore("signing-key", 0).Issue("parent", nil, time.Hour)
+	require.NoError(t, err)
+	payload := strings.Split(credentials.SessionToken, ".")[0]
+
+	for _, token := range []string{"", "garbage", payload + ".", payload + "x." + strings.Split(credentials.SessionToken, ".")[1]} {
+		_, _, err = NewSessionStore("signing-key", 0).Validate(token)
+		assert.Equal(t, ErrInvalidSessionToken, err, token)
+	}
+	_, _, err = NewSessionStore("other-key", 0).Validate(credentials.SessionToken)
+	assert.Equal(t, ErrInvalidSessionToken, err)
+}
+
+func TestShouldRejectExpiredSessionTokens(t *testing.T) {
+	store := NewSessionStore("signing-key", 0)
+	expired := &Session{AccessKey: "ASIA", ParentAccessKey: "parent", Expiration: time.Now().Add(-time.Second)}
+	sessionJSON, err := json.Marshal(expired)
+	require.NoError(t, err)
+	payload := base64.RawURLEncoding.EncodeToString(sessionJSON)
+
+	_, _, err = store.Validate(payload + "." + store.sign("token", payload))
+
+	assert.Equal(t, ErrExpiredSessionToken, err)
+}
+
+func TestShouldLimitTheSessionDuration(t *testing.T) {
+	store := NewSessionStore("signing-key", time.Hour)
+
+	_, tooShortErr := store.Issue("parent", nil, time.Minute)
+	_, tooLongErr := store.Issue("parent", nil, 2*time.Hour)
+
+	assert.Error(t, tooShortErr)
+	assert.Error(t, tooLongErr)
+}
@@ -104,34 +104,42 @@ func (vault *vaultCredsBackend) FetchCredentials(accessKey string, storageName s
 		metrics.UpdateSince(fmt.Sprintf("credsStore.%s.err", vault.name), fetchStartTime)
 		return nil, err
 	}
-	access, secret, err := parseVaultResponse(vaultResponse)
+	credentials, err := parseVaultResponse(vaultResponse)
 	if err != nil {
 		metrics.UpdateSince(fmt.Sprintf("credsStore.%s.invalid", vault.name), fetchStartTime)
 		return nil, err
 	}
-	return &CredentialsStoreData{
-		AccessKey: access,
-		SecretKey: secret,
-	}, nil
+	return credentials, nil
 }
 
-func parseVaultResponse(vaultResponse *api.Secret) (string, string, error) {
+func parseVaultResponse(vaultResponse *api.Secret) (*CredentialsStoreData, error) {
 	if vaultResponse == nil || vaultResponse.Data == nil || vaultResponse.Data["data"] == nil {
-		return "", "", errNoCredentialsFound
+		return nil, errNoCredentialsFound
 	}
 	responseData, castOK := vaultResponse.Data["data"].([]interface{})
 	if !castOK || len(responseData) == 0 {
-		return "", "", errInvalidCredentialsFormat
+		return nil, errInvalidCredentialsFormat
 	}
 	keys, castOK := responseData[0].(map[string]interface{})
 	if !castOK || len(responseData) == 0 {
-		return "", "", errInvalidCredentialsFormat
+		return nil, errInvalidCredentialsFormat
 	}
 	if _, accessPresent := keys["access_key"]; !accessPresent {
-		return "", "", errAccessKeyMissing
+		return nil, errAccessKeyMissing
 	}
 	if _, secretPresent := keys["secret_key"]; !secretPresent {
-		return "", "", errSecretKeyMissing
+		return nil, errSecretKeyMissing
+	}
+	credentials := &CredentialsStoreData{AccessKey: keys["access_key"].(string), SecretKey: keys["secret_key"].(string)}
+	if sessionToken, isTemporary := keys["session_token"].(string); isTemporary {
+		credentials.SessionToken = sessionToken
+	}
+	if expiration, expires := keys["expiration"].(string); expires {
+		expirationTime, err := time.Parse(time.RFC3339, expiration)
+		if err != nil {
+			return nil, errInvalidCredentialsFormat
+		}
+		credentials.Expiration = expirationTime
 	}
-	return keys["access_key"].(string), keys["secret_key"].(string), nil
+	return credentials, nil
 }
@@ -142,6 +142,21 @@ func TestShouldReturnErrorWhenResponseIsInvalid(t *testing.T) {
 	assert.Equal(t, err, errNoCredentialsFound)
 }
 
+func TestShouldParseTemporaryCredentialsFromVaultResponse(t *testing.T) {
+	keys := map[string]interface{}{"access_key": "access", "secret_key": "secret", "session_token": "token",
+		"expiration": "2020-03-01T12:00:00Z"}
+
+	creds, err := parseVaultResponse(&api.Secret{Data: map[string]interface{}{"data": []interface{}{keys}}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, &CredentialsStoreData{AccessKey: "access", SecretKey: "secret", SessionToken: "token",
+		Expiration: time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)}, creds)
+
+	keys["expiration"] = "tomorrow"
+	_, err = parseVaultResponse(&api.Secret{Data: map[string]interface{}{"data": []interface{}{keys}}})
+	assert.Equal(t, errInvalidCredentialsFormat, err)
+}
+
 const vaultResponseFormat = `
 {
   "request_id": "c107f9f8-940e-aa5e-8209-19626c4f1032",
@@ -108,10 +108,12 @@ func respBodyCloserFactory(resp *http.Response, randomIDStr string) func() {
 	}
 }
 
-// DecorateRoundTripper applies common http.RoundTripper decorators
+// DecorateRoundTripper applies common http.RoundTripper decorators, the parsed authorization of requests
+// is put in their context for the shard authenticators of rt
 func DecorateRoundTripper(conf config.Client, servConfig config.Server, accesslog log.Logger, healthCheckEndpoint string, rt http.RoundTripper) http.RoundTripper {
 	return Decorate(
 		rt,
+		AuthHeaderContextSuplementer(),
 		RequestLimiter(servConfig.MaxConcurrentRequests),
 		BodySizeLimitter(servConfig.BodyMaxSize.SizeInBytes),
 		HeadersSuplier(conf.AdditionalRequestHeaders, conf.AdditionalResponseHeaders),
@@ -84,9 +84,8 @@ func (hs *headersSuplier) RoundTrip(req *http.Request) (resp *http.Response, err
 
 	// While tcp host is rewritten we need to keep Host header
 	// intact for sake of s3 authorization
-	if strings.Contains(req.Host, ".s3.") {
-		prefix := strings.Split(req.Host, ".s3.")[0]
-		newhost := prefix + "." + req.URL.Host
+	if bucket, isVirtualHost := utils.VirtualHostBucket(req.Host); isVirtualHost {
+		newhost := bucket + "." + req.URL.Host
 		req.Header.Set("Host", newhost)
 		req.Host = newhost
 	}
@@ -228,8 +227,8 @@ func HealthCheckHandler(healthCheckEndpoint string) Decorator {
 	}
 }
 
-// AuthHeaderContextSuplementer adds utils.ParsedAuthorizationHeader to request
-// context value
+// AuthHeaderContextSuplementer adds utils.ParsedAuthorizationHeader of the header or the presigned query
+// to request context value
 func AuthHeaderContextSuplementer() Decorator {
 	return func(roundTripper http.RoundTripper) http.RoundTripper {
 		return &authHeaderContextSuplementer{
@@ -245,17 +244,15 @@ type authHeaderContextSuplementer struct {
 func (authHeaderRT *authHeaderContextSuplementer) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	log.Debug("Request in authHeaderContextSuplementer %s", utils.RequestID(req))
 	defer log.Debug("Request out authHeaderContextSuplementer %s", utils.RequestID(req))
-	httpAuthHeader := req.Header.Get("Authorization")
-	if httpAuthHeader != "" {
-		authHeader, err := utils.ParseAuthorizationHeader(httpAuthHeader)
-		if err != nil {
-			log.Debugf("failed to parse auth header for req %s: %q", utils.RequestID(req), err)
-			return makeResponse(req, http.StatusBadRequest, incorrectAuthHeader, "text/plain"), nil
-		}
+	authHeader, err := utils.ParseRequestAuthorization(req)
+	if err == nil {
 		reqCtx := context.WithValue(req.Context(), AuthHeader, &authHeader)
 		req = req.WithContext(reqCtx)
+	} else if req.Header.Get("Authorization") != "" || err == utils.ErrMalformedPresignedQuery {
+		log.Debugf("failed to parse auth header for req %s: %q", utils.RequestID(req), err)
+		return makeResponse(req, http.StatusBadRequest, incorrectAuthHeader, "text/plain"), nil
 	}
-	return authHeaderRT.RoundTrip(req)
+	return authHeaderRT.roundTripper.RoundTrip(req)
 }
 
 // RequestLimiter limits number of concurrent requests
@@ -51,6 +51,12 @@ func UpdateGauge(name string, value int64) {
 	gauge.Update(value)
 }
 
+// UpdateHistogram creates and updates Histogram
+func UpdateHistogram(name string, value int64) {
+	histogram := metrics.GetOrRegisterHistogram(name, metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015))
+	histogram.Update(value)
+}
+
 func setupPrefix(cfg Config) string {
 	pfx = cfg.Prefix
 	if pfx == "default" {
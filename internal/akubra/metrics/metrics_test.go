@@ -89,6 +89,29 @@ func TestUpdateGauge(t *testing.T) {
 	assert.Nil(t, metrics.Get("marker"))
 }
 
+func TestUpdateHistogram(t *testing.T) {
+	// given
+	err := Init(Config{Target: "stdout", Prefix: ""})
+	assert.NoError(t, err)
+	// expect
+	assert.Nil(t, metrics.Get("histogram"))
+
+	// when
+	UpdateHistogram("histogram", 10)
+	UpdateHistogram("histogram", 30)
+
+	// then
+	histogram := metrics.Get("histogram").(metrics.Histogram)
+	assert.Equal(t, int64(2), histogram.Count())
+	assert.Equal(t, int64(30), histogram.Max())
+
+	// when
+	Clear()
+
+	// then
+	assert.Nil(t, metrics.Get("histogram"))
+}
+
 func TestMetricsInit_ForGraphiteWithNoAddress(t *testing.T) {
 	err := Init(Config{Target: "graphite", Addr: ""})
 	assert.Error(t, err)
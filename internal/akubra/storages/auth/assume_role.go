@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/crdstore"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/utils"
+)
+
+const (
+	// AssumeRoleEndpointPath is the path of the technical endpoint issuing temporary credentials
+	AssumeRoleEndpointPath = "/sts"
+	// DefaultAssumeRoleDuration is the lifetime of temporary credentials if DurationSeconds isn't given
+	DefaultAssumeRoleDuration = time.Hour
+	assumeRoleBodyMaxSize     = 8 * 1024
+	stsNamespace              = "https://sts.amazonaws.com/doc/2011-06-15/"
+)
+
+var errCredentialsStoreNotReady = errors.New("default credentials store is not initialized")
+
+type assumeRoleResponse struct {
+	XMLName     xml.Name             `xml:"AssumeRoleResponse"`
+	Namespace   string               `xml:"xmlns,attr"`
+	Credentials temporaryCredentials `xml:"AssumeRoleResult>Credentials"`
+}
+
+type temporaryCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	SessionToken    string `xml:"SessionToken"`
+	Expiration      string `xml:"Expiration"`
+}
+
+type stsErrorResponse struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Namespace string   `xml:"xmlns,attr"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+}
+
+type assumeRoleHandler struct {
+	sessions            *crdstore.SessionStore
+	akubraCredentialsOf credentialsLookup
+}
+
+// NewAssumeRoleHandler creates the STS-like endpoint which issues temporary credentials to the callers authorized
+// with their akubra keys. Action=AssumeRole takes the optional DurationSeconds and Buckets (comma separated) params.
+// The keys are looked up in the default CredentialsStore at request time, so the handler outlives configuration reloads
+func NewAssumeRoleHandler(sessions *crdstore.SessionStore) http.Handler {
+	return &assumeRoleHandler{sessions: sessions, akubraCredentialsOf: defaultAkubraCredentials}
+}
+
+func defaultAkubraCredentials(accessKey string) (*crdstore.CredentialsStoreData, error) {
+	credentialsStore, err := crdstore.GetInstance(crdstore.DefaultCredentialsStoreName)
+	if err != nil {
+		return nil, errCredentialsStoreNotReady
+	}
+	return credentialsStore.Get(accessKey, "akubra")
+}
+
+func (handler *assumeRoleHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, assumeRoleBodyMaxSize))
+	if err != nil {
+		writeSTSError(w, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	accessKey, status, message := handler.authenticate(req, body)
+	if status != http.StatusOK {
+		writeSTSError(w, status, "AccessDenied", message)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err = req.ParseForm(); err != nil {
+		writeSTSError(w, http.StatusBadRequest, "InvalidParameterValue", err.Error())
+		return
+	}
+	if req.Form.Get("Action") != "AssumeRole" {
+		writeSTSError(w, http.StatusBadRequest, "InvalidAction", "only the AssumeRole action is supported")
+		return
+	}
+	duration := DefaultAssumeRoleDuration
+	if durationSeconds := req.Form.Get("DurationSeconds"); durationSeconds != "" {
+		seconds, parseErr := strconv.Atoi(durationSeconds)
+		if parseErr != nil {
+			writeSTSError(w, http.StatusBadRequest, "ValidationError", "DurationSeconds is not a number")
+			return
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	credentials, err := handler.sessions.Issue(accessKey, bucketsParam(req.Form.Get("Buckets")), duration)
+	if err != nil {
+		writeSTSError(w, http.StatusBadRequest, "ValidationError", err.Error())
+		return
+	}
+	log.Printf("Issued temporary credentials %s of %s valid until %s", credentials.AccessKey, accessKey, credentials.Expiration)
+	writeXML(w, http.StatusOK, assumeRoleResponse{Namespace: stsNamespace,
+		Credentials: temporaryCredentials{
+			AccessKeyID:     credentials.AccessKey,
+			SecretAccessKey: credentials.SecretKey,
+			SessionToken:    credentials.SessionToken,
+			Expiration:      credentials.Expiration.Format(time.RFC3339),
+		}})
+}
+
+// authenticate verifies the signature of the caller with its akubra keys, temporary credentials can't assume roles
+func (handler *assumeRoleHandler) authenticate(req *http.Request, body []byte) (string, int, string) {
+	authHeader, err := utils.ParseRequestAuthorization(req)
+	if err != nil {
+		return "", http.StatusForbidden, "request is not signed"
+	}
+	if securityToken(req) != "" {
+		return "", http.StatusForbidden, "temporary credentials can't assume roles"
+	}
+	credentials, err := handler.akubraCredentialsOf(authHeader.AccessKey)
+	if err == crdstore.ErrCredentialsNotFound {
+		return "", http.StatusForbidden, "unknown access key"
+	}
+	if err == errCredentialsStoreNotReady {
+		return "", http.StatusServiceUnavailable, err.Error()
+	}
+	if err != nil {
+		return "", http.StatusInternalServerError, err.Error()
+	}
+	// STS clients sign the hash of the form body rather than sending it in a header
+	if authHeader.Version == utils.SignV4Algorithm && req.Header.Get("X-Amz-Content-Sha256") == "" {
+		bodyHash := sha256.Sum256(body)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash[:]))
+	}
+	keys := Keys{AccessKeyID: credentials.AccessKey, SecretAccessKey: credentials.SecretKey}
+	if doesRequestSignMatch(req, authHeader, keys, noHeadersIgnored) != ErrNone {
+		return "", http.StatusForbidden, "signature does not match"
+	}
+	return authHeader.AccessKey, http.StatusOK, ""
+}
+
+func bucketsParam(value string) []string {
+	var buckets []string
+	for _, bucket := range strings.Split(value, ",") {
+		if bucket = strings.TrimSpace(bucket); bucket != "" {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+func writeSTSError(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, stsErrorResponse{Namespace: stsNamespace, Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, document interface{}) {
+	body, err := xml.Marshal(document)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/external/miniotweak/s3signer"
+	"github.com/allegro/akubra/internal/akubra/crdstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assumeRoleRequest signs the hash of the form body like STS clients do, without the X-Amz-Content-Sha256 header
+func assumeRoleRequest(form url.Values, accessKey, secretKey, sessionToken string) *http.Request {
+	body := form.Encode()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:8071"+AssumeRoleEndpointPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	bodyHash := sha256.Sum256([]byte(body))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(bodyHash[:]))
+	ignoredHeaders := makeV4IgnoredHeaders(map[string]bool{"X-Amz-Content-Sha256": true})
+	req = s3signer.SignV4WithIgnoredHeaders(req, accessKey, secretKey, sessionToken, "us-east-1", "sts", ignoredHeaders)
+	req.Header.Del("X-Amz-Content-Sha256")
+	return req
+}
+
+func TestShouldIssueScopedTemporaryCredentials(t *testing.T) {
+	sessions := crdstore.NewSessionStore("signing-key", 0)
+	handler := &assumeRoleHandler{sessions: sessions, akubraCredentialsOf: akubraCredentialsForTest}
+	form := url.Values{"Action": {"AssumeRole"}, "DurationSeconds": {"900"}, "Buckets": {"first, second"}}
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, assumeRoleRequest(form, "access", "secret", ""))
+
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	response := assumeRoleResponse{}
+	require.NoError(t, xml.Unmarshal(recorder.Body.Bytes(), &response))
+	session, secretKey, err := sessions.Validate(response.Credentials.SessionToken)
+	require.NoError(t, err)
+	assert.Equal(t, response.Credentials.AccessKeyID, session.AccessKey)
+	assert.Equal(t, response.Credentials.SecretAccessKey, secretKey)
+	assert.Equal(t, "access", session.ParentAccessKey)
+	assert.Equal(t, []string{"first", "second"}, session.Buckets)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), session.Expiration, time.Second)
+}
+
+func TestShouldRejectInvalidAssumeRoleRequests(t *testing.T) {
+	sessions := crdstore.NewSessionStore("signing-key", 0)
+	temporary := issueForTest(t, sessions)
+	assumeRole := url.Values{"Action": {"AssumeRole"}}
+	testCases := []struct {
+		name         string
+		req          *http.Request
+		expectedCode int
+		expectedErr  string
+	}{
+		{"unknown access key", assumeRoleRequest(assumeRole, "unknown", "secret", ""), http.StatusForbidden, "AccessDenied"},
+		{"wrong secret", assumeRoleRequest(assumeRole, "access", "other", ""), http.StatusForbidden, "AccessDenied"},
+		{"temporary credentials", assumeRoleRequest(assumeRole, temporary.AccessKey, temporary.SecretKey, temporary.SessionToken),
+			http.StatusForbidden, "AccessDenied"},
+		{"unsupported action", assumeRoleRequest(url.Values{"Action": {"GetCallerIdentity"}}, "access", "secret", ""),
+			http.StatusBadRequest, "InvalidAction"},
+		{"too short duration", assumeRoleRequest(url.Values{"Action": {"AssumeRole"}, "DurationSeconds": {"60"}}, "access", "secret", ""),
+			http.StatusBadRequest, "ValidationError"},
+	}
+	handler := &assumeRoleHandler{sessions: sessions, akubraCredentialsOf: akubraCredentialsForTest}
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, testCase.req)
+
+		assert.Equal(t, testCase.expectedCode, recorder.Code, testCase.name)
+		response := stsErrorResponse{}
+		require.NoError(t, xml.Unmarshal(recorder.Body.Bytes(), &response), testCase.name)
+		assert.Equal(t, testCase.expectedErr, response.Code, testCase.name)
+	}
+}
+
+func TestShouldRespondUnavailableUntilDefaultCredentialsStoreIsInitialized(t *testing.T) {
+	defaultCredentialsStoreName := crdstore.DefaultCredentialsStoreName
+	defer func() { crdstore.DefaultCredentialsStoreName = defaultCredentialsStoreName }()
+	crdstore.DefaultCredentialsStoreName = "not-initialized"
+	handler := NewAssumeRoleHandler(crdstore.NewSessionStore("signing-key", 0))
+	recorder := httptest.NewRecorder()
+
+	handler.ServeHTTP(recorder, assumeRoleRequest(url.Values{"Action": {"AssumeRole"}}, "access", "secret", ""))
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
@@ -0,0 +1,569 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/external/miniotweak/s3signer"
+	"github.com/allegro/akubra/internal/akubra/crdstore"
+	"github.com/allegro/akubra/internal/akubra/httphandler"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/utils"
+)
+
+// postFormFieldsMaxSize limits the size of the form fields preceding the file, as S3 does
+const postFormFieldsMaxSize = 20 << 10
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+var (
+	errMalformedPostRequest = errors.New("malformed POST request")
+	errPostPolicyViolation  = errors.New("invalid according to policy")
+	errPostFileTooLarge     = errors.New("file of POST request is too large")
+	errPostSessionRejected  = errors.New("session token of POST request rejected")
+)
+
+// postFormFieldsNotInPolicy are the form fields which don't have to be covered by the policy conditions
+var postFormFieldsNotInPolicy = map[string]bool{
+	"awsaccesskeyid":  true,
+	"signature":       true,
+	"x-amz-signature": true,
+	"policy":          true,
+	"file":            true,
+}
+
+// postFormHeaders are the form fields passed to the backends as the headers of the object
+var postFormHeaders = map[string]string{
+	"acl":                 "X-Amz-Acl",
+	"cache-control":       "Cache-Control",
+	"content-disposition": "Content-Disposition",
+	"content-encoding":    "Content-Encoding",
+	"content-type":        "Content-Type",
+	"expires":             "Expires",
+}
+
+// postFormAuthFields are the x-amz-* form fields authorizing the upload, not passed to the backends
+var postFormAuthFields = map[string]bool{
+	"x-amz-algorithm":      true,
+	"x-amz-credential":     true,
+	"x-amz-date":           true,
+	"x-amz-signature":      true,
+	"x-amz-security-token": true,
+}
+
+// postForm holds the form fields of a POST Object request, keyed by the lower cased field name
+type postForm struct {
+	fields   map[string]string
+	fileName string
+	file     []byte
+}
+
+func (form *postForm) get(name string) string {
+	return form.fields[strings.ToLower(name)]
+}
+
+// postAuthorization holds the credentials which signed the policy of a POST Object request
+type postAuthorization struct {
+	version   string
+	accessKey string
+	signature string
+	region    string
+	service   string
+	date      time.Time
+}
+
+// postPolicy is the decoded policy document of a POST Object request
+type postPolicy struct {
+	Expiration time.Time     `json:"expiration"`
+	Conditions []interface{} `json:"conditions"`
+}
+
+// postError is the body of the POST Object response if the request is rejected before it reaches the backends
+type postError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// postResponse is the body of the POST Object response if success_action_status is 201
+type postResponse struct {
+	XMLName  xml.Name `xml:"PostResponse"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type postObjectRoundTripper struct {
+	rt          http.RoundTripper
+	secretKeyOf func(accessKey string) (string, error)
+	sessions    *crdstore.SessionStore
+	fileMaxSize int64
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (prt postObjectRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isPostObjectRequest(req) {
+		return prt.rt.RoundTrip(req)
+	}
+	reqID := utils.RequestID(req)
+	form, err := readPostForm(req, prt.fileMaxSize)
+	if err == errPostFileTooLarge {
+		log.Printf("POST request %s rejected: %s", reqID, err)
+		return responseWithError(req, http.StatusBadRequest, "EntityTooLarge",
+			"Your proposed upload exceeds the maximum allowed size"), nil
+	}
+	if err != nil {
+		log.Printf("Failed to read the form of POST request %s: %s", reqID, err)
+		return responseWithStatus(req, http.StatusBadRequest), nil
+	}
+	if form.get("key") == "" {
+		log.Printf("POST request %s rejected: no key field", reqID)
+		return responseWithError(req, http.StatusBadRequest, "InvalidArgument",
+			"Bucket POST must contain a field named 'key'"), nil
+	}
+	authorization, err := form.authorization()
+	if err != nil {
+		log.Printf("Failed to read the authorization of POST request %s: %s", reqID, err)
+		return utils.ResponseForbidden(req), nil
+	}
+	sessionToken := form.get(securityTokenHeader)
+	secretKey, err := prt.secretKeyFor(authorization.accessKey, sessionToken)
+	if errors.Is(err, errPostSessionRejected) {
+		log.Printf("POST request %s rejected: %s", reqID, err)
+		return utils.ResponseForbidden(req), nil
+	}
+	if err == crdstore.ErrCredentialsNotFound {
+		return utils.ResponseForbidden(req), nil
+	}
+	if err != nil {
+		return responseWithStatus(req, http.StatusInternalServerError), err
+	}
+	if !authorization.matches(form.get("policy"), secretKey) {
+		log.Printf("Policy signature of POST request %s doesn't match", reqID)
+		return utils.ResponseForbidden(req), nil
+	}
+	bucket := utils.ExtractBucketFrom(req.URL.Path)
+	if err = checkPostPolicy(form, bucket, time.Now()); err != nil {
+		log.Printf("POST request %s rejected: %s", reqID, err)
+		return utils.ResponseForbidden(req), nil
+	}
+	putReq := postAsPutRequest(req, form, bucket, authorization, secretKey, sessionToken)
+	resp, err := prt.rt.RoundTrip(putReq)
+	if err != nil || resp == nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	return postObjectResponse(req, form, bucket, resp), nil
+}
+
+// secretKeyFor returns the secret key which signed the policy: the one of the akubra credentials, or the one of the
+// temporary credentials if the form carries a session token
+func (prt postObjectRoundTripper) secretKeyFor(accessKey, sessionToken string) (string, error) {
+	if sessionToken == "" {
+		return prt.secretKeyOf(accessKey)
+	}
+	if prt.sessions == nil {
+		return "", fmt.Errorf("%w: sessions are not enabled", errPostSessionRejected)
+	}
+	session, secretKey, err := prt.sessions.Validate(sessionToken)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errPostSessionRejected, err)
+	}
+	if session.AccessKey != accessKey {
+		return "", fmt.Errorf("%w: token issued for another access key", errPostSessionRejected)
+	}
+	return secretKey, nil
+}
+
+// PostObjectDecorator turns browser-based (POST Object) uploads into signed PUT requests, after their policy is verified
+// against the akubra credentials of the CredentialsStore, or the temporary credentials of the session store if the form
+// has a x-amz-security-token. The PUT requests of temporary credentials keep the token, so they have to pass the
+// SessionDecorator. The uploaded file is read into memory, up to the content-length-range of the policy and never more
+// than bodyMaxSize
+func PostObjectDecorator(credentialsStoreName string, sessions *crdstore.SessionStore, bodyMaxSize int64) httphandler.Decorator {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		credentialsStore, err := crdstore.GetInstance(credentialsStoreName)
+		if err != nil {
+			log.Fatalf("CredentialsStore `%s` is not defined", credentialsStoreName)
+		}
+		return postObjectRoundTripper{rt: rt, fileMaxSize: bodyMaxSize, sessions: sessions, secretKeyOf: func(accessKey string) (string, error) {
+			csd, err := credentialsStore.Get(accessKey, "akubra")
+			if err != nil {
+				return "", err
+			}
+			return csd.SecretKey, nil
+		}}
+	}
+}
+
+func isPostObjectRequest(req *http.Request) bool {
+	if req.Method != http.MethodPost || !utils.IsBucketPath(req.URL.Path) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// readPostForm reads the form fields up to the file, the fields after the file are ignored. The file is read up to
+// fileMaxSize bytes, or the maximum of the content-length-range of the policy if it's lower
+func readPostForm(req *http.Request, fileMaxSize int64) (*postForm, error) {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := &postForm{fields: make(map[string]string)}
+	fieldsSize := 0
+	for {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			return nil, fmt.Errorf("%s: no file field", errMalformedPostRequest)
+		}
+		if partErr != nil {
+			return nil, partErr
+		}
+		name := strings.ToLower(part.FormName())
+		if name == "file" {
+			form.fileName = part.FileName()
+			return form, form.readFile(part, fileMaxSize)
+		}
+		value, readErr := readPostFormField(part, postFormFieldsMaxSize-fieldsSize)
+		if readErr != nil {
+			return nil, readErr
+		}
+		fieldsSize += len(value)
+		form.fields[name] = value
+	}
+}
+
+func (form *postForm) readFile(part *multipart.Part, fileMaxSize int64) error {
+	if policyMaxSize, found := policyContentLengthMax(form.get("policy")); found && policyMaxSize < fileMaxSize {
+		fileMaxSize = policyMaxSize
+	}
+	file, err := ioutil.ReadAll(io.LimitReader(part, fileMaxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(file)) > fileMaxSize {
+		return errPostFileTooLarge
+	}
+	form.file = file
+	return nil
+}
+
+func readPostFormField(part *multipart.Part, maxSize int) (string, error) {
+	value, err := ioutil.ReadAll(io.LimitReader(part, int64(maxSize)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxSize {
+		return "", fmt.Errorf("%s: form fields exceed %d bytes", errMalformedPostRequest, postFormFieldsMaxSize)
+	}
+	return string(value), nil
+}
+
+// authorization reads the V2 (AWSAccessKeyId, signature) or V4 (x-amz-algorithm, x-amz-credential, x-amz-signature)
+// authorization of the policy
+func (form *postForm) authorization() (*postAuthorization, error) {
+	if form.get("policy") == "" {
+		return nil, errors.New("no policy")
+	}
+	if algorithm := form.get("x-amz-algorithm"); algorithm != "" {
+		if algorithm != utils.SignV4Algorithm {
+			return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+		}
+		credential := strings.Split(form.get("x-amz-credential"), "/")
+		if len(credential) != 5 || form.get("x-amz-signature") == "" {
+			return nil, fmt.Errorf("malformed credential %q", form.get("x-amz-credential"))
+		}
+		date, err := time.Parse("20060102", credential[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed credential date %q", credential[1])
+		}
+		return &postAuthorization{version: utils.SignV4Algorithm, accessKey: credential[0], date: date,
+			region: credential[2], service: credential[3], signature: form.get("x-amz-signature")}, nil
+	}
+	if form.get("awsaccesskeyid") == "" || form.get("signature") == "" {
+		return nil, errors.New("no credentials")
+	}
+	return &postAuthorization{version: utils.SignV2Algorithm, accessKey: form.get("awsaccesskeyid"),
+		signature: form.get("signature")}, nil
+}
+
+func (authorization *postAuthorization) matches(policy, secretKey string) bool {
+	var expected string
+	switch authorization.version {
+	case utils.SignV2Algorithm:
+		expected = s3signer.PostPresignSignatureV2(policy, secretKey)
+	case utils.SignV4Algorithm:
+		expected = s3signer.PostPresignSignatureV4(policy, authorization.date, secretKey, authorization.region, authorization.service)
+	}
+	return hmac.Equal([]byte(expected), []byte(authorization.signature))
+}
+
+// checkPostPolicy checks the expiration and the conditions of the policy against the form, every form field
+// has to be covered by a condition
+func checkPostPolicy(form *postForm, bucket string, now time.Time) error {
+	policy, err := decodePostPolicy(form.get("policy"))
+	if err != nil {
+		return fmt.Errorf("%s: %s", errPostPolicyViolation, err)
+	}
+	if !now.Before(policy.Expiration) {
+		return fmt.Errorf("%s: policy expired", errPostPolicyViolation)
+	}
+	fields := make(map[string]string, len(form.fields)+1)
+	for name, value := range form.fields {
+		fields[name] = value
+	}
+	fields["bucket"] = bucket
+	covered := make(map[string]bool)
+	for _, condition := range policy.Conditions {
+		name, err := checkPostPolicyCondition(condition, fields, len(form.file))
+		if err != nil {
+			return fmt.Errorf("%s: %s", errPostPolicyViolation, err)
+		}
+		covered[name] = true
+	}
+	for name := range form.fields {
+		if !covered[name] && !postFormFieldsNotInPolicy[name] && !strings.HasPrefix(name, "x-ignore-") {
+			return fmt.Errorf("%s: extra input field %q", errPostPolicyViolation, name)
+		}
+	}
+	return nil
+}
+
+func decodePostPolicy(encodedPolicy string) (*postPolicy, error) {
+	policyJSON, err := base64.StdEncoding.DecodeString(encodedPolicy)
+	if err != nil {
+		return nil, errors.New("malformed policy encoding")
+	}
+	var policy postPolicy
+	if err = json.Unmarshal(policyJSON, &policy); err != nil {
+		return nil, fmt.Errorf("malformed policy document: %s", err)
+	}
+	return &policy, nil
+}
+
+// policyContentLengthMax returns the maximum of the content-length-range condition of the policy, the policy
+// itself is checked once the whole form is read
+func policyContentLengthMax(encodedPolicy string) (int64, bool) {
+	policy, err := decodePostPolicy(encodedPolicy)
+	if err != nil {
+		return 0, false
+	}
+	for _, condition := range policy.Conditions {
+		condition, isList := condition.([]interface{})
+		if !isList || len(condition) != 3 {
+			continue
+		}
+		if operator, _ := condition[0].(string); strings.ToLower(operator) != "content-length-range" {
+			continue
+		}
+		if max, err := policyNumber(condition[2]); err == nil && max >= 0 {
+			return max, true
+		}
+	}
+	return 0, false
+}
+
+// checkPostPolicyCondition checks a {"field": "value"}, ["eq", "$field", "value"], ["starts-with", "$field", "prefix"]
+// or ["content-length-range", min, max] condition and returns the name of the field it covers
+func checkPostPolicyCondition(condition interface{}, fields map[string]string, contentLength int) (string, error) {
+	switch condition := condition.(type) {
+	case map[string]interface{}:
+		if len(condition) != 1 {
+			return "", fmt.Errorf("malformed condition %v", condition)
+		}
+		for name, value := range condition {
+			return checkPostPolicyMatch("eq", "$"+name, value, fields)
+		}
+	case []interface{}:
+		if len(condition) != 3 {
+			return "", fmt.Errorf("malformed condition %v", condition)
+		}
+		operator, _ := condition[0].(string)
+		if strings.ToLower(operator) == "content-length-range" {
+			return "", checkContentLengthRange(condition[1], condition[2], contentLength)
+		}
+		field, _ := condition[1].(string)
+		return checkPostPolicyMatch(strings.ToLower(operator), field, condition[2], fields)
+	}
+	return "", fmt.Errorf("malformed condition %v", condition)
+}
+
+func checkPostPolicyMatch(operator, field string, value interface{}, fields map[string]string) (string, error) {
+	expected, isString := value.(string)
+	if !isString || !strings.HasPrefix(field, "$") {
+		return "", fmt.Errorf("malformed condition [%s, %s, %v]", operator, field, value)
+	}
+	name := strings.ToLower(strings.TrimPrefix(field, "$"))
+	actual := fields[name]
+	switch operator {
+	case "eq":
+		if actual != expected {
+			return "", fmt.Errorf("field %q doesn't equal %q", name, expected)
+		}
+	case "starts-with":
+		if !strings.HasPrefix(actual, expected) {
+			return "", fmt.Errorf("field %q doesn't start with %q", name, expected)
+		}
+	default:
+		return "", fmt.Errorf("unsupported condition %q", operator)
+	}
+	return name, nil
+}
+
+func checkContentLengthRange(minValue, maxValue interface{}, contentLength int) error {
+	min, minErr := policyNumber(minValue)
+	max, maxErr := policyNumber(maxValue)
+	if minErr != nil || maxErr != nil {
+		return fmt.Errorf("malformed content-length-range [%v, %v]", minValue, maxValue)
+	}
+	if int64(contentLength) < min || int64(contentLength) > max {
+		return fmt.Errorf("content length %d is out of [%d, %d]", contentLength, min, max)
+	}
+	return nil
+}
+
+func policyNumber(value interface{}) (int64, error) {
+	switch value := value.(type) {
+	case float64:
+		return int64(value), nil
+	case string:
+		return strconv.ParseInt(value, 10, 64)
+	}
+	return 0, fmt.Errorf("not a number %v", value)
+}
+
+// objectKey substitutes ${filename} in the key field with the name of the uploaded file
+func (form *postForm) objectKey() string {
+	return strings.Replace(form.get("key"), "${filename}", form.fileName, -1)
+}
+
+// postAsPutRequest builds the PUT request of the uploaded file, signed with the keys (and the session token) which
+// signed the policy, so the request is authorized and replicated as any other upload
+func postAsPutRequest(req *http.Request, form *postForm, bucket string, authorization *postAuthorization, secretKey, sessionToken string) *http.Request {
+	putReq := req.Clone(req.Context())
+	putReq.Method = http.MethodPut
+	putReq.URL.Path = "/" + bucket + "/" + form.objectKey()
+	putReq.URL.RawPath = ""
+	putReq.URL.RawQuery = ""
+	putReq.RequestURI = ""
+	for _, header := range []string{"Authorization", "Content-Type", "Content-Length", "X-Amz-Content-Sha256", securityTokenHeader} {
+		putReq.Header.Del(header)
+	}
+	for name, value := range form.fields {
+		if header, isHeader := postFormHeaders[name]; isHeader {
+			putReq.Header.Set(header, value)
+		}
+		if strings.HasPrefix(name, "x-amz-") && !postFormAuthFields[name] {
+			putReq.Header.Set(name, value)
+		}
+	}
+	file := form.file
+	putReq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(file)), nil
+	}
+	putReq.Body, _ = putReq.GetBody()
+	putReq.ContentLength = int64(len(file))
+
+	switch authorization.version {
+	case utils.SignV2Algorithm:
+		if sessionToken != "" {
+			putReq.Header.Set(securityTokenHeader, sessionToken)
+		}
+		return s3signer.SignV2(putReq, authorization.accessKey, secretKey, noHeadersIgnored)
+	default:
+		putReq.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+		return s3signer.SignV4WithIgnoredHeaders(putReq, authorization.accessKey, secretKey, sessionToken, authorization.region,
+			authorization.service, v4IgnoredHeaders)
+	}
+}
+
+// postObjectResponse maps the PUT response to a redirect if success_action_redirect is set, or to the
+// success_action_status (204 by default)
+func postObjectResponse(req *http.Request, form *postForm, bucket string, putResp *http.Response) *http.Response {
+	if putResp.Body != nil {
+		_, _ = io.Copy(ioutil.Discard, putResp.Body)
+		_ = putResp.Body.Close()
+	}
+	key := form.objectKey()
+	etag := putResp.Header.Get("ETag")
+	resp := responseWithStatus(req, http.StatusNoContent)
+	resp.Header = putResp.Header.Clone()
+	resp.Header.Del("Content-Length")
+
+	redirect := form.get("success_action_redirect")
+	if redirect == "" {
+		redirect = form.get("redirect")
+	}
+	if redirectURL, err := url.Parse(redirect); redirect != "" && err == nil {
+		query := redirectURL.Query()
+		query.Set("bucket", bucket)
+		query.Set("key", key)
+		query.Set("etag", etag)
+		redirectURL.RawQuery = query.Encode()
+		resp.StatusCode = http.StatusSeeOther
+		resp.Header.Set("Location", redirectURL.String())
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		return resp
+	}
+
+	location := (&url.URL{Scheme: "http", Host: req.Host, Path: "/" + bucket + "/" + key}).String()
+	if req.TLS != nil {
+		location = "https" + strings.TrimPrefix(location, "http")
+	}
+	resp.Header.Set("Location", location)
+	switch form.get("success_action_status") {
+	case "200":
+		resp.StatusCode = http.StatusOK
+	case "201":
+		body, err := xml.Marshal(postResponse{Location: location, Bucket: bucket, Key: key, ETag: etag})
+		if err == nil {
+			resp.StatusCode = http.StatusCreated
+			resp.Header.Set("Content-Type", "application/xml")
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+			resp.ContentLength = int64(len(body))
+		}
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	return resp
+}
+
+func responseWithError(req *http.Request, statusCode int, code, message string) *http.Response {
+	resp := responseWithStatus(req, statusCode)
+	body, err := xml.Marshal(postError{Code: code, Message: message})
+	if err != nil {
+		return resp
+	}
+	resp.Header.Set("Content-Type", "application/xml")
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp
+}
+
+func responseWithStatus(req *http.Request, statusCode int) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode: statusCode,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/external/miniotweak/s3signer"
+	"github.com/allegro/akubra/internal/akubra/crdstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type putCapturingRoundTripper struct {
+	requests []*http.Request
+	bodies   []string
+}
+
+func (rt *putCapturingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req)
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		rt.bodies = append(rt.bodies, string(body))
+	}
+	header := http.Header{"Etag": []string{`"etag"`}}
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(&bytes.Buffer{}), Request: req}, nil
+}
+
+func newPostObjectRoundTripper(rt http.RoundTripper) postObjectRoundTripper {
+	return postObjectRoundTripper{rt: rt, fileMaxSize: 1024, secretKeyOf: func(accessKey string) (string, error) {
+		if accessKey != "access" {
+			return "", crdstore.ErrCredentialsNotFound
+		}
+		return "secret", nil
+	}}
+}
+
+func encodePolicy(t *testing.T, expiration time.Time, conditions ...interface{}) string {
+	policy, err := json.Marshal(map[string]interface{}{"expiration": expiration.Format(time.RFC3339), "conditions": conditions})
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(policy)
+}
+
+func postObjectRequest(t *testing.T, fields [][2]string, file string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, field := range fields {
+		require.NoError(t, writer.WriteField(field[0], field[1]))
+	}
+	fileWriter, err := writer.CreateFormFile("file", "photo.jpg")
+	require.NoError(t, err)
+	_, err = fileWriter.Write([]byte(file))
+	require.NoError(t, err)
+	require.NoError(t, writer.WriteField("ignored", "after the file"))
+	require.NoError(t, writer.Close())
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:8080/bucket", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func v4PostObjectFields(t *testing.T, secret string, conditions ...interface{}) [][2]string {
+	return v4PostObjectFieldsOf(t, "access", secret, "", conditions...)
+}
+
+func v4PostObjectFieldsOf(t *testing.T, accessKey, secret, sessionToken string, conditions ...interface{}) [][2]string {
+	now := time.Now().UTC()
+	credential := accessKey + "/" + now.Format("20060102") + "/us-east-1/s3/aws4_request"
+	amzDate := now.Format("20060102T150405Z")
+	conditions = append(conditions, map[string]string{"x-amz-algorithm": "AWS4-HMAC-SHA256"},
+		map[string]string{"x-amz-credential": credential}, map[string]string{"x-amz-date": amzDate})
+	fields := [][2]string{
+		{"key", "uploads/${filename}"},
+		{"Content-Type", "image/jpeg"},
+		{"x-amz-meta-owner", "john"},
+		{"success_action_status", "201"},
+		{"X-Amz-Algorithm", "AWS4-HMAC-SHA256"},
+		{"X-Amz-Credential", credential},
+		{"X-Amz-Date", amzDate},
+	}
+	if sessionToken != "" {
+		conditions = append(conditions, map[string]string{"x-amz-security-token": sessionToken})
+		fields = append(fields, [2]string{"X-Amz-Security-Token", sessionToken})
+	}
+	policy := encodePolicy(t, now.Add(time.Hour), conditions...)
+	return append(fields,
+		[2]string{"Policy", policy},
+		[2]string{"X-Amz-Signature", s3signer.PostPresignSignatureV4(policy, now, secret, "us-east-1", "s3")})
+}
+
+var v4PostObjectConditions = []interface{}{
+	map[string]string{"bucket": "bucket"},
+	[]interface{}{"starts-with", "$key", "uploads/"},
+	[]interface{}{"starts-with", "$Content-Type", "image/"},
+	[]interface{}{"eq", "$x-amz-meta-owner", "john"},
+	map[string]string{"success_action_status": "201"},
+	[]interface{}{"content-length-range", 1, 1024},
+}
+
+func TestShouldUploadV4SignedPostObjectAsSignedPutRequest(t *testing.T) {
+	backend := &putCapturingRoundTripper{}
+	req := postObjectRequest(t, v4PostObjectFields(t, "secret", v4PostObjectConditions...), "content")
+
+	resp, err := newPostObjectRoundTripper(backend).RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Len(t, backend.requests, 1)
+	putReq := backend.requests[0]
+	assert.Equal(t, http.MethodPut, putReq.Method)
+	assert.Equal(t, "/bucket/uploads/photo.jpg", putReq.URL.Path)
+	assert.Equal(t, "content", backend.bodies[0])
+	assert.Equal(t, int64(len("content")), putReq.ContentLength)
+	assert.Equal(t, "image/jpeg", putReq.Header.Get("Content-Type"))
+	assert.Equal(t, "john", putReq.Header.Get("X-Amz-Meta-Owner"))
+	assert.Empty(t, putReq.Header.Get("X-Amz-Credential"))
+	verified, err := s3signer.VerifyV4(putReq, "secret")
+	assert.True(t, verified, err)
+	replayedBody, err := putReq.GetBody()
+	require.NoError(t, err)
+	replayed, _ := ioutil.ReadAll(replayedBody)
+	assert.Equal(t, "content", string(replayed))
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `<PostResponse><Location>http://localhost:8080/bucket/uploads/photo.jpg</Location>`+
+		`<Bucket>bucket</Bucket><Key>uploads/photo.jpg</Key><ETag>&#34;etag&#34;</ETag></PostResponse>`, string(body))
+}
+
+func TestShouldUploadPostObjectOfTemporaryCredentialsThroughTheSession(t *testing.T) {
+	sessions := crdstore.NewSessionStore("signing-key", 0)
+	credentials := issueForTest(t, sessions, "bucket")
+	otherBucketCredentials := issueForTest(t, sessions, "other")
+	backend := &putCapturingRoundTripper{}
+	postRT := newPostObjectRoundTripper(newSessionRoundTripper(backend, sessions))
+	postRT.sessions = sessions
+
+	req := postObjectRequest(t, v4PostObjectFieldsOf(t, credentials.AccessKey, credentials.SecretKey,
+		credentials.SessionToken, v4PostObjectConditions...), "content")
+	resp, err := postRT.RoundTrip(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Len(t, backend.requests, 1)
+	putReq := backend.requests[0]
+	assert.Equal(t, "/bucket/uploads/photo.jpg", putReq.URL.Path)
+	assert.Empty(t, putReq.Header.Get(securityTokenHeader))
+	verified, err := s3signer.VerifyV4(putReq, "secret")
+	assert.True(t, verified, err)
+
+	testCases := map[string][][2]string{
+		"bucket out of scope": v4PostObjectFieldsOf(t, otherBucketCredentials.AccessKey, otherBucketCredentials.SecretKey,
+			otherBucketCredentials.SessionToken, v4PostObjectConditions...),
+		"token of another session": v4PostObjectFieldsOf(t, credentials.AccessKey, credentials.SecretKey,
+			otherBucketCredentials.SessionToken, v4PostObjectConditions...),
+		"forged token": v4PostObjectFieldsOf(t, credentials.AccessKey, credentials.SecretKey,
+			"forged", v4PostObjectConditions...),
+		"wrong secret": v4PostObjectFieldsOf(t, credentials.AccessKey, "secret",
+			credentials.SessionToken, v4PostObjectConditions...),
+	}
+	for name, fields := range testCases {
+		resp, err := postRT.RoundTrip(postObjectRequest(t, fields, "content"))
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, name)
+	}
+	assert.Len(t, backend.requests, 1)
+
+	withoutSessions := newPostObjectRoundTripper(backend)
+	resp, err = withoutSessions.RoundTrip(postObjectRequest(t, v4PostObjectFieldsOf(t, credentials.AccessKey,
+		credentials.SecretKey, credentials.SessionToken, v4PostObjectConditions...), "content"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Len(t, backend.requests, 1)
+}
+
+func TestShouldRedirectV2SignedPostObjectUploads(t *testing.T) {
+	backend := &putCapturingRoundTripper{}
+	policy := encodePolicy(t, time.Now().Add(time.Hour), map[string]string{"bucket": "bucket"},
+		map[string]string{"key": "photo"}, map[string]string{"acl": "public-read"},
+		map[string]string{"success_action_redirect": "http://example.com/done?from=upload"})
+	req := postObjectRequest(t, [][2]string{{"key", "photo"}, {"acl", "public-read"},
+		{"success_action_redirect", "http://example.com/done?from=upload"}, {"AWSAccessKeyId", "access"},
+		{"policy", policy}, {"signature", s3signer.PostPresignSignatureV2(policy, "secret")}}, "content")
+
+	resp, err := newPostObjectRoundTripper(backend).RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Len(t, backend.requests, 1)
+	assert.Equal(t, "public-read", backend.requests[0].Header.Get("X-Amz-Acl"))
+	verified, err := s3signer.VerifyV2(backend.requests[0], "secret", noHeadersIgnored)
+	assert.True(t, verified, err)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", location.Host)
+	assert.Equal(t, url.Values{"from": {"upload"}, "bucket": {"bucket"}, "key": {"photo"}, "etag": {`"etag"`}}, location.Query())
+}
+
+func TestShouldRejectPostObjectUploadsViolatingThePolicy(t *testing.T) {
+	testCases := map[string][][2]string{
+		"unknown access key": func() [][2]string {
+			fields := v4PostObjectFields(t, "secret", v4PostObjectConditions...)
+			fields[5][1] = "unknown" + fields[5][1][len("access"):]
+			return fields
+		}(),
+		"wrong signature":  v4PostObjectFields(t, "other-secret", v4PostObjectConditions...),
+		"key out of scope": v4PostObjectFields(t, "secret", v4PostObjectConditions[0], []interface{}{"starts-with", "$key", "private/"}),
+		"extra input field": v4PostObjectFields(t, "secret", v4PostObjectConditions[0], v4PostObjectConditions[1],
+			v4PostObjectConditions[3], v4PostObjectConditions[4]),
+		"file too small": v4PostObjectFields(t, "secret", append(v4PostObjectConditions[:5:5],
+			[]interface{}{"content-length-range", 10, 20})...),
+	}
+	for name, fields := range testCases {
+		backend := &putCapturingRoundTripper{}
+		resp, err := newPostObjectRoundTripper(backend).RoundTrip(postObjectRequest(t, fields, "content"))
+
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, name)
+		assert.Empty(t, backend.requests, name)
+	}
+}
+
+func TestShouldRejectPostObjectUploadsExceedingTheSizeLimit(t *testing.T) {
+	testCases := map[string]struct {
+		conditions []interface{}
+		file       string
+	}{
+		"over the policy range":  {append(v4PostObjectConditions[:5:5], []interface{}{"content-length-range", 1, 3}), "content"},
+		"over the body max size": {append(v4PostObjectConditions[:5:5], []interface{}{"content-length-range", 1, 4096}), string(make([]byte, 2048))},
+	}
+	for name, testCase := range testCases {
+		backend := &putCapturingRoundTripper{}
+		req := postObjectRequest(t, v4PostObjectFields(t, "secret", testCase.conditions...), testCase.file)
+
+		resp, err := newPostObjectRoundTripper(backend).RoundTrip(req)
+
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "<Code>EntityTooLarge</Code>", name)
+		assert.Empty(t, backend.requests, name)
+	}
+}
+
+func TestShouldRejectPostObjectUploadsWithoutKey(t *testing.T) {
+	backend := &putCapturingRoundTripper{}
+	fields := v4PostObjectFields(t, "secret", v4PostObjectConditions[0], v4PostObjectConditions[2],
+		v4PostObjectConditions[3], v4PostObjectConditions[4], v4PostObjectConditions[5])
+
+	resp, err := newPostObjectRoundTripper(backend).RoundTrip(postObjectRequest(t, fields[1:], "content"))
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "<Code>InvalidArgument</Code>")
+	assert.Empty(t, backend.requests)
+}
+
+func TestShouldRejectExpiredPostObjectPolicy(t *testing.T) {
+	form := &postForm{fields: map[string]string{"key": "photo",
+		"policy": encodePolicy(t, time.Now().Add(-time.Second), map[string]string{"key": "photo"})}}
+
+	err := checkPostPolicy(form, "bucket", time.Now())
+
+	assert.EqualError(t, err, "invalid according to policy: policy expired")
+}
+
+func TestShouldPassThroughRequestsOtherThanPostObject(t *testing.T) {
+	backend := &putCapturingRoundTripper{}
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:8080/bucket/object?uploads", nil)
+
+	_, err := newPostObjectRoundTripper(backend).RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Len(t, backend.requests, 1)
+	assert.Equal(t, req, backend.requests[0])
+}
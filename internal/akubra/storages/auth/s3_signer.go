@@ -22,9 +22,22 @@ type APIErrorCode int
 const (
 	ErrSignatureDoesNotMatch APIErrorCode = iota
 	ErrUnsupportedSignatureVersion
+	ErrExpiredPresignRequest
+	ErrRequestNotReadyYet
+	ErrMaximumExpires
 	ErrNone
 )
 
+const (
+	// maxPresignedExpiry is the longest validity of V4 presigned requests accepted by S3
+	maxPresignedExpiry = 7 * 24 * time.Hour
+	// presignedClockSkew is the tolerated difference between the clocks of the client and akubra
+	presignedClockSkew = 15 * time.Minute
+)
+
+// errPresignedRequestExpired is returned when a presigned request expires before it is signed for the backend
+var errPresignedRequestExpired = errors.New("presigned request expired")
+
 var v4IgnoredHeaders = map[string]bool{
 	"Authorization":   true,
 	"Content-Type":    true,
@@ -36,6 +49,9 @@ var v4IgnoredHeaders = map[string]bool{
 
 var noHeadersIgnored = make(map[string]bool)
 
+// securityTokenHeader carries the session token of temporary credentials
+const securityTokenHeader = "X-Amz-Security-Token"
+
 //DoesSignMatch - Verify authorization header with calculated header
 //returns true if matches, false otherwise. if error is not nil then it is always false
 func DoesSignMatch(r *http.Request, cred Keys, ignoredCanonicalizedHeaders map[string]bool) APIErrorCode {
@@ -43,7 +59,14 @@ func DoesSignMatch(r *http.Request, cred Keys, ignoredCanonicalizedHeaders map[s
 	if authHeaderVal == nil {
 		return ErrNone
 	}
-	authHeader := authHeaderVal.(*utils.ParsedAuthorizationHeader)
+	return doesRequestSignMatch(r, *authHeaderVal.(*utils.ParsedAuthorizationHeader), cred, ignoredCanonicalizedHeaders)
+}
+
+// doesRequestSignMatch verifies the signature of the request authorized in the header or in the query string
+func doesRequestSignMatch(r *http.Request, authHeader utils.ParsedAuthorizationHeader, cred Keys, ignoredCanonicalizedHeaders map[string]bool) APIErrorCode {
+	if authHeader.Presigned {
+		return doesPresignedSignMatch(r, authHeader, cred, ignoredCanonicalizedHeaders)
+	}
 
 	switch authHeader.Version {
 	case utils.SignV2Algorithm:
@@ -71,6 +94,37 @@ func DoesSignMatch(r *http.Request, cred Keys, ignoredCanonicalizedHeaders map[s
 	return ErrNone
 }
 
+// doesPresignedSignMatch verifies the query string signature and the validity period of a presigned request
+func doesPresignedSignMatch(r *http.Request, authHeader utils.ParsedAuthorizationHeader, cred Keys, ignoredCanonicalizedHeaders map[string]bool) APIErrorCode {
+	now := time.Now()
+	if now.After(authHeader.Expires) {
+		return ErrExpiredPresignRequest
+	}
+	if !authHeader.SignedAt.IsZero() {
+		if authHeader.SignedAt.After(now.Add(presignedClockSkew)) {
+			return ErrRequestNotReadyYet
+		}
+		if authHeader.Expires.Sub(authHeader.SignedAt) > maxPresignedExpiry {
+			return ErrMaximumExpires
+		}
+	}
+	var result bool
+	var err error
+	switch authHeader.Version {
+	case utils.SignV2Algorithm:
+		result, err = s3signer.VerifyPresignedV2(r, cred.SecretAccessKey, ignoredCanonicalizedHeaders)
+	case utils.SignV4Algorithm:
+		result, err = s3signer.VerifyPresignedV4(r, cred.SecretAccessKey)
+	default:
+		return ErrUnsupportedSignatureVersion
+	}
+	if !result {
+		log.Printf("Error while verifying presigned %s Signature for request %s: %s", authHeader.Version, utils.RequestID(r), err)
+		return ErrSignatureDoesNotMatch
+	}
+	return ErrNone
+}
+
 // Keys user credentials
 type Keys struct {
 	AccessKeyID     string `json:"access-key" yaml:"AccessKey"`
@@ -97,30 +151,41 @@ type signAuthServiceRoundTripper struct {
 
 // RoundTrip implements http.RoundTripper interface
 func (srt signRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	authHeader, err := utils.ParseAuthorizationHeader(req.Header.Get("Authorization"))
+	authHeader, err := utils.ParseRequestAuthorization(req)
 	if err != nil {
 		if err == utils.ErrNoAuthHeader {
 			return srt.rt.RoundTrip(req)
 		}
+		if err == utils.ErrMalformedPresignedQuery {
+			return malformedPresignedQuery(req), nil
+		}
 		return &http.Response{StatusCode: http.StatusBadRequest, Request: req}, err
 	}
-	if DoesSignMatch(req, Keys{AccessKeyID: srt.keys.AccessKeyID, SecretAccessKey: srt.keys.SecretAccessKey}, srt.ignoredCanonicalizedHeaders) != ErrNone {
+	if authHeader.Presigned {
+		// presigned requests are authorized by the backend keys once signed again, so they are always verified here
+		if doesPresignedSignMatch(req, authHeader, srt.keys, srt.ignoredCanonicalizedHeaders) != ErrNone {
+			return utils.ResponseForbidden(req), nil
+		}
+	} else if DoesSignMatch(req, Keys{AccessKeyID: srt.keys.AccessKeyID, SecretAccessKey: srt.keys.SecretAccessKey}, srt.ignoredCanonicalizedHeaders) != ErrNone {
 		return &http.Response{StatusCode: http.StatusForbidden, Request: req}, err
 	}
-	req, err = sign(req, authHeader, srt.host, srt.keys.AccessKeyID, srt.keys.SecretAccessKey, srt.ignoredCanonicalizedHeaders, srt.v4IgnoredHeaders)
+	req, err = sign(req, authHeader, srt.host, srt.keys.AccessKeyID, srt.keys.SecretAccessKey, "", srt.ignoredCanonicalizedHeaders, srt.v4IgnoredHeaders)
 	if err != nil {
-		return &http.Response{StatusCode: http.StatusBadRequest, Request: req}, err
+		return signingFailure(req, err)
 	}
 	return srt.rt.RoundTrip(req)
 }
 
 // RoundTrip implements http.RoundTripper interface
 func (srt signAuthServiceRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	authHeader, err := utils.ParseAuthorizationHeader(req.Header.Get("Authorization"))
+	authHeader, err := utils.ParseRequestAuthorization(req)
 	if err != nil {
 		if err == utils.ErrNoAuthHeader {
 			return srt.rt.RoundTrip(req)
 		}
+		if err == utils.ErrMalformedPresignedQuery {
+			return malformedPresignedQuery(req), nil
+		}
 		return &http.Response{StatusCode: http.StatusBadRequest, Request: req}, err
 	}
 	csd, err := srt.crd.Get(authHeader.AccessKey, "akubra")
@@ -130,6 +195,12 @@ func (srt signAuthServiceRoundTripper) RoundTrip(req *http.Request) (*http.Respo
 	if err != nil {
 		return &http.Response{StatusCode: http.StatusInternalServerError, Request: req}, err
 	}
+	if authHeader.Presigned {
+		keys := Keys{AccessKeyID: csd.AccessKey, SecretAccessKey: csd.SecretKey}
+		if doesPresignedSignMatch(req, authHeader, keys, srt.ignoredCanonicalizedHeaders) != ErrNone {
+			return utils.ResponseForbidden(req), nil
+		}
+	}
 	csd, err = srt.crd.Get(authHeader.AccessKey, srt.backend)
 	if err == crdstore.ErrCredentialsNotFound {
 		return &http.Response{StatusCode: http.StatusForbidden, Request: req}, err
@@ -137,9 +208,9 @@ func (srt signAuthServiceRoundTripper) RoundTrip(req *http.Request) (*http.Respo
 	if err != nil {
 		return &http.Response{StatusCode: http.StatusInternalServerError, Request: req}, err
 	}
-	req, err = sign(req, authHeader, srt.host, csd.AccessKey, csd.SecretKey, srt.ignoredCanonicalizedHeaders, srt.v4IgnoredHeaders)
+	req, err = sign(req, authHeader, srt.host, csd.AccessKey, csd.SecretKey, csd.SessionToken, srt.ignoredCanonicalizedHeaders, srt.v4IgnoredHeaders)
 	if err != nil {
-		return &http.Response{StatusCode: http.StatusBadRequest, Request: req}, err
+		return signingFailure(req, err)
 	}
 	if req == nil {
 		return &http.Response{StatusCode: http.StatusInternalServerError, Request: req}, err
@@ -147,6 +218,22 @@ func (srt signAuthServiceRoundTripper) RoundTrip(req *http.Request) (*http.Respo
 	return srt.rt.RoundTrip(req)
 }
 
+// malformedPresignedQuery is the response to a request with presigned query parameters which can't be parsed,
+// such requests mustn't be passed to the backend as anonymous ones
+func malformedPresignedQuery(req *http.Request) *http.Response {
+	log.Printf("Rejected request %s with malformed presigned query", utils.RequestID(req))
+	return &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Bad Request", Request: req,
+		Body: http.NoBody}
+}
+
+// signingFailure is the response to a request that couldn't be signed for the backend
+func signingFailure(req *http.Request, err error) (*http.Response, error) {
+	if err == errPresignedRequestExpired {
+		return utils.ResponseForbidden(req), nil
+	}
+	return &http.Response{StatusCode: http.StatusBadRequest, Request: req}, err
+}
+
 func isStreamingRequest(req *http.Request) (bool, int64, error) {
 	if req.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
 		return false, 0, nil
@@ -217,11 +304,17 @@ func (srt forceSignRoundTripper) RoundTrip(req *http.Request) (*http.Response, e
 	return srt.rt.RoundTrip(req)
 }
 
-func sign(req *http.Request, authHeader utils.ParsedAuthorizationHeader, newHost, accessKey, secretKey string, ignoredHeaders, v4IgnoredHeaders map[string]bool) (*http.Request, error) {
+func sign(req *http.Request, authHeader utils.ParsedAuthorizationHeader, newHost, accessKey, secretKey, sessionToken string, ignoredHeaders, v4IgnoredHeaders map[string]bool) (*http.Request, error) {
 	req.Host = newHost
 	req.URL.Host = newHost
+	if authHeader.Presigned {
+		return presign(req, authHeader, accessKey, secretKey, sessionToken)
+	}
 	switch authHeader.Version {
 	case utils.SignV2Algorithm:
+		if sessionToken != "" {
+			req.Header.Set(securityTokenHeader, sessionToken)
+		}
 		return s3signer.SignV2(req, accessKey, secretKey, noHeadersIgnored), nil
 	case utils.SignV4Algorithm:
 		isStreamingRequest, dataLen, err := isStreamingRequest(req)
@@ -229,9 +322,41 @@ func sign(req *http.Request, authHeader utils.ParsedAuthorizationHeader, newHost
 			if err != nil {
 				return nil, err
 			}
-			return s3signer.StreamingSignV4WithIgnoredHeaders(req, accessKey, secretKey, "", authHeader.Region, authHeader.Service, dataLen, time.Now().UTC(), v4IgnoredHeaders, true), nil
+			return s3signer.StreamingSignV4WithIgnoredHeaders(req, accessKey, secretKey, sessionToken, authHeader.Region, authHeader.Service, dataLen, time.Now().UTC(), v4IgnoredHeaders, true), nil
 		}
-		return s3signer.SignV4WithIgnoredHeaders(req, accessKey, secretKey, "", authHeader.Region, authHeader.Service, v4IgnoredHeaders), nil
+		return s3signer.SignV4WithIgnoredHeaders(req, accessKey, secretKey, sessionToken, authHeader.Region, authHeader.Service, v4IgnoredHeaders), nil
+	}
+	return req, nil
+}
+
+// presign replaces the query string authorization of the client with the backend's keys,
+// the backend's request expires with the client's one
+func presign(req *http.Request, authHeader utils.ParsedAuthorizationHeader, accessKey, secretKey, sessionToken string) (*http.Request, error) {
+	expires := int64(time.Until(authHeader.Expires).Seconds())
+	if expires < 1 {
+		return req, errPresignedRequestExpired
+	}
+	query := req.URL.Query()
+	for _, param := range utils.PresignQueryParams {
+		query.Del(param)
+	}
+	req.URL.RawQuery = query.Encode()
+	switch authHeader.Version {
+	case utils.SignV2Algorithm:
+		// PreSignV2 signs the Expires header, which is object's metadata if sent by the client
+		clientExpires, hasClientExpires := req.Header["Expires"]
+		req.Header.Del("Expires")
+		if sessionToken != "" {
+			req.Header.Set(securityTokenHeader, sessionToken)
+		}
+		req = s3signer.PreSignV2(req, accessKey, secretKey, expires, noHeadersIgnored)
+		req.Header.Del("Expires")
+		if hasClientExpires {
+			req.Header["Expires"] = clientExpires
+		}
+		return req, nil
+	case utils.SignV4Algorithm:
+		return s3signer.PreSignV4(req, accessKey, secretKey, sessionToken, authHeader.Region, authHeader.Service, expires), nil
 	}
 	return req, nil
 }
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/external/miniotweak/s3signer"
+	"github.com/allegro/akubra/internal/akubra/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldPresignV4RequestsWithTheBackendKeys(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost:8080/bucket/obj?partNumber=1&uploadId=2", nil)
+	req = s3signer.PreSignV4(req, "client", "client-secret", "", "us-east-1", "s3", 300)
+	authHeader, err := utils.ParseRequestAuthorization(req)
+	require.NoError(t, err)
+
+	req, err = sign(req, authHeader, "backend:9000", "backend", "backend-secret", "", nil, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, "backend:9000", req.Host)
+	ok, err := s3signer.VerifyPresignedV4(req, "backend-secret")
+	assert.True(t, ok, err)
+	query := req.URL.Query()
+	assert.True(t, strings.HasPrefix(query.Get("X-Amz-Credential"), "backend/"))
+	assert.Len(t, query["X-Amz-Signature"], 1)
+	assert.Equal(t, "2", query.Get("uploadId"))
+	assert.Empty(t, req.Header.Get("Authorization"))
+}
+
+func TestShouldPresignV2RequestsWithTheBackendKeysKeepingTheExpiresMetadata(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost:8080/bucket/obj", nil)
+	req = s3signer.PreSignV2(req, "client", "client-secret", 300, nil)
+	req.Header.Set("Expires", "Thu, 01 Dec 2050 16:00:00 GMT")
+	authHeader, err := utils.ParseRequestAuthorization(req)
+	require.NoError(t, err)
+	assert.Equal(t, ErrNone, doesPresignedSignMatch(req, authHeader, Keys{SecretAccessKey: "client-secret"}, nil),
+		"the Expires header isn't signed by presigned requests")
+
+	req, err = sign(req, authHeader, "backend:9000", "backend", "backend-secret", "", nil, nil)
+
+	require.NoError(t, err)
+	ok, err := s3signer.VerifyPresignedV2(req, "backend-secret", nil)
+	assert.True(t, ok, err)
+	assert.Equal(t, "backend", req.URL.Query().Get("AWSAccessKeyId"))
+	assert.Equal(t, "Thu, 01 Dec 2050 16:00:00 GMT", req.Header.Get("Expires"))
+}
+
+func TestShouldSignBackendRequestsWithTheSessionTokenOfTemporaryCredentials(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	req = s3signer.SignV4(req, "client", "client-secret", "", "us-east-1", "s3")
+	authHeader, err := utils.ParseRequestAuthorization(req)
+	require.NoError(t, err)
+
+	req, err = sign(req, authHeader, "backend:9000", "backend", "backend-secret", "backend-token", nil, makeV4IgnoredHeaders(nil))
+
+	require.NoError(t, err)
+	assert.Equal(t, "backend-token", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "x-amz-security-token")
+	ok, err := s3signer.VerifyV4(req, "backend-secret")
+	assert.True(t, ok, err)
+
+	presigned, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	presigned = s3signer.PreSignV4(presigned, "client", "client-secret", "", "us-east-1", "s3", 300)
+	authHeader, err = utils.ParseRequestAuthorization(presigned)
+	require.NoError(t, err)
+
+	presigned, err = sign(presigned, authHeader, "backend:9000", "backend", "backend-secret", "backend-token", nil, nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, "backend-token", presigned.URL.Query().Get("X-Amz-Security-Token"))
+}
+
+type recordingRoundTripper struct {
+	called bool
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.called = true
+	return &http.Response{StatusCode: http.StatusOK, Request: req}, nil
+}
+
+func TestShouldRejectForgedAndExpiredPresignedRequestsToFixedKeyBackends(t *testing.T) {
+	keys := Keys{AccessKeyID: "fixed", SecretAccessKey: "fixed-secret"}
+	valid, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	valid = s3signer.PreSignV4(valid, "fixed", "fixed-secret", "", "us-east-1", "s3", 300)
+	forged, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	forged = s3signer.PreSignV4(forged, "fixed", "guessed-secret", "", "us-east-1", "s3", 300)
+	expired, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	expired = s3signer.PreSignV2(expired, "fixed", "fixed-secret", -1, nil)
+
+	for name, scenario := range map[string]struct {
+		req            *http.Request
+		expectedStatus int
+	}{
+		"valid":   {req: valid, expectedStatus: http.StatusOK},
+		"forged":  {req: forged, expectedStatus: http.StatusForbidden},
+		"expired": {req: expired, expectedStatus: http.StatusForbidden},
+	} {
+		backend := &recordingRoundTripper{}
+		roundTripper := SignDecorator(keys, "us-east-1", "backend:9000", nil)(backend)
+
+		resp, err := roundTripper.RoundTrip(scenario.req)
+
+		require.NoError(t, err, name)
+		assert.Equal(t, scenario.expectedStatus, resp.StatusCode, name)
+		assert.Equal(t, scenario.expectedStatus == http.StatusOK, backend.called, name)
+	}
+}
+
+func TestShouldRejectPresignedRequestsOutsideTheirValidityPeriod(t *testing.T) {
+	keys := Keys{AccessKeyID: "client", SecretAccessKey: "client-secret"}
+	tooLong, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	tooLong = s3signer.PreSignV4(tooLong, "client", "client-secret", "", "us-east-1", "s3", int64(8*24*time.Hour/time.Second))
+	authHeader, err := utils.ParseRequestAuthorization(tooLong)
+	require.NoError(t, err)
+	assert.Equal(t, ErrMaximumExpires, doesPresignedSignMatch(tooLong, authHeader, keys, nil))
+
+	future, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	future = s3signer.PreSignV4(future, "client", "client-secret", "", "us-east-1", "s3", 300)
+	query := future.URL.Query()
+	query.Set("X-Amz-Date", time.Now().UTC().Add(time.Hour).Format("20060102T150405Z"))
+	future.URL.RawQuery = query.Encode()
+	authHeader, err = utils.ParseRequestAuthorization(future)
+	require.NoError(t, err)
+	assert.Equal(t, ErrRequestNotReadyYet, doesPresignedSignMatch(future, authHeader, keys, nil))
+
+	expiring, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	expiring = s3signer.PreSignV4(expiring, "client", "client-secret", "", "us-east-1", "s3", 300)
+	authHeader, err = utils.ParseRequestAuthorization(expiring)
+	require.NoError(t, err)
+	authHeader.Expires = time.Now()
+	_, err = sign(expiring, authHeader, "backend:9000", "backend", "backend-secret", "", nil, nil)
+	assert.Equal(t, errPresignedRequestExpired, err, "expired requests shouldn't be presigned for the backend")
+}
+
+func TestShouldRejectMalformedPresignedRequestsInsteadOfPassingThemUnsigned(t *testing.T) {
+	keys := Keys{AccessKeyID: "fixed", SecretAccessKey: "fixed-secret"}
+	truncated, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	truncated = s3signer.PreSignV4(truncated, "fixed", "fixed-secret", "", "us-east-1", "s3", 300)
+	truncated.URL.RawQuery = truncated.URL.RawQuery[:strings.Index(truncated.URL.RawQuery, "X-Amz-Signature")]
+	unknownAlgorithm, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj?X-Amz-Algorithm=AWS4-HMAC-SHA1", nil)
+	noExpiry, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj?AWSAccessKeyId=fixed&Signature=abc", nil)
+
+	for name, req := range map[string]*http.Request{"truncated": truncated, "unknown algorithm": unknownAlgorithm,
+		"no expiry": noExpiry} {
+		_, err := utils.ParseRequestAuthorization(req)
+		assert.Equal(t, utils.ErrMalformedPresignedQuery, err, name)
+		backend := &recordingRoundTripper{}
+
+		resp, err := SignDecorator(keys, "us-east-1", "backend:9000", nil)(backend).RoundTrip(req)
+
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+		assert.False(t, backend.called, name)
+	}
+}
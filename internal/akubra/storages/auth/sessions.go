@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/allegro/akubra/internal/akubra/crdstore"
+	"github.com/allegro/akubra/internal/akubra/httphandler"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/utils"
+)
+
+type credentialsLookup func(accessKey string) (*crdstore.CredentialsStoreData, error)
+
+type sessionRoundTripper struct {
+	rt                          http.RoundTripper
+	sessions                    *crdstore.SessionStore
+	akubraCredentialsOf         credentialsLookup
+	ignoredCanonicalizedHeaders map[string]bool
+	v4IgnoredHeaders            map[string]bool
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (srt sessionRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	sessionToken := securityToken(req)
+	if sessionToken == "" {
+		return srt.rt.RoundTrip(req)
+	}
+	reqID := utils.RequestID(req)
+	authHeader, err := utils.ParseRequestAuthorization(req)
+	if err != nil {
+		log.Printf("Request %s with a session token isn't signed: %s", reqID, err)
+		return utils.ResponseForbidden(req), nil
+	}
+	session, secretKey, err := srt.sessions.Validate(sessionToken)
+	if err != nil {
+		log.Printf("Session token of request %s rejected: %s", reqID, err)
+		return utils.ResponseForbidden(req), nil
+	}
+	if session.AccessKey != authHeader.AccessKey || !session.AllowsBucket(utils.ExtractBucketFromRequest(req)) {
+		log.Printf("Request %s is out of the scope of the session of %s", reqID, session.AccessKey)
+		return utils.ResponseForbidden(req), nil
+	}
+	keys := Keys{AccessKeyID: session.AccessKey, SecretAccessKey: secretKey}
+	if doesRequestSignMatch(req, authHeader, keys, srt.ignoredCanonicalizedHeaders) != ErrNone {
+		return utils.ResponseForbidden(req), nil
+	}
+	parent, err := srt.akubraCredentialsOf(session.ParentAccessKey)
+	if err == crdstore.ErrCredentialsNotFound {
+		return utils.ResponseForbidden(req), nil
+	}
+	if err != nil {
+		return &http.Response{StatusCode: http.StatusInternalServerError, Request: req}, err
+	}
+	req.Header.Del(securityTokenHeader)
+	req, err = sign(req, authHeader, req.Host, parent.AccessKey, parent.SecretKey, "", srt.ignoredCanonicalizedHeaders, srt.v4IgnoredHeaders)
+	if err != nil {
+		return signingFailure(req, err)
+	}
+	return srt.rt.RoundTrip(req)
+}
+
+// SessionDecorator accepts requests signed with temporary credentials, validated with the session store. They are signed
+// again with the akubra keys the credentials were issued for, so the rest of the chain treats them as any other request
+func SessionDecorator(credentialsStoreName string, sessions *crdstore.SessionStore, ignoredCanonicalizedHeaders map[string]bool) httphandler.Decorator {
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return sessionRoundTripper{
+			rt: rt, sessions: sessions, akubraCredentialsOf: akubraCredentialsOf(credentialsStoreName),
+			ignoredCanonicalizedHeaders: ignoredCanonicalizedHeaders,
+			v4IgnoredHeaders:            makeV4IgnoredHeaders(ignoredCanonicalizedHeaders)}
+	}
+}
+
+func akubraCredentialsOf(credentialsStoreName string) credentialsLookup {
+	credentialsStore, err := crdstore.GetInstance(credentialsStoreName)
+	if err != nil {
+		log.Fatalf("CredentialsStore `%s` is not defined", credentialsStoreName)
+	}
+	return func(accessKey string) (*crdstore.CredentialsStoreData, error) {
+		return credentialsStore.Get(accessKey, "akubra")
+	}
+}
+
+func securityToken(req *http.Request) string {
+	if sessionToken := req.Header.Get(securityTokenHeader); sessionToken != "" {
+		return sessionToken
+	}
+	if req.URL == nil {
+		return ""
+	}
+	return req.URL.Query().Get(securityTokenHeader)
+}
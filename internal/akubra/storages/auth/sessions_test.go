@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/external/miniotweak/s3signer"
+	"github.com/allegro/akubra/internal/akubra/crdstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func akubraCredentialsForTest(accessKey string) (*crdstore.CredentialsStoreData, error) {
+	if accessKey != "access" {
+		return nil, crdstore.ErrCredentialsNotFound
+	}
+	return &crdstore.CredentialsStoreData{AccessKey: "access", SecretKey: "secret"}, nil
+}
+
+func newSessionRoundTripper(rt http.RoundTripper, sessions *crdstore.SessionStore) sessionRoundTripper {
+	return sessionRoundTripper{rt: rt, sessions: sessions, akubraCredentialsOf: akubraCredentialsForTest,
+		v4IgnoredHeaders: makeV4IgnoredHeaders(nil)}
+}
+
+func issueForTest(t *testing.T, sessions *crdstore.SessionStore, buckets ...string) *crdstore.CredentialsStoreData {
+	credentials, err := sessions.Issue("access", buckets, time.Hour)
+	require.NoError(t, err)
+	return credentials
+}
+
+func TestShouldSignRequestsOfTemporaryCredentialsAgainWithTheParentKeys(t *testing.T) {
+	sessions := crdstore.NewSessionStore("signing-key", 0)
+	credentials := issueForTest(t, sessions, "bucket")
+	backend := &putCapturingRoundTripper{}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/object", nil)
+	req = s3signer.SignV4(req, credentials.AccessKey, credentials.SecretKey, credentials.SessionToken, "us-east-1", "s3")
+
+	resp, err := newSessionRoundTripper(backend, sessions).RoundTrip(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, backend.requests, 1)
+	signed := backend.requests[0]
+	assert.Empty(t, signed.Header.Get(securityTokenHeader))
+	verified, err := s3signer.VerifyV4(signed, "secret")
+	assert.True(t, verified, err)
+}
+
+func TestShouldPresignRequestsOfTemporaryCredentialsAgainWithTheParentKeys(t *testing.T) {
+	sessions := crdstore.NewSessionStore("signing-key", 0)
+	credentials := issueForTest(t, sessions)
+	backend := &putCapturingRoundTripper{}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/object", nil)
+	req = s3signer.PreSignV4(req, credentials.AccessKey, credentials.SecretKey, credentials.SessionToken, "us-east-1", "s3", 300)
+
+	_, err := newSessionRoundTripper(backend, sessions).RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Len(t, backend.requests, 1)
+	presigned := backend.requests[0]
+	assert.Empty(t, presigned.URL.Query().Get(securityTokenHeader))
+	verified, err := s3signer.VerifyPresignedV4(presigned, "secret")
+	assert.True(t, verified, err)
+}
+
+func TestShouldRejectRequestsOutOfTheSession(t *testing.T) {
+	sessions := crdstore.NewSessionStore("signing-key", 0)
+	credentials := issueForTest(t, sessions, "bucket")
+	otherCredentials := issueForTest(t, sessions, "bucket")
+	testCases := map[string]func() *http.Request{
+		"bucket out of scope": func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/other/object", nil)
+			return s3signer.SignV4(req, credentials.AccessKey, credentials.SecretKey, credentials.SessionToken, "us-east-1", "s3")
+		},
+		"token of another session": func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/object", nil)
+			return s3signer.SignV4(req, credentials.AccessKey, credentials.SecretKey, otherCredentials.SessionToken, "us-east-1", "s3")
+		},
+		"virtual host bucket out of scope": func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, "http://other.s3.localhost:8080/bucket/object", nil)
+			return s3signer.SignV4(req, credentials.AccessKey, credentials.SecretKey, credentials.SessionToken, "us-east-1", "s3")
+		},
+		"wrong secret": func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/object", nil)
+			return s3signer.SignV4(req, credentials.AccessKey, otherCredentials.SecretKey, credentials.SessionToken, "us-east-1", "s3")
+		},
+		"forged token": func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/object", nil)
+			return s3signer.SignV4(req, credentials.AccessKey, credentials.SecretKey, "forged.token", "us-east-1", "s3")
+		},
+		"unsigned request": func() *http.Request {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/object", nil)
+			req.Header.Set(securityTokenHeader, credentials.SessionToken)
+			return req
+		},
+	}
+	for name, request := range testCases {
+		backend := &putCapturingRoundTripper{}
+
+		resp, err := newSessionRoundTripper(backend, sessions).RoundTrip(request())
+
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, name)
+		assert.Empty(t, backend.requests, name)
+	}
+}
+
+func TestShouldScopeVirtualHostRequestsOfTemporaryCredentialsByTheHostBucket(t *testing.T) {
+	sessions := crdstore.NewSessionStore("signing-key", 0)
+	credentials := issueForTest(t, sessions, "bucket")
+	backend := &putCapturingRoundTripper{}
+	req, _ := http.NewRequest(http.MethodGet, "http://bucket.s3.localhost:8080/object", nil)
+	req = s3signer.SignV4(req, credentials.AccessKey, credentials.SecretKey, credentials.SessionToken, "us-east-1", "s3")
+
+	resp, err := newSessionRoundTripper(backend, sessions).RoundTrip(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, backend.requests, 1)
+}
+
+func TestShouldPassThroughRequestsWithoutSessionToken(t *testing.T) {
+	backend := &putCapturingRoundTripper{}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/object", nil)
+	req = s3signer.SignV4(req, "access", "secret", "", "us-east-1", "s3")
+
+	_, err := newSessionRoundTripper(backend, crdstore.NewSessionStore("signing-key", 0)).RoundTrip(req)
+
+	require.NoError(t, err)
+	require.Len(t, backend.requests, 1)
+	assert.Equal(t, req, backend.requests[0])
+}
@@ -14,6 +14,25 @@ const (
 	Passthrough = "passthrough"
 )
 
+const (
+	// ResponseTimeBalancing elects storage with the lowest time spent in last meter period
+	ResponseTimeBalancing = "ResponseTime"
+	// LeastOutstandingBalancing elects storage with the lowest number of in-flight requests
+	LeastOutstandingBalancing = "LeastOutstanding"
+	// PowerOfTwoChoicesBalancing elects faster storage of two random picks
+	PowerOfTwoChoicesBalancing = "PowerOfTwoChoices"
+	// WeightedRandomBalancing elects random storage with probability derived from priority
+	WeightedRandomBalancing = "WeightedRandom"
+)
+
+// BalancingStrategies lists supported read balancing strategies
+var BalancingStrategies = []string{
+	ResponseTimeBalancing,
+	LeastOutstandingBalancing,
+	PowerOfTwoChoicesBalancing,
+	WeightedRandomBalancing,
+}
+
 // Storage defines backend
 type Storage struct {
 	Backend     types.YAMLUrl     `yaml:"Backend"`
@@ -28,6 +47,8 @@ type StoragesMap map[string]Storage
 // Shard defines shard storages configuration
 type Shard struct {
 	Storages Storages `yaml:"Storages"`
+	// Balancing is read balancing strategy, ResponseTime if empty
+	Balancing string `yaml:"Balancing"`
 }
 
 // ShardsMap is map of Cluster
@@ -52,6 +52,10 @@ func (shardAuth *ShardAuthenticator) RoundTrip(req *http.Request) (*http.Respons
 			backendsCredentials = append(backendsCredentials, extractKeysFrom(backends[idx].Properties))
 		case auth.S3AuthService:
 			keys, err := fetchKeysFor(authHeader.AccessKey, backends[idx])
+			if err == crdstore.ErrCredentialsNotFound {
+				log.Debugf("authorization check failed for req %s, unknown access '%s'", utils.RequestID(req), authHeader.AccessKey)
+				return utils.ResponseForbidden(req), nil
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -62,7 +66,7 @@ func (shardAuth *ShardAuthenticator) RoundTrip(req *http.Request) (*http.Respons
 	for idx := range backendsCredentials {
 		if auth.ErrNone != auth.DoesSignMatch(req, backendsCredentials[idx], shardAuth.ignoredCanonicalizedHeaders) {
 			log.Debugf("authorization check failed for req %s, signature mismatch on storage '%s' using access '%s'",
-				req.Context().Value(log.ContextreqIDKey).(string), backends[idx].Name, backendsCredentials[idx].AccessKeyID)
+				utils.RequestID(req), backends[idx].Name, backendsCredentials[idx].AccessKeyID)
 			return utils.ResponseForbidden(req), nil
 		}
 	}
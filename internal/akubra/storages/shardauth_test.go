@@ -3,6 +3,7 @@ package storages
 import (
 	"github.com/allegro/akubra/external/miniotweak/s3signer"
 	"github.com/allegro/akubra/internal/akubra/httphandler"
+	httpConfig "github.com/allegro/akubra/internal/akubra/httphandler/config"
 	"github.com/allegro/akubra/internal/akubra/log"
 	"github.com/allegro/akubra/internal/akubra/storages/auth"
 	"github.com/allegro/akubra/internal/akubra/storages/config"
@@ -92,6 +93,71 @@ func TestShouldValidateRequestCredentialsBasedOnBackendType(t *testing.T) {
 	assert.Equal(t, &expectedResp, resp)
 }
 
+func TestShouldValidatePresignedRequestsAndTheirExpiry(t *testing.T) {
+	access := "access"
+	secret := "secret"
+	fixedKeyBackend := StorageClient{Storage: config.Storage{
+		Type:       auth.S3FixedKey,
+		Properties: map[string]string{"AccessKey": access, "Secret": secret}}}
+
+	validReq, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	validReq = s3signer.PreSignV4(validReq, access, secret, "", "us-east-1", "s3", 60)
+	expiredReq, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	expiredReq = s3signer.PreSignV2(expiredReq, access, secret, -60, nil)
+	expiredReq.Header.Del("Expires")
+
+	for _, req := range []*http.Request{validReq, expiredReq} {
+		authHeader, err := utils.ParseRequestAuthorization(req)
+		assert.Nil(t, err)
+		assert.True(t, authHeader.Presigned)
+		*req = *req.WithContext(context.WithValue(context.Background(), httphandler.AuthHeader, &authHeader))
+		*req = *req.WithContext(context.WithValue(req.Context(), log.ContextreqIDKey, "123"))
+	}
+
+	expectedResp := http.Response{Request: validReq, StatusCode: http.StatusOK}
+	shardMock := shardClientMock{Mock: &mock.Mock{}}
+	shardMock.On("RoundTrip", validReq).Return(&expectedResp, nil)
+	shardMock.On("Backends").Return([]*StorageClient{&fixedKeyBackend})
+	shardAuthenticator := NewShardAuthenticator(&shardMock, nil)
+
+	resp, err := shardAuthenticator.RoundTrip(validReq)
+	assert.Nil(t, err)
+	assert.Equal(t, &expectedResp, resp)
+
+	resp, err = shardAuthenticator.RoundTrip(expiredReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestShouldAuthenticatePresignedRequestsPassedThroughTheHandlerChain(t *testing.T) {
+	access := "access"
+	secret := "secret"
+	fixedKeyBackend := StorageClient{Storage: config.Storage{
+		Type:       auth.S3FixedKey,
+		Properties: map[string]string{"AccessKey": access, "Secret": secret}}}
+	validReq, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	validReq = s3signer.PreSignV4(validReq, access, secret, "", "us-east-1", "s3", 60)
+	forgedReq, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/bucket/obj", nil)
+	forgedReq = s3signer.PreSignV4(forgedReq, access, "guessed", "", "us-east-1", "s3", 60)
+
+	shardMock := shardClientMock{Mock: &mock.Mock{}}
+	shardMock.On("RoundTrip", mock.Anything).Return(&http.Response{StatusCode: http.StatusOK}, nil)
+	shardMock.On("Backends").Return([]*StorageClient{&fixedKeyBackend})
+	chain := httphandler.DecorateRoundTripper(httpConfig.Client{},
+		httpConfig.Server{MaxConcurrentRequests: 10, BodyMaxSize: httpConfig.HumanSizeUnits{SizeInBytes: 1024}},
+		nil, "/status/ping", NewShardAuthenticator(&shardMock, nil))
+
+	resp, err := chain.RoundTrip(forgedReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	shardMock.AssertNotCalled(t, "RoundTrip", mock.Anything)
+
+	resp, err = chain.RoundTrip(validReq)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	shardMock.AssertNumberOfCalls(t, "RoundTrip", 1)
+}
+
 func (mock *shardClientMock) Name() string {
 	return mock.Called().String(0)
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/allegro/akubra/internal/akubra/balancing"
 	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/storages/backend"
 	"github.com/allegro/akubra/internal/akubra/utils"
 	"github.com/allegro/akubra/internal/akubra/watchdog"
 	set "github.com/deckarep/golang-set"
@@ -59,6 +60,11 @@ func (shardClient *ShardClient) balancerRoundTrip(req *http.Request) (resp *http
 		if err != nil {
 			return nil, err
 		}
+		// Response from previously asked node will not be used
+		previous := &backend.Response{Response: resp, Request: req}
+		if discardErr := previous.DiscardBody(); discardErr != nil {
+			log.Debugf("Could not discard body of response to request %s: %s", previous.ReqID(), discardErr)
+		}
 
 		resp, err = node.RoundTrip(nodeRequest)
 		if (resp == nil && err != balancing.ErrNoActiveNodes) || http.StatusNotFound == resp.StatusCode || http.StatusForbidden == resp.StatusCode {
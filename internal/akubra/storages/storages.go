@@ -110,7 +110,7 @@ func (factory *Factory) InitStorages(clustersConf config.ShardsMap, storagesMap
 
 	for name, clusterConf := range clustersConf {
 		cluster, err := factory.shardFactory.newShard(name, storageNames(clusterConf), storageClients)
-		cluster.balancer = balancing.NewBalancerPrioritySet(clusterConf.Storages, convertToRoundTrippersMap(storageClients))
+		cluster.balancer = balancing.NewBalancerPrioritySet(clusterConf, convertToRoundTrippersMap(storageClients))
 		if err != nil {
 			return nil, err
 		}
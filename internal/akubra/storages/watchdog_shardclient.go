@@ -100,6 +100,11 @@ func (consistencyShard *ConsistencyShardClient) shouldLogRequest(consistencyRequ
 	if consistencyRequest.consistencyLevel == config.None {
 		return false
 	}
+	isWrite := http.MethodPut == consistencyRequest.Request.Method || http.MethodDelete == consistencyRequest.Request.Method
+	if utils.IsBucketPath(consistencyRequest.URL.Path) {
+		_, isTrackedSubResource := watchdog.RequestSubResource(consistencyRequest.Request, watchdog.BucketSubResources)
+		return isWrite && isTrackedSubResource
+	}
 	isObjectPath := utils.IsObjectPath(consistencyRequest.URL.Path)
 	if http.MethodDelete == consistencyRequest.Request.Method && isObjectPath {
 		return true
@@ -123,9 +128,12 @@ func (consistencyShard *ConsistencyShardClient) logRequest(consistencyRequest *c
 		}
 		consistencyRequest.DeleteMarker = deleteMarker
 	}
-	consistencyRequest.
-		Header.
-		Add(consistencyShard.versionHeaderName, fmt.Sprintf("%d", consistencyRequest.ConsistencyRecord.ObjectVersion))
+	//only the object's content carries the version, buckets and sub-resources are compared by brim directly
+	if consistencyRequest.ConsistencyRecord.IsObjectContent() {
+		consistencyRequest.
+			Header.
+			Add(consistencyShard.versionHeaderName, fmt.Sprintf("%d", consistencyRequest.ConsistencyRecord.ObjectVersion))
+	}
 	return consistencyRequest, nil
 }
 
@@ -154,6 +162,7 @@ func (consistencyShard *ConsistencyShardClient) ensureConsistency(consistencyReq
 		}
 		return consistencyRequest, nil
 	}
+	consistencyRecord.ConsistencyLevel = consistencyRequest.consistencyLevel
 	consistencyRequest.ConsistencyRecord = consistencyRecord
 
 	loggedRequest, err := consistencyShard.logRequest(consistencyRequest)
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/allegro/akubra/internal/akubra/regions/config"
+	"github.com/allegro/akubra/internal/akubra/utils"
 	"github.com/allegro/akubra/internal/akubra/watchdog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -31,9 +32,14 @@ func TestInsertingRecordsBasedOnTheRequest(t *testing.T) {
 		shouldInsertRecord bool
 		isMultiPart        bool
 	}{
-		{method: http.MethodPut, url: "http://localhost/newBucket", consistencyLevel: config.Strong, shouldInsertRecord: false},
-		{method: http.MethodPut, url: "http://localhost/newBucket", consistencyLevel: config.Weak, shouldInsertRecord: false},
+		{method: http.MethodPut, url: "http://localhost/newBucket", consistencyLevel: config.Strong, shouldInsertRecord: true},
+		{method: http.MethodPut, url: "http://localhost/newBucket", consistencyLevel: config.Weak, shouldInsertRecord: true},
 		{method: http.MethodPut, url: "http://localhost/newBucket", consistencyLevel: config.None, shouldInsertRecord: false},
+		{method: http.MethodDelete, url: "http://localhost/newBucket", consistencyLevel: config.Strong, shouldInsertRecord: true},
+		{method: http.MethodGet, url: "http://localhost/newBucket", consistencyLevel: config.Strong, shouldInsertRecord: false},
+		{method: http.MethodPut, url: "http://localhost/newBucket?cors", consistencyLevel: config.Strong, shouldInsertRecord: true},
+		{method: http.MethodDelete, url: "http://localhost/newBucket?lifecycle", consistencyLevel: config.Weak, shouldInsertRecord: true},
+		{method: http.MethodPut, url: "http://localhost/newBucket?versioning", consistencyLevel: config.Strong, shouldInsertRecord: false},
 		{method: http.MethodPut, url: "http://localhost/newBucket/objectg", consistencyLevel: config.Strong, shouldInsertRecord: true},
 		{method: http.MethodPut, url: "http://localhost/newBucket/objectg", consistencyLevel: config.Weak, shouldInsertRecord: true},
 		{method: http.MethodPut, url: "http://localhost/newBucket/objectg", consistencyLevel: config.None, shouldInsertRecord: false},
@@ -64,6 +70,9 @@ func TestInsertingRecordsBasedOnTheRequest(t *testing.T) {
 		shardMock.On("RoundTrip", request).Return(response, nil)
 
 		consistencyRecord := &watchdog.ConsistencyRecord{}
+		if utils.IsBucketPath(request.URL.Path) {
+			consistencyRecord.Operation = watchdog.BucketOperation
+		}
 		factoryMock.On("CreateRecordFor", request).Return(consistencyRecord, nil)
 
 		watchdogMock.On("Insert", consistencyRecord).Return(nil, nil)
@@ -84,7 +93,7 @@ func TestInsertingRecordsBasedOnTheRequest(t *testing.T) {
 			}
 			factoryMock.AssertCalled(t, "CreateRecordFor", request)
 			watchdogMock.AssertCalled(t, "Insert", consistencyRecord)
-			assert.NotEmpty(t, request.Header.Get(versionHeaderName))
+			assert.Equal(t, consistencyRecord.IsObjectContent(), request.Header.Get(versionHeaderName) != "")
 		} else {
 			factoryMock.AssertNotCalled(t, "CreateRecordFor", request)
 			watchdogMock.AssertNotCalled(t, "Insert", consistencyRecord)
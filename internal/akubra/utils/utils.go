@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/allegro/akubra/internal/akubra/log"
 	"github.com/allegro/akubra/internal/akubra/types"
@@ -31,6 +33,9 @@ const (
 //ErrNoAuthHeader indicates that no authorization header was found in the request
 var ErrNoAuthHeader = fmt.Errorf("cannot find correct authorization header")
 
+//ErrMalformedPresignedQuery indicates that the request has presigned query parameters which can't be parsed
+var ErrMalformedPresignedQuery = fmt.Errorf("malformed presigned query")
+
 var reV2 = regexp.MustCompile(RegexV2Algorithm)
 var reV4 = regexp.MustCompile(RegexV4Algorithm)
 
@@ -42,6 +47,12 @@ type ParsedAuthorizationHeader struct {
 	SignedHeaders string
 	Region        string
 	Service       string
+	// Presigned tells that the request was authorized in the query string
+	Presigned bool
+	// Expires is the time a presigned request is valid until
+	Expires time.Time
+	// SignedAt is the X-Amz-Date of a V4 presigned request
+	SignedAt time.Time
 }
 
 // BackendError interface helps logging inconsistencies
@@ -77,20 +88,59 @@ func ParseAuthorizationHeader(authorizationHeader string) (authHeader ParsedAuth
 	return ParsedAuthorizationHeader{}, ErrNoAuthHeader
 }
 
-// ExtractAccessKey extracts s3 auth key from header
+// PresignQueryParams are the query string authorization params of V2 and V4 presigned requests
+var PresignQueryParams = []string{"AWSAccessKeyId", "Signature", "Expires", "X-Amz-Algorithm", "X-Amz-Credential",
+	"X-Amz-Date", "X-Amz-Expires", "X-Amz-SignedHeaders", "X-Amz-Signature", "X-Amz-Security-Token"}
+
+// ParsePresignedQuery - extract S3 query string authorization details of V2 (AWSAccessKeyId, Signature and Expires)
+// or V4 (X-Amz-Algorithm, X-Amz-Credential, X-Amz-Signature...) presigned requests. ErrNoAuthHeader is returned
+// if the query isn't presigned, ErrMalformedPresignedQuery if it is but can't be parsed
+func ParsePresignedQuery(query url.Values) (ParsedAuthorizationHeader, error) {
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != SignV4Algorithm {
+			return ParsedAuthorizationHeader{}, ErrMalformedPresignedQuery
+		}
+		credential := strings.Split(query.Get("X-Amz-Credential"), "/")
+		signedAt, dateErr := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+		expires, expiresErr := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if len(credential) != 5 || dateErr != nil || expiresErr != nil || query.Get("X-Amz-Signature") == "" {
+			return ParsedAuthorizationHeader{}, ErrMalformedPresignedQuery
+		}
+		return ParsedAuthorizationHeader{AccessKey: credential[0], Signature: query.Get("X-Amz-Signature"),
+			Region: credential[2], Service: credential[3], SignedHeaders: query.Get("X-Amz-SignedHeaders"),
+			Version: SignV4Algorithm, Presigned: true, Expires: signedAt.Add(time.Duration(expires) * time.Second), SignedAt: signedAt}, nil
+	}
+	if query.Get("AWSAccessKeyId") != "" || query.Get("Signature") != "" {
+		expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64)
+		if err != nil || query.Get("AWSAccessKeyId") == "" || query.Get("Signature") == "" {
+			return ParsedAuthorizationHeader{}, ErrMalformedPresignedQuery
+		}
+		return ParsedAuthorizationHeader{AccessKey: query.Get("AWSAccessKeyId"), Signature: query.Get("Signature"),
+			Version: SignV2Algorithm, Presigned: true, Expires: time.Unix(expires, 0)}, nil
+	}
+	return ParsedAuthorizationHeader{}, ErrNoAuthHeader
+}
+
+// ParseRequestAuthorization - extract S3 authorization details from the "Authorization" header or the query string
+func ParseRequestAuthorization(req *http.Request) (ParsedAuthorizationHeader, error) {
+	if authorizationHeader := req.Header.Get("Authorization"); authorizationHeader != "" {
+		return ParseAuthorizationHeader(authorizationHeader)
+	}
+	if req.URL == nil {
+		return ParsedAuthorizationHeader{}, ErrNoAuthHeader
+	}
+	return ParsePresignedQuery(req.URL.Query())
+}
+
+// ExtractAccessKey extracts s3 auth key from header or the query string of presigned requests
 func ExtractAccessKey(req *http.Request) string {
 	if req.Header == nil {
 		log.Debugf("failed to extract access key from req %s - no headers present", req.Context().Value(log.ContextreqIDKey))
 		return ""
 	}
-	authHeader := req.Header.Get("Authorization")
-	if authHeader == "" {
-		log.Debugf("failed to extract access key from req %s - authorization headers is missing", req.Context().Value(log.ContextreqIDKey))
-		return ""
-	}
-	parsedAuthHeader, parsingErr := ParseAuthorizationHeader(authHeader)
+	parsedAuthHeader, parsingErr := ParseRequestAuthorization(req)
 	if parsingErr != nil {
-		log.Debugf("failed to extract access key from req %s - %s, auth header = %s", req.Context().Value(log.ContextreqIDKey), parsingErr, authHeader)
+		log.Debugf("failed to extract access key from req %s - %s", req.Context().Value(log.ContextreqIDKey), parsingErr)
 		return ""
 	}
 	return parsedAuthHeader.AccessKey
@@ -123,6 +173,26 @@ func ExtractBucketFrom(requestPath string) string {
 	return pathParts[0]
 }
 
+// virtualHostSeparator separates the bucket from the domain in virtual host style requests
+const virtualHostSeparator = ".s3."
+
+// VirtualHostBucket returns the bucket of virtual host style request host (bucket.s3.domain)
+func VirtualHostBucket(host string) (string, bool) {
+	if !strings.Contains(host, virtualHostSeparator) {
+		return "", false
+	}
+	return strings.Split(host, virtualHostSeparator)[0], true
+}
+
+// ExtractBucketFromRequest extracts bucket's name from request's host if it's a virtual host style
+// request, or from request's path otherwise
+func ExtractBucketFromRequest(req *http.Request) string {
+	if bucket, isVirtualHost := VirtualHostBucket(req.Host); isVirtualHost {
+		return bucket
+	}
+	return ExtractBucketFrom(req.URL.Path)
+}
+
 // IsBucketPath check if a given path is a bucket path
 func IsBucketPath(path string) bool {
 	trimmedPath := strings.Trim(path, "/")
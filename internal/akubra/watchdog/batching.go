@@ -0,0 +1,412 @@
+package watchdog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	regionsconfig "github.com/allegro/akubra/internal/akubra/regions/config"
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+)
+
+const (
+	defaultMaxBatchSize      = 500
+	defaultFlushInterval     = 100 * time.Millisecond
+	defaultMaxPendingRecords = 10000
+	defaultGroupCommitWindow = 2 * time.Millisecond
+	clockSyncInterval        = 30 * time.Second
+
+	insertValuesPlaceholder = "(?, ?, ?, ?, ?, ?, ?, ?, ?)"
+)
+
+// ErrWatchdogClosed is returned by BatchingWatchdog after Close
+var ErrWatchdogClosed = errors.New("watchdog closed")
+
+type objectKey struct {
+	domain      string
+	objectID    string
+	operation   Operation
+	subResource SubResource
+}
+
+func (key objectKey) marker(version int) *DeleteMarker {
+	return &DeleteMarker{domain: key.domain, objectID: key.objectID, operation: key.operation, subResource: key.subResource, objectVersion: version}
+}
+
+// pendingInsert is a record waiting for a flush, done is set when the caller
+// waits for the commit
+type pendingInsert struct {
+	record ConsistencyRecord
+	done   chan error
+}
+
+// supersededBy tells if the pending record is superseded by the marker, see SupersededRecords
+func (pending *pendingInsert) supersededBy(marker *DeleteMarker) bool {
+	record := pending.record
+	return record.Domain == marker.domain && record.ObjectID == marker.objectID && record.OperationOrDefault() == marker.operation &&
+		(marker.subResource == "" || record.SubResource == marker.subResource) && record.ObjectVersion <= marker.objectVersion
+}
+
+// BatchingWatchdog is a ConsistencyWatchdog that writes records with multi-row
+// statements. Inserts of Weak requests and deletes are written behind, Strong
+// inserts wait for the commit but share it with other pending writes. An insert
+// which is deleted before being flushed is never written, the delete is still
+// written to remove the versions flushed earlier.
+type BatchingWatchdog struct {
+	watchdog *SQLWatchdog
+	config   config.BatchingConfig
+
+	mx               sync.Mutex
+	inserts          []*pendingInsert
+	pendingByRequest map[string]*pendingInsert
+	deletes          map[objectKey]int
+	closed           bool
+
+	// flushMx is held while a batch is written
+	flushMx     sync.Mutex
+	flushNow    chan struct{}
+	groupCommit chan struct{}
+	stop        chan struct{}
+	stopped     chan struct{}
+
+	clockOffset     int64
+	clockSyncedAt   time.Time
+	microsecondsNow func() int64
+}
+
+// NewBatchingWatchdog wraps the watchdog with write-behind batching
+func NewBatchingWatchdog(watchdog ConsistencyWatchdog, batchingConfig config.BatchingConfig) (*BatchingWatchdog, error) {
+	sqlWatchdog, ok := watchdog.(*SQLWatchdog)
+	if !ok {
+		return nil, fmt.Errorf("batching is supported only by SQL watchdogs, got %T", watchdog)
+	}
+	batchingWatchdog := &BatchingWatchdog{
+		watchdog:         sqlWatchdog,
+		config:           withBatchingDefaults(batchingConfig),
+		pendingByRequest: make(map[string]*pendingInsert),
+		deletes:          make(map[objectKey]int),
+		flushNow:         make(chan struct{}, 1),
+		groupCommit:      make(chan struct{}, 1),
+		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+		microsecondsNow: func() int64 {
+			return time.Now().UnixNano() / int64(time.Microsecond)
+		},
+	}
+	batchingWatchdog.syncClock()
+	go batchingWatchdog.flushLoop()
+	log.Printf("BatchingWatchdog setup successful, max batch size %d, flush interval %s, max pending records %d",
+		batchingWatchdog.config.MaxBatchSize, batchingWatchdog.config.FlushInterval, batchingWatchdog.config.MaxPendingRecords)
+	return batchingWatchdog, nil
+}
+
+func withBatchingDefaults(batchingConfig config.BatchingConfig) config.BatchingConfig {
+	if batchingConfig.MaxBatchSize <= 0 {
+		batchingConfig.MaxBatchSize = defaultMaxBatchSize
+	}
+	if batchingConfig.FlushInterval <= 0 {
+		batchingConfig.FlushInterval = defaultFlushInterval
+	}
+	if batchingConfig.MaxPendingRecords <= 0 {
+		batchingConfig.MaxPendingRecords = defaultMaxPendingRecords
+	}
+	if batchingConfig.GroupCommitWindow <= 0 {
+		batchingConfig.GroupCommitWindow = defaultGroupCommitWindow
+	}
+	return batchingConfig
+}
+
+// Insert queues the record, Strong requests and requests exceeding the
+// pending records limit wait for the commit
+func (watchdog *BatchingWatchdog) Insert(record *ConsistencyRecord) (*DeleteMarker, error) {
+	if record.ObjectVersion <= 0 {
+		if err := watchdog.SupplyRecordWithVersion(record); err != nil {
+			return nil, err
+		}
+	}
+	pending := &pendingInsert{record: *record}
+
+	watchdog.mx.Lock()
+	if watchdog.closed {
+		watchdog.mx.Unlock()
+		return nil, ErrWatchdogClosed
+	}
+	if record.ConsistencyLevel == regionsconfig.Strong {
+		pending.done = make(chan error, 1)
+	} else if watchdog.pendingCount() >= watchdog.config.MaxPendingRecords {
+		metrics.Mark("watchdog.batch.backpressure")
+		pending.done = make(chan error, 1)
+	}
+	watchdog.inserts = append(watchdog.inserts, pending)
+	watchdog.pendingByRequest[record.RequestID] = pending
+	pendingCount := watchdog.pendingCount()
+	watchdog.mx.Unlock()
+
+	if pendingCount >= watchdog.config.MaxBatchSize {
+		signal(watchdog.flushNow)
+	}
+	if pending.done == nil {
+		log.Debugf("[watchdog] INSERT QUEUED reqID %s, objID %s, domain %s, version %d", record.RequestID, record.ObjectID, record.Domain, record.ObjectVersion)
+		return DeleteMarkerFor(record), nil
+	}
+
+	signal(watchdog.groupCommit)
+	if err := <-pending.done; err != nil {
+		log.Debugf("[watchdog] INSERT FAIL reqID %s, objID %s, domain %s: %s", record.RequestID, record.ObjectID, record.Domain, err)
+		return nil, ErrDataBase
+	}
+	return DeleteMarkerFor(record), nil
+}
+
+// Delete cancels pending inserts of the object older than marker and queues
+// the delete of the versions already written
+func (watchdog *BatchingWatchdog) Delete(marker *DeleteMarker) error {
+	key := objectKey{domain: marker.domain, objectID: marker.objectID, operation: marker.operation, subResource: marker.subResource}
+
+	watchdog.mx.Lock()
+	if watchdog.closed {
+		watchdog.mx.Unlock()
+		return ErrWatchdogClosed
+	}
+	cancelled := 0
+	remaining := watchdog.inserts[:0]
+	for _, pending := range watchdog.inserts {
+		if pending.done == nil && pending.supersededBy(marker) {
+			delete(watchdog.pendingByRequest, pending.record.RequestID)
+			metrics.Mark("watchdog.batch.cancelled")
+			cancelled++
+			continue
+		}
+		remaining = append(remaining, pending)
+	}
+	for idx := len(remaining); idx < len(watchdog.inserts); idx++ {
+		watchdog.inserts[idx] = nil
+	}
+	watchdog.inserts = remaining
+	if watchdog.deletes[key] < marker.objectVersion {
+		watchdog.deletes[key] = marker.objectVersion
+	}
+	pendingCount := watchdog.pendingCount()
+	watchdog.mx.Unlock()
+
+	if cancelled > 0 {
+		log.Debugf("[watchdog] DELETE CANCELLED %d pending inserts of objID %s, version <= %d", cancelled, marker.objectID, marker.objectVersion)
+	}
+	if pendingCount >= watchdog.config.MaxBatchSize {
+		signal(watchdog.flushNow)
+	}
+	return nil
+}
+
+// UpdateExecutionDelay updates the pending record or the one already written
+func (watchdog *BatchingWatchdog) UpdateExecutionDelay(delta *ExecutionDelay) error {
+	watchdog.flushMx.Lock()
+	defer watchdog.flushMx.Unlock()
+
+	watchdog.mx.Lock()
+	if pending, ok := watchdog.pendingByRequest[delta.RequestID]; ok {
+		pending.record.ExecutionDelay = delta.Delay
+		watchdog.mx.Unlock()
+		return nil
+	}
+	watchdog.mx.Unlock()
+	return watchdog.watchdog.UpdateExecutionDelay(delta)
+}
+
+// SupplyRecordWithVersion sets the version from the local clock, which is
+// periodically synchronized with the database one
+func (watchdog *BatchingWatchdog) SupplyRecordWithVersion(record *ConsistencyRecord) error {
+	watchdog.mx.Lock()
+	now := watchdog.microsecondsNow() + watchdog.clockOffset
+	watchdog.mx.Unlock()
+	record.ObjectVersion = watchdog.watchdog.versions.next(int(now))
+	return nil
+}
+
+// GetVersionHeaderName returns the name of the HTTP header that should hold to object's verison
+func (watchdog *BatchingWatchdog) GetVersionHeaderName() string {
+	return watchdog.watchdog.GetVersionHeaderName()
+}
+
+// Close flushes pending records and stops batching
+func (watchdog *BatchingWatchdog) Close() error {
+	watchdog.mx.Lock()
+	if watchdog.closed {
+		watchdog.mx.Unlock()
+		return nil
+	}
+	watchdog.closed = true
+	watchdog.mx.Unlock()
+	close(watchdog.stop)
+	<-watchdog.stopped
+	return nil
+}
+
+func (watchdog *BatchingWatchdog) pendingCount() int {
+	return len(watchdog.inserts) + len(watchdog.deletes)
+}
+
+func (watchdog *BatchingWatchdog) flushLoop() {
+	defer close(watchdog.stopped)
+	ticker := time.NewTicker(watchdog.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watchdog.stop:
+			watchdog.flush()
+			return
+		case <-watchdog.groupCommit:
+			time.Sleep(watchdog.config.GroupCommitWindow)
+		case <-watchdog.flushNow:
+		case <-ticker.C:
+		}
+		watchdog.flush()
+		if time.Since(watchdog.clockSyncedAt) > clockSyncInterval {
+			watchdog.syncClock()
+		}
+	}
+}
+
+// flush writes all pending records in a single transaction
+func (watchdog *BatchingWatchdog) flush() {
+	watchdog.flushMx.Lock()
+	defer watchdog.flushMx.Unlock()
+
+	watchdog.mx.Lock()
+	inserts, deletes := watchdog.inserts, watchdog.deletes
+	watchdog.inserts = nil
+	watchdog.deletes = make(map[objectKey]int)
+	watchdog.pendingByRequest = make(map[string]*pendingInsert)
+	watchdog.mx.Unlock()
+
+	if len(inserts) == 0 && len(deletes) == 0 {
+		metrics.UpdateGauge("watchdog.batch.pending", 0)
+		return
+	}
+
+	flushStartTime := time.Now()
+	err := watchdog.write(inserts, deletes)
+	if err == nil {
+		metrics.UpdateSince("watchdog.batch.flush.ok", flushStartTime)
+		metrics.UpdateGauge("watchdog.batch.inserts", int64(len(inserts)))
+		metrics.UpdateGauge("watchdog.batch.deletes", int64(len(deletes)))
+		for _, pending := range inserts {
+			if pending.done != nil {
+				pending.done <- nil
+			}
+		}
+		metrics.UpdateGauge("watchdog.batch.pending", 0)
+		return
+	}
+
+	metrics.UpdateSince("watchdog.batch.flush.err", flushStartTime)
+	log.Printf("[watchdog] BATCH FLUSH FAIL of %d inserts and %d deletes, writing them one by one: %s", len(inserts), len(deletes), err)
+	watchdog.writeOneByOne(inserts, deletes)
+}
+
+func (watchdog *BatchingWatchdog) write(inserts []*pendingInsert, deletes map[objectKey]int) error {
+	tx := watchdog.watchdog.dbConn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for start := 0; start < len(inserts); start += watchdog.config.MaxBatchSize {
+		end := start + watchdog.config.MaxBatchSize
+		if end > len(inserts) {
+			end = len(inserts)
+		}
+		query, args := watchdog.multiRowInsert(inserts[start:end])
+		if err := tx.Exec(query, args...).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	keys := make([]objectKey, 0, len(deletes))
+	for key := range deletes {
+		keys = append(keys, key)
+	}
+	for start := 0; start < len(keys); start += watchdog.config.MaxBatchSize {
+		end := start + watchdog.config.MaxBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		query, args := multiRowDelete(keys[start:end], deletes)
+		if err := tx.Exec(query, args...).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// writeOneByOne isolates the records that make the batch fail, e.g. duplicated versions
+func (watchdog *BatchingWatchdog) writeOneByOne(inserts []*pendingInsert, deletes map[objectKey]int) {
+	for _, pending := range inserts {
+		_, err := watchdog.watchdog.Insert(&pending.record)
+		if pending.done != nil {
+			pending.done <- err
+		} else if err != nil {
+			metrics.Mark("watchdog.batch.dropped")
+			log.Printf("[watchdog] Dropping record of reqID %s, objID %s, domain %s: %s",
+				pending.record.RequestID, pending.record.ObjectID, pending.record.Domain, err)
+		}
+	}
+	for key, version := range deletes {
+		err := watchdog.watchdog.Delete(key.marker(version))
+		if err != nil {
+			metrics.Mark("watchdog.batch.dropped")
+		}
+	}
+}
+
+func (watchdog *BatchingWatchdog) multiRowInsert(inserts []*pendingInsert) (string, []interface{}) {
+	dialect := watchdog.watchdog.dialect
+	placeholders := make([]string, 0, len(inserts))
+	args := make([]interface{}, 0, 9*len(inserts))
+	for _, pending := range inserts {
+		record := pending.record
+		placeholders = append(placeholders, insertValuesPlaceholder)
+		args = append(args, record.ObjectVersion, record.RequestID, record.ObjectID, record.Domain, record.AccessKey,
+			dialect.ExecutionDelay(record.ExecutionDelay), record.Method, record.OperationOrDefault(), record.SubResource)
+	}
+	return fmt.Sprintf("%s %s", strings.TrimSuffix(insertWithObjectVersion, " "+insertValuesPlaceholder), strings.Join(placeholders, ", ")), args
+}
+
+func multiRowDelete(keys []objectKey, versions map[objectKey]int) (string, []interface{}) {
+	conditions := make([]string, 0, len(keys))
+	args := make([]interface{}, 0, 5*len(keys))
+	for _, key := range keys {
+		condition, conditionArgs := supersededCondition(key.marker(versions[key]))
+		conditions = append(conditions, "("+condition+")")
+		args = append(args, conditionArgs...)
+	}
+	return deleteRecords + strings.Join(conditions, " OR "), args
+}
+
+// syncClock estimates the offset between the local and the database clock
+func (watchdog *BatchingWatchdog) syncClock() {
+	before := watchdog.microsecondsNow()
+	record := &ConsistencyRecord{}
+	err := watchdog.watchdog.SupplyRecordWithVersion(record)
+	after := watchdog.microsecondsNow()
+
+	watchdog.mx.Lock()
+	defer watchdog.mx.Unlock()
+	watchdog.clockSyncedAt = time.Now()
+	if err != nil {
+		log.Printf("[watchdog] Failed to synchronize clock with the database, using offset %dus: %s", watchdog.clockOffset, err)
+		return
+	}
+	watchdog.clockOffset = int64(record.ObjectVersion) - (before+after)/2
+	metrics.UpdateGauge("watchdog.batch.clock_offset", watchdog.clockOffset)
+}
+
+func signal(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
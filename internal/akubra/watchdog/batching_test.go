@@ -0,0 +1,204 @@
+package watchdog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	regionsconfig "github.com/allegro/akubra/internal/akubra/regions/config"
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createBatchingWatchdog(t *testing.T, batchingConfig config.BatchingConfig) (*BatchingWatchdog, *SQLWatchdog, func()) {
+	embedded, cleanup := createEmbeddedWatchdog(t)
+	batching, err := NewBatchingWatchdog(embedded, batchingConfig)
+	require.NoError(t, err)
+	return batching, embedded, func() {
+		_ = batching.Close()
+		cleanup()
+	}
+}
+
+func batchedRecord(requestID, objectID string, level regionsconfig.ConsistencyLevel) *ConsistencyRecord {
+	return &ConsistencyRecord{
+		RequestID:        requestID,
+		ObjectID:         objectID,
+		AccessKey:        "access",
+		ExecutionDelay:   fiveMinutes,
+		Domain:           "local.qxlint",
+		Method:           PUT,
+		ConsistencyLevel: level,
+	}
+}
+
+type unsupportedWatchdog struct {
+	ConsistencyWatchdog
+}
+
+func awaitRecords(t *testing.T, watchdog *SQLWatchdog, objectID string, expected int) {
+	deadline := time.Now().Add(time.Second)
+	for countRecords(t, watchdog, objectID) != expected && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, expected, countRecords(t, watchdog, objectID))
+}
+
+func TestBatchingWatchdogShouldRequireSQLWatchdog(t *testing.T) {
+	_, err := NewBatchingWatchdog(&unsupportedWatchdog{}, config.BatchingConfig{Enabled: true})
+	assert.Error(t, err)
+}
+
+func TestBatchingWatchdogShouldFlushWeakInsertsWhenBatchIsFull(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{MaxBatchSize: 10, FlushInterval: time.Hour})
+	defer cleanup()
+
+	for i := 0; i < 9; i++ {
+		_, err := batching.Insert(batchedRecord(fmt.Sprintf("req-%d", i), "bucket/key", regionsconfig.Weak))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 0, countRecords(t, embedded, "bucket/key"))
+
+	_, err := batching.Insert(batchedRecord("req-9", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	awaitRecords(t, embedded, "bucket/key", 10)
+}
+
+func TestBatchingWatchdogShouldFlushAfterInterval(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: 20 * time.Millisecond})
+	defer cleanup()
+
+	_, err := batching.Insert(batchedRecord("req", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	awaitRecords(t, embedded, "bucket/key", 1)
+}
+
+func TestBatchingWatchdogShouldCancelInsertDeletedWithinFlushWindow(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: time.Hour})
+	defer cleanup()
+
+	marker, err := batching.Insert(batchedRecord("req-1", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	_, err = batching.Insert(batchedRecord("req-2", "bucket/other", regionsconfig.Weak))
+	require.NoError(t, err)
+	require.NoError(t, batching.Delete(marker))
+	assert.Len(t, batching.inserts, 1)
+	assert.Len(t, batching.deletes, 1)
+
+	batching.flush()
+	assert.Equal(t, 0, countRecords(t, embedded, "bucket/key"))
+	assert.Equal(t, 1, countRecords(t, embedded, "bucket/other"))
+}
+
+func TestBatchingWatchdogShouldDeleteFlushedVersionsWhenCancellingPendingInsert(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: time.Hour})
+	defer cleanup()
+
+	_, err := batching.Insert(batchedRecord("req-1", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	batching.flush()
+	require.Equal(t, 1, countRecords(t, embedded, "bucket/key"))
+
+	marker, err := batching.Insert(batchedRecord("req-2", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	require.NoError(t, batching.Delete(marker))
+	assert.Empty(t, batching.inserts)
+
+	batching.flush()
+	assert.Equal(t, 0, countRecords(t, embedded, "bucket/key"))
+}
+
+func TestBatchingWatchdogShouldBatchDeletesOfFlushedRecords(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: time.Hour})
+	defer cleanup()
+
+	var markers []*DeleteMarker
+	for i := 0; i < 3; i++ {
+		marker, err := batching.Insert(batchedRecord(fmt.Sprintf("req-%d", i), fmt.Sprintf("bucket/key-%d", i), regionsconfig.Weak))
+		require.NoError(t, err)
+		markers = append(markers, marker)
+	}
+	batching.flush()
+	for _, marker := range markers[:2] {
+		require.NoError(t, batching.Delete(marker))
+	}
+	assert.Len(t, batching.deletes, 2)
+
+	batching.flush()
+	assert.Equal(t, 0, countRecords(t, embedded, "bucket/key-0"))
+	assert.Equal(t, 0, countRecords(t, embedded, "bucket/key-1"))
+	assert.Equal(t, 1, countRecords(t, embedded, "bucket/key-2"))
+}
+
+func TestBatchingWatchdogShouldCommitStrongInsertsBeforeReturning(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: time.Hour})
+	defer cleanup()
+
+	_, err := batching.Insert(batchedRecord("weak", "bucket/weak", regionsconfig.Weak))
+	require.NoError(t, err)
+	marker, err := batching.Insert(batchedRecord("strong", "bucket/strong", regionsconfig.Strong))
+	require.NoError(t, err)
+	assert.Equal(t, 1, countRecords(t, embedded, "bucket/strong"))
+	assert.Equal(t, 1, countRecords(t, embedded, "bucket/weak"), "weak record should share the commit")
+
+	require.NoError(t, batching.Delete(marker))
+	batching.flush()
+	assert.Equal(t, 0, countRecords(t, embedded, "bucket/strong"))
+}
+
+func TestBatchingWatchdogShouldWaitForFlushWhenPendingLimitIsReached(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: time.Hour, MaxPendingRecords: 2})
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		_, err := batching.Insert(batchedRecord(fmt.Sprintf("req-%d", i), "bucket/key", regionsconfig.Weak))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 0, countRecords(t, embedded, "bucket/key"))
+
+	_, err := batching.Insert(batchedRecord("req-2", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	assert.Equal(t, 3, countRecords(t, embedded, "bucket/key"))
+}
+
+func TestBatchingWatchdogShouldUpdateExecutionDelayOfPendingRecord(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: time.Hour})
+	defer cleanup()
+
+	_, err := batching.Insert(batchedRecord("req", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	require.NoError(t, batching.UpdateExecutionDelay(&ExecutionDelay{RequestID: "req", Delay: oneWeek}))
+	assert.Equal(t, oneWeek, batching.pendingByRequest["req"].record.ExecutionDelay)
+	batching.flush()
+
+	var delays []int64
+	require.NoError(t, embedded.dbConn.Table("consistency_record").Where("request_id = ?", "req").Pluck("execution_delay", &delays).Error)
+	assert.Equal(t, []int64{int64(oneWeek.Seconds())}, delays)
+}
+
+func TestBatchingWatchdogShouldFlushPendingRecordsOnClose(t *testing.T) {
+	batching, embedded, cleanup := createBatchingWatchdog(t, config.BatchingConfig{FlushInterval: time.Hour})
+	defer cleanup()
+
+	_, err := batching.Insert(batchedRecord("req", "bucket/key", regionsconfig.Weak))
+	require.NoError(t, err)
+	require.NoError(t, batching.Close())
+	assert.Equal(t, 1, countRecords(t, embedded, "bucket/key"))
+
+	_, err = batching.Insert(batchedRecord("late", "bucket/key", regionsconfig.Weak))
+	assert.Equal(t, ErrWatchdogClosed, err)
+}
+
+func TestBatchingWatchdogShouldSupplyIncreasingVersions(t *testing.T) {
+	batching, _, cleanup := createBatchingWatchdog(t, config.BatchingConfig{})
+	defer cleanup()
+
+	previousVersion := 0
+	for i := 0; i < 100; i++ {
+		record := &ConsistencyRecord{}
+		require.NoError(t, batching.SupplyRecordWithVersion(record))
+		assert.True(t, record.ObjectVersion > previousVersion)
+		previousVersion = record.ObjectVersion
+	}
+}
@@ -1,10 +1,43 @@
 package config
 
+import "time"
+
 type watchdogProps = map[string]string
 
+const (
+	// PostgresDialect is the name of PostgreSQL consistency log dialect
+	PostgresDialect = "postgres"
+	// MySQLDialect is the name of MySQL 8 consistency log dialect
+	MySQLDialect = "mysql"
+	// SQLiteDialect is the name of SQLite consistency log dialect
+	SQLiteDialect = "sqlite3"
+)
+
+// SQLDialects lists dialects supported by the sql watchdog
+var SQLDialects = []string{PostgresDialect, MySQLDialect, SQLiteDialect}
+
 // WatchdogConfig is watchdog type
 type WatchdogConfig struct {
-	ObjectVersionHeaderName string        `yaml:"ObjectVersionHeaderName"`
-	Type                    string        `yaml:"Type"`
-	Props                   watchdogProps `yaml:"Props"`
+	ObjectVersionHeaderName string         `yaml:"ObjectVersionHeaderName"`
+	Type                    string         `yaml:"Type"`
+	Props                   watchdogProps  `yaml:"Props"`
+	Batching                BatchingConfig `yaml:"Batching"`
+	// LagMetricsInterval is how often replication lag gauges are computed from the log, disabled if zero
+	LagMetricsInterval time.Duration `yaml:"LagMetricsInterval"`
+}
+
+// BatchingConfig configures write-behind batching of consistency log writes.
+// Inserts of Weak consistency requests and all deletes wait in memory for a flush,
+// so at most MaxPendingRecords records may be lost on crash
+type BatchingConfig struct {
+	Enabled bool `yaml:"Enabled"`
+	// MaxBatchSize is the number of pending records that triggers a flush
+	MaxBatchSize int `yaml:"MaxBatchSize"`
+	// FlushInterval is the longest time a record waits for a flush
+	FlushInterval time.Duration `yaml:"FlushInterval"`
+	// MaxPendingRecords bounds the number of records waiting for a flush, inserts
+	// exceeding it wait for the flush like Strong ones
+	MaxPendingRecords int `yaml:"MaxPendingRecords"`
+	// GroupCommitWindow is how long a Strong insert waits for others to share a commit
+	GroupCommitWindow time.Duration `yaml:"GroupCommitWindow"`
 }
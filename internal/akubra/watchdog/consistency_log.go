@@ -0,0 +1,260 @@
+package watchdog
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/database"
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	selectRecordColumns = "object_version, inserted_at, updated_at, object_id, method, domain, access_key, %s AS execution_delay, request_id, error, operation, sub_resource, attempts"
+	importRecord        = "INSERT INTO consistency_record (object_version, request_id, object_id, domain, access_key, execution_delay, method, operation, sub_resource, attempts, error, inserted_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+)
+
+var postgresIntervalPattern = regexp.MustCompile(`^(?:(\d+) days? )?(\d+):(\d{2}):(\d{2}(?:\.\d+)?)$`)
+
+// AgeClasses are the upper bounds of record age groups reported by ConsistencyLog.Stats
+var AgeClasses = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+// ConsistencyLog gives operators direct access to the records of any watchdog backend
+type ConsistencyLog struct {
+	db      *gorm.DB
+	dialect Dialect
+}
+
+// RecordFilter selects consistency records, empty fields match all records
+type RecordFilter struct {
+	RequestID string
+	Domain    string
+	Bucket    string
+	Method    Method
+	// OlderThan matches records inserted earlier than that
+	OlderThan time.Duration
+}
+
+// RecordGroup counts records of a domain, bucket and method inserted within an age class
+type RecordGroup struct {
+	Domain   string
+	Bucket   string
+	Method   string
+	AgeClass string
+	Count    int
+	Oldest   time.Time
+}
+
+// NewConsistencyLog creates a ConsistencyLog of the records in db
+func NewConsistencyLog(db *gorm.DB, dialect Dialect) *ConsistencyLog {
+	return &ConsistencyLog{db: db, dialect: dialect}
+}
+
+// OpenConsistencyLog connects to the consistency log described by the watchdog config
+func OpenConsistencyLog(watchdogConfig *config.WatchdogConfig) (*ConsistencyLog, error) {
+	switch strings.ToLower(watchdogConfig.Type) {
+	case EmbeddedWatchdogType:
+		db, err := OpenEmbeddedDB(watchdogConfig.Props[EmbeddedPathProp])
+		if err != nil {
+			return nil, err
+		}
+		return NewConsistencyLog(db, &SQLiteDialect{}), nil
+	case "sql":
+		dialect, err := DialectFor(watchdogConfig.Props["dialect"])
+		if err != nil {
+			return nil, err
+		}
+		db, err := database.
+			NewDBClientFactory(dialect.Name(), dialect.ConnectionStringFormat(), dialect.ConnectionStringArgs()).
+			CreateConnection(CreateWatchdogSQLClientProps(watchdogConfig, Writer))
+		if err != nil {
+			return nil, err
+		}
+		return NewConsistencyLog(db, dialect), nil
+	}
+	return nil, fmt.Errorf("no consistency log for watchdog of type '%s'", watchdogConfig.Type)
+}
+
+// DeadLetters returns the dead-letter queue of the log
+func (consistencyLog *ConsistencyLog) DeadLetters() *DeadLetterQueue {
+	return NewDeadLetterQueue(consistencyLog.db, consistencyLog.dialect)
+}
+
+// Close closes the database connection
+func (consistencyLog *ConsistencyLog) Close() error {
+	return consistencyLog.db.Close()
+}
+
+// IsEmpty tells if the filter matches all records
+func (filter RecordFilter) IsEmpty() bool {
+	return filter == RecordFilter{}
+}
+
+func (filter RecordFilter) apply(db *gorm.DB) *gorm.DB {
+	if filter.RequestID != "" {
+		db = db.Where("request_id = ?", filter.RequestID)
+	}
+	if filter.Domain != "" {
+		db = db.Where("domain = ?", filter.Domain)
+	}
+	if filter.Bucket != "" {
+		db = whereBucket(db, filter.Bucket)
+	}
+	if filter.Method != "" {
+		db = db.Where("method = ?", filter.Method)
+	}
+	if filter.OlderThan > 0 {
+		db = db.Where("inserted_at < ?", time.Now().UTC().Add(-filter.OlderThan))
+	}
+	return db
+}
+
+// Each streams the records matching the filter, oldest first
+func (consistencyLog *ConsistencyLog) Each(filter RecordFilter, consume func(record *SQLConsistencyRecord) error) error {
+	rows, err := filter.
+		apply(consistencyLog.db.Model(&SQLConsistencyRecord{})).
+		Select(fmt.Sprintf(selectRecordColumns, consistencyLog.dialect.ExecutionDelayText())).
+		Order("object_version ASC").
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		record := &SQLConsistencyRecord{}
+		if err := consistencyLog.db.ScanRows(rows, record); err != nil {
+			return err
+		}
+		if err := consume(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Stats groups the records matching the filter by domain, bucket, method and AgeClasses
+func (consistencyLog *ConsistencyLog) Stats(filter RecordFilter, now time.Time) ([]*RecordGroup, error) {
+	groups := make(map[RecordGroup]*RecordGroup)
+	err := consistencyLog.Each(filter, func(record *SQLConsistencyRecord) error {
+		key := RecordGroup{
+			Domain:   record.Domain,
+			Bucket:   BucketOf(record.ObjectID),
+			Method:   record.Method,
+			AgeClass: AgeClassOf(now.Sub(record.InsertedAt)),
+		}
+		group, ok := groups[key]
+		if !ok {
+			group = &RecordGroup{Domain: key.Domain, Bucket: key.Bucket, Method: key.Method, AgeClass: key.AgeClass, Oldest: record.InsertedAt}
+			groups[key] = group
+		}
+		group.Count++
+		if record.InsertedAt.Before(group.Oldest) {
+			group.Oldest = record.InsertedAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*RecordGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Domain != result[j].Domain {
+			return result[i].Domain < result[j].Domain
+		}
+		if result[i].Bucket != result[j].Bucket {
+			return result[i].Bucket < result[j].Bucket
+		}
+		if result[i].Method != result[j].Method {
+			return result[i].Method < result[j].Method
+		}
+		return result[i].Oldest.Before(result[j].Oldest)
+	})
+	return result, nil
+}
+
+// ForceExecution makes the records matching the filter due immediately
+func (consistencyLog *ConsistencyLog) ForceExecution(filter RecordFilter) (int64, error) {
+	res := filter.
+		apply(consistencyLog.db.Model(&SQLConsistencyRecord{})).
+		// the expression keeps the delay from being converted to the model field type
+		UpdateColumn("execution_delay", gorm.Expr("?", consistencyLog.dialect.ExecutionDelay(0)))
+	return res.RowsAffected, res.Error
+}
+
+// Delete removes the records matching the filter
+func (consistencyLog *ConsistencyLog) Delete(filter RecordFilter) (int64, error) {
+	res := filter.apply(consistencyLog.db).Delete(SQLConsistencyRecord{})
+	return res.RowsAffected, res.Error
+}
+
+// Import inserts a record exported from a log of any backend
+func (consistencyLog *ConsistencyLog) Import(record *SQLConsistencyRecord) error {
+	executionDelay, err := ParseExecutionDelay(record.ExecutionDelay)
+	if err != nil {
+		return err
+	}
+	operation := record.Operation
+	if operation == "" {
+		operation = string(ObjectOperation)
+	}
+	return consistencyLog.db.Exec(importRecord, record.ObjectVersion, record.RequestID, record.ObjectID, record.Domain, record.AccessKey,
+		consistencyLog.dialect.ExecutionDelay(executionDelay), record.Method, operation, record.SubResource, record.Attempts,
+		record.Error, record.InsertedAt.UTC(), record.UpdatedAt.UTC()).Error
+}
+
+// ParseExecutionDelay parses execution_delay read from any dialect, seconds of MySQL and SQLite
+// or PostgreSQL's interval
+func ParseExecutionDelay(executionDelay string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(executionDelay, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if delay, err := time.ParseDuration(executionDelay); err == nil {
+		return delay, nil
+	}
+	match := postgresIntervalPattern.FindStringSubmatch(executionDelay)
+	if match == nil {
+		return 0, fmt.Errorf("unsupported execution delay '%s'", executionDelay)
+	}
+	days, _ := strconv.Atoi("0" + match[1])
+	hours, _ := strconv.Atoi(match[2])
+	minutes, _ := strconv.Atoi(match[3])
+	seconds, _ := strconv.ParseFloat(match[4], 64)
+	return time.Duration(days)*24*time.Hour + time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)), nil
+}
+
+// BucketOf returns the bucket of an object id, bucket records' ids are bucket names
+func BucketOf(objectID string) string {
+	return strings.SplitN(objectID, "/", 2)[0]
+}
+
+// AgeClassOf names the AgeClasses group of the age
+func AgeClassOf(age time.Duration) string {
+	for _, limit := range AgeClasses {
+		if age < limit {
+			return "<" + shortDuration(limit)
+		}
+	}
+	return ">=" + shortDuration(AgeClasses[len(AgeClasses)-1])
+}
+
+func shortDuration(duration time.Duration) string {
+	switch {
+	case duration%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", duration/(24*time.Hour))
+	case duration%time.Hour == 0:
+		return fmt.Sprintf("%dh", duration/time.Hour)
+	}
+	return fmt.Sprintf("%dm", duration/time.Minute)
+}
+
+func whereBucket(db *gorm.DB, bucket string) *gorm.DB {
+	return db.Where("(object_id = ? OR object_id LIKE ? ESCAPE '!')", bucket, escapeLike(bucket)+"/%")
+}
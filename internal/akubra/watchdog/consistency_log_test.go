@@ -0,0 +1,117 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collectRecords(t *testing.T, consistencyLog *ConsistencyLog, filter RecordFilter) []*SQLConsistencyRecord {
+	var records []*SQLConsistencyRecord
+	require.NoError(t, consistencyLog.Each(filter, func(record *SQLConsistencyRecord) error {
+		records = append(records, record)
+		return nil
+	}))
+	return records
+}
+
+func TestShouldForceExecutionAndDeleteFilteredRecords(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+	for i, objectID := range []string{"bucket/a", "bucket/b", "other/a"} {
+		record := batchedRecord(objectID, objectID, "")
+		record.ObjectVersion = i + 1
+		_, err := watchdog.Insert(record)
+		require.NoError(t, err)
+	}
+	consistencyLog := NewConsistencyLog(watchdog.dbConn, watchdog.dialect)
+
+	forced, err := consistencyLog.ForceExecution(RecordFilter{Bucket: "bucket"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), forced)
+	for _, record := range collectRecords(t, consistencyLog, RecordFilter{}) {
+		delay, err := ParseExecutionDelay(record.ExecutionDelay)
+		require.NoError(t, err)
+		if BucketOf(record.ObjectID) == "bucket" {
+			assert.Equal(t, time.Duration(0), delay)
+		} else {
+			assert.Equal(t, fiveMinutes, delay)
+		}
+	}
+
+	deleted, err := consistencyLog.Delete(RecordFilter{Bucket: "bucket", Method: PUT})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	records := collectRecords(t, consistencyLog, RecordFilter{})
+	require.Len(t, records, 1)
+	assert.Equal(t, "other/a", records[0].ObjectID)
+}
+
+func TestShouldImportExportedRecords(t *testing.T) {
+	source, cleanupSource := createEmbeddedWatchdog(t)
+	defer cleanupSource()
+	destination, cleanupDestination := createEmbeddedWatchdog(t)
+	defer cleanupDestination()
+	record := batchedRecord("req", "bucket/key", "")
+	record.ObjectVersion = 42
+	_, err := source.Insert(record)
+	require.NoError(t, err)
+
+	exported := collectRecords(t, NewConsistencyLog(source.dbConn, source.dialect), RecordFilter{RequestID: "req"})
+	require.Len(t, exported, 1)
+	exported[0].Attempts = 3
+	imported := NewConsistencyLog(destination.dbConn, destination.dialect)
+	require.NoError(t, imported.Import(exported[0]))
+
+	records := collectRecords(t, imported, RecordFilter{})
+	require.Len(t, records, 1)
+	assert.Equal(t, 42, records[0].ObjectVersion)
+	assert.Equal(t, "bucket/key", records[0].ObjectID)
+	assert.Equal(t, 3, records[0].Attempts)
+	assert.Equal(t, exported[0].InsertedAt.Unix(), records[0].InsertedAt.Unix())
+}
+
+func TestShouldGroupRecordsByAge(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+	for i, objectID := range []string{"bucket/a", "bucket/b", "bucket"} {
+		record := batchedRecord(objectID, objectID, "")
+		record.ObjectVersion = i + 1
+		_, err := watchdog.Insert(record)
+		require.NoError(t, err)
+	}
+
+	groups, err := NewConsistencyLog(watchdog.dbConn, watchdog.dialect).Stats(RecordFilter{}, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, "bucket", groups[0].Bucket)
+	assert.Equal(t, "PUT", groups[0].Method)
+	assert.Equal(t, "<1d", groups[0].AgeClass)
+	assert.Equal(t, 3, groups[0].Count)
+}
+
+func TestShouldParseExecutionDelayOfAllDialects(t *testing.T) {
+	for executionDelay, expected := range map[string]time.Duration{
+		"300":              5 * time.Minute,
+		"5m0s":             5 * time.Minute,
+		"00:05:00":         5 * time.Minute,
+		"1 day 02:00:01.5": 26*time.Hour + 1500*time.Millisecond,
+		"3 days 00:00:00":  72 * time.Hour,
+	} {
+		delay, err := ParseExecutionDelay(executionDelay)
+		require.NoError(t, err, executionDelay)
+		assert.Equal(t, expected, delay, executionDelay)
+	}
+	_, err := ParseExecutionDelay("soon")
+	assert.Error(t, err)
+}
+
+func TestShouldNameAgeClasses(t *testing.T) {
+	assert.Equal(t, "<1m", AgeClassOf(time.Second))
+	assert.Equal(t, "<10m", AgeClassOf(5*time.Minute))
+	assert.Equal(t, "<1h", AgeClassOf(30*time.Minute))
+	assert.Equal(t, "<1d", AgeClassOf(2*time.Hour))
+	assert.Equal(t, ">=1d", AgeClassOf(48*time.Hour))
+}
@@ -0,0 +1,194 @@
+package watchdog
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/jinzhu/gorm"
+)
+
+// maxDeadLetterErrorLength is the size of the error column
+const maxDeadLetterErrorLength = 1024
+
+// SQLDeadLetterRecord is a consistency record which processing failed too many times
+type SQLDeadLetterRecord struct {
+	RequestID      string    `gorm:"column:request_id" json:"requestId"`
+	ObjectVersion  int       `gorm:"column:object_version" json:"objectVersion"`
+	ObjectID       string    `gorm:"column:object_id" json:"objectId"`
+	Method         string    `gorm:"column:method" json:"method"`
+	Domain         string    `gorm:"column:domain" json:"domain"`
+	AccessKey      string    `gorm:"column:access_key" json:"accessKey"`
+	Operation      string    `gorm:"column:operation" json:"operation"`
+	SubResource    string    `gorm:"column:sub_resource" json:"subResource,omitempty"`
+	Attempts       int       `gorm:"column:attempts" json:"attempts"`
+	Error          string    `gorm:"column:error" json:"error"`
+	ErrorClass     string    `gorm:"column:error_class" json:"errorClass"`
+	Backend        string    `gorm:"column:backend" json:"backend,omitempty"`
+	DeadLetteredAt time.Time `gorm:"column:dead_lettered_at" json:"deadLetteredAt"`
+}
+
+// TableName provides the table name for consistency_dead_letter
+func (SQLDeadLetterRecord) TableName() string {
+	return "consistency_dead_letter"
+}
+
+// DeadLetterFailure describes the last failure of a dead-lettered record
+type DeadLetterFailure struct {
+	Err        error
+	ErrorClass string
+	Backend    string
+}
+
+// DeadLetterFilter selects dead-lettered records, empty fields match all records
+type DeadLetterFilter struct {
+	RequestID  string
+	Domain     string
+	Bucket     string
+	ErrorClass string
+}
+
+// IsEmpty tells if the filter matches all records
+func (filter DeadLetterFilter) IsEmpty() bool {
+	return filter == DeadLetterFilter{}
+}
+
+func (filter DeadLetterFilter) apply(db *gorm.DB) *gorm.DB {
+	if filter.RequestID != "" {
+		db = db.Where("request_id = ?", filter.RequestID)
+	}
+	if filter.Domain != "" {
+		db = db.Where("domain = ?", filter.Domain)
+	}
+	if filter.Bucket != "" {
+		db = whereBucket(db, filter.Bucket)
+	}
+	if filter.ErrorClass != "" {
+		db = db.Where("error_class = ?", filter.ErrorClass)
+	}
+	return db
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+// MoveToDeadLetter moves the record to the dead-letter table. The older records of the same
+// resource are removed from the log too, requeueing the dead-lettered record covers them
+func MoveToDeadLetter(tx *gorm.DB, record *ConsistencyRecord, failure DeadLetterFailure) error {
+	errorMessage := ""
+	if failure.Err != nil {
+		errorMessage = failure.Err.Error()
+	}
+	if len(errorMessage) > maxDeadLetterErrorLength {
+		errorMessage = errorMessage[:maxDeadLetterErrorLength]
+	}
+	deadLetter := &SQLDeadLetterRecord{
+		RequestID:      record.RequestID,
+		ObjectVersion:  record.ObjectVersion,
+		ObjectID:       record.ObjectID,
+		Method:         string(record.Method),
+		Domain:         record.Domain,
+		AccessKey:      record.AccessKey,
+		Operation:      string(record.OperationOrDefault()),
+		SubResource:    string(record.SubResource),
+		Attempts:       record.Attempts,
+		Error:          errorMessage,
+		ErrorClass:     failure.ErrorClass,
+		Backend:        failure.Backend,
+		DeadLetteredAt: time.Now().UTC(),
+	}
+	if err := tx.Create(deadLetter).Error; err != nil {
+		return fmt.Errorf("failed to dead-letter record '%s': %s", record.RequestID, err)
+	}
+	if err := SupersededRecords(tx, record).Delete(SQLConsistencyRecord{}).Error; err != nil {
+		return fmt.Errorf("failed to remove dead-lettered record '%s' from the log: %s", record.RequestID, err)
+	}
+	return nil
+}
+
+// DeadLetterQueue lets operators inspect, requeue and purge dead-lettered records
+type DeadLetterQueue struct {
+	db      *gorm.DB
+	dialect Dialect
+}
+
+// NewDeadLetterQueue creates a DeadLetterQueue of the consistency log in db
+func NewDeadLetterQueue(db *gorm.DB, dialect Dialect) *DeadLetterQueue {
+	return &DeadLetterQueue{db: db, dialect: dialect}
+}
+
+// OpenDeadLetterQueue connects to the consistency log described by the watchdog config
+func OpenDeadLetterQueue(watchdogConfig *config.WatchdogConfig) (*DeadLetterQueue, error) {
+	consistencyLog, err := OpenConsistencyLog(watchdogConfig)
+	if err != nil {
+		return nil, err
+	}
+	return consistencyLog.DeadLetters(), nil
+}
+
+// List returns at most limit most recently dead-lettered records matching the filter
+func (queue *DeadLetterQueue) List(filter DeadLetterFilter, limit int) ([]SQLDeadLetterRecord, error) {
+	records := make([]SQLDeadLetterRecord, 0)
+	err := filter.
+		apply(queue.db).
+		Order("dead_lettered_at DESC").
+		Limit(limit).
+		Find(&records).
+		Error
+	return records, err
+}
+
+// Get returns the dead-lettered record of the request, nil if there is none
+func (queue *DeadLetterQueue) Get(requestID string) (*SQLDeadLetterRecord, error) {
+	record := &SQLDeadLetterRecord{}
+	err := queue.db.Where("request_id = ?", requestID).First(record).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Requeue moves the records matching the filter back to the consistency log, they are
+// due immediately and their attempts are counted from zero
+func (queue *DeadLetterQueue) Requeue(filter DeadLetterFilter) (int, error) {
+	tx := queue.db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	var records []SQLDeadLetterRecord
+	if err := filter.apply(tx).Find(&records).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, record := range records {
+		err := tx.Exec(insertWithObjectVersion, record.ObjectVersion, record.RequestID, record.ObjectID, record.Domain, record.AccessKey,
+			queue.dialect.ExecutionDelay(0), record.Method, record.Operation, record.SubResource).Error
+		if err == nil {
+			err = tx.Where("request_id = ?", record.RequestID).Delete(SQLDeadLetterRecord{}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to requeue record '%s': %s", record.RequestID, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// Purge removes the records matching the filter
+func (queue *DeadLetterQueue) Purge(filter DeadLetterFilter) (int64, error) {
+	res := filter.apply(queue.db).Delete(SQLDeadLetterRecord{})
+	return res.RowsAffected, res.Error
+}
+
+// Close closes the database connection
+func (queue *DeadLetterQueue) Close() error {
+	return queue.db.Close()
+}
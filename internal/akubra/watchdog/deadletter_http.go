@@ -0,0 +1,130 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+)
+
+// DeadLetterEndpointPath is where akubra and brim serve the DeadLetterHandler
+const DeadLetterEndpointPath = "/consistency/dead-letters"
+
+const (
+	defaultDeadLetterListLimit = 100
+	maxDeadLetterListLimit     = 1000
+	requeuePath                = "requeue"
+)
+
+// DeadLetterHandler exposes the dead-letter queue under the path prefix:
+//
+//	GET    <prefix>              lists records matching 'domain', 'bucket' and 'error_class' params, at most 'limit'
+//	GET    <prefix>/<request id> shows a record
+//	POST   <prefix>/requeue      moves matching records back to the consistency log
+//	DELETE <prefix>              purges matching records, purging all records requires 'all=true'
+type DeadLetterHandler struct {
+	queue  *DeadLetterQueue
+	prefix string
+}
+
+// NewDeadLetterHandler creates a DeadLetterHandler serving under the path prefix
+func NewDeadLetterHandler(queue *DeadLetterQueue, prefix string) *DeadLetterHandler {
+	return &DeadLetterHandler{queue: queue, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// ServeHTTP dispatches the admin requests
+func (handler *DeadLetterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, handler.prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resource := strings.Trim(strings.TrimPrefix(r.URL.Path, handler.prefix), "/")
+	filter := DeadLetterFilter{
+		Domain:     r.URL.Query().Get("domain"),
+		Bucket:     r.URL.Query().Get("bucket"),
+		ErrorClass: r.URL.Query().Get("error_class"),
+		RequestID:  r.URL.Query().Get("request_id"),
+	}
+	switch {
+	case resource == "" && r.Method == http.MethodGet:
+		handler.list(w, r, filter)
+	case resource == "" && r.Method == http.MethodDelete:
+		handler.purge(w, r, filter)
+	case resource == requeuePath && r.Method == http.MethodPost:
+		handler.requeue(w, filter)
+	case resource != "" && resource != requeuePath && r.Method == http.MethodGet:
+		handler.get(w, resource)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (handler *DeadLetterHandler) list(w http.ResponseWriter, r *http.Request, filter DeadLetterFilter) {
+	limit := defaultDeadLetterListLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed <= 0 || parsed > maxDeadLetterListLimit {
+			http.Error(w, "limit has to be a number between 1 and "+strconv.Itoa(maxDeadLetterListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	records, err := handler.queue.List(filter, limit)
+	if err != nil {
+		handler.fail(w, "list", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (handler *DeadLetterHandler) get(w http.ResponseWriter, requestID string) {
+	record, err := handler.queue.Get(requestID)
+	if err != nil {
+		handler.fail(w, "get", err)
+		return
+	}
+	if record == nil {
+		http.Error(w, "no dead-lettered record of request "+requestID, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+func (handler *DeadLetterHandler) requeue(w http.ResponseWriter, filter DeadLetterFilter) {
+	requeued, err := handler.queue.Requeue(filter)
+	if err != nil {
+		handler.fail(w, "requeue", err)
+		return
+	}
+	log.Printf("Requeued %d dead-lettered consistency records matching %+v", requeued, filter)
+	writeJSON(w, http.StatusOK, map[string]int{"requeued": requeued})
+}
+
+func (handler *DeadLetterHandler) purge(w http.ResponseWriter, r *http.Request, filter DeadLetterFilter) {
+	if filter.IsEmpty() && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "purging all dead-lettered records requires all=true", http.StatusBadRequest)
+		return
+	}
+	purged, err := handler.queue.Purge(filter)
+	if err != nil {
+		handler.fail(w, "purge", err)
+		return
+	}
+	log.Printf("Purged %d dead-lettered consistency records matching %+v", purged, filter)
+	writeJSON(w, http.StatusOK, map[string]int64{"purged": purged})
+}
+
+func (handler *DeadLetterHandler) fail(w http.ResponseWriter, action string, err error) {
+	log.Printf("Failed to %s dead-lettered consistency records: %s", action, err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
@@ -0,0 +1,121 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deadLetterRecord(t *testing.T, watchdog *SQLWatchdog, requestID, objectID, errorClass string, version int) {
+	record := batchedRecord(requestID, objectID, "")
+	record.ObjectVersion = version
+	record.Attempts = 5
+	_, err := watchdog.Insert(record)
+	require.NoError(t, err)
+	failure := DeadLetterFailure{Err: errors.New("access denied"), ErrorClass: errorClass, Backend: "http://storage:9000"}
+	require.NoError(t, MoveToDeadLetter(watchdog.dbConn, record, failure))
+}
+
+func TestShouldMoveRecordWithItsOlderVersionsToDeadLetter(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+
+	older := batchedRecord("older", "bucket/key", "")
+	older.ObjectVersion = 5
+	_, err := watchdog.Insert(older)
+	require.NoError(t, err)
+	deadLetterRecord(t, watchdog, "req", "bucket/key", "forbidden", 10)
+
+	assert.Equal(t, 0, countRecords(t, watchdog, "bucket/key"))
+	record, err := NewDeadLetterQueue(watchdog.dbConn, watchdog.dialect).Get("req")
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.Equal(t, 10, record.ObjectVersion)
+	assert.Equal(t, 5, record.Attempts)
+	assert.Equal(t, "access denied", record.Error)
+	assert.Equal(t, "forbidden", record.ErrorClass)
+	assert.Equal(t, "http://storage:9000", record.Backend)
+	assert.Equal(t, string(ObjectOperation), record.Operation)
+}
+
+func TestShouldFilterDeadLetteredRecordsByBucket(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+	deadLetterRecord(t, watchdog, "1", "bucket", "forbidden", 10)
+	deadLetterRecord(t, watchdog, "2", "bucket/key", "not_found", 11)
+	deadLetterRecord(t, watchdog, "3", "bucket_2/key", "forbidden", 12)
+	deadLetterRecord(t, watchdog, "4", "bucketx/key", "forbidden", 13)
+	queue := NewDeadLetterQueue(watchdog.dbConn, watchdog.dialect)
+
+	records, err := queue.List(DeadLetterFilter{Bucket: "bucket"}, 10)
+	require.NoError(t, err)
+	var requestIDs []string
+	for _, record := range records {
+		requestIDs = append(requestIDs, record.RequestID)
+	}
+	assert.ElementsMatch(t, []string{"1", "2"}, requestIDs)
+
+	records, err = queue.List(DeadLetterFilter{Bucket: "bucket_2"}, 10)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	records, err = queue.List(DeadLetterFilter{ErrorClass: "forbidden"}, 2)
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestShouldRequeueDeadLetteredRecordsWithAttemptsReset(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+	deadLetterRecord(t, watchdog, "1", "bucket/key", "forbidden", 10)
+	deadLetterRecord(t, watchdog, "2", "bucket/other", "not_found", 11)
+	queue := NewDeadLetterQueue(watchdog.dbConn, watchdog.dialect)
+
+	requeued, err := queue.Requeue(DeadLetterFilter{ErrorClass: "forbidden"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+
+	var records []SQLConsistencyRecord
+	require.NoError(t, watchdog.dbConn.Find(&records).Error)
+	require.Len(t, records, 1)
+	assert.Equal(t, "bucket/key", records[0].ObjectID)
+	assert.Equal(t, 10, records[0].ObjectVersion)
+	assert.Equal(t, 0, records[0].Attempts)
+	remaining, err := queue.List(DeadLetterFilter{}, 10)
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, "2", remaining[0].RequestID)
+}
+
+func TestDeadLetterHandlerShouldRequireExplicitPurgeOfAllRecords(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+	deadLetterRecord(t, watchdog, "1", "bucket/key", "forbidden", 10)
+	deadLetterRecord(t, watchdog, "2", "other/key", "forbidden", 11)
+	handler := NewDeadLetterHandler(NewDeadLetterQueue(watchdog.dbConn, watchdog.dialect), "/consistency/dead-letters")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/consistency/dead-letters", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/consistency/dead-letters?bucket=other", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"purged": 1}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/consistency/dead-letters/1", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var record SQLDeadLetterRecord
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &record))
+	assert.Equal(t, "bucket/key", record.ObjectID)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/consistency/dead-letters/2", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
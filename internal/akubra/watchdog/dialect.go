@@ -0,0 +1,253 @@
+package watchdog
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/jinzhu/gorm"
+	// registers database drivers of supported dialects
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+const (
+	insertWithObjectVersion = "INSERT INTO consistency_record (object_version, request_id, object_id, domain, access_key, execution_delay, method, operation, sub_resource) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	deleteRecords           = "DELETE FROM consistency_record WHERE "
+	updateExecutionDelay    = "UPDATE consistency_record SET execution_delay = ? WHERE request_id = ?"
+
+	supersededResourceRecords    = "domain = ? AND object_id = ? AND operation = ? AND object_version <= ?"
+	supersededSubResourceRecords = "domain = ? AND object_id = ? AND operation = ? AND sub_resource = ? AND object_version <= ?"
+)
+
+// Dialect hides database specific parts of the consistency log queries
+type Dialect interface {
+	// Name is the name of the gorm dialect and database/sql driver
+	Name() string
+	// ConnectionStringFormat is a connection string with ':arg:' placeholders
+	ConnectionStringFormat() string
+	// ConnectionStringArgs lists the placeholders of ConnectionStringFormat
+	ConnectionStringArgs() []string
+	// CurrentVersionQuery selects database time in microseconds since epoch
+	CurrentVersionQuery() string
+	// InsertReturningVersionQuery inserts a record with the version generated
+	// by the database and returns it, empty if the database can't do it
+	InsertReturningVersionQuery() string
+	// ExecutionDelay converts delay to the execution_delay column value
+	ExecutionDelay(delay time.Duration) interface{}
+	// ExecutionDelayText selects execution_delay as text readable by ParseExecutionDelay
+	ExecutionDelayText() string
+	// DueCondition matches records which execution delay has passed
+	DueCondition() string
+	// PostponeQuery stores the error, counts the attempt and makes the record due
+	// after the delay, takes error, execution delay and request id
+	PostponeQuery() string
+	// LockClause locks selected records until the end of transaction, so
+	// they are not handed to concurrent feeders
+	LockClause() string
+}
+
+// DialectFor returns the dialect of given name, PostgreSQL is the default
+func DialectFor(name string) (Dialect, error) {
+	switch strings.ToLower(name) {
+	case "", config.PostgresDialect:
+		return &PostgresDialect{}, nil
+	case config.MySQLDialect:
+		return &MySQLDialect{}, nil
+	case config.SQLiteDialect:
+		return &SQLiteDialect{}, nil
+	}
+	return nil, fmt.Errorf("unsupported consistency log dialect '%s'", name)
+}
+
+// DueRecords prepares a query of at most limit newest records which execution
+// delay has passed, the records are locked if the dialect supports it
+func DueRecords(tx *gorm.DB, dialect Dialect, limit uint) *gorm.DB {
+	query := tx.
+		Order("object_version DESC").
+		Where(dialect.DueCondition()).
+		Limit(limit)
+	if lockClause := dialect.LockClause(); lockClause != "" {
+		query = query.Set("gorm:query_option", lockClause)
+	}
+	return query
+}
+
+// SupersededRecords prepares a query of records superseded by the given one. Changes of
+// a bucket or an object supersede the older changes of its sub-resources, changes of
+// a sub-resource supersede only the older changes of the same sub-resource
+func SupersededRecords(db *gorm.DB, record *ConsistencyRecord) *gorm.DB {
+	condition, args := supersededCondition(DeleteMarkerFor(record))
+	return db.Where(condition, args...)
+}
+
+func supersededCondition(marker *DeleteMarker) (string, []interface{}) {
+	if marker.subResource == "" {
+		return supersededResourceRecords, []interface{}{marker.domain, marker.objectID, marker.operation, marker.objectVersion}
+	}
+	return supersededSubResourceRecords, []interface{}{marker.domain, marker.objectID, marker.operation, marker.subResource, marker.objectVersion}
+}
+
+// PostgresDialect is the PostgreSQL dialect
+type PostgresDialect struct{}
+
+// Name is the name of the gorm dialect and database/sql driver
+func (*PostgresDialect) Name() string {
+	return config.PostgresDialect
+}
+
+// ConnectionStringFormat is a connection string with ':arg:' placeholders
+func (*PostgresDialect) ConnectionStringFormat() string {
+	return "sslmode=disable dbname=:dbname: user=:user: password=:password: host=:host: port=:port: connect_timeout=:conntimeout:"
+}
+
+// ConnectionStringArgs lists the placeholders of ConnectionStringFormat
+func (*PostgresDialect) ConnectionStringArgs() []string {
+	return []string{"user", "password", "dbname", "host", "port", "conntimeout"}
+}
+
+// CurrentVersionQuery selects database time in microseconds since epoch
+func (*PostgresDialect) CurrentVersionQuery() string {
+	return "SELECT CAST(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP at time zone 'utc') * 10^6 AS BIGINT)"
+}
+
+// InsertReturningVersionQuery inserts a record and returns the version generated by the database
+func (*PostgresDialect) InsertReturningVersionQuery() string {
+	return "INSERT INTO consistency_record (request_id, object_id, domain, access_key, execution_delay, method, operation, sub_resource) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING object_version"
+}
+
+// ExecutionDelay converts delay to INTERVAL literal
+func (*PostgresDialect) ExecutionDelay(delay time.Duration) interface{} {
+	return delay.String()
+}
+
+// ExecutionDelayText casts execution_delay to text
+func (*PostgresDialect) ExecutionDelayText() string {
+	return "CAST(execution_delay AS TEXT)"
+}
+
+// DueCondition matches records which execution delay has passed
+func (*PostgresDialect) DueCondition() string {
+	return "updated_at + execution_delay < NOW() AT TIME ZONE 'UTC'"
+}
+
+// PostponeQuery stores the error and makes the record due after the delay
+func (*PostgresDialect) PostponeQuery() string {
+	return "UPDATE consistency_record SET error = ?, execution_delay = ?, attempts = attempts + 1, updated_at = NOW() AT TIME ZONE 'UTC' WHERE request_id = ?"
+}
+
+// LockClause skips records locked by concurrent feeders
+func (*PostgresDialect) LockClause() string {
+	return "FOR UPDATE SKIP LOCKED"
+}
+
+// MySQLDialect is the MySQL 8 dialect, execution delay is kept in seconds
+type MySQLDialect struct{}
+
+// Name is the name of the gorm dialect and database/sql driver
+func (*MySQLDialect) Name() string {
+	return config.MySQLDialect
+}
+
+// ConnectionStringFormat is a connection string with ':arg:' placeholders
+func (*MySQLDialect) ConnectionStringFormat() string {
+	return ":user:::password:@tcp(:host:::port:)/:dbname:?parseTime=true&timeout=:conntimeout:s"
+}
+
+// ConnectionStringArgs lists the placeholders of ConnectionStringFormat
+func (*MySQLDialect) ConnectionStringArgs() []string {
+	return []string{"user", "password", "host", "port", "dbname", "conntimeout"}
+}
+
+// CurrentVersionQuery selects database time in microseconds since epoch
+func (*MySQLDialect) CurrentVersionQuery() string {
+	return "SELECT CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000 AS SIGNED)"
+}
+
+// InsertReturningVersionQuery is not supported by MySQL
+func (*MySQLDialect) InsertReturningVersionQuery() string {
+	return ""
+}
+
+// ExecutionDelay converts delay to seconds
+func (*MySQLDialect) ExecutionDelay(delay time.Duration) interface{} {
+	return int64(delay.Seconds())
+}
+
+// ExecutionDelayText casts execution_delay to text
+func (*MySQLDialect) ExecutionDelayText() string {
+	return "CAST(execution_delay AS CHAR)"
+}
+
+// DueCondition matches records which execution delay has passed
+func (*MySQLDialect) DueCondition() string {
+	return "updated_at + INTERVAL execution_delay SECOND <= UTC_TIMESTAMP(6)"
+}
+
+// PostponeQuery stores the error and makes the record due after the delay
+func (*MySQLDialect) PostponeQuery() string {
+	return "UPDATE consistency_record SET error = ?, execution_delay = ?, attempts = attempts + 1, updated_at = UTC_TIMESTAMP(6) WHERE request_id = ?"
+}
+
+// LockClause skips records locked by concurrent feeders
+func (*MySQLDialect) LockClause() string {
+	return "FOR UPDATE SKIP LOCKED"
+}
+
+// SQLiteDialect is the SQLite dialect, execution delay is kept in seconds.
+// SQLite has no row locks, transactions are started with a write lock
+// (see _txlock in the connection string) which serializes feeders instead
+type SQLiteDialect struct{}
+
+// Name is the name of the gorm dialect and database/sql driver
+func (*SQLiteDialect) Name() string {
+	return config.SQLiteDialect
+}
+
+// ConnectionStringFormat is a connection string with ':arg:' placeholders
+func (*SQLiteDialect) ConnectionStringFormat() string {
+	return "file::path:?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+}
+
+// ConnectionStringArgs lists the placeholders of ConnectionStringFormat
+func (*SQLiteDialect) ConnectionStringArgs() []string {
+	return []string{"path"}
+}
+
+// CurrentVersionQuery selects database time in microseconds since epoch, SQLite's
+// clock has millisecond precision
+func (*SQLiteDialect) CurrentVersionQuery() string {
+	return "SELECT CAST(ROUND((julianday('now') - 2440587.5) * 86400000) AS INTEGER) * 1000"
+}
+
+// InsertReturningVersionQuery is not supported by SQLite
+func (*SQLiteDialect) InsertReturningVersionQuery() string {
+	return ""
+}
+
+// ExecutionDelay converts delay to seconds
+func (*SQLiteDialect) ExecutionDelay(delay time.Duration) interface{} {
+	return int64(delay.Seconds())
+}
+
+// ExecutionDelayText casts execution_delay to text
+func (*SQLiteDialect) ExecutionDelayText() string {
+	return "CAST(execution_delay AS TEXT)"
+}
+
+// DueCondition matches records which execution delay has passed
+func (*SQLiteDialect) DueCondition() string {
+	return "datetime(updated_at, '+' || execution_delay || ' seconds') <= CURRENT_TIMESTAMP"
+}
+
+// PostponeQuery stores the error and makes the record due after the delay
+func (*SQLiteDialect) PostponeQuery() string {
+	return "UPDATE consistency_record SET error = ?, execution_delay = ?, attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP WHERE request_id = ?"
+}
+
+// LockClause is empty, SQLite locks the whole database
+func (*SQLiteDialect) LockClause() string {
+	return ""
+}
@@ -0,0 +1,250 @@
+package watchdog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Dialects are checked against SQLite by default, PostgreSQL and MySQL are
+// checked when a DSN of a disposable database is given in these variables,
+// MySQL DSN requires parseTime=true
+const (
+	postgresConformanceDSN = "AKUBRA_TEST_POSTGRES_DSN"
+	mysqlConformanceDSN    = "AKUBRA_TEST_MYSQL_DSN"
+)
+
+// conformanceTarget prepares an empty consistency log and returns a function
+// opening independent connections to it
+type conformanceTarget struct {
+	dialect Dialect
+	prepare func(t *testing.T) (connect func() *gorm.DB, cleanup func())
+}
+
+func conformanceTargets() []conformanceTarget {
+	targets := []conformanceTarget{{dialect: &SQLiteDialect{}, prepare: prepareSQLite}}
+	if dsn := os.Getenv(postgresConformanceDSN); dsn != "" {
+		targets = append(targets, conformanceTarget{dialect: &PostgresDialect{}, prepare: prepareServer(config.PostgresDialect, dsn)})
+	}
+	if dsn := os.Getenv(mysqlConformanceDSN); dsn != "" {
+		targets = append(targets, conformanceTarget{dialect: &MySQLDialect{}, prepare: prepareServer(config.MySQLDialect, dsn)})
+	}
+	return targets
+}
+
+func prepareSQLite(t *testing.T) (func() *gorm.DB, func()) {
+	dir, err := ioutil.TempDir("", "dialect-conformance")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "wal.db")
+	connections := make([]*gorm.DB, 0)
+	connect := func() *gorm.DB {
+		db, err := OpenEmbeddedDB(path)
+		require.NoError(t, err)
+		connections = append(connections, db)
+		return db
+	}
+	return connect, func() {
+		for _, db := range connections {
+			_ = db.Close()
+		}
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func prepareServer(dialect, dsn string) func(t *testing.T) (func() *gorm.DB, func()) {
+	return func(t *testing.T) (func() *gorm.DB, func()) {
+		connections := make([]*gorm.DB, 0)
+		connect := func() *gorm.DB {
+			db, err := gorm.Open(dialect, dsn)
+			require.NoError(t, err)
+			connections = append(connections, db)
+			return db
+		}
+		db := connect()
+		// dropping the tables drops their indexes as well
+		for _, table := range []string{"consistency_record", "consistency_dead_letter"} {
+			require.NoError(t, db.Exec("DROP TABLE IF EXISTS "+table).Error)
+		}
+		for _, statement := range generatedMigrations[dialect] {
+			require.NoError(t, db.Exec(statement).Error)
+		}
+		return connect, func() {
+			for _, db := range connections {
+				_ = db.Close()
+			}
+		}
+	}
+}
+
+func TestDialectConformance(t *testing.T) {
+	for _, target := range conformanceTargets() {
+		target := target
+		t.Run(target.dialect.Name(), func(t *testing.T) {
+			t.Run("versions are increasing", func(t *testing.T) {
+				connect, cleanup := target.prepare(t)
+				defer cleanup()
+				checkVersionOrdering(t, &SQLWatchdog{dbConn: connect(), dialect: target.dialect})
+			})
+			t.Run("delete removes older versions", func(t *testing.T) {
+				connect, cleanup := target.prepare(t)
+				defer cleanup()
+				checkDelete(t, &SQLWatchdog{dbConn: connect(), dialect: target.dialect})
+			})
+			t.Run("due records follow execution delay", func(t *testing.T) {
+				connect, cleanup := target.prepare(t)
+				defer cleanup()
+				checkExecutionDelay(t, &SQLWatchdog{dbConn: connect(), dialect: target.dialect})
+			})
+			t.Run("selected records are locked", func(t *testing.T) {
+				connect, cleanup := target.prepare(t)
+				defer cleanup()
+				checkLocking(t, target.dialect, connect)
+			})
+		})
+	}
+}
+
+func conformanceRecord(requestID, objectID string, delay time.Duration, version int) *ConsistencyRecord {
+	return &ConsistencyRecord{
+		RequestID:      requestID,
+		ObjectID:       objectID,
+		Domain:         "conformance.local",
+		AccessKey:      "access",
+		Method:         PUT,
+		ExecutionDelay: delay,
+		ObjectVersion:  version,
+	}
+}
+
+func dueRequestIDs(t *testing.T, db *gorm.DB, dialect Dialect) []string {
+	var records []SQLConsistencyRecord
+	require.NoError(t, DueRecords(db, dialect, 100).Find(&records).Error)
+	requestIDs := make([]string, 0, len(records))
+	for _, record := range records {
+		requestIDs = append(requestIDs, strings.TrimSpace(record.RequestID))
+	}
+	return requestIDs
+}
+
+func checkVersionOrdering(t *testing.T, watchdog *SQLWatchdog) {
+	previousVersion := 0
+	for i := 0; i < 50; i++ {
+		marker, err := watchdog.Insert(conformanceRecord(fmt.Sprintf("ordering-%d", i), "bucket/key", time.Hour, 0))
+		require.NoError(t, err)
+		require.True(t, marker.objectVersion > previousVersion, "version %d is not greater than %d", marker.objectVersion, previousVersion)
+		previousVersion = marker.objectVersion
+
+		supplied := conformanceRecord(fmt.Sprintf("supplied-%d", i), "bucket/key", time.Hour, 0)
+		require.NoError(t, watchdog.SupplyRecordWithVersion(supplied))
+		require.True(t, supplied.ObjectVersion > previousVersion, "version %d is not greater than %d", supplied.ObjectVersion, previousVersion)
+		_, err = watchdog.Insert(supplied)
+		require.NoError(t, err)
+		previousVersion = supplied.ObjectVersion
+	}
+
+	now := int(time.Now().UnixNano() / int64(time.Microsecond))
+	assert.InDelta(t, now, previousVersion, float64(time.Minute/time.Microsecond), "versions are not microseconds since epoch")
+
+	var newest SQLConsistencyRecord
+	require.NoError(t, watchdog.dbConn.Order("object_version DESC").First(&newest).Error)
+	assert.Equal(t, "supplied-49", strings.TrimSpace(newest.RequestID))
+	assert.Equal(t, previousVersion, newest.ObjectVersion)
+}
+
+func checkDelete(t *testing.T, watchdog *SQLWatchdog) {
+	older, err := watchdog.Insert(conformanceRecord("older", "bucket/key", time.Hour, 10))
+	require.NoError(t, err)
+	_, err = watchdog.Insert(conformanceRecord("newer", "bucket/key", time.Hour, 20))
+	require.NoError(t, err)
+	_, err = watchdog.Insert(conformanceRecord("other", "bucket/other", time.Hour, 5))
+	require.NoError(t, err)
+
+	_, err = watchdog.Insert(conformanceRecord("duplicate", "bucket/key", time.Hour, 20))
+	assert.Equal(t, ErrDataBase, err, "versions of an object have to be unique")
+
+	require.NoError(t, watchdog.Delete(older))
+	var remaining []SQLConsistencyRecord
+	require.NoError(t, watchdog.dbConn.Order("object_version DESC").Find(&remaining).Error)
+	require.Len(t, remaining, 2)
+	assert.Equal(t, "newer", strings.TrimSpace(remaining[0].RequestID))
+	assert.Equal(t, "other", strings.TrimSpace(remaining[1].RequestID))
+}
+
+func checkExecutionDelay(t *testing.T, watchdog *SQLWatchdog) {
+	_, err := watchdog.Insert(conformanceRecord("due", "bucket/due", 0, 0))
+	require.NoError(t, err)
+	_, err = watchdog.Insert(conformanceRecord("later", "bucket/later", time.Hour, 0))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, []string{"due"}, dueRequestIDs(t, watchdog.dbConn, watchdog.dialect))
+
+	require.NoError(t, watchdog.UpdateExecutionDelay(&ExecutionDelay{RequestID: "later", Delay: 0}))
+	assert.ElementsMatch(t, []string{"due", "later"}, dueRequestIDs(t, watchdog.dbConn, watchdog.dialect))
+
+	postpone := watchdog.dbConn.Exec(watchdog.dialect.PostponeQuery(), "storage unavailable", watchdog.dialect.ExecutionDelay(time.Hour), "due")
+	require.NoError(t, postpone.Error)
+	assert.Equal(t, []string{"later"}, dueRequestIDs(t, watchdog.dbConn, watchdog.dialect))
+
+	var postponed SQLConsistencyRecord
+	require.NoError(t, watchdog.dbConn.Where("request_id = ?", "due").First(&postponed).Error)
+	assert.Equal(t, "storage unavailable", postponed.Error)
+}
+
+func checkLocking(t *testing.T, dialect Dialect, connect func() *gorm.DB) {
+	firstFeeder, secondFeeder := connect(), connect()
+	watchdog := &SQLWatchdog{dbConn: firstFeeder, dialect: dialect}
+	_, err := watchdog.Insert(conformanceRecord("locked", "bucket/key", 0, 0))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	firstTx := firstFeeder.Begin()
+	require.NoError(t, firstTx.Error)
+	require.Equal(t, []string{"locked"}, dueRequestIDs(t, firstTx, dialect))
+
+	// the second feeder may either skip locked records or wait for the first transaction
+	secondResult := make(chan []string, 1)
+	go func() {
+		secondTx := secondFeeder.Begin()
+		if secondTx.Error != nil {
+			secondResult <- []string{secondTx.Error.Error()}
+			return
+		}
+		var records []SQLConsistencyRecord
+		err := DueRecords(secondTx, dialect, 100).Find(&records).Error
+		requestIDs := []string{}
+		for _, record := range records {
+			requestIDs = append(requestIDs, strings.TrimSpace(record.RequestID))
+		}
+		if err != nil {
+			requestIDs = append(requestIDs, err.Error())
+		}
+		_ = secondTx.Commit()
+		secondResult <- requestIDs
+	}()
+
+	select {
+	case requestIDs := <-secondResult:
+		require.Empty(t, requestIDs, "records locked by a feeder were handed to another one")
+		require.NoError(t, firstTx.Exec(deleteRecords+supersededResourceRecords, "conformance.local", "bucket/key", ObjectOperation, 1<<62).Error)
+		require.NoError(t, firstTx.Commit().Error)
+	case <-time.After(200 * time.Millisecond):
+		require.NoError(t, firstTx.Exec(deleteRecords+supersededResourceRecords, "conformance.local", "bucket/key", ObjectOperation, 1<<62).Error)
+		require.NoError(t, firstTx.Commit().Error)
+		select {
+		case requestIDs := <-secondResult:
+			require.Empty(t, requestIDs, "records processed by a feeder were handed to another one")
+		case <-time.After(10 * time.Second):
+			t.Fatal("second feeder is still blocked after the first transaction ended")
+		}
+	}
+}
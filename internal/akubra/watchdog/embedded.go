@@ -0,0 +1,57 @@
+package watchdog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// EmbeddedWatchdogType is the type name of watchdog backed by a local SQLite file
+	EmbeddedWatchdogType = "embedded"
+	// EmbeddedPathProp is the watchdog property holding path to the database file
+	EmbeddedPathProp = "path"
+)
+
+// EmbeddedWatchdogFactory creates SQLWatchdogs keeping the log in a local SQLite file,
+// it's meant for single node and test deployments
+type EmbeddedWatchdogFactory struct {
+}
+
+// OpenEmbeddedDB opens (and creates if needed) the embedded consistency log database
+func OpenEmbeddedDB(path string) (*gorm.DB, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, fmt.Errorf("embedded consistency log requires '%s' property", EmbeddedPathProp)
+	}
+	dialect := &SQLiteDialect{}
+	db, err := gorm.Open(dialect.Name(), strings.Replace(dialect.ConnectionStringFormat(), ":path:", path, 1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open embedded consistency log '%s': %s", path, err)
+	}
+	// SQLite allows a single writer, serializing connections avoids busy errors within the process
+	db.DB().SetMaxOpenConns(1)
+	db.SetLogger(log.DefaultLogger)
+	for _, statement := range generatedMigrations[dialect.Name()] {
+		if err := db.Exec(statement).Error; err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to prepare embedded consistency log schema: %s", err)
+		}
+	}
+	return db, nil
+}
+
+// CreateWatchdogInstance creates instances of SQLWatchdog using SQLite dialect
+func (factory *EmbeddedWatchdogFactory) CreateWatchdogInstance(config *config.WatchdogConfig) (ConsistencyWatchdog, error) {
+	if strings.ToLower(config.Type) != EmbeddedWatchdogType {
+		return nil, fmt.Errorf("EmbeddedWatchdogFactory can't instantiate watchdog of type '%s'", config.Type)
+	}
+	db, err := OpenEmbeddedDB(config.Props[EmbeddedPathProp])
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("EmbeddedWatchdog setup successful, using %s", config.Props[EmbeddedPathProp])
+	return &SQLWatchdog{dbConn: db, versionHeaderName: config.ObjectVersionHeaderName, dialect: &SQLiteDialect{}}, nil
+}
@@ -0,0 +1,114 @@
+package watchdog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createEmbeddedWatchdog(t *testing.T) (*SQLWatchdog, func()) {
+	dir, err := ioutil.TempDir("", "embedded-watchdog")
+	require.NoError(t, err)
+	watchdogConfig := &config.WatchdogConfig{
+		Type:                    EmbeddedWatchdogType,
+		ObjectVersionHeaderName: "x-amz-meta-version",
+		Props:                   map[string]string{EmbeddedPathProp: filepath.Join(dir, "wal.db")},
+	}
+	watchdog, err := (&EmbeddedWatchdogFactory{}).CreateWatchdogInstance(watchdogConfig)
+	require.NoError(t, err)
+	embedded := watchdog.(*SQLWatchdog)
+	return embedded, func() {
+		_ = embedded.dbConn.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func countRecords(t *testing.T, watchdog *SQLWatchdog, objectID string) int {
+	var count int
+	require.NoError(t, watchdog.dbConn.Table("consistency_record").Where("object_id = ?", objectID).Count(&count).Error)
+	return count
+}
+
+func TestEmbeddedWatchdogShouldRefuseOtherWatchdogTypes(t *testing.T) {
+	_, err := (&EmbeddedWatchdogFactory{}).CreateWatchdogInstance(&config.WatchdogConfig{Type: "sql"})
+	assert.Error(t, err)
+	_, err = (&EmbeddedWatchdogFactory{}).CreateWatchdogInstance(&config.WatchdogConfig{Type: EmbeddedWatchdogType})
+	assert.Error(t, err)
+}
+
+func TestEmbeddedWatchdogShouldGenerateIncreasingVersions(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+
+	previousVersion := 0
+	for i := 0; i < 100; i++ {
+		record := &ConsistencyRecord{
+			RequestID:      time.Now().String() + string(rune('a'+i%26)) + string(rune('a'+i/26)),
+			ObjectID:       "bucket/key",
+			AccessKey:      "access",
+			ExecutionDelay: fiveMinutes,
+			Domain:         "local.qxlint",
+			Method:         PUT,
+		}
+		marker, err := watchdog.Insert(record)
+		require.NoError(t, err)
+		assert.True(t, marker.objectVersion > previousVersion)
+		assert.Equal(t, marker.objectVersion, record.ObjectVersion)
+		previousVersion = marker.objectVersion
+	}
+
+	supplied := &ConsistencyRecord{RequestID: "supplied"}
+	require.NoError(t, watchdog.SupplyRecordWithVersion(supplied))
+	assert.True(t, supplied.ObjectVersion > previousVersion)
+}
+
+func TestEmbeddedWatchdogShouldInsertRecordWithSuppliedVersionAndDeleteOlderRecords(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+
+	first := &ConsistencyRecord{RequestID: "1", ObjectID: "bucket/key", AccessKey: "access", ExecutionDelay: fiveMinutes, Domain: "local", Method: PUT, ObjectVersion: 10}
+	second := &ConsistencyRecord{RequestID: "2", ObjectID: "bucket/key", AccessKey: "access", ExecutionDelay: fiveMinutes, Domain: "local", Method: DELETE, ObjectVersion: 20}
+	other := &ConsistencyRecord{RequestID: "3", ObjectID: "bucket/other", AccessKey: "access", ExecutionDelay: fiveMinutes, Domain: "local", Method: PUT, ObjectVersion: 5}
+
+	firstMarker, err := watchdog.Insert(first)
+	require.NoError(t, err)
+	assert.Equal(t, 10, firstMarker.objectVersion)
+	_, err = watchdog.Insert(second)
+	require.NoError(t, err)
+	_, err = watchdog.Insert(other)
+	require.NoError(t, err)
+
+	_, err = watchdog.Insert(&ConsistencyRecord{RequestID: "4", ObjectID: "bucket/key", Domain: "local", Method: PUT, ObjectVersion: 10})
+	assert.Equal(t, ErrDataBase, err)
+
+	require.NoError(t, watchdog.Delete(firstMarker))
+	assert.Equal(t, 1, countRecords(t, watchdog, "bucket/key"))
+	assert.Equal(t, 1, countRecords(t, watchdog, "bucket/other"))
+
+	require.NoError(t, watchdog.Delete(&DeleteMarker{domain: "local", objectID: "bucket/key", operation: ObjectOperation, objectVersion: 20}))
+	assert.Equal(t, 0, countRecords(t, watchdog, "bucket/key"))
+}
+
+func TestEmbeddedWatchdogShouldUpdateExecutionDelay(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+
+	record := &ConsistencyRecord{RequestID: "1", ObjectID: "bucket/key", AccessKey: "access", ExecutionDelay: oneWeek, Domain: "local", Method: PUT}
+	_, err := watchdog.Insert(record)
+	require.NoError(t, err)
+
+	var due int
+	dueQuery := watchdog.dbConn.Table("consistency_record").Where(watchdog.dialect.DueCondition())
+	require.NoError(t, dueQuery.Count(&due).Error)
+	assert.Equal(t, 0, due)
+
+	require.NoError(t, watchdog.UpdateExecutionDelay(&ExecutionDelay{RequestID: "1", Delay: 0}))
+	require.NoError(t, dueQuery.Count(&due).Error)
+	assert.Equal(t, 1, due)
+}
@@ -0,0 +1,65 @@
+//go:build ignore
+// +build ignore
+
+// gen_migrations translates db-migrations/migration.sql to the supported
+// dialects, run it with go generate
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+)
+
+const migrationsDir = "../../../db-migrations"
+
+func main() {
+	source, err := ioutil.ReadFile(filepath.Join(migrationsDir, "migration.sql"))
+	if err != nil {
+		log.Fatalf("failed to read migration: %s", err)
+	}
+
+	code := &bytes.Buffer{}
+	fmt.Fprint(code, "// Code generated by gen_migrations.go; DO NOT EDIT.\n\npackage watchdog\n\n")
+	fmt.Fprint(code, "// generatedMigrations holds db-migrations/migration.sql translated to supported dialects\n")
+	fmt.Fprint(code, "var generatedMigrations = map[string][]string{\n")
+	for _, dialect := range config.SQLDialects {
+		statements, err := watchdog.GenerateMigration(string(source), dialect)
+		if err != nil {
+			log.Fatalf("failed to generate %s migration: %s", dialect, err)
+		}
+		fmt.Fprintf(code, "%q: {\n", dialect)
+		for _, statement := range statements {
+			fmt.Fprintf(code, "`%s`,\n", statement)
+		}
+		fmt.Fprint(code, "},\n")
+
+		if dialect == config.PostgresDialect {
+			continue
+		}
+		dialectDir := filepath.Join(migrationsDir, dialect)
+		if err := os.MkdirAll(dialectDir, 0755); err != nil {
+			log.Fatalf("failed to create %s: %s", dialectDir, err)
+		}
+		migration := []byte(watchdog.RenderMigration(statements))
+		if err := ioutil.WriteFile(filepath.Join(dialectDir, "migration.sql"), migration, 0644); err != nil {
+			log.Fatalf("failed to write %s migration: %s", dialect, err)
+		}
+	}
+	fmt.Fprint(code, "}\n")
+
+	formatted, err := format.Source(code.Bytes())
+	if err != nil {
+		log.Fatalf("failed to format generated code: %s", err)
+	}
+	if err := ioutil.WriteFile("migrations_generated.go", formatted, 0644); err != nil {
+		log.Fatalf("failed to write generated code: %s", err)
+	}
+}
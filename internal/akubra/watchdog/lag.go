@@ -0,0 +1,153 @@
+package watchdog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+)
+
+// ReplicationLag summarizes how far behind the replication of the consistency log is
+type ReplicationLag struct {
+	// Pending is the number of records in the log
+	Pending int64
+	// Due is the number of records past their execution delay
+	Due int64
+	// OldestDueAge is the age of the oldest due record, zero when none is due
+	OldestDueAge time.Duration
+	// Errors counts records which failed at least once
+	Errors []*ErrorCount
+}
+
+// ErrorCount is the number of failed records of a domain and method
+type ErrorCount struct {
+	Domain string `gorm:"column:domain"`
+	Method string `gorm:"column:method"`
+	Count  int64  `gorm:"column:count"`
+}
+
+// LagReporter periodically exports ReplicationLag of a consistency log as metrics gauges
+type LagReporter struct {
+	consistencyLog *ConsistencyLog
+	interval       time.Duration
+	errorGauges    map[string]bool
+	stop           chan struct{}
+	stopped        chan struct{}
+	// ownsLog is set when the reporter opened the log and closes it on Stop
+	ownsLog bool
+}
+
+// ReplicationLag computes the lag of the records in the log
+func (consistencyLog *ConsistencyLog) ReplicationLag(now time.Time) (*ReplicationLag, error) {
+	lag := &ReplicationLag{}
+	records := consistencyLog.db.Model(&SQLConsistencyRecord{})
+	if err := records.Count(&lag.Pending).Error; err != nil {
+		return nil, err
+	}
+	dueRecords := records.Where(consistencyLog.dialect.DueCondition())
+	if err := dueRecords.Count(&lag.Due).Error; err != nil {
+		return nil, err
+	}
+	if lag.Due > 0 {
+		var oldest SQLConsistencyRecord
+		if err := dueRecords.Select("inserted_at").Order("inserted_at ASC").Limit(1).Scan(&oldest).Error; err != nil {
+			return nil, err
+		}
+		lag.OldestDueAge = now.Sub(oldest.InsertedAt)
+	}
+	err := records.
+		Select("domain, method, COUNT(*) AS count").
+		Where("error <> ''").
+		Group("domain, method").
+		Order("domain, method").
+		Scan(&lag.Errors).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return lag, nil
+}
+
+// NewLagReporter creates a LagReporter exporting every interval
+func NewLagReporter(consistencyLog *ConsistencyLog, interval time.Duration) *LagReporter {
+	return &LagReporter{
+		consistencyLog: consistencyLog,
+		interval:       interval,
+		errorGauges:    make(map[string]bool),
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+}
+
+// StartLagReporter starts reporting the lag of the configured consistency log, it
+// returns nil if LagMetricsInterval is not set
+func StartLagReporter(watchdogConfig *config.WatchdogConfig) (*LagReporter, error) {
+	if watchdogConfig.LagMetricsInterval <= 0 {
+		return nil, nil
+	}
+	consistencyLog, err := OpenConsistencyLog(watchdogConfig)
+	if err != nil {
+		return nil, err
+	}
+	reporter := NewLagReporter(consistencyLog, watchdogConfig.LagMetricsInterval)
+	reporter.ownsLog = true
+	reporter.Start()
+	return reporter, nil
+}
+
+// Start exports the lag in the background until Stop is called
+func (reporter *LagReporter) Start() {
+	go func() {
+		defer close(reporter.stopped)
+		ticker := time.NewTicker(reporter.interval)
+		defer ticker.Stop()
+		for {
+			reporter.Report()
+			select {
+			case <-reporter.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the reporting and closes the log opened by StartLagReporter
+func (reporter *LagReporter) Stop() {
+	close(reporter.stop)
+	<-reporter.stopped
+	if reporter.ownsLog {
+		_ = reporter.consistencyLog.Close()
+	}
+}
+
+// Report computes and exports the lag once
+func (reporter *LagReporter) Report() {
+	queryStartTime := time.Now()
+	lag, err := reporter.consistencyLog.ReplicationLag(time.Now().UTC())
+	if err != nil {
+		metrics.UpdateSince("watchdog.lag.query.err", queryStartTime)
+		log.Printf("[watchdog] failed to compute replication lag: %s", err)
+		return
+	}
+	metrics.UpdateSince("watchdog.lag.query.ok", queryStartTime)
+	metrics.UpdateGauge("watchdog.lag.pending", lag.Pending)
+	metrics.UpdateGauge("watchdog.lag.due", lag.Due)
+	metrics.UpdateGauge("watchdog.lag.oldest_due_seconds", int64(lag.OldestDueAge/time.Second))
+
+	// gauges of domains which recovered are zeroed, not left at the last error count
+	reported := make(map[string]bool, len(lag.Errors))
+	for _, errorCount := range lag.Errors {
+		name := fmt.Sprintf("watchdog.lag.errors.%s.%s", metrics.Clean(errorCount.Domain), errorCount.Method)
+		metrics.UpdateGauge(name, errorCount.Count)
+		reported[name] = true
+	}
+	for name := range reporter.errorGauges {
+		if !reported[name] {
+			metrics.UpdateGauge(name, 0)
+		}
+	}
+	reporter.errorGauges = reported
+}
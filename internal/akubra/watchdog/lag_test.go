@@ -0,0 +1,49 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldComputeReplicationLag(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+	consistencyLog := NewConsistencyLog(watchdog.dbConn, watchdog.dialect)
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, record := range []*SQLConsistencyRecord{
+		{ObjectID: "bucket/due", Method: "PUT", Domain: "a.qxlint", InsertedAt: now.Add(-2 * time.Hour), Error: "500 Internal Server Error"},
+		{ObjectID: "bucket/due-later", Method: "DELETE", Domain: "a.qxlint", InsertedAt: now.Add(-time.Hour)},
+		{ObjectID: "bucket/pending", Method: "PUT", Domain: "b.qxlint", InsertedAt: now, Error: "403 Forbidden"},
+	} {
+		record.ObjectVersion = i + 1
+		record.RequestID = record.ObjectID
+		record.ExecutionDelay = "300"
+		record.UpdatedAt = record.InsertedAt
+		require.NoError(t, consistencyLog.Import(record))
+	}
+
+	lag, err := consistencyLog.ReplicationLag(now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), lag.Pending)
+	assert.Equal(t, int64(2), lag.Due)
+	assert.Equal(t, 2*time.Hour, lag.OldestDueAge)
+	assert.Equal(t, []*ErrorCount{
+		{Domain: "a.qxlint", Method: "PUT", Count: 1},
+		{Domain: "b.qxlint", Method: "PUT", Count: 1},
+	}, lag.Errors)
+}
+
+func TestShouldReportNoLagOfEmptyLog(t *testing.T) {
+	watchdog, cleanup := createEmbeddedWatchdog(t)
+	defer cleanup()
+
+	lag, err := NewConsistencyLog(watchdog.dbConn, watchdog.dialect).ReplicationLag(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), lag.Pending)
+	assert.Equal(t, int64(0), lag.Due)
+	assert.Equal(t, time.Duration(0), lag.OldestDueAge)
+	assert.Empty(t, lag.Errors)
+}
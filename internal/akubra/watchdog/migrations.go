@@ -0,0 +1,189 @@
+package watchdog
+
+//go:generate go run gen_migrations.go
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+)
+
+// typeRule translates a PostgreSQL column type
+type typeRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// migrationRules describe how a dialect differs from db-migrations/migration.sql
+type migrationRules struct {
+	types         []typeRule
+	defaults      map[string]string
+	indexPrefixes map[string]int
+	ifNotExists   bool
+}
+
+var (
+	postgresVersionDefault   = "EXTRACT(EPOCH FROM CURRENT_TIMESTAMP at time zone 'utc') * 10^6"
+	postgresTimestampDefault = "(CURRENT_TIMESTAMP at time zone 'utc')"
+
+	createTablePattern = regexp.MustCompile(`(?s)^CREATE TABLE (\w+)\s*\((.*)\)$`)
+	columnPattern      = regexp.MustCompile(`(?s)^(\w+)\s+(BIGINT|CHARACTER VARYING\(\d+\)|CHARACTER\(\d+\)|INTERVAL|TIMESTAMPTZ)\s*(.*)$`)
+	createIndexPattern = regexp.MustCompile(`(?s)^CREATE (UNIQUE )?INDEX (\w+)\s+ON (\w+)\s+(?:USING \w+\s*)?\((.*)\)$`)
+
+	dialectMigrationRules = map[string]migrationRules{
+		config.MySQLDialect: {
+			types: []typeRule{
+				{regexp.MustCompile(`^BIGINT$`), "BIGINT"},
+				{regexp.MustCompile(`^CHARACTER VARYING\((\d+)\)$`), "VARCHAR($1)"},
+				{regexp.MustCompile(`^CHARACTER\((\d+)\)$`), "CHAR($1)"},
+				{regexp.MustCompile(`^INTERVAL$`), "BIGINT"},
+				{regexp.MustCompile(`^TIMESTAMPTZ$`), "DATETIME(6)"},
+			},
+			defaults: map[string]string{
+				postgresVersionDefault:   "(CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000 AS SIGNED))",
+				postgresTimestampDefault: "(UTC_TIMESTAMP(6))",
+			},
+			// InnoDB keys are limited to 3072 bytes
+			indexPrefixes: map[string]int{"object_id": 500},
+		},
+		config.SQLiteDialect: {
+			types: []typeRule{
+				{regexp.MustCompile(`^BIGINT$`), "INTEGER"},
+				{regexp.MustCompile(`^CHARACTER VARYING\(\d+\)$`), "TEXT"},
+				{regexp.MustCompile(`^CHARACTER\(\d+\)$`), "TEXT"},
+				{regexp.MustCompile(`^INTERVAL$`), "INTEGER"},
+				{regexp.MustCompile(`^TIMESTAMPTZ$`), "TIMESTAMP"},
+			},
+			defaults: map[string]string{
+				postgresVersionDefault:   "(CAST(ROUND((julianday('now') - 2440587.5) * 86400000) AS INTEGER) * 1000)",
+				postgresTimestampDefault: "CURRENT_TIMESTAMP",
+			},
+			ifNotExists: true,
+		},
+	}
+)
+
+// GenerateMigration translates db-migrations/migration.sql, written for
+// PostgreSQL, to statements of the given dialect
+func GenerateMigration(postgresMigration string, dialect string) ([]string, error) {
+	statements := splitStatements(postgresMigration)
+	if dialect == config.PostgresDialect {
+		return statements, nil
+	}
+	rules, ok := dialectMigrationRules[dialect]
+	if !ok {
+		return nil, fmt.Errorf("no migration rules for dialect '%s'", dialect)
+	}
+	translated := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		var err error
+		switch {
+		case createTablePattern.MatchString(statement):
+			statement, err = rules.translateTable(statement)
+		case createIndexPattern.MatchString(statement):
+			statement = rules.translateIndex(statement)
+		default:
+			err = fmt.Errorf("unsupported statement '%s'", statement)
+		}
+		if err != nil {
+			return nil, err
+		}
+		translated = append(translated, statement)
+	}
+	return translated, nil
+}
+
+func (rules migrationRules) translateTable(statement string) (string, error) {
+	match := createTablePattern.FindStringSubmatch(statement)
+	columns := make([]string, 0)
+	for _, column := range splitTopLevel(match[2]) {
+		columnMatch := columnPattern.FindStringSubmatch(column)
+		if columnMatch == nil {
+			return "", fmt.Errorf("unsupported column definition '%s'", column)
+		}
+		columnType, err := rules.translateType(columnMatch[2])
+		if err != nil {
+			return "", err
+		}
+		constraints := columnMatch[3]
+		if idx := strings.Index(constraints, "DEFAULT "); idx >= 0 {
+			postgresDefault := strings.TrimSpace(constraints[idx+len("DEFAULT "):])
+			columnDefault, translated := rules.defaults[postgresDefault]
+			if !translated {
+				columnDefault = postgresDefault
+			}
+			constraints = strings.TrimSpace(constraints[:idx]) + " DEFAULT " + columnDefault
+		}
+		columns = append(columns, strings.TrimSpace(fmt.Sprintf("  %s %s %s", columnMatch[1], columnType, strings.TrimSpace(constraints))))
+	}
+	return fmt.Sprintf("CREATE TABLE %s%s\n(\n  %s\n)", rules.ifNotExistsClause(), match[1], strings.Join(columns, ",\n  ")), nil
+}
+
+func (rules migrationRules) translateType(postgresType string) (string, error) {
+	for _, rule := range rules.types {
+		if rule.pattern.MatchString(postgresType) {
+			return rule.pattern.ReplaceAllString(postgresType, rule.replacement), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported column type '%s'", postgresType)
+}
+
+func (rules migrationRules) translateIndex(statement string) string {
+	match := createIndexPattern.FindStringSubmatch(statement)
+	columns := make([]string, 0)
+	for _, column := range splitTopLevel(match[4]) {
+		fields := strings.Fields(column)
+		if prefix, ok := rules.indexPrefixes[fields[0]]; ok {
+			fields[0] = fmt.Sprintf("%s(%d)", fields[0], prefix)
+		}
+		columns = append(columns, strings.Join(fields, " "))
+	}
+	return fmt.Sprintf("CREATE %sINDEX %s%s\n  ON %s (%s)", match[1], rules.ifNotExistsClause(), match[2], match[3], strings.Join(columns, ", "))
+}
+
+func (rules migrationRules) ifNotExistsClause() string {
+	if rules.ifNotExists {
+		return "IF NOT EXISTS "
+	}
+	return ""
+}
+
+// RenderMigration joins statements into a migration file
+func RenderMigration(statements []string) string {
+	return strings.Join(statements, ";\n\n") + ";\n"
+}
+
+func splitStatements(migration string) []string {
+	statements := make([]string, 0)
+	for _, statement := range strings.Split(migration, ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// splitTopLevel splits by commas which are not enclosed in parentheses
+func splitTopLevel(list string) []string {
+	parts := make([]string, 0)
+	depth, start := 0, 0
+	for idx, char := range list {
+		switch char {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(list[start:idx]))
+				start = idx + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(list[start:]); last != "" {
+		parts = append(parts, last)
+	}
+	return parts
+}
@@ -0,0 +1,137 @@
+// Code generated by gen_migrations.go; DO NOT EDIT.
+
+package watchdog
+
+// generatedMigrations holds db-migrations/migration.sql translated to supported dialects
+var generatedMigrations = map[string][]string{
+	"postgres": {
+		`CREATE TABLE consistency_record
+(
+  object_version  BIGINT                  NOT NULL DEFAULT EXTRACT(EPOCH FROM CURRENT_TIMESTAMP at time zone 'utc') * 10^6,
+  request_id      CHARACTER(36) PRIMARY KEY,
+  object_id       CHARACTER VARYING(1024) NOT NULL,
+  method          CHARACTER VARYING(8)    NOT NULL,
+  domain          CHARACTER VARYING(254)  NOT NULL,
+  access_key      CHARACTER VARYING(128)  NOT NULL,
+  execution_delay INTERVAL                NOT NULL,
+  inserted_at     TIMESTAMPTZ             NOT NULL DEFAULT (CURRENT_TIMESTAMP at time zone 'utc'),
+  updated_at      TIMESTAMPTZ             NOT NULL DEFAULT (CURRENT_TIMESTAMP at time zone 'utc'),
+  error           CHARACTER VARYING(1024)          DEFAULT '',
+  operation       CHARACTER VARYING(8)    NOT NULL DEFAULT 'object',
+  sub_resource    CHARACTER VARYING(16)   NOT NULL DEFAULT '',
+  attempts        BIGINT                  NOT NULL DEFAULT 0
+)`,
+		`CREATE UNIQUE INDEX consistency_record__domain__object_id__inserted_at
+  ON consistency_record
+    USING btree (domain, object_id, object_version)`,
+		`CREATE INDEX consistency_record__request_id
+  ON consistency_record
+    USING btree (request_id)`,
+		`CREATE INDEX consistency_record__inserted_at
+  ON consistency_record
+    USING btree (object_version DESC)`,
+		`CREATE TABLE consistency_dead_letter
+(
+  request_id       CHARACTER(36) PRIMARY KEY,
+  object_version   BIGINT                  NOT NULL,
+  object_id        CHARACTER VARYING(1024) NOT NULL,
+  method           CHARACTER VARYING(8)    NOT NULL,
+  domain           CHARACTER VARYING(254)  NOT NULL,
+  access_key       CHARACTER VARYING(128)  NOT NULL,
+  operation        CHARACTER VARYING(8)    NOT NULL DEFAULT 'object',
+  sub_resource     CHARACTER VARYING(16)   NOT NULL DEFAULT '',
+  attempts         BIGINT                  NOT NULL DEFAULT 0,
+  error            CHARACTER VARYING(1024) NOT NULL DEFAULT '',
+  error_class      CHARACTER VARYING(32)   NOT NULL DEFAULT '',
+  backend          CHARACTER VARYING(254)  NOT NULL DEFAULT '',
+  dead_lettered_at TIMESTAMPTZ             NOT NULL DEFAULT (CURRENT_TIMESTAMP at time zone 'utc')
+)`,
+		`CREATE INDEX consistency_dead_letter__domain__object_id
+  ON consistency_dead_letter
+    USING btree (domain, object_id)`,
+	},
+	"mysql": {
+		`CREATE TABLE consistency_record
+(
+  object_version BIGINT NOT NULL DEFAULT (CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000 AS SIGNED)),
+  request_id CHAR(36) PRIMARY KEY,
+  object_id VARCHAR(1024) NOT NULL,
+  method VARCHAR(8) NOT NULL,
+  domain VARCHAR(254) NOT NULL,
+  access_key VARCHAR(128) NOT NULL,
+  execution_delay BIGINT NOT NULL,
+  inserted_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+  updated_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6)),
+  error VARCHAR(1024) DEFAULT '',
+  operation VARCHAR(8) NOT NULL DEFAULT 'object',
+  sub_resource VARCHAR(16) NOT NULL DEFAULT '',
+  attempts BIGINT NOT NULL DEFAULT 0
+)`,
+		`CREATE UNIQUE INDEX consistency_record__domain__object_id__inserted_at
+  ON consistency_record (domain, object_id(500), object_version)`,
+		`CREATE INDEX consistency_record__request_id
+  ON consistency_record (request_id)`,
+		`CREATE INDEX consistency_record__inserted_at
+  ON consistency_record (object_version DESC)`,
+		`CREATE TABLE consistency_dead_letter
+(
+  request_id CHAR(36) PRIMARY KEY,
+  object_version BIGINT NOT NULL,
+  object_id VARCHAR(1024) NOT NULL,
+  method VARCHAR(8) NOT NULL,
+  domain VARCHAR(254) NOT NULL,
+  access_key VARCHAR(128) NOT NULL,
+  operation VARCHAR(8) NOT NULL DEFAULT 'object',
+  sub_resource VARCHAR(16) NOT NULL DEFAULT '',
+  attempts BIGINT NOT NULL DEFAULT 0,
+  error VARCHAR(1024) NOT NULL DEFAULT '',
+  error_class VARCHAR(32) NOT NULL DEFAULT '',
+  backend VARCHAR(254) NOT NULL DEFAULT '',
+  dead_lettered_at DATETIME(6) NOT NULL DEFAULT (UTC_TIMESTAMP(6))
+)`,
+		`CREATE INDEX consistency_dead_letter__domain__object_id
+  ON consistency_dead_letter (domain, object_id(500))`,
+	},
+	"sqlite3": {
+		`CREATE TABLE IF NOT EXISTS consistency_record
+(
+  object_version INTEGER NOT NULL DEFAULT (CAST(ROUND((julianday('now') - 2440587.5) * 86400000) AS INTEGER) * 1000),
+  request_id TEXT PRIMARY KEY,
+  object_id TEXT NOT NULL,
+  method TEXT NOT NULL,
+  domain TEXT NOT NULL,
+  access_key TEXT NOT NULL,
+  execution_delay INTEGER NOT NULL,
+  inserted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  error TEXT DEFAULT '',
+  operation TEXT NOT NULL DEFAULT 'object',
+  sub_resource TEXT NOT NULL DEFAULT '',
+  attempts INTEGER NOT NULL DEFAULT 0
+)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS consistency_record__domain__object_id__inserted_at
+  ON consistency_record (domain, object_id, object_version)`,
+		`CREATE INDEX IF NOT EXISTS consistency_record__request_id
+  ON consistency_record (request_id)`,
+		`CREATE INDEX IF NOT EXISTS consistency_record__inserted_at
+  ON consistency_record (object_version DESC)`,
+		`CREATE TABLE IF NOT EXISTS consistency_dead_letter
+(
+  request_id TEXT PRIMARY KEY,
+  object_version INTEGER NOT NULL,
+  object_id TEXT NOT NULL,
+  method TEXT NOT NULL,
+  domain TEXT NOT NULL,
+  access_key TEXT NOT NULL,
+  operation TEXT NOT NULL DEFAULT 'object',
+  sub_resource TEXT NOT NULL DEFAULT '',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '',
+  error_class TEXT NOT NULL DEFAULT '',
+  backend TEXT NOT NULL DEFAULT '',
+  dead_lettered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+		`CREATE INDEX IF NOT EXISTS consistency_dead_letter__domain__object_id
+  ON consistency_dead_letter (domain, object_id)`,
+	},
+}
@@ -0,0 +1,35 @@
+package watchdog
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratedMigrationsAreUpToDate(t *testing.T) {
+	source, err := ioutil.ReadFile("../../../db-migrations/migration.sql")
+	require.NoError(t, err)
+
+	for _, dialect := range config.SQLDialects {
+		statements, err := GenerateMigration(string(source), dialect)
+		require.NoError(t, err)
+		assert.Equal(t, statements, generatedMigrations[dialect], "run go generate after changing db-migrations/migration.sql")
+		if dialect == config.PostgresDialect {
+			continue
+		}
+		migration, err := ioutil.ReadFile(filepath.Join("../../../db-migrations", dialect, "migration.sql"))
+		require.NoError(t, err)
+		assert.Equal(t, RenderMigration(statements), string(migration), "run go generate after changing db-migrations/migration.sql")
+	}
+}
+
+func TestGenerateMigrationShouldRejectUnknownColumnTypes(t *testing.T) {
+	_, err := GenerateMigration("CREATE TABLE t (id UUID PRIMARY KEY)", config.MySQLDialect)
+	assert.Error(t, err)
+	_, err = GenerateMigration("CREATE TABLE t (id BIGINT)", "oracle")
+	assert.Error(t, err)
+}
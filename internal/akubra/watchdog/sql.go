@@ -1,11 +1,11 @@
 package watchdog
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/allegro/akubra/internal/akubra/watchdog/config"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/allegro/akubra/internal/akubra/database"
@@ -15,13 +15,6 @@ import (
 )
 
 const (
-	insertNew                        = "INSERT INTO consistency_record (request_id, object_id, domain, access_key, execution_delay, method) VALUES (?, ?, ?, ?, ?, ?) RETURNING object_version"
-	insertNewWithObjectVersion       = "INSERT INTO consistency_record (object_version, request_id, object_id, domain, access_key, execution_delay, method) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING object_version"
-	selectNow                        = "SELECT CAST(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP at time zone 'utc') * 10^6 AS BIGINT)"
-	deleteMarkersInsertedEalier      = "DELETE FROM consistency_record WHERE domain = ? AND object_id = ? AND object_version <= ?"
-	updateRecordExecutionTimeByReqID = "UPDATE consistency_record " +
-		"SET execution_delay = ?" +
-		"WHERE request_id = ?"
 	//Reader turns on reader config generation
 	Reader = true
 	//Writer turn on writer config generation
@@ -31,12 +24,15 @@ const (
 // SQLWatchdogFactory creates instances of SQLWatchdog
 type SQLWatchdogFactory struct {
 	dbClientFactory database.DBClientFactory
+	dialect         Dialect
 }
 
 // SQLWatchdog is a type of ConsistencyWatchdog that uses a SQL database
 type SQLWatchdog struct {
 	dbConn            *gorm.DB
 	versionHeaderName string
+	dialect           Dialect
+	versions          versionClock
 }
 
 // ErrDataBase indicates a database errors
@@ -44,16 +40,19 @@ var ErrDataBase = errors.New("database error")
 
 // SQLConsistencyRecord is a SQL representation of ConsistencyRecord
 type SQLConsistencyRecord struct {
-	ObjectVersion  int       `gorm:"column:object_version;default:EXTRACT(EPOCH FROM CURRENT_TIMESTAMP at time zone 'utc') * 10^6"`
-	InsertedAt     time.Time `gorm:"column:inserted_at"`
-	UpdatedAt      time.Time `gorm:"column:updated_at"`
-	ObjectID       string    `gorm:"column:object_id"`
-	Method         string    `gorm:"column:method"`
-	Domain         string    `gorm:"column:domain"`
-	AccessKey      string    `gorm:"column:access_key"`
-	ExecutionDelay string    `gorm:"column:execution_delay"`
-	RequestID      string    `gorm:"column:request_id"`
-	Error          string    `gorm:"column:error"`
+	ObjectVersion  int       `gorm:"column:object_version;default:EXTRACT(EPOCH FROM CURRENT_TIMESTAMP at time zone 'utc') * 10^6" json:"object_version"`
+	InsertedAt     time.Time `gorm:"column:inserted_at" json:"inserted_at"`
+	UpdatedAt      time.Time `gorm:"column:updated_at" json:"updated_at"`
+	ObjectID       string    `gorm:"column:object_id" json:"object_id"`
+	Method         string    `gorm:"column:method" json:"method"`
+	Domain         string    `gorm:"column:domain" json:"domain"`
+	AccessKey      string    `gorm:"column:access_key" json:"access_key"`
+	ExecutionDelay string    `gorm:"column:execution_delay" json:"execution_delay"`
+	RequestID      string    `gorm:"column:request_id" json:"request_id"`
+	Error          string    `gorm:"column:error" json:"error"`
+	Operation      string    `gorm:"column:operation" json:"operation"`
+	SubResource    string    `gorm:"column:sub_resource" json:"sub_resource"`
+	Attempts       int       `gorm:"column:attempts" json:"attempts"`
 }
 
 //TableName provides the table name for consistency_record
@@ -69,6 +68,7 @@ var sqlParams = map[string]string{
 	"port":            "port",
 	"conntimeout":     "conntimeout",
 	"connmaxlifetime": "connmaxlifetime",
+	"path":            "path",
 }
 
 var configurableSQLParams = map[string]string{
@@ -77,18 +77,19 @@ var configurableSQLParams = map[string]string{
 }
 
 // CreateSQLWatchdogFactory creates instances of SQLWatchdogFactory
-func CreateSQLWatchdogFactory(dbClientFactory *database.GORMDBClientFactory) ConsistencyWatchdogFactory {
-	return &SQLWatchdogFactory{dbClientFactory: dbClientFactory}
+func CreateSQLWatchdogFactory(dbClientFactory database.DBClientFactory, dialect Dialect) ConsistencyWatchdogFactory {
+	return &SQLWatchdogFactory{dbClientFactory: dbClientFactory, dialect: dialect}
 }
 
-// CreateSQL creates ConsistencyWatchdog and ConsistencyRecordFactory that make use of a SQL database
-func CreateSQL(dialect, connStringFormat string, params []string, watchdogConfig *config.WatchdogConfig) (ConsistencyWatchdog, error) {
-	sqlWatchdogFactory := CreateSQLWatchdogFactory(database.NewDBClientFactory(dialect, connStringFormat, params))
-	watchdog, err := sqlWatchdogFactory.CreateWatchdogInstance(watchdogConfig)
+// CreateSQL creates ConsistencyWatchdog and ConsistencyRecordFactory that make use of a SQL database,
+// the database is picked by the 'dialect' property
+func CreateSQL(watchdogConfig *config.WatchdogConfig) (ConsistencyWatchdog, error) {
+	dialect, err := DialectFor(watchdogConfig.Props["dialect"])
 	if err != nil {
 		return nil, err
 	}
-	return watchdog, nil
+	dbClientFactory := database.NewDBClientFactory(dialect.Name(), dialect.ConnectionStringFormat(), dialect.ConnectionStringArgs())
+	return CreateSQLWatchdogFactory(dbClientFactory, dialect).CreateWatchdogInstance(watchdogConfig)
 }
 
 // CreateWatchdogInstance creates instances of SQLWatchdog
@@ -101,9 +102,9 @@ func (factory *SQLWatchdogFactory) CreateWatchdogInstance(config *config.Watchdo
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("SQLWatchdog watcher setup successful")
+	log.Printf("SQLWatchdog watcher setup successful, using %s dialect", factory.dialect.Name())
 
-	return &SQLWatchdog{dbConn: db, versionHeaderName: config.ObjectVersionHeaderName}, nil
+	return &SQLWatchdog{dbConn: db, versionHeaderName: config.ObjectVersionHeaderName, dialect: factory.dialect}, nil
 }
 
 // Insert inserts to SQL db
@@ -112,22 +113,12 @@ func (watchdog *SQLWatchdog) Insert(record *ConsistencyRecord) (*DeleteMarker, e
 
 	queryStartTime := time.Now()
 
-	var rows *sql.Rows
+	var objVersion int
 	var err error
-	if record.ObjectVersion > 0 {
-
-		rows, err = watchdog.
-			dbConn.
-			Raw(insertNewWithObjectVersion, record.ObjectVersion, record.RequestID, record.ObjectID, record.Domain, record.AccessKey, record.ExecutionDelay.String(), record.Method).
-			Rows()
-
+	if record.ObjectVersion <= 0 && watchdog.dialect.InsertReturningVersionQuery() != "" {
+		objVersion, err = watchdog.insertReturningVersion(record)
 	} else {
-
-		rows, err = watchdog.
-			dbConn.
-			Raw(insertNew, record.RequestID, record.ObjectID, record.Domain, record.AccessKey, record.ExecutionDelay.String(), record.Method).
-			Rows()
-
+		objVersion, err = watchdog.insertWithVersion(record)
 	}
 
 	if err != nil {
@@ -136,29 +127,49 @@ func (watchdog *SQLWatchdog) Insert(record *ConsistencyRecord) (*DeleteMarker, e
 		return nil, ErrDataBase
 	}
 
-	defer rows.Close()
 	metrics.UpdateSince("watchdog.insert.ok", queryStartTime)
 
+	log.Debugf("[watchdog] INSERT OK reqID %s, objID %s, domain %s, version %d", record.RequestID, record.ObjectID, record.Domain, objVersion)
+	record.ObjectVersion = objVersion
+	return DeleteMarkerFor(record), nil
+}
+
+func (watchdog *SQLWatchdog) insertReturningVersion(record *ConsistencyRecord) (int, error) {
+	rows, err := watchdog.
+		dbConn.
+		Raw(watchdog.dialect.InsertReturningVersionQuery(), record.RequestID, record.ObjectID, record.Domain, record.AccessKey,
+			watchdog.dialect.ExecutionDelay(record.ExecutionDelay), record.Method, record.OperationOrDefault(), record.SubResource).
+		Rows()
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
 	if !rows.Next() {
-		return nil, ErrDataBase
+		return 0, errors.New("no version returned")
 	}
 
 	var objVersion int
 	err = rows.Scan(&objVersion)
-	if err != nil {
-		return nil, ErrDataBase
-	}
+	return objVersion, err
+}
 
-	log.Debugf("[watchdog] INSERT OK reqID %s, objID %s, domain %s, version %d", record.RequestID, record.ObjectID, record.Domain, objVersion)
-	record.ObjectVersion = objVersion
-	return &DeleteMarker{
-		objectID:      record.ObjectID,
-		domain:        record.Domain,
-		objectVersion: objVersion,
-	}, nil
+func (watchdog *SQLWatchdog) insertWithVersion(record *ConsistencyRecord) (int, error) {
+	if record.ObjectVersion <= 0 {
+		if err := watchdog.SupplyRecordWithVersion(record); err != nil {
+			return 0, err
+		}
+	}
+	err := watchdog.
+		dbConn.
+		Exec(insertWithObjectVersion, record.ObjectVersion, record.RequestID, record.ObjectID, record.Domain, record.AccessKey,
+			watchdog.dialect.ExecutionDelay(record.ExecutionDelay), record.Method, record.OperationOrDefault(), record.SubResource).
+		Error
+	return record.ObjectVersion, err
 }
 
-//InsertWithRequestID inserts a record with custom ID
+// InsertWithRequestID inserts a record with custom ID
 func (watchdog *SQLWatchdog) InsertWithRequestID(requestID string, record *ConsistencyRecord) (*DeleteMarker, error) {
 	record.RequestID = requestID
 	return watchdog.Insert(record)
@@ -168,16 +179,11 @@ func (watchdog *SQLWatchdog) InsertWithRequestID(requestID string, record *Consi
 func (watchdog *SQLWatchdog) Delete(marker *DeleteMarker) error {
 	log.Debugf("[watchdog] DELETE objID %s, version %d", marker.objectID, marker.objectVersion)
 	queryStartTime := time.Now()
-	rows, err := watchdog.
+	condition, args := supersededCondition(marker)
+	err := watchdog.
 		dbConn.
-		Raw(deleteMarkersInsertedEalier, marker.domain, marker.objectID, marker.objectVersion).
-		Rows()
-
-	defer func() {
-		if rows != nil {
-			_ = rows.Close()
-		}
-	}()
+		Exec(deleteRecords+condition, args...).
+		Error
 
 	if err != nil {
 		metrics.UpdateSince("watchdog.delete.err", queryStartTime)
@@ -187,7 +193,7 @@ func (watchdog *SQLWatchdog) Delete(marker *DeleteMarker) error {
 
 	metrics.UpdateSince("watchdog.delete.ok", queryStartTime)
 
-	log.Debugf("[watchdog] DELETE OK objID, version <= %d", marker.objectID, marker.objectVersion)
+	log.Debugf("[watchdog] DELETE OK objID %s, version <= %d", marker.objectID, marker.objectVersion)
 	return nil
 }
 
@@ -197,23 +203,25 @@ func (watchdog *SQLWatchdog) UpdateExecutionDelay(delta *ExecutionDelay) error {
 	queryStartTime := time.Now()
 	updateErr := watchdog.
 		dbConn.
-		Exec(updateRecordExecutionTimeByReqID, fmt.Sprintf("%d minutes", uint64(delta.Delay.Minutes())), delta.RequestID).
+		Exec(updateExecutionDelay, watchdog.dialect.ExecutionDelay(delta.Delay), delta.RequestID).
 		Error
 
 	if updateErr != nil {
 		metrics.UpdateSince("watchdog.update.err", queryStartTime)
-		log.Printf("[watchdog] UPDATE EXEC FAIL delay reqID: %s", delta.RequestID, updateErr.Error())
+		log.Printf("[watchdog] UPDATE EXEC FAIL delay reqID %s: %s", delta.RequestID, updateErr.Error())
+		return ErrDataBase
 	}
 
-	log.Printf("[watchdog] UPDATE EXEC OK delay reqID ", delta.RequestID)
+	log.Debugf("[watchdog] UPDATE EXEC OK delay reqID %s", delta.RequestID)
 	return nil
 }
 
-// SupplyRecordWithVersion queries database for NOW and sets it as object's version
+// SupplyRecordWithVersion queries database for NOW and sets it as object's version,
+// versions supplied by a single watchdog are strictly increasing
 func (watchdog *SQLWatchdog) SupplyRecordWithVersion(record *ConsistencyRecord) error {
 	rows, err := watchdog.
 		dbConn.
-		Raw(selectNow).
+		Raw(watchdog.dialect.CurrentVersionQuery()).
 		Rows()
 
 	if err != nil {
@@ -235,17 +243,34 @@ func (watchdog *SQLWatchdog) SupplyRecordWithVersion(record *ConsistencyRecord)
 		return err
 	}
 
-	record.ObjectVersion = objectVersion
+	record.ObjectVersion = watchdog.versions.next(objectVersion)
 	log.Debugf("[watchdog] VERSION SUPPLY OK reqID %s", record.RequestID)
 	return nil
 }
 
-//GetVersionHeaderName returns the name of the HTTP header that should hold to object's verison
+// GetVersionHeaderName returns the name of the HTTP header that should hold to object's verison
 func (watchdog *SQLWatchdog) GetVersionHeaderName() string {
 	return watchdog.versionHeaderName
 }
 
-//CreateWatchdogSQLClientProps creates watchdog reader/writer config
+// versionClock keeps versions increasing when the database clock is coarser
+// than the rate of requests
+type versionClock struct {
+	last int
+	mx   sync.Mutex
+}
+
+func (clock *versionClock) next(version int) int {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	if version <= clock.last {
+		version = clock.last + 1
+	}
+	clock.last = version
+	return version
+}
+
+// CreateWatchdogSQLClientProps creates watchdog reader/writer config
 func CreateWatchdogSQLClientProps(watchdogConfig *config.WatchdogConfig, readerConfig bool) map[string]string {
 	propPrefix := "writer"
 	if readerConfig {
@@ -10,7 +10,7 @@ import (
 
 func TestShouldAddConsistencyRecordForRequestAndReturnTheObjectVersionGeneratedByDatabase(t *testing.T) {
 	_, dbMock, gormDbMock := createDBMock(t)
-	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header"}
+	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header", dialect: &PostgresDialect{}}
 
 	expectedObjectVersion := 123
 	record := ConsistencyRecord{
@@ -23,8 +23,8 @@ func TestShouldAddConsistencyRecordForRequestAndReturnTheObjectVersionGeneratedB
 	}
 
 	dbMock.
-		ExpectQuery(`INSERT\ INTO\ consistency_record\ \(request_id\,\ object_id\,\ domain\,\ access_key\,\ execution_delay\,\ method\)\ VALUES\ .+\ RETURNING\ object_version`).
-		WithArgs(record.RequestID, record.ObjectID, record.Domain, record.AccessKey, record.ExecutionDelay.String(), record.Method).
+		ExpectQuery(`INSERT\ INTO\ consistency_record\ \(request_id\,\ object_id\,\ domain\,\ access_key\,\ execution_delay\,\ method\,\ operation\,\ sub_resource\)\ VALUES\ .+\ RETURNING\ object_version`).
+		WithArgs(record.RequestID, record.ObjectID, record.Domain, record.AccessKey, record.ExecutionDelay.String(), record.Method, ObjectOperation, SubResource("")).
 		WillReturnRows(sqlmock.NewRows([]string{"object_version"}).AddRow(expectedObjectVersion)).
 		WillReturnError(nil).
 		RowsWillBeClosed()
@@ -39,7 +39,7 @@ func TestShouldAddConsistencyRecordForRequestAndReturnTheObjectVersionGeneratedB
 
 func TestShouldAddConsistencyRecordForRequestWithTheVersionSuppliedInTheRecord(t *testing.T) {
 	_, dbMock, gormDbMock := createDBMock(t)
-	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header"}
+	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header", dialect: &PostgresDialect{}}
 
 	expectedObjectVersion := 123
 	record := ConsistencyRecord{
@@ -53,11 +53,9 @@ func TestShouldAddConsistencyRecordForRequestWithTheVersionSuppliedInTheRecord(t
 	}
 
 	dbMock.
-		ExpectQuery(`INSERT\ INTO\ consistency_record\ \(object_version\,\ request_id\,\ object_id\,\ domain\,\ access_key\,\ execution_delay\,\ method\)\ VALUES\ .+\ RETURNING\ object_version`).
-		WithArgs(expectedObjectVersion, record.RequestID, record.ObjectID, record.Domain, record.AccessKey, record.ExecutionDelay.String(), record.Method).
-		WillReturnRows(sqlmock.NewRows([]string{"object_version"}).AddRow(expectedObjectVersion)).
-		WillReturnError(nil).
-		RowsWillBeClosed()
+		ExpectExec(`INSERT\ INTO\ consistency_record\ \(object_version\,\ request_id\,\ object_id\,\ domain\,\ access_key\,\ execution_delay\,\ method\,\ operation\,\ sub_resource\)\ VALUES\ .+`).
+		WithArgs(expectedObjectVersion, record.RequestID, record.ObjectID, record.Domain, record.AccessKey, record.ExecutionDelay.String(), record.Method, ObjectOperation, SubResource("")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	deleteMarker, err := watchdog.Insert(&record)
 
@@ -70,7 +68,7 @@ func TestShouldAddConsistencyRecordForRequestWithTheVersionSuppliedInTheRecord(t
 
 func TestShouldSupplyRecordWithObjectVersion(t *testing.T) {
 	_, dbMock, gormDbMock := createDBMock(t)
-	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header"}
+	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header", dialect: &PostgresDialect{}}
 
 	expectedObjectVersion := 123
 	record := ConsistencyRecord{
@@ -98,20 +96,19 @@ func TestShouldSupplyRecordWithObjectVersion(t *testing.T) {
 
 func TestShouldDeleteRecordsByMarker(t *testing.T) {
 	_, dbMock, gormDbMock := createDBMock(t)
-	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header"}
+	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header", dialect: &PostgresDialect{}}
 
 	marker := DeleteMarker{
 		domain:        "domain.local",
 		objectID:      "key/bucket",
 		objectVersion: 123,
+		operation:     ObjectOperation,
 	}
 
 	dbMock.
-		ExpectQuery(`DELETE\ FROM\ consistency_record\ WHERE\ domain\ \=\ .+\ AND\ object_id\ \=\ .+\ AND\ object_version\ \<\=\ .+`).
-		WithArgs(marker.domain, marker.objectID, marker.objectVersion).
-		WillReturnRows(sqlmock.NewRows([]string{""})).
-		WillReturnError(nil).
-		RowsWillBeClosed()
+		ExpectExec(`DELETE\ FROM\ consistency_record\ WHERE\ domain\ \=\ .+\ AND\ object_id\ \=\ .+\ AND\ operation\ \=\ .+\ AND\ object_version\ \<\=\ .+`).
+		WithArgs(marker.domain, marker.objectID, marker.operation, marker.objectVersion).
+		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	err := watchdog.Delete(&marker)
 	assert.Nil(t, err)
@@ -125,3 +122,19 @@ func createDBMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock, *gorm.DB) {
 
 	return db, dbMock, gormDB
 }
+
+func TestShouldDeleteOnlyRecordsOfTheSameSubResource(t *testing.T) {
+	_, dbMock, gormDbMock := createDBMock(t)
+	watchdog := SQLWatchdog{dbConn: gormDbMock, versionHeaderName: "x-version-header", dialect: &PostgresDialect{}}
+
+	marker := DeleteMarkerFor(&ConsistencyRecord{Domain: "domain.local", ObjectID: "bucket", ObjectVersion: 123,
+		Operation: BucketOperation, SubResource: CORSSubResource})
+
+	dbMock.
+		ExpectExec(`DELETE\ FROM\ consistency_record\ WHERE\ domain\ \=\ .+\ AND\ object_id\ \=\ .+\ AND\ operation\ \=\ .+\ AND\ sub_resource\ \=\ .+\ AND\ object_version\ \<\=\ .+`).
+		WithArgs("domain.local", "bucket", BucketOperation, CORSSubResource, 123).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.Nil(t, watchdog.Delete(marker))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/allegro/akubra/internal/akubra/httphandler"
+	regionsconfig "github.com/allegro/akubra/internal/akubra/regions/config"
 	"github.com/allegro/akubra/internal/akubra/watchdog/config"
 	"net/http"
 	"time"
@@ -34,9 +35,40 @@ const (
 	DELETE Method = "DELETE"
 )
 
+const (
+	// ObjectOperation states that the record describes an object
+	ObjectOperation Operation = "object"
+	// BucketOperation states that the record describes a bucket, ObjectID holds the bucket name
+	BucketOperation Operation = "bucket"
+)
+
+const (
+	// ACLSubResource is the access control list of a bucket or an object
+	ACLSubResource SubResource = "acl"
+	// CORSSubResource is the CORS configuration of a bucket
+	CORSSubResource SubResource = "cors"
+	// PolicySubResource is the policy of a bucket
+	PolicySubResource SubResource = "policy"
+	// LifecycleSubResource is the lifecycle configuration of a bucket
+	LifecycleSubResource SubResource = "lifecycle"
+)
+
+var (
+	// BucketSubResources lists the bucket sub-resources tracked in the consistency log
+	BucketSubResources = []SubResource{ACLSubResource, CORSSubResource, PolicySubResource, LifecycleSubResource}
+	// ObjectSubResources lists the object sub-resources tracked in the consistency log
+	ObjectSubResources = []SubResource{ACLSubResource}
+)
+
 // Method is the ConsistencyRecord type
 type Method string
 
+// Operation tells which kind of resource the ConsistencyRecord describes
+type Operation string
+
+// SubResource is the part of the resource changed by the request, empty if it's the resource itself
+type SubResource string
+
 // ConsistencyWatchdogFactory creates ConsistencyWatchdogs
 type ConsistencyWatchdogFactory interface {
 	CreateWatchdogInstance(config *config.WatchdogConfig) (ConsistencyWatchdog, error)
@@ -51,6 +83,12 @@ type ConsistencyRecord struct {
 	Domain         string
 	AccessKey      string
 	ObjectVersion  int
+	Operation      Operation
+	SubResource    SubResource
+	// ConsistencyLevel of the region, watchdogs may write records of Weak requests lazily
+	ConsistencyLevel regionsconfig.ConsistencyLevel
+	// Attempts counts the failed attempts to process the record
+	Attempts int
 }
 
 // DeleteMarker indicates which ConsistencyRecords for a given object can be deleted
@@ -58,6 +96,8 @@ type DeleteMarker struct {
 	objectID      string
 	domain        string
 	objectVersion int
+	operation     Operation
+	subResource   SubResource
 }
 
 //ExecutionDelay tells how to change the execution time of a record
@@ -95,9 +135,9 @@ func (factory *DefaultConsistencyRecordFactory) CreateRecordFor(request *http.Re
 		return nil, fmt.Errorf("unsupported method - %s", request.Method)
 	}
 
-	bucket, key := utils.ExtractBucketAndKey(request.URL.Path)
-	if bucket == "" || key == "" {
-		return nil, errors.New("failed to extract bucket/key from path")
+	objectID, operation, subResource, err := resourceOf(request)
+	if err != nil {
+		return nil, err
 	}
 
 	accessKey := utils.ExtractAccessKey(request)
@@ -123,9 +163,69 @@ func (factory *DefaultConsistencyRecordFactory) CreateRecordFor(request *http.Re
 	return &ConsistencyRecord{
 		RequestID:      requestID,
 		ExecutionDelay: executionDelay,
-		ObjectID:       fmt.Sprintf("%s/%s", bucket, key),
+		ObjectID:       objectID,
 		AccessKey:      accessKey,
 		Domain:         domain,
 		Method:         method,
+		Operation:      operation,
+		SubResource:    subResource,
 	}, nil
 }
+
+// resourceOf determines the resource changed by the request, sub-resources of objects
+// which are not tracked are treated as changes of the object
+func resourceOf(request *http.Request) (string, Operation, SubResource, error) {
+	if utils.IsBucketPath(request.URL.Path) {
+		subResource, tracked := RequestSubResource(request, BucketSubResources)
+		if !tracked {
+			return "", "", "", errors.New("unsupported bucket sub-resource")
+		}
+		return utils.ExtractBucketFrom(request.URL.Path), BucketOperation, subResource, nil
+	}
+	bucket, key := utils.ExtractBucketAndKey(request.URL.Path)
+	if bucket == "" || key == "" {
+		return "", "", "", errors.New("failed to extract bucket/key from path")
+	}
+	subResource, _ := RequestSubResource(request, ObjectSubResources)
+	return fmt.Sprintf("%s/%s", bucket, key), ObjectOperation, subResource, nil
+}
+
+// RequestSubResource returns the sub-resource of the request if it's one of supported,
+// tracked is false if the request targets other sub-resource. Authorization params of
+// presigned requests don't denote sub-resources
+func RequestSubResource(request *http.Request, supported []SubResource) (subResource SubResource, tracked bool) {
+	query := request.URL.Query()
+	for _, param := range utils.PresignQueryParams {
+		query.Del(param)
+	}
+	for _, candidate := range supported {
+		if _, present := query[string(candidate)]; present {
+			return candidate, true
+		}
+	}
+	return "", len(query) == 0
+}
+
+// IsObjectContent tells if the record describes the content of an object
+func (record *ConsistencyRecord) IsObjectContent() bool {
+	return record.Operation != BucketOperation && record.SubResource == ""
+}
+
+// OperationOrDefault returns the operation, records created before operations were tracked describe objects
+func (record *ConsistencyRecord) OperationOrDefault() Operation {
+	if record.Operation == "" {
+		return ObjectOperation
+	}
+	return record.Operation
+}
+
+// DeleteMarkerFor creates a marker of the record and the ones it supersedes
+func DeleteMarkerFor(record *ConsistencyRecord) *DeleteMarker {
+	return &DeleteMarker{
+		objectID:      record.ObjectID,
+		domain:        record.Domain,
+		objectVersion: record.ObjectVersion,
+		operation:     record.OperationOrDefault(),
+		subResource:   record.SubResource,
+	}
+}
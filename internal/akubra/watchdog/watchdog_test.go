@@ -0,0 +1,77 @@
+package watchdog
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/allegro/akubra/internal/akubra/httphandler"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldCreateRecordsOfBucketsAndSubResources(t *testing.T) {
+	factory := &DefaultConsistencyRecordFactory{}
+	for _, testCase := range []struct {
+		method              string
+		url                 string
+		expectedOperation   Operation
+		expectedSubResource SubResource
+		expectedObjectID    string
+		expectedMethod      Method
+	}{
+		{http.MethodPut, "http://localhost/bucket/key", ObjectOperation, "", "bucket/key", PUT},
+		{http.MethodPut, "http://localhost/bucket/key?tagging", ObjectOperation, "", "bucket/key", PUT},
+		{http.MethodPut, "http://localhost/bucket/key?acl", ObjectOperation, ACLSubResource, "bucket/key", PUT},
+		{http.MethodPut, "http://localhost/bucket", BucketOperation, "", "bucket", PUT},
+		{http.MethodDelete, "http://localhost/bucket/", BucketOperation, "", "bucket", DELETE},
+		{http.MethodPut, "http://localhost/bucket?acl", BucketOperation, ACLSubResource, "bucket", PUT},
+		{http.MethodPut, "http://localhost/bucket?cors", BucketOperation, CORSSubResource, "bucket", PUT},
+		{http.MethodDelete, "http://localhost/bucket?policy", BucketOperation, PolicySubResource, "bucket", DELETE},
+		{http.MethodPut, "http://localhost/bucket?lifecycle", BucketOperation, LifecycleSubResource, "bucket", PUT},
+		{http.MethodPut, "http://localhost/bucket?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=access%2F20190101%2Fus-east-1%2Fs3%2Faws4_request" +
+			"&X-Amz-Date=20190101T000000Z&X-Amz-Expires=300&X-Amz-SignedHeaders=host&X-Amz-Signature=abc", BucketOperation, "", "bucket", PUT},
+		{http.MethodDelete, "http://localhost/bucket?AWSAccessKeyId=access&Expires=1546300800&Signature=abc", BucketOperation, "", "bucket", DELETE},
+		{http.MethodPut, "http://localhost/bucket?cors&X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Signature=abc", BucketOperation, CORSSubResource, "bucket", PUT},
+	} {
+		record, err := factory.CreateRecordFor(recordRequest(t, testCase.method, testCase.url))
+		require.NoError(t, err, testCase.url)
+		assert.Equal(t, testCase.expectedOperation, record.Operation, testCase.url)
+		assert.Equal(t, testCase.expectedSubResource, record.SubResource, testCase.url)
+		assert.Equal(t, testCase.expectedObjectID, record.ObjectID, testCase.url)
+		assert.Equal(t, testCase.expectedMethod, record.Method, testCase.url)
+	}
+}
+
+func TestShouldRefuseToCreateRecordsOfUntrackedBucketSubResources(t *testing.T) {
+	_, err := (&DefaultConsistencyRecordFactory{}).CreateRecordFor(recordRequest(t, http.MethodPut, "http://localhost/bucket?versioning"))
+	assert.Error(t, err)
+}
+
+func TestSubResourceChangesShouldBeSupersededByChangesOfTheResource(t *testing.T) {
+	bucketMarker := DeleteMarkerFor(&ConsistencyRecord{Domain: "local", ObjectID: "bucket", Operation: BucketOperation, ObjectVersion: 10})
+	corsMarker := DeleteMarkerFor(&ConsistencyRecord{Domain: "local", ObjectID: "bucket", Operation: BucketOperation, SubResource: CORSSubResource, ObjectVersion: 10})
+
+	cors := &pendingInsert{record: ConsistencyRecord{Domain: "local", ObjectID: "bucket", Operation: BucketOperation, SubResource: CORSSubResource, ObjectVersion: 5}}
+	policy := &pendingInsert{record: ConsistencyRecord{Domain: "local", ObjectID: "bucket", Operation: BucketOperation, SubResource: PolicySubResource, ObjectVersion: 5}}
+	bucket := &pendingInsert{record: ConsistencyRecord{Domain: "local", ObjectID: "bucket", Operation: BucketOperation, ObjectVersion: 5}}
+	legacyObject := &pendingInsert{record: ConsistencyRecord{Domain: "local", ObjectID: "bucket", ObjectVersion: 5}}
+
+	assert.True(t, cors.supersededBy(bucketMarker))
+	assert.True(t, policy.supersededBy(bucketMarker))
+	assert.True(t, bucket.supersededBy(bucketMarker))
+	assert.True(t, cors.supersededBy(corsMarker))
+	assert.False(t, policy.supersededBy(corsMarker))
+	assert.False(t, bucket.supersededBy(corsMarker))
+	assert.False(t, legacyObject.supersededBy(bucketMarker))
+}
+
+func recordRequest(t *testing.T, method, url string) *http.Request {
+	request, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	request.Header.Set("Authorization", "AWS access:signature")
+	ctx := context.WithValue(request.Context(), httphandler.Domain, "localhost")
+	ctx = context.WithValue(ctx, log.ContextreqIDKey, "reqID")
+	return request.WithContext(ctx)
+}
@@ -0,0 +1,371 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/allegro/akubra/external/miniotweak/s3signer"
+	radosAPI "github.com/mjarco/go-radosgw/pkg/api"
+)
+
+// Kinds of ownership differences
+const (
+	MissingUser = "missing-user"
+	MissingKey  = "missing-key"
+	BucketOwner = "bucket-owner"
+)
+
+// OwnershipDifference is a user, an access key or a bucket owner of the source cluster which is missing
+// or different on the destination cluster of the same region
+type OwnershipDifference struct {
+	Region      string `json:"region"`
+	Kind        string `json:"kind"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	UID         string `json:"uid"`
+	AccessKey   string `json:"access_key,omitempty"`
+	Bucket      string `json:"bucket,omitempty"`
+	// DestinationOwner is the owner of the bucket on the destination cluster
+	DestinationOwner string `json:"destination_owner,omitempty"`
+	Fixed            bool   `json:"fixed"`
+	Error            string `json:"error,omitempty"`
+}
+
+// OwnershipSummary counts the differences found and fixed
+type OwnershipSummary struct {
+	Differences int `json:"differences"`
+	Fixed       int `json:"fixed"`
+	Failed      int `json:"failed"`
+}
+
+type ownershipAPI interface {
+	adminAPI
+	CreateUser(conf radosAPI.UserConfig) (*radosAPI.User, error)
+	CreateKey(conf radosAPI.KeyConfig) (*radosAPI.KeysDefinition, error)
+	RelinkBucket(bucket, bucketID, uid string) error
+}
+
+// OwnershipSync compares the users, their access keys and the bucket owners of the clusters of every region.
+// Users and keys are copied from the first cluster listed having them, buckets are linked to their owner
+// on the first cluster listed having them
+type OwnershipSync struct {
+	admins  AdminsConf
+	connect func(conf Conf) (ownershipAPI, error)
+}
+
+// NewOwnershipSync creates an OwnershipSync of the clusters of the admins configuration
+func NewOwnershipSync(admins AdminsConf) *OwnershipSync {
+	return &OwnershipSync{admins: admins, connect: newRadosAdmin}
+}
+
+// Run writes the differences as JSON lines, they are fixed on the destination clusters only if fix is set
+func (ownershipSync *OwnershipSync) Run(output io.Writer, fix bool) (OwnershipSummary, error) {
+	summary := OwnershipSummary{}
+	encoder := json.NewEncoder(output)
+	regions := make([]string, 0, len(ownershipSync.admins))
+	for region := range ownershipSync.admins {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		comparison, err := ownershipSync.readRegion(region)
+		if err != nil {
+			return summary, err
+		}
+		for _, difference := range comparison.differences() {
+			summary.Differences++
+			if fix {
+				if err := comparison.fix(difference); err != nil {
+					log.Printf("Failed to fix %s of '%s' on %s: %s", difference.Kind, difference.UID, difference.Destination, err)
+					difference.Error = err.Error()
+					summary.Failed++
+				} else {
+					difference.Fixed = true
+					summary.Fixed++
+				}
+			}
+			if err := encoder.Encode(difference); err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, nil
+}
+
+type clusterState struct {
+	endpoint string
+	api      ownershipAPI
+	users    map[string]*radosAPI.User
+	buckets  map[string]*radosAPI.Stats
+}
+
+type regionComparison struct {
+	region   string
+	clusters []*clusterState
+}
+
+func (ownershipSync *OwnershipSync) readRegion(region string) (*regionComparison, error) {
+	comparison := &regionComparison{region: region}
+	for _, conf := range ownershipSync.admins[region] {
+		api, err := ownershipSync.connect(conf)
+		if err != nil {
+			return nil, err
+		}
+		cluster, err := readCluster(conf.Endpoint, api)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read users and buckets of %s in region %s: %s", conf.Endpoint, region, err)
+		}
+		comparison.clusters = append(comparison.clusters, cluster)
+	}
+	return comparison, nil
+}
+
+func readCluster(endpoint string, api ownershipAPI) (*clusterState, error) {
+	cluster := &clusterState{endpoint: endpoint, api: api,
+		users: make(map[string]*radosAPI.User), buckets: make(map[string]*radosAPI.Stats)}
+	uids, err := api.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, uid := range uids {
+		user, err := api.GetUser(uid)
+		if err != nil {
+			return nil, err
+		}
+		cluster.users[uid] = user
+	}
+	buckets, err := api.GetBucket(radosAPI.BucketConfig{Stats: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		if bucket.Stats != nil && bucket.Stats.Bucket != "" {
+			cluster.buckets[bucket.Stats.Bucket] = bucket.Stats
+		}
+	}
+	return cluster, nil
+}
+
+// differences lists the missing users first, then the missing keys and the bucket owners,
+// so the fixes of the later ones can rely on the users
+func (comparison *regionComparison) differences() []OwnershipDifference {
+	var users, keys, owners []OwnershipDifference
+	for _, uid := range comparison.uids() {
+		source := comparison.firstWithUser(uid)
+		for _, cluster := range comparison.clusters {
+			user, ok := cluster.users[uid]
+			if !ok {
+				users = append(users, comparison.difference(MissingUser, source, cluster, uid))
+				continue
+			}
+			for _, accessKey := range comparison.accessKeys(uid) {
+				if !hasAccessKey(user, accessKey) {
+					difference := comparison.difference(MissingKey, comparison.firstWithKey(uid, accessKey), cluster, uid)
+					difference.AccessKey = accessKey
+					keys = append(keys, difference)
+				}
+			}
+		}
+	}
+	for _, bucket := range comparison.bucketNames() {
+		source := comparison.firstWithBucket(bucket)
+		owner := source.buckets[bucket].Owner
+		for _, cluster := range comparison.clusters {
+			stats, ok := cluster.buckets[bucket]
+			if !ok || stats.Owner == owner {
+				continue
+			}
+			difference := comparison.difference(BucketOwner, source, cluster, owner)
+			difference.Bucket = bucket
+			difference.DestinationOwner = stats.Owner
+			owners = append(owners, difference)
+		}
+	}
+	return append(append(users, keys...), owners...)
+}
+
+func (comparison *regionComparison) fix(difference OwnershipDifference) error {
+	destination := comparison.cluster(difference.Destination)
+	switch difference.Kind {
+	case MissingUser:
+		return comparison.createUser(difference.UID, comparison.cluster(difference.Source), destination)
+	case MissingKey:
+		secretKey := secretKeyOf(comparison.cluster(difference.Source).users[difference.UID], difference.AccessKey)
+		_, err := destination.api.CreateKey(radosAPI.KeyConfig{UID: difference.UID, KeyType: "s3",
+			AccessKey: difference.AccessKey, SecretKey: secretKey})
+		return err
+	case BucketOwner:
+		return destination.api.RelinkBucket(difference.Bucket, destination.buckets[difference.Bucket].ID, difference.UID)
+	}
+	return fmt.Errorf("unknown difference %s", difference.Kind)
+}
+
+// createUser copies the user with all the access keys it has on any cluster of the region
+func (comparison *regionComparison) createUser(uid string, source, destination *clusterState) error {
+	user := source.users[uid]
+	displayName := user.DisplayName
+	if displayName == "" {
+		displayName = uid
+	}
+	userConfig := radosAPI.UserConfig{UID: uid, DisplayName: displayName, Email: user.Email, MaxBuckets: &user.MaxBuckets}
+	accessKeys := comparison.accessKeys(uid)
+	if len(accessKeys) == 0 {
+		_, err := destination.api.CreateUser(userConfig)
+		return err
+	}
+	userConfig.AccessKey = accessKeys[0]
+	userConfig.SecretKey = secretKeyOf(comparison.firstWithKey(uid, accessKeys[0]).users[uid], accessKeys[0])
+	if _, err := destination.api.CreateUser(userConfig); err != nil {
+		return err
+	}
+	for _, accessKey := range accessKeys[1:] {
+		secretKey := secretKeyOf(comparison.firstWithKey(uid, accessKey).users[uid], accessKey)
+		if _, err := destination.api.CreateKey(radosAPI.KeyConfig{UID: uid, KeyType: "s3", AccessKey: accessKey, SecretKey: secretKey}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (comparison *regionComparison) difference(kind string, source, destination *clusterState, uid string) OwnershipDifference {
+	return OwnershipDifference{Region: comparison.region, Kind: kind, Source: source.endpoint,
+		Destination: destination.endpoint, UID: uid}
+}
+
+func (comparison *regionComparison) cluster(endpoint string) *clusterState {
+	for _, cluster := range comparison.clusters {
+		if cluster.endpoint == endpoint {
+			return cluster
+		}
+	}
+	return nil
+}
+
+func (comparison *regionComparison) uids() []string {
+	uids := make(map[string]struct{})
+	for _, cluster := range comparison.clusters {
+		for uid := range cluster.users {
+			uids[uid] = struct{}{}
+		}
+	}
+	return sortedKeys(uids)
+}
+
+func (comparison *regionComparison) bucketNames() []string {
+	buckets := make(map[string]struct{})
+	for _, cluster := range comparison.clusters {
+		for bucket := range cluster.buckets {
+			buckets[bucket] = struct{}{}
+		}
+	}
+	return sortedKeys(buckets)
+}
+
+// accessKeys lists the S3 keys of the user on all the clusters
+func (comparison *regionComparison) accessKeys(uid string) []string {
+	keys := make(map[string]struct{})
+	for _, cluster := range comparison.clusters {
+		if user, ok := cluster.users[uid]; ok {
+			for _, key := range user.Keys {
+				keys[key.AccessKey] = struct{}{}
+			}
+		}
+	}
+	return sortedKeys(keys)
+}
+
+func (comparison *regionComparison) firstWithUser(uid string) *clusterState {
+	for _, cluster := range comparison.clusters {
+		if _, ok := cluster.users[uid]; ok {
+			return cluster
+		}
+	}
+	return nil
+}
+
+func (comparison *regionComparison) firstWithKey(uid, accessKey string) *clusterState {
+	for _, cluster := range comparison.clusters {
+		if user, ok := cluster.users[uid]; ok && hasAccessKey(user, accessKey) {
+			return cluster
+		}
+	}
+	return nil
+}
+
+func (comparison *regionComparison) firstWithBucket(bucket string) *clusterState {
+	for _, cluster := range comparison.clusters {
+		if _, ok := cluster.buckets[bucket]; ok {
+			return cluster
+		}
+	}
+	return nil
+}
+
+func hasAccessKey(user *radosAPI.User, accessKey string) bool {
+	for _, key := range user.Keys {
+		if key.AccessKey == accessKey {
+			return true
+		}
+	}
+	return false
+}
+
+func secretKeyOf(user *radosAPI.User, accessKey string) string {
+	for _, key := range user.Keys {
+		if key.AccessKey == accessKey {
+			return key.SecretKey
+		}
+	}
+	return ""
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// radosAdmin adds linking buckets, which the rados admin client lacks
+type radosAdmin struct {
+	*radosAPI.API
+	conf Conf
+}
+
+func newRadosAdmin(conf Conf) (ownershipAPI, error) {
+	api, err := New(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &radosAdmin{API: api, conf: conf}, nil
+}
+
+// RelinkBucket links the bucket to the user, unlinking it from its previous owner
+func (admin *radosAdmin) RelinkBucket(bucket, bucketID, uid string) error {
+	query := url.Values{"bucket": {bucket}, "bucket-id": {bucketID}, "uid": {uid}, "format": {"json"}}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/%s/bucket?%s",
+		strings.TrimSuffix(admin.conf.Endpoint, "/"), strings.Trim(admin.conf.AdminPrefix, "/"), query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req = s3signer.SignV2(req, admin.conf.AdminAccessKey, admin.conf.AdminSecretKey, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("linking bucket %s to %s failed with %s: %s", bucket, uid, resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	radosAPI "github.com/mjarco/go-radosgw/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCluster struct {
+	users   map[string]*radosAPI.User
+	buckets map[string]*radosAPI.Stats
+	relinks []string
+}
+
+func (cluster *fakeCluster) GetUsers() ([]string, error) {
+	var uids []string
+	for uid := range cluster.users {
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+func (cluster *fakeCluster) GetUser(uid string) (*radosAPI.User, error) {
+	return cluster.users[uid], nil
+}
+
+func (cluster *fakeCluster) GetBucket(_ radosAPI.BucketConfig) (radosAPI.Buckets, error) {
+	var buckets radosAPI.Buckets
+	for _, stats := range cluster.buckets {
+		buckets = append(buckets, radosAPI.Bucket{Stats: stats})
+	}
+	return buckets, nil
+}
+
+func (cluster *fakeCluster) CreateUser(conf radosAPI.UserConfig) (*radosAPI.User, error) {
+	user := &radosAPI.User{UserID: conf.UID, DisplayName: conf.DisplayName}
+	user.Keys = append(user.Keys, keyOf(conf.AccessKey, conf.SecretKey)...)
+	cluster.users[conf.UID] = user
+	return user, nil
+}
+
+func (cluster *fakeCluster) CreateKey(conf radosAPI.KeyConfig) (*radosAPI.KeysDefinition, error) {
+	user, ok := cluster.users[conf.UID]
+	if !ok {
+		return nil, errors.New("NoSuchUser")
+	}
+	user.Keys = append(user.Keys, keyOf(conf.AccessKey, conf.SecretKey)...)
+	return &user.Keys, nil
+}
+
+func (cluster *fakeCluster) RelinkBucket(bucket, bucketID, uid string) error {
+	cluster.relinks = append(cluster.relinks, bucket+":"+bucketID+":"+uid)
+	cluster.buckets[bucket].Owner = uid
+	return nil
+}
+
+func keyOf(accessKey, secretKey string) radosAPI.KeysDefinition {
+	keys := radosAPI.KeysDefinition{}
+	keys = append(keys, struct {
+		AccessKey string `json:"access_key,omitempty"`
+		SecretKey string `json:"secret_key"`
+		User      string `json:"user"`
+	}{AccessKey: accessKey, SecretKey: secretKey})
+	return keys
+}
+
+func userWithKeys(uid string, keys ...string) *radosAPI.User {
+	user := &radosAPI.User{UserID: uid, DisplayName: uid}
+	for _, key := range keys {
+		user.Keys = append(user.Keys, keyOf(key, "secret-"+key)...)
+	}
+	return user
+}
+
+func newFakeSync(clusters map[string]*fakeCluster) *OwnershipSync {
+	return &OwnershipSync{
+		admins: AdminsConf{"region": {{Endpoint: "http://first"}, {Endpoint: "http://second"}}},
+		connect: func(conf Conf) (ownershipAPI, error) {
+			return clusters[conf.Endpoint], nil
+		},
+	}
+}
+
+func twoClusters() (*fakeCluster, *fakeCluster) {
+	first := &fakeCluster{
+		users: map[string]*radosAPI.User{"alice": userWithKeys("alice", "AK1", "AK2"), "bob": userWithKeys("bob", "BK1")},
+		buckets: map[string]*radosAPI.Stats{"photos": {Bucket: "photos", ID: "first.1", Owner: "alice"},
+			"logs": {Bucket: "logs", ID: "first.2", Owner: "bob"}},
+	}
+	second := &fakeCluster{
+		users:   map[string]*radosAPI.User{"alice": userWithKeys("alice", "AK1")},
+		buckets: map[string]*radosAPI.Stats{"photos": {Bucket: "photos", ID: "second.1", Owner: "bob"}},
+	}
+	return first, second
+}
+
+func decodeDifferences(t *testing.T, output *bytes.Buffer) []OwnershipDifference {
+	var differences []OwnershipDifference
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var difference OwnershipDifference
+		require.NoError(t, json.Unmarshal([]byte(line), &difference))
+		differences = append(differences, difference)
+	}
+	return differences
+}
+
+func TestOwnershipSyncShouldReportDifferencesWithoutFixingThem(t *testing.T) {
+	first, second := twoClusters()
+	output := &bytes.Buffer{}
+
+	summary, err := newFakeSync(map[string]*fakeCluster{"http://first": first, "http://second": second}).Run(output, false)
+
+	require.NoError(t, err)
+	assert.Equal(t, OwnershipSummary{Differences: 3}, summary)
+	assert.Equal(t, []OwnershipDifference{
+		{Region: "region", Kind: MissingUser, Source: "http://first", Destination: "http://second", UID: "bob"},
+		{Region: "region", Kind: MissingKey, Source: "http://first", Destination: "http://second", UID: "alice", AccessKey: "AK2"},
+		{Region: "region", Kind: BucketOwner, Source: "http://first", Destination: "http://second", UID: "alice",
+			Bucket: "photos", DestinationOwner: "bob"},
+	}, decodeDifferences(t, output))
+	assert.NotContains(t, output.String(), "secret")
+	assert.Len(t, second.users, 1)
+	assert.Empty(t, second.relinks)
+}
+
+func TestOwnershipSyncShouldCreateUsersAndKeysAndRelinkBuckets(t *testing.T) {
+	first, second := twoClusters()
+	clusters := map[string]*fakeCluster{"http://first": first, "http://second": second}
+
+	summary, err := newFakeSync(clusters).Run(&bytes.Buffer{}, true)
+
+	require.NoError(t, err)
+	assert.Equal(t, OwnershipSummary{Differences: 3, Fixed: 3}, summary)
+	require.Contains(t, second.users, "bob")
+	assert.Equal(t, "secret-BK1", second.users["bob"].Keys[0].SecretKey)
+	assert.True(t, hasAccessKey(second.users["alice"], "AK2"))
+	assert.Equal(t, []string{"photos:second.1:alice"}, second.relinks)
+
+	summary, err = newFakeSync(clusters).Run(&bytes.Buffer{}, false)
+	require.NoError(t, err)
+	assert.Equal(t, OwnershipSummary{}, summary)
+}
+
+func TestRadosAdminShouldRelinkBucketsWithSignedRequests(t *testing.T) {
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	api, err := newRadosAdmin(Conf{Endpoint: server.URL, AdminAccessKey: "admin", AdminSecretKey: "secret", AdminPrefix: "admin"})
+	require.NoError(t, err)
+
+	require.NoError(t, api.RelinkBucket("photos", "second.1", "alice"))
+
+	require.NotNil(t, request)
+	assert.Equal(t, http.MethodPut, request.Method)
+	assert.Equal(t, "/admin/bucket", request.URL.Path)
+	assert.Equal(t, "photos", request.URL.Query().Get("bucket"))
+	assert.Equal(t, "second.1", request.URL.Query().Get("bucket-id"))
+	assert.Equal(t, "alice", request.URL.Query().Get("uid"))
+	assert.True(t, strings.HasPrefix(request.Header.Get("Authorization"), "AWS admin:"))
+}
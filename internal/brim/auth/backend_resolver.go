@@ -19,6 +19,7 @@ import (
 	"github.com/allegro/akubra/internal/brim/admin"
 	"github.com/allegro/akubra/internal/brim/config"
 	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/store"
 )
 
 // BackendResolver resolves backends based on urls
@@ -105,6 +106,10 @@ func (bs *ConfigBasedBackendResolver) GetShardsRing(domain string) (sharding.Sha
 }
 
 func (bs *ConfigBasedBackendResolver) lookupUsingCrdStor(akubraBackendName, hostURL, access string) (*s3.S3, error) {
+	if storage, ok := bs.akubraConfig.Storages[akubraBackendName]; ok && storage.Backend.URL != nil && storage.Backend.Scheme == store.LocalScheme {
+		// local directories don't authenticate requests
+		return brimS3.GetS3Client(&brimS3.MigrationAuth{Endpoint: storage.Backend.String(), AccessKey: access}), nil
+	}
 	csCreds, err := bs.credentialsStore.Get(access, akubraBackendName)
 	if err != nil {
 		return nil, err
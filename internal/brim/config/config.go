@@ -7,6 +7,7 @@ import (
 
 	"github.com/allegro/akubra/internal/akubra/log"
 	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/types"
 	"gopkg.in/yaml.v2"
 
 	// "github.com/allegro/akubra/internal/brim/admin" # spare
@@ -57,6 +58,131 @@ type WALConf struct {
 	MaxEmittedTasksCount    int           `yaml:"MaxEmittedTasksCount"`
 	TaskEmissionDuration    time.Duration `yaml:"TaskEmissionDuration"`
 	FeederTaskFailureDelay  time.Duration `yaml:"FeederTaskFailureDelay"`
+	// FeederTaskMaxFailureDelay caps the failure delay doubled after every failed attempt
+	FeederTaskMaxFailureDelay time.Duration `yaml:"FeederTaskMaxFailureDelay"`
+	// FeederTaskMaxAttempts moves records failing that many times to the dead-letter table, zero retries forever
+	FeederTaskMaxAttempts int `yaml:"FeederTaskMaxAttempts"`
+	// FeederMaxPendingBatches is the number of consistency log batches in progress at once, so the Scheduler orders
+	// the records of several batches. 1 by default, SQLite and the embedded log process one batch at a time
+	FeederMaxPendingBatches int `yaml:"FeederMaxPendingBatches"`
+	// MultipartThreshold is the size from which objects are migrated with multipart uploads, 100MB by default
+	MultipartThreshold types.HumanSizeUnits `yaml:"MultipartThreshold"`
+	// MultipartPartSize is the part size of streamed objects which source part layout is unknown
+	MultipartPartSize types.HumanSizeUnits `yaml:"MultipartPartSize"`
+	// MultipartMaxInFlightParts is the number of parts of an object copied at once
+	MultipartMaxInFlightParts int `yaml:"MultipartMaxInFlightParts"`
+	// MultipartMemoryBudget bounds the memory taken by parts of a single migration
+	MultipartMemoryBudget types.HumanSizeUnits `yaml:"MultipartMemoryBudget"`
+	// VerifyChecksums compares checksums of the whole content of migrated objects
+	VerifyChecksums bool `yaml:"VerifyChecksums"`
+	// DeleteInvalidCopies removes migrated copies which failed the verification
+	DeleteInvalidCopies bool `yaml:"DeleteInvalidCopies"`
+	// MetadataAllowList limits the object attributes copied by migrations to the matching header names
+	MetadataAllowList []string `yaml:"MetadataAllowList"`
+	// MetadataDenyList excludes the matching header names from the copied object attributes
+	MetadataDenyList []string `yaml:"MetadataDenyList"`
+	// AdaptiveConcurrency limits the concurrent operations on every destination storage separately
+	AdaptiveConcurrency AdaptiveConcurrencyConf `yaml:"AdaptiveConcurrency"`
+	// Filter tunes the version lookups of the records
+	Filter FilterConf `yaml:"Filter"`
+}
+
+// FilterConf configures how the filter reads the versions of objects on the storages, zero values are the defaults
+type FilterConf struct {
+	// LookupTimeout bounds the version lookups of a single record on all the storages, 30s by default
+	LookupTimeout time.Duration `yaml:"LookupTimeout"`
+	// CacheSize is the number of objects which versions are cached, 1000 by default, negative disables the cache
+	CacheSize int `yaml:"CacheSize"`
+	// CacheTTL is the time the versions are cached for, 5s by default
+	CacheTTL time.Duration `yaml:"CacheTTL"`
+	// BatchSize is the number of queued records coalesced at once, 100 by default
+	BatchSize int `yaml:"BatchSize"`
+}
+
+// AdaptiveConcurrencyConf configures per storage limits, raised by one after every Window of healthy
+// operations and cut by DecreaseFactor when the latency or error rate exceeds the thresholds
+type AdaptiveConcurrencyConf struct {
+	Enabled bool `yaml:"Enabled"`
+	// MinPerBackend is 1 by default
+	MinPerBackend int `yaml:"MinPerBackend"`
+	// MaxPerBackend is workercount by default
+	MaxPerBackend int `yaml:"MaxPerBackend"`
+	// Window is the number of operations after which the limit is adjusted, 10 by default
+	Window int `yaml:"Window"`
+	// LatencyThreshold is the highest healthy mean duration of moving a mebibyte, latency is ignored if zero
+	LatencyThreshold time.Duration `yaml:"LatencyThreshold"`
+	// ErrorRateThreshold is the highest healthy share of server and network errors, 0.1 by default
+	ErrorRateThreshold float64 `yaml:"ErrorRateThreshold"`
+	// DecreaseFactor multiplies the limit of an unhealthy storage, 0.5 by default
+	DecreaseFactor float64 `yaml:"DecreaseFactor"`
+}
+
+// ScannedBucket is a bucket compared across the storages by the scanner
+type ScannedBucket struct {
+	Domain string `yaml:"Domain"`
+	Bucket string `yaml:"Bucket"`
+	// AccessKey resolves the credentials used on the storages
+	AccessKey string `yaml:"AccessKey"`
+}
+
+// ScannerConf configures the anti-entropy scanner, disabled if no buckets are listed
+type ScannerConf struct {
+	Buckets []ScannedBucket `yaml:"Buckets"`
+	// Interval is the pause between complete scans of the buckets
+	Interval time.Duration `yaml:"Interval"`
+	// CompareVersions reads the version header of every object, not only of the ones differing in listings
+	CompareVersions bool `yaml:"CompareVersions"`
+	// ListPageSize is the number of keys listed at once, checkpoints are saved every page
+	ListPageSize int `yaml:"ListPageSize"`
+	// ListRequestsPerSecond limits requests sent to the storages, unlimited if zero
+	ListRequestsPerSecond int `yaml:"ListRequestsPerSecond"`
+	// RepairsPerSecond limits the repair records emitted, unlimited if zero
+	RepairsPerSecond int `yaml:"RepairsPerSecond"`
+	// CheckpointFile keeps the progress and reports of scans, interrupted scans start over if empty
+	CheckpointFile string `yaml:"CheckpointFile"`
+}
+
+// Fairness keys of the scheduler
+const (
+	DomainFairnessKey    = "domain"
+	AccessKeyFairnessKey = "access_key"
+)
+
+// PriorityClass matches the records served before the records of the classes listed after it
+type PriorityClass struct {
+	Name string `yaml:"Name"`
+	// Methods are PUT or DELETE, any method matches if empty
+	Methods []string `yaml:"Methods"`
+	// Operations are object or bucket, any operation matches if empty
+	Operations []string `yaml:"Operations"`
+	// Repairs matches only the repair records fed by the scanner
+	Repairs bool `yaml:"Repairs"`
+}
+
+// SchedulerConf orders the records between the feeds and the filter
+type SchedulerConf struct {
+	// FairnessKey shares the consistency log queries and the queues of every class equally between the domains
+	// or the access keys, 'domain' or 'access_key', records are queued in the log's order if empty
+	FairnessKey string `yaml:"FairnessKey"`
+	// Classes are served in the listed order, records matching no class are served last
+	Classes []PriorityClass `yaml:"Classes"`
+	// MaxWait is the wait after which records are served regardless of their class, 1m by default
+	MaxWait time.Duration `yaml:"MaxWait"`
+	// Capacity is the number of records queued in the scheduler, 1000 by default
+	Capacity int `yaml:"Capacity"`
+}
+
+// ReplayConf configures the replay of akubra's access and sync logs, which replaces the consistency log feed if Path is set
+type ReplayConf struct {
+	// Path is a JSON log file or a directory of rotated log files
+	Path string `yaml:"Path"`
+	// From and To bound the time of the replayed entries, RFC3339 timestamps, the window is open if empty
+	From time.Time `yaml:"From"`
+	To   time.Time `yaml:"To"`
+	// CheckpointFile keeps the offsets of the replayed files, an interrupted replay starts over if empty
+	CheckpointFile string `yaml:"CheckpointFile"`
+	// Domain is the domain of the sync log entries, which don't name it, they are skipped if empty
+	Domain string `yaml:"Domain"`
 }
 
 // BrimConf is read from configuration file
@@ -70,8 +196,18 @@ type BrimConf struct {
 	Metrics                   metrics.Config `yaml:"Metrics,omitempty"`
 	DefaultPermanentProcessID uint64         `yaml:"DefaultPermanentProcessID"`
 	Supervisor                SupervisorConf `yaml:"Supervisor"`
-	WorkerCount               int            `yaml:"workercount"`
-	WALConf                   WALConf        `yaml:"WAL"`
+	// WorkerCount is the number of storage operations performed at once, 2 by default
+	WorkerCount int         `yaml:"workercount"`
+	WALConf     WALConf     `yaml:"WAL"`
+	Scanner     ScannerConf `yaml:"Scanner"`
+	// Scheduler orders the records fed to the filter
+	Scheduler SchedulerConf `yaml:"Scheduler"`
+	// Replay feeds the records from akubra's logs instead of the consistency log
+	Replay ReplayConf `yaml:"Replay"`
+	// TechnicalEndpointListen is the address of the admin endpoints, disabled if empty
+	TechnicalEndpointListen string `yaml:"TechnicalEndpointListen"`
+	// DrainTimeout bounds the wait for the records in progress on shutdown
+	DrainTimeout time.Duration `yaml:"DrainTimeout"`
 }
 
 // EndpointRegionMapping returns region to endpoint map
@@ -2,10 +2,20 @@ package config
 
 import (
 	"fmt"
+	"path"
+	"path/filepath"
 
+	"github.com/allegro/akubra/internal/akubra/watchdog"
 	"github.com/allegro/akubra/internal/brim/admin"
 )
 
+const (
+	// minMultipartPartSize is the smallest part size accepted by S3
+	minMultipartPartSize = 5 * 1024 * 1024
+	// maxSinglePutSize is the largest object uploaded with a single PUT
+	maxSinglePutSize = 5 * 1024 * 1024 * 1024
+)
+
 // ValidateBrimConfig Brim Yaml values validation
 func ValidateBrimConfig(bc BrimConf) bool {
 	// err := validator.SetValidationFunc("SupervisorConfValidator", SupervisorConfValidator)
@@ -101,6 +111,123 @@ func WALConfValidator(v interface{}, param string) error {
 	if walConf.MaxEmittedTasksCount < 1 {
 		return fmt.Errorf("%s WALConfValidator.MaxEmittedTasksCountcan't be < 1", msgPfx)
 	}
+	if walConf.FeederTaskMaxAttempts < 0 {
+		return fmt.Errorf("%s WALConfValidator.FeederTaskMaxAttempts can't be < 0", msgPfx)
+	}
+	if walConf.FeederMaxPendingBatches < 0 {
+		return fmt.Errorf("%s WALConfValidator.FeederMaxPendingBatches can't be < 0", msgPfx)
+	}
+	if walConf.FeederTaskMaxFailureDelay != 0 && walConf.FeederTaskMaxFailureDelay < walConf.FeederTaskFailureDelay {
+		return fmt.Errorf("%s WALConfValidator.FeederTaskMaxFailureDelay can't be lower than FeederTaskFailureDelay", msgPfx)
+	}
+	if walConf.MultipartPartSize.SizeInBytes != 0 && walConf.MultipartPartSize.SizeInBytes < minMultipartPartSize {
+		return fmt.Errorf("%s WALConfValidator.MultipartPartSize can't be < 5MiB", msgPfx)
+	}
+	if walConf.MultipartMaxInFlightParts < 0 {
+		return fmt.Errorf("%s WALConfValidator.MultipartMaxInFlightParts can't be < 0", msgPfx)
+	}
+	if walConf.MultipartThreshold.SizeInBytes > maxSinglePutSize {
+		return fmt.Errorf("%s WALConfValidator.MultipartThreshold can't be > 5GiB", msgPfx)
+	}
+	if err := adaptiveConcurrencyConfValidator(walConf.AdaptiveConcurrency); err != nil {
+		return fmt.Errorf("%s WALConfValidator.AdaptiveConcurrency %s", msgPfx, err)
+	}
+	for _, patterns := range [][]string{walConf.MetadataAllowList, walConf.MetadataDenyList} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s WALConfValidator metadata pattern %q is malformed", msgPfx, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func adaptiveConcurrencyConfValidator(adaptiveConf AdaptiveConcurrencyConf) error {
+	if adaptiveConf.MinPerBackend < 0 || adaptiveConf.MaxPerBackend < 0 || adaptiveConf.Window < 0 {
+		return fmt.Errorf("MinPerBackend, MaxPerBackend and Window can't be < 0")
+	}
+	if adaptiveConf.MaxPerBackend != 0 && adaptiveConf.MaxPerBackend < adaptiveConf.MinPerBackend {
+		return fmt.Errorf("MaxPerBackend can't be lower than MinPerBackend")
+	}
+	if adaptiveConf.ErrorRateThreshold < 0 || adaptiveConf.ErrorRateThreshold > 1 {
+		return fmt.Errorf("ErrorRateThreshold has to be between 0 and 1")
+	}
+	if adaptiveConf.DecreaseFactor < 0 || adaptiveConf.DecreaseFactor >= 1 {
+		return fmt.Errorf("DecreaseFactor has to be between 0 and 1")
+	}
+	return nil
+}
+
+// ScannerConfValidator for "Scanner" section in brim Yaml configuration
+func ScannerConfValidator(v interface{}, param string) error {
+	msgPfx := "ScannerConfValidator: "
+	scannerConf, ok := v.(ScannerConf)
+	if !ok {
+		return fmt.Errorf("%s ScannerConf type mismatch in section %q", msgPfx, param)
+	}
+	for _, bucket := range scannerConf.Buckets {
+		if bucket.Domain == "" || bucket.Bucket == "" || bucket.AccessKey == "" {
+			return fmt.Errorf("%s scanned bucket requires Domain, Bucket and AccessKey in section %q", msgPfx, param)
+		}
+	}
+	if scannerConf.Interval < 0 || scannerConf.ListPageSize < 0 ||
+		scannerConf.ListRequestsPerSecond < 0 || scannerConf.RepairsPerSecond < 0 {
+		return fmt.Errorf("%s Interval, ListPageSize and rate limits can't be negative in section %q", msgPfx, param)
+	}
+	return nil
+}
+
+// SchedulerConfValidator for "Scheduler" section in brim Yaml configuration
+func SchedulerConfValidator(v interface{}, param string) error {
+	msgPfx := "SchedulerConfValidator: "
+	schedulerConf, ok := v.(SchedulerConf)
+	if !ok {
+		return fmt.Errorf("%s SchedulerConf type mismatch in section %q", msgPfx, param)
+	}
+	switch schedulerConf.FairnessKey {
+	case "", DomainFairnessKey, AccessKeyFairnessKey:
+	default:
+		return fmt.Errorf("%s FairnessKey has to be %q or %q in section %q", msgPfx, DomainFairnessKey, AccessKeyFairnessKey, param)
+	}
+	if schedulerConf.MaxWait < 0 || schedulerConf.Capacity < 0 {
+		return fmt.Errorf("%s MaxWait and Capacity can't be negative in section %q", msgPfx, param)
+	}
+	names := make(map[string]bool)
+	for _, class := range schedulerConf.Classes {
+		if class.Name == "" || names[class.Name] {
+			return fmt.Errorf("%s priority classes require unique names in section %q", msgPfx, param)
+		}
+		names[class.Name] = true
+		for _, method := range class.Methods {
+			if method != string(watchdog.PUT) && method != string(watchdog.DELETE) {
+				return fmt.Errorf("%s method %q of class %q has to be PUT or DELETE", msgPfx, method, class.Name)
+			}
+		}
+		for _, operation := range class.Operations {
+			if operation != string(watchdog.ObjectOperation) && operation != string(watchdog.BucketOperation) {
+				return fmt.Errorf("%s operation %q of class %q has to be object or bucket", msgPfx, operation, class.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ReplayConfValidator for "Replay" section in brim Yaml configuration
+func ReplayConfValidator(v interface{}, param string) error {
+	msgPfx := "ReplayConfValidator: "
+	replayConf, ok := v.(ReplayConf)
+	if !ok {
+		return fmt.Errorf("%s ReplayConf type mismatch in section %q", msgPfx, param)
+	}
+	if replayConf.Path == "" {
+		return fmt.Errorf("%s Path is required in section %q", msgPfx, param)
+	}
+	if !replayConf.From.IsZero() && !replayConf.To.IsZero() && !replayConf.From.Before(replayConf.To) {
+		return fmt.Errorf("%s From has to be before To in section %q", msgPfx, param)
+	}
+	if replayConf.CheckpointFile != "" && filepath.Dir(replayConf.CheckpointFile) == filepath.Clean(replayConf.Path) {
+		return fmt.Errorf("%s CheckpointFile can't be kept among the replayed files in section %q", msgPfx, param)
+	}
 	return nil
 }
 
@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -90,3 +91,109 @@ func prepareYamlConfig(adminsConf rados.AdminsConf, supervisorConfig SupervisorC
 
 	return bc
 }
+
+func TestWALConfValidatorShouldValidateRetryPolicy(t *testing.T) {
+	walConf := WALConf{MaxRecordsPerQuery: 1, MaxConcurrentMigrations: 1, MaxEmittedTasksCount: 1, FeederTaskFailureDelay: time.Minute}
+	assert.NoError(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.FeederTaskMaxFailureDelay = time.Hour
+	walConf.FeederTaskMaxAttempts = 10
+	assert.NoError(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.FeederTaskMaxAttempts = -1
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.FeederTaskMaxAttempts = 10
+	walConf.FeederTaskMaxFailureDelay = time.Second
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+}
+
+func TestWALConfValidatorShouldValidateMultipartLimits(t *testing.T) {
+	walConf := WALConf{MaxRecordsPerQuery: 1, MaxConcurrentMigrations: 1, MaxEmittedTasksCount: 1}
+	walConf.MultipartPartSize.SizeInBytes = 8 * 1024 * 1024
+	walConf.MultipartMaxInFlightParts = 4
+	assert.NoError(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.MultipartMaxInFlightParts = -1
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.MultipartMaxInFlightParts = 4
+	walConf.MultipartPartSize.SizeInBytes = 1024 * 1024
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.MultipartPartSize.SizeInBytes = 8 * 1024 * 1024
+	walConf.MultipartThreshold.SizeInBytes = 6 * 1024 * 1024 * 1024
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+}
+
+func TestWALConfValidatorShouldValidateAdaptiveConcurrency(t *testing.T) {
+	walConf := WALConf{MaxRecordsPerQuery: 1, MaxConcurrentMigrations: 1, MaxEmittedTasksCount: 1}
+	walConf.AdaptiveConcurrency = AdaptiveConcurrencyConf{Enabled: true, MinPerBackend: 1, MaxPerBackend: 8,
+		ErrorRateThreshold: 0.2, DecreaseFactor: 0.5}
+	assert.NoError(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.AdaptiveConcurrency.MinPerBackend = 10
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.AdaptiveConcurrency.MinPerBackend = 1
+	walConf.AdaptiveConcurrency.ErrorRateThreshold = 2
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.AdaptiveConcurrency.ErrorRateThreshold = 0.2
+	walConf.AdaptiveConcurrency.DecreaseFactor = 1
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+}
+
+func TestScannerConfValidatorShouldRequireBucketLocation(t *testing.T) {
+	scannerConf := ScannerConf{Buckets: []ScannedBucket{{Domain: "example.com", Bucket: "images", AccessKey: "access"}}}
+	assert.NoError(t, ScannerConfValidator(scannerConf, "Scanner"))
+
+	scannerConf.RepairsPerSecond = -1
+	assert.Error(t, ScannerConfValidator(scannerConf, "Scanner"))
+
+	scannerConf.RepairsPerSecond = 0
+	scannerConf.Buckets = append(scannerConf.Buckets, ScannedBucket{Domain: "example.com", Bucket: "docs"})
+	assert.Error(t, ScannerConfValidator(scannerConf, "Scanner"))
+}
+
+func TestWALConfValidatorShouldValidateMetadataPatterns(t *testing.T) {
+	walConf := WALConf{MaxRecordsPerQuery: 1, MaxConcurrentMigrations: 1, MaxEmittedTasksCount: 1,
+		MetadataAllowList: []string{"x-amz-meta-*"}, MetadataDenyList: []string{"x-amz-meta-[a-c]*"}}
+	assert.NoError(t, WALConfValidator(walConf, "WAL"))
+
+	walConf.MetadataDenyList = []string{"x-amz-meta-[a-c"}
+	assert.Error(t, WALConfValidator(walConf, "WAL"))
+}
+
+func TestSchedulerConfValidatorShouldValidateClasses(t *testing.T) {
+	schedulerConf := SchedulerConf{FairnessKey: DomainFairnessKey, MaxWait: time.Minute, Classes: []PriorityClass{
+		{Name: "repairs", Repairs: true},
+		{Name: "deletes", Methods: []string{"DELETE"}, Operations: []string{"object"}},
+	}}
+	assert.NoError(t, SchedulerConfValidator(schedulerConf, "Scheduler"))
+
+	schedulerConf.FairnessKey = "bucket"
+	assert.Error(t, SchedulerConfValidator(schedulerConf, "Scheduler"))
+
+	schedulerConf.FairnessKey = AccessKeyFairnessKey
+	schedulerConf.Classes = append(schedulerConf.Classes, PriorityClass{Name: "deletes"})
+	assert.Error(t, SchedulerConfValidator(schedulerConf, "Scheduler"))
+
+	schedulerConf.Classes = []PriorityClass{{Name: "gets", Methods: []string{"GET"}}}
+	assert.Error(t, SchedulerConfValidator(schedulerConf, "Scheduler"))
+}
+
+func TestReplayConfValidatorShouldValidateTheWindowAndPaths(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	replayConf := ReplayConf{Path: "/var/log/akubra", From: from, To: from.Add(time.Hour), CheckpointFile: "/var/lib/brim/replay.json"}
+	assert.NoError(t, ReplayConfValidator(replayConf, "Replay"))
+
+	replayConf.To = from
+	assert.Error(t, ReplayConfValidator(replayConf, "Replay"))
+
+	replayConf.To = time.Time{}
+	replayConf.CheckpointFile = "/var/log/akubra/replay.json"
+	assert.Error(t, ReplayConfValidator(replayConf, "Replay"))
+
+	assert.Error(t, ReplayConfValidator(ReplayConf{}, "Replay"))
+}
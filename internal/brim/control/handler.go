@@ -0,0 +1,245 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/brim/scheduler"
+	feederUtils "github.com/allegro/akubra/pkg/brim/feeder"
+)
+
+// EndpointPath is where brim serves the Handler
+const EndpointPath = "/brim"
+
+const (
+	statusPath        = "status"
+	pausePath         = "feeder/pause"
+	resumePath        = "feeder/resume"
+	throttlePath      = "throttle"
+	workersPath       = "workers"
+	drainPath         = "drain"
+	defaultDrainLimit = 30 * time.Second
+)
+
+// Workers is the part of the worker adjusted at runtime
+type Workers interface {
+	SetConcurrency(maxConcurrentMigrations int)
+	Concurrency() (limit, inUse int)
+	InFlightTasks() int
+}
+
+// Throughput is the rate of processed records per second
+type Throughput struct {
+	Rate1  float64 `json:"rate1"`
+	Rate5  float64 `json:"rate5"`
+	Rate15 float64 `json:"rate15"`
+}
+
+// InFlight counts the work in progress
+type InFlight struct {
+	// Records were emitted to the filter and aren't processed yet
+	Records int64 `json:"records"`
+	Tasks   int   `json:"tasks"`
+	// StorageOperations are the operations of the tasks holding the concurrency limit
+	StorageOperations int `json:"storage_operations"`
+}
+
+// Queues are the numbers of records waiting between the stages
+type Queues struct {
+	FeederToFilter int `json:"feeder_to_filter"`
+	FilterToWorker int `json:"filter_to_worker"`
+	// Scheduled are the non empty queues of the scheduler in front of the throttle
+	Scheduled []scheduler.QueueStatus `json:"scheduled"`
+}
+
+// Throttle is the emission rate of the feeder
+type Throttle struct {
+	MaxEmittedTasksCount uint64 `json:"max_emitted_tasks"`
+	TaskEmissionDuration string `json:"emission_duration"`
+	BurstEnabled         bool   `json:"burst"`
+}
+
+// Status is the state of the pipeline reported by the Handler
+type Status struct {
+	Paused         bool       `json:"paused"`
+	Draining       bool       `json:"draining"`
+	Fed            int64      `json:"fed"`
+	Finished       int64      `json:"finished"`
+	Failed         int64      `json:"failed"`
+	Throughput     Throughput `json:"throughput"`
+	InFlight       InFlight   `json:"in_flight"`
+	Queues         Queues     `json:"queues"`
+	Concurrency    int        `json:"concurrency"`
+	Throttle       Throttle   `json:"throttle"`
+	RecentFailures []Failure  `json:"recent_failures"`
+}
+
+// Handler exposes the state of the pipeline and adjusts it under the path prefix:
+//
+//	GET  <prefix>/status         shows throughput, work in progress, queue depths (also of the scheduler) and recent failures
+//	POST <prefix>/feeder/pause   stops taking records from the feeds
+//	POST <prefix>/feeder/resume  restarts the feeds
+//	POST <prefix>/throttle       sets 'max_emitted_tasks', 'emission_duration' and 'burst' of the feeder
+//	POST <prefix>/workers        sets the worker 'concurrency'
+//	POST <prefix>/drain          pauses the feeds and waits until the records taken are processed, at most 'timeout'
+type Handler struct {
+	pipeline  *Pipeline
+	throttler *feederUtils.Throttler
+	workers   Workers
+	prefix    string
+}
+
+// NewHandler creates a Handler serving under the path prefix
+func NewHandler(pipeline *Pipeline, throttler *feederUtils.Throttler, workers Workers, prefix string) *Handler {
+	return &Handler{pipeline: pipeline, throttler: throttler, workers: workers, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// ServeHTTP dispatches the control requests
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, handler.prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resource := strings.Trim(strings.TrimPrefix(r.URL.Path, handler.prefix), "/")
+	switch {
+	case resource == statusPath && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, handler.Status())
+	case resource == pausePath && r.Method == http.MethodPost:
+		handler.pipeline.Pause()
+		log.Printf("Brim feeder paused")
+		writeJSON(w, http.StatusOK, handler.Status())
+	case resource == resumePath && r.Method == http.MethodPost:
+		handler.pipeline.Resume()
+		log.Printf("Brim feeder resumed")
+		writeJSON(w, http.StatusOK, handler.Status())
+	case resource == throttlePath && r.Method == http.MethodPost:
+		handler.throttle(w, r)
+	case resource == workersPath && r.Method == http.MethodPost:
+		handler.setConcurrency(w, r)
+	case resource == drainPath && r.Method == http.MethodPost:
+		handler.drain(w, r)
+	case resource == statusPath || resource == pausePath || resource == resumePath ||
+		resource == throttlePath || resource == workersPath || resource == drainPath:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Status collects the state of the pipeline
+func (handler *Handler) Status() Status {
+	pipeline := handler.pipeline
+	concurrency, inUse := handler.workers.Concurrency()
+	config := handler.throttler.Config()
+	pipeline.mx.Lock()
+	defer pipeline.mx.Unlock()
+	return Status{
+		Paused:   pipeline.paused,
+		Draining: pipeline.draining,
+		Fed:      pipeline.fed,
+		Finished: pipeline.finished,
+		Failed:   pipeline.failed,
+		Throughput: Throughput{
+			Rate1:  pipeline.throughput.Rate1(),
+			Rate5:  pipeline.throughput.Rate5(),
+			Rate15: pipeline.throughput.Rate15(),
+		},
+		InFlight: InFlight{
+			Records:           pipeline.emitted - pipeline.finished - pipeline.failed,
+			Tasks:             handler.workers.InFlightTasks(),
+			StorageOperations: inUse,
+		},
+		Queues: Queues{
+			FeederToFilter: len(pipeline.entries),
+			FilterToWorker: len(pipeline.tasks),
+			Scheduled:      scheduledQueues(pipeline.scheduler),
+		},
+		Concurrency: concurrency,
+		Throttle: Throttle{
+			MaxEmittedTasksCount: config.MaxEmittedTasksCount,
+			TaskEmissionDuration: config.TaskEmissionDuration.String(),
+			BurstEnabled:         config.BurstEnabled,
+		},
+		RecentFailures: append([]Failure{}, pipeline.failures...),
+	}
+}
+
+func scheduledQueues(recordsScheduler *scheduler.Scheduler) []scheduler.QueueStatus {
+	if recordsScheduler == nil {
+		return []scheduler.QueueStatus{}
+	}
+	return recordsScheduler.Queues()
+}
+
+func (handler *Handler) throttle(w http.ResponseWriter, r *http.Request) {
+	config := handler.throttler.Config()
+	query := r.URL.Query()
+	if param := query.Get("max_emitted_tasks"); param != "" {
+		parsed, err := strconv.ParseUint(param, 10, 64)
+		if err != nil || parsed == 0 {
+			http.Error(w, "max_emitted_tasks has to be a positive number", http.StatusBadRequest)
+			return
+		}
+		config.MaxEmittedTasksCount = parsed
+	}
+	if param := query.Get("emission_duration"); param != "" {
+		parsed, err := time.ParseDuration(param)
+		if err != nil || parsed < 0 {
+			http.Error(w, "emission_duration has to be a non negative duration", http.StatusBadRequest)
+			return
+		}
+		config.TaskEmissionDuration = parsed
+	}
+	if param := query.Get("burst"); param != "" {
+		parsed, err := strconv.ParseBool(param)
+		if err != nil {
+			http.Error(w, "burst has to be true or false", http.StatusBadRequest)
+			return
+		}
+		config.BurstEnabled = parsed
+	}
+	handler.throttler.SetConfig(config)
+	log.Printf("Brim feeder throttle set to %d tasks per %s, burst %t",
+		config.MaxEmittedTasksCount, config.TaskEmissionDuration, config.BurstEnabled)
+	writeJSON(w, http.StatusOK, handler.Status())
+}
+
+func (handler *Handler) setConcurrency(w http.ResponseWriter, r *http.Request) {
+	concurrency, err := strconv.Atoi(r.URL.Query().Get("concurrency"))
+	if err != nil || concurrency <= 0 {
+		http.Error(w, "concurrency has to be a positive number", http.StatusBadRequest)
+		return
+	}
+	handler.workers.SetConcurrency(concurrency)
+	log.Printf("Brim worker concurrency set to %d", concurrency)
+	writeJSON(w, http.StatusOK, handler.Status())
+}
+
+func (handler *Handler) drain(w http.ResponseWriter, r *http.Request) {
+	timeout := defaultDrainLimit
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		parsed, err := time.ParseDuration(param)
+		if err != nil || parsed < 0 {
+			http.Error(w, "timeout has to be a non negative duration", http.StatusBadRequest)
+			return
+		}
+		timeout = parsed
+	}
+	status := http.StatusOK
+	if !handler.pipeline.Drain(timeout) {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, handler.Status())
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
@@ -0,0 +1,123 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/brim/config"
+	"github.com/allegro/akubra/internal/brim/scheduler"
+	feederUtils "github.com/allegro/akubra/pkg/brim/feeder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testWorkers struct {
+	concurrency int
+}
+
+func (workers *testWorkers) SetConcurrency(concurrency int)  { workers.concurrency = concurrency }
+func (workers *testWorkers) Concurrency() (limit, inUse int) { return workers.concurrency, 1 }
+func (workers *testWorkers) InFlightTasks() int              { return 3 }
+
+func serve(handler *Handler, method, target string) (*httptest.ResponseRecorder, Status) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	var status Status
+	_ = json.Unmarshal(recorder.Body.Bytes(), &status)
+	return recorder, status
+}
+
+func TestShouldAdjustPipelineWithHandler(t *testing.T) {
+	pipeline := NewPipeline()
+	throttler := feederUtils.NewThrottler(feederUtils.ThrottledPublisherConfig{MaxEmittedTasksCount: 10,
+		TaskEmissionDuration: time.Second})
+	workers := &testWorkers{concurrency: 2}
+	handler := NewHandler(pipeline, throttler, workers, EndpointPath)
+
+	recorder, status := serve(handler, http.MethodPost, "/brim/feeder/pause")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, status.Paused)
+
+	recorder, status = serve(handler, http.MethodPost, "/brim/throttle?max_emitted_tasks=50&emission_duration=2s&burst=true")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, Throttle{MaxEmittedTasksCount: 50, TaskEmissionDuration: "2s", BurstEnabled: true}, status.Throttle)
+	assert.Equal(t, feederUtils.ThrottledPublisherConfig{MaxEmittedTasksCount: 50, TaskEmissionDuration: 2 * time.Second,
+		BurstEnabled: true}, throttler.Config())
+
+	recorder, status = serve(handler, http.MethodPost, "/brim/workers?concurrency=8")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 8, workers.concurrency)
+	assert.Equal(t, 8, status.Concurrency)
+	assert.Equal(t, InFlight{Tasks: 3, StorageOperations: 1}, status.InFlight)
+
+	recorder, status = serve(handler, http.MethodPost, "/brim/feeder/resume")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.False(t, status.Paused)
+}
+
+func TestShouldReportProgressAndFailures(t *testing.T) {
+	pipeline := NewPipeline()
+	handler := NewHandler(pipeline, feederUtils.NewThrottler(feederUtils.ThrottledPublisherConfig{}),
+		&testWorkers{concurrency: 2}, EndpointPath)
+	entry := pipeline.Track(entryOf("1"))
+	pipeline.Track(entryOf("2"))
+	_ = entry.RecordProcessedHook(entry.Record, errors.New("503 Service Unavailable"))
+
+	recorder, status := serve(handler, http.MethodGet, "/brim/status")
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, int64(1), status.Failed)
+	assert.Equal(t, int64(1), status.InFlight.Records)
+	require.Len(t, status.RecentFailures, 1)
+	assert.Equal(t, "bucket/1", status.RecentFailures[0].ObjectID)
+	assert.Equal(t, "server_error", status.RecentFailures[0].ErrorClass)
+}
+
+func TestShouldReportScheduledQueues(t *testing.T) {
+	pipeline := NewPipeline()
+	recordsScheduler := scheduler.NewScheduler(config.SchedulerConf{})
+	pipeline.WatchScheduler(recordsScheduler)
+	handler := NewHandler(pipeline, feederUtils.NewThrottler(feederUtils.ThrottledPublisherConfig{}),
+		&testWorkers{}, EndpointPath)
+	feed := make(chan interface{}, 3)
+	for _, requestID := range []string{"1", "2", "3"} {
+		feed <- entryOf(requestID)
+	}
+	recordsScheduler.Schedule(feed)
+
+	var status Status
+	for attempt := 0; attempt < 100; attempt++ {
+		_, status = serve(handler, http.MethodGet, "/brim/status")
+		if len(status.Queues.Scheduled) == 1 && status.Queues.Scheduled[0].Depth == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.Len(t, status.Queues.Scheduled, 1)
+	assert.Equal(t, scheduler.DefaultClass, status.Queues.Scheduled[0].Class)
+	assert.Equal(t, 2, status.Queues.Scheduled[0].Depth, "the scheduler should hold the record it emits next")
+}
+
+func TestShouldRejectInvalidControlRequests(t *testing.T) {
+	handler := NewHandler(NewPipeline(), feederUtils.NewThrottler(feederUtils.ThrottledPublisherConfig{}),
+		&testWorkers{}, EndpointPath)
+	for _, request := range []struct {
+		method, target string
+		expected       int
+	}{
+		{http.MethodPost, "/brim/workers?concurrency=0", http.StatusBadRequest},
+		{http.MethodPost, "/brim/throttle?max_emitted_tasks=none", http.StatusBadRequest},
+		{http.MethodPost, "/brim/throttle?emission_duration=-1s", http.StatusBadRequest},
+		{http.MethodPost, "/brim/drain?timeout=soon", http.StatusBadRequest},
+		{http.MethodPost, "/brim/status", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/brim/unknown", http.StatusNotFound},
+	} {
+		recorder, _ := serve(handler, request.method, request.target)
+		assert.Equal(t, request.expected, recorder.Code, request.target)
+	}
+}
@@ -0,0 +1,169 @@
+package control
+
+import (
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/scheduler"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// QueueCapacity is the size of the queues between the feeder, the filter and the workers
+	QueueCapacity        = 100
+	recentFailuresLimit  = 50
+	drainPollingInterval = 100 * time.Millisecond
+)
+
+// Failure is a consistency record which sync failed
+type Failure struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	ObjectID   string    `json:"object_id"`
+	Domain     string    `json:"domain"`
+	Method     string    `json:"method"`
+	ErrorClass string    `json:"error_class"`
+	Error      string    `json:"error"`
+}
+
+// Pipeline counts the records passing from the feeds to the workers and pauses the feeds
+type Pipeline struct {
+	paused   bool
+	draining bool
+	resumed  *sync.Cond
+	// fed records left the feeds, emitted ones passed the throttle to the filter
+	fed      int64
+	emitted  int64
+	finished int64
+	failed   int64
+	failures []Failure
+	// entries and tasks are the queues in front of the filter and the workers
+	entries    chan *model.WALEntry
+	tasks      <-chan *model.WALTask
+	scheduler  *scheduler.Scheduler
+	throughput metrics.Meter
+	mx         sync.Mutex
+}
+
+// NewPipeline creates a running Pipeline
+func NewPipeline() *Pipeline {
+	pipeline := &Pipeline{throughput: metrics.NewMeter()}
+	pipeline.resumed = sync.NewCond(&pipeline.mx)
+	return pipeline
+}
+
+// WatchQueues sets the queues which depth is reported
+func (pipeline *Pipeline) WatchQueues(entries chan *model.WALEntry, tasks <-chan *model.WALTask) {
+	pipeline.mx.Lock()
+	defer pipeline.mx.Unlock()
+	pipeline.entries, pipeline.tasks = entries, tasks
+}
+
+// WatchScheduler sets the scheduler which queues are reported
+func (pipeline *Pipeline) WatchScheduler(recordsScheduler *scheduler.Scheduler) {
+	pipeline.mx.Lock()
+	defer pipeline.mx.Unlock()
+	pipeline.scheduler = recordsScheduler
+}
+
+// Forward passes the records of the feed to the channel, it stops taking records while the pipeline is paused
+func (pipeline *Pipeline) Forward(feed <-chan *model.WALEntry, feedChannel chan<- interface{}) {
+	for {
+		pipeline.waitIfPaused()
+		entry, ok := <-feed
+		if !ok {
+			return
+		}
+		pipeline.mx.Lock()
+		pipeline.fed++
+		pipeline.mx.Unlock()
+		feedChannel <- entry
+	}
+}
+
+func (pipeline *Pipeline) waitIfPaused() {
+	pipeline.mx.Lock()
+	defer pipeline.mx.Unlock()
+	for pipeline.paused {
+		pipeline.resumed.Wait()
+	}
+}
+
+// Track counts the entry as emitted to the filter and wraps its hook to count it as finished
+func (pipeline *Pipeline) Track(entry *model.WALEntry) *model.WALEntry {
+	pipeline.mx.Lock()
+	pipeline.emitted++
+	pipeline.mx.Unlock()
+	hook := entry.RecordProcessedHook
+	entry.RecordProcessedHook = func(record *watchdog.ConsistencyRecord, err error) error {
+		pipeline.finish(record, err)
+		return hook(record, err)
+	}
+	return entry
+}
+
+func (pipeline *Pipeline) finish(record *watchdog.ConsistencyRecord, err error) {
+	pipeline.throughput.Mark(1)
+	pipeline.mx.Lock()
+	defer pipeline.mx.Unlock()
+	if err == nil {
+		pipeline.finished++
+		return
+	}
+	pipeline.failed++
+	failure := Failure{
+		Time:       time.Now(),
+		RequestID:  record.RequestID,
+		ObjectID:   record.ObjectID,
+		Domain:     record.Domain,
+		Method:     string(record.Method),
+		ErrorClass: brimS3.ClassifyError(err),
+		Error:      err.Error(),
+	}
+	pipeline.failures = append(pipeline.failures, failure)
+	if len(pipeline.failures) > recentFailuresLimit {
+		pipeline.failures = pipeline.failures[len(pipeline.failures)-recentFailuresLimit:]
+	}
+}
+
+// Pause stops the feeds, records already taken from them are still processed
+func (pipeline *Pipeline) Pause() {
+	pipeline.mx.Lock()
+	defer pipeline.mx.Unlock()
+	pipeline.paused = true
+}
+
+// Resume restarts the feeds paused by Pause or Drain
+func (pipeline *Pipeline) Resume() {
+	pipeline.mx.Lock()
+	defer pipeline.mx.Unlock()
+	pipeline.paused = false
+	pipeline.draining = false
+	pipeline.resumed.Broadcast()
+}
+
+// Drain pauses the feeds and waits until the records taken from them are processed,
+// it returns false if they aren't processed within the timeout
+func (pipeline *Pipeline) Drain(timeout time.Duration) bool {
+	pipeline.mx.Lock()
+	pipeline.paused = true
+	pipeline.draining = true
+	pipeline.mx.Unlock()
+	deadline := time.Now().Add(timeout)
+	for {
+		pipeline.mx.Lock()
+		pending := pipeline.fed - pipeline.finished - pipeline.failed
+		draining := pipeline.draining
+		pipeline.mx.Unlock()
+		if pending <= 0 {
+			return true
+		}
+		if !draining || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollingInterval)
+	}
+}
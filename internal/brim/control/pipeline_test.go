@@ -0,0 +1,67 @@
+package control
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func entryOf(requestID string) *model.WALEntry {
+	return &model.WALEntry{
+		Record:              &watchdog.ConsistencyRecord{RequestID: requestID, ObjectID: "bucket/" + requestID},
+		RecordProcessedHook: func(record *watchdog.ConsistencyRecord, err error) error { return nil },
+	}
+}
+
+func TestShouldStopForwardingRecordsWhilePaused(t *testing.T) {
+	pipeline := NewPipeline()
+	feed := make(chan *model.WALEntry, 2)
+	forwarded := make(chan interface{})
+	pipeline.Pause()
+	go pipeline.Forward(feed, forwarded)
+
+	feed <- entryOf("1")
+	select {
+	case <-forwarded:
+		t.Fatal("record forwarded while the pipeline is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pipeline.Resume()
+	select {
+	case entry := <-forwarded:
+		assert.Equal(t, "1", entry.(*model.WALEntry).Record.RequestID)
+	case <-time.After(time.Second):
+		t.Fatal("record not forwarded after the pipeline was resumed")
+	}
+}
+
+func TestShouldDrainRecordsTakenFromFeeds(t *testing.T) {
+	pipeline := NewPipeline()
+	feed := make(chan *model.WALEntry, 2)
+	forwarded := make(chan interface{}, 2)
+	feed <- entryOf("1")
+	feed <- entryOf("2")
+	go pipeline.Forward(feed, forwarded)
+	first := pipeline.Track((<-forwarded).(*model.WALEntry))
+	second := pipeline.Track((<-forwarded).(*model.WALEntry))
+
+	require.NoError(t, first.RecordProcessedHook(first.Record, nil))
+	assert.False(t, pipeline.Drain(10*time.Millisecond))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = second.RecordProcessedHook(second.Record, errors.New("failed"))
+	}()
+	assert.True(t, pipeline.Drain(time.Second))
+	assert.Equal(t, int64(1), pipeline.finished)
+	assert.Equal(t, int64(1), pipeline.failed)
+	require.Len(t, pipeline.failures, 1)
+	assert.Equal(t, "2", pipeline.failures[0].RequestID)
+	assert.Equal(t, "failed", pipeline.failures[0].Error)
+}
@@ -0,0 +1,92 @@
+package feeder
+
+import (
+	"strings"
+
+	"github.com/allegro/akubra/internal/akubra/config"
+	"github.com/allegro/akubra/internal/akubra/database"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/jinzhu/gorm"
+)
+
+const defaultDryRunPageSize = 1000
+
+//DryRunWALFeeder is an implementation of WALFeeder that feeds the records due in the consistency log once, without
+//locking, postponing or compacting them. The feed is closed after the last record
+type DryRunWALFeeder struct {
+	WALFeeder
+	db      *gorm.DB
+	dialect watchdog.Dialect
+	config  *WALFeederConfig
+}
+
+//NewDryRunWALFeeder constructs an instance of DryRunWALFeeder reading the SQL or the embedded consistency log
+func NewDryRunWALFeeder(akubraConfig *config.Config, feederConfig *WALFeederConfig,
+	dbClientFactory database.DBClientFactory) (WALFeeder, error) {
+	if strings.ToLower(akubraConfig.Watchdog.Type) == watchdog.EmbeddedWatchdogType {
+		db, err := watchdog.OpenEmbeddedDB(akubraConfig.Watchdog.Props[watchdog.EmbeddedPathProp])
+		if err != nil {
+			return nil, err
+		}
+		return &DryRunWALFeeder{db: db, dialect: &watchdog.SQLiteDialect{}, config: feederConfig}, nil
+	}
+	dialect, err := watchdog.DialectFor(akubraConfig.Watchdog.Props["dialect"])
+	if err != nil {
+		return nil, err
+	}
+	db, err := dbClientFactory.CreateConnection(akubraConfig.Watchdog.Props)
+	if err != nil {
+		return nil, err
+	}
+	return &DryRunWALFeeder{db: db, dialect: dialect, config: feederConfig}, nil
+}
+
+//CreateFeed streams the newest due record of every object, bucket and sub-resource, their hooks do nothing
+func (feeder *DryRunWALFeeder) CreateFeed() <-chan *model.WALEntry {
+	walEntriesChannel := make(chan *model.WALEntry, feeder.config.MaxRecordsPerQuery)
+	go feeder.queryDB(walEntriesChannel)
+	return walEntriesChannel
+}
+
+func (feeder *DryRunWALFeeder) queryDB(walEntriesChannel chan *model.WALEntry) {
+	defer close(walEntriesChannel)
+	pageSize := int(feeder.config.MaxRecordsPerQuery)
+	if pageSize == 0 {
+		pageSize = defaultDryRunPageSize
+	}
+	seen := make(map[string]struct{})
+	for offset := 0; ; offset += pageSize {
+		var consistencyRecords []watchdog.SQLConsistencyRecord
+		res := feeder.db.
+			Order("object_version DESC").
+			Order("request_id").
+			Where(feeder.dialect.DueCondition()).
+			Offset(offset).
+			Limit(pageSize).
+			Find(&consistencyRecords)
+		if res.Error != nil {
+			log.Printf("Dry run failed on querying the consistency log: %s", res.Error)
+			return
+		}
+		for _, record := range consistencyRecords {
+			key := distinctKey(&record)
+			if _, duplicate := seen[key]; duplicate {
+				continue
+			}
+			seen[key] = struct{}{}
+			walEntriesChannel <- &model.WALEntry{
+				Record:              mapSQLToRecord(&record),
+				RecordProcessedHook: leaveRecordHook,
+			}
+		}
+		if len(consistencyRecords) < pageSize {
+			return
+		}
+	}
+}
+
+func leaveRecordHook(_ *watchdog.ConsistencyRecord, _ error) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+package feeder
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunFeederShouldFeedNewestDueRecordsOnceAndLeaveTheLog(t *testing.T) {
+	akubraConfig, consistencyWatchdog, cleanup := createEmbeddedLog(t)
+	defer cleanup()
+
+	insertDueRecord(t, consistencyWatchdog, "1", "bucket/first", 10)
+	insertDueRecord(t, consistencyWatchdog, "2", "bucket/first", 20)
+	insertDueRecord(t, consistencyWatchdog, "3", "bucket/second", 15)
+	insertDueRecord(t, consistencyWatchdog, "4", "bucket/third", 5)
+
+	walFeeder, err := NewDryRunWALFeeder(akubraConfig, &WALFeederConfig{MaxRecordsPerQuery: 2}, nil)
+	require.NoError(t, err)
+
+	emitted := make(map[string]int)
+	for entry := range walFeeder.CreateFeed() {
+		emitted[entry.Record.ObjectID] = entry.Record.ObjectVersion
+		require.NoError(t, entry.RecordProcessedHook(entry.Record, nil))
+		require.NoError(t, entry.RecordProcessedHook(entry.Record, errors.New("storage unavailable")))
+	}
+
+	assert.Equal(t, map[string]int{"bucket/first": 20, "bucket/second": 15, "bucket/third": 5}, emitted)
+	var remaining []watchdog.SQLConsistencyRecord
+	require.NoError(t, walFeeder.(*DryRunWALFeeder).db.Table("consistency_record").Find(&remaining).Error)
+	assert.Len(t, remaining, 4)
+	for _, record := range remaining {
+		assert.Empty(t, record.Error)
+		assert.Equal(t, 0, record.Attempts)
+	}
+}
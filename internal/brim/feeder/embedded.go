@@ -0,0 +1,122 @@
+package feeder
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/config"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+//EmbeddedWALFeeder is an implementation of WALFeeder that creates a feed from the embedded consistency log,
+//records are not locked so the log should be read by a single feeder
+type EmbeddedWALFeeder struct {
+	WALFeeder
+	db        *gorm.DB
+	dialect   watchdog.Dialect
+	config    *WALFeederConfig
+	fairQuery *fairQuery
+}
+
+//NewEmbeddedWALFeeder constructs an instance of EmbeddedWALFeeder
+func NewEmbeddedWALFeeder(akubraConfig *config.Config, feederConfig *WALFeederConfig) (WALFeeder, error) {
+	if strings.ToLower(akubraConfig.Watchdog.Type) != watchdog.EmbeddedWatchdogType {
+		return nil, errors.New("Can't create embedded feeder if no embedded watchdog is defined")
+	}
+	db, err := watchdog.OpenEmbeddedDB(akubraConfig.Watchdog.Props[watchdog.EmbeddedPathProp])
+	if err != nil {
+		return nil, err
+	}
+	return &EmbeddedWALFeeder{
+		db:        db,
+		dialect:   &watchdog.SQLiteDialect{},
+		config:    feederConfig,
+		fairQuery: newFairQuery(feederConfig.FairnessKey),
+	}, nil
+}
+
+//CreateFeed streams WALEntries from the embedded log
+func (feeder *EmbeddedWALFeeder) CreateFeed() <-chan *model.WALEntry {
+	walEntriesChannel := make(chan *model.WALEntry, feeder.config.MaxRecordsPerQuery)
+	go feeder.queryDB(walEntriesChannel)
+	return walEntriesChannel
+}
+
+func (feeder *EmbeddedWALFeeder) queryDB(walEntriesChannel chan *model.WALEntry) {
+	for {
+		log.Debugf("Querying embedded log for at most %d consistency records", feeder.config.MaxRecordsPerQuery)
+		startTime := time.Now()
+
+		consistencyRecords, err := dueRecords(feeder.db, feeder.dialect, feeder.config.MaxRecordsPerQuery, feeder.fairQuery)
+		if err != nil {
+			log.Printf("Failed on querying embedded log for tasks: %s", err)
+			metrics.UpdateSince("watchdog.feeder.select.err", startTime)
+			time.Sleep(feeder.config.NoRecordsSleepDuration)
+			continue
+		}
+		metrics.UpdateSince("watchdog.feeder.select.ok", startTime)
+
+		distinctRecords := distinct(consistencyRecords)
+		if len(distinctRecords) < 1 {
+			log.Printf("No entries in the log. Waiting %.2f seconds", feeder.config.NoRecordsSleepDuration.Seconds())
+			time.Sleep(feeder.config.NoRecordsSleepDuration)
+			continue
+		}
+
+		// Records are not locked, so the next query waits until the whole batch is processed
+		wg := &sync.WaitGroup{}
+		wg.Add(len(distinctRecords))
+		for idx := range distinctRecords {
+			consistencyRecord := mapSQLToRecord(distinctRecords[idx])
+			walEntriesChannel <- &model.WALEntry{
+				Record:              consistencyRecord,
+				RecordProcessedHook: feeder.recordProcessedHook(wg, consistencyRecord, startTime),
+			}
+		}
+		wg.Wait()
+	}
+}
+
+func (feeder *EmbeddedWALFeeder) recordProcessedHook(wg *sync.WaitGroup, fedRecord *watchdog.ConsistencyRecord, taskStartTime time.Time) model.Hook {
+	return func(record *watchdog.ConsistencyRecord, err error) error {
+		defer wg.Done()
+		if err != nil {
+			metrics.UpdateSince("watchdog.worker.failure", taskStartTime)
+			log.Printf("Error during processing of task for requestID = '%s': %s", record.RequestID, err)
+			failureErr := handleFailure(feeder.db, feeder.dialect, feeder.config, fedRecord, err)
+			if failureErr != nil {
+				log.Printf("Failed to handle failure of reqID = %s: %s", record.RequestID, failureErr)
+			}
+			return failureErr
+		}
+
+		metrics.UpdateSince("watchdog.worker.success", taskStartTime)
+		return compactRecord(feeder.db, record)
+	}
+}
+
+// distinct keeps only the first (newest) record of every object, bucket and their sub-resources
+func distinct(consistencyRecords []watchdog.SQLConsistencyRecord) []*watchdog.SQLConsistencyRecord {
+	grouping := make(map[string]struct{})
+	distinctRecords := make([]*watchdog.SQLConsistencyRecord, 0)
+	for idx := range consistencyRecords {
+		obj := distinctKey(&consistencyRecords[idx])
+		if _, seen := grouping[obj]; seen {
+			continue
+		}
+		grouping[obj] = struct{}{}
+		distinctRecords = append(distinctRecords, &consistencyRecords[idx])
+	}
+	return distinctRecords
+}
+
+func distinctKey(record *watchdog.SQLConsistencyRecord) string {
+	return fmt.Sprintf("%s%s:%s:%s", record.Domain, record.ObjectID, record.Operation, record.SubResource)
+}
@@ -0,0 +1,161 @@
+package feeder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/config"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	wc "github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createEmbeddedLog(t *testing.T) (*config.Config, watchdog.ConsistencyWatchdog, func()) {
+	dir, err := ioutil.TempDir("", "embedded-feeder")
+	require.NoError(t, err)
+	akubraConfig := &config.Config{YamlConfig: config.YamlConfig{
+		Watchdog: wc.WatchdogConfig{
+			Type:  watchdog.EmbeddedWatchdogType,
+			Props: map[string]string{watchdog.EmbeddedPathProp: filepath.Join(dir, "wal.db")},
+		}}}
+	consistencyWatchdog, err := (&watchdog.EmbeddedWatchdogFactory{}).CreateWatchdogInstance(&akubraConfig.Watchdog)
+	require.NoError(t, err)
+	return akubraConfig, consistencyWatchdog, func() { _ = os.RemoveAll(dir) }
+}
+
+func insertDueRecord(t *testing.T, consistencyWatchdog watchdog.ConsistencyWatchdog, requestID, objectID string, version int) {
+	_, err := consistencyWatchdog.Insert(&watchdog.ConsistencyRecord{
+		RequestID:     requestID,
+		ObjectID:      objectID,
+		Domain:        "local",
+		AccessKey:     "access",
+		Method:        watchdog.PUT,
+		ObjectVersion: version,
+	})
+	require.NoError(t, err)
+}
+
+func TestEmbeddedFeederShouldRefuseNonEmbeddedWatchdog(t *testing.T) {
+	akubraConfig := &config.Config{YamlConfig: config.YamlConfig{Watchdog: wc.WatchdogConfig{Type: "sql"}}}
+	_, err := NewEmbeddedWALFeeder(akubraConfig, &WALFeederConfig{})
+	assert.Error(t, err)
+}
+
+func TestEmbeddedFeederShouldEmitNewestVersionOfEveryObjectAndCompactTheLog(t *testing.T) {
+	akubraConfig, consistencyWatchdog, cleanup := createEmbeddedLog(t)
+	defer cleanup()
+
+	insertDueRecord(t, consistencyWatchdog, "1", "bucket/first", 10)
+	insertDueRecord(t, consistencyWatchdog, "2", "bucket/first", 20)
+	insertDueRecord(t, consistencyWatchdog, "3", "bucket/second", 15)
+	insertDueRecord(t, consistencyWatchdog, "4", "bucket/second", 5)
+
+	feederConfig := &WALFeederConfig{NoRecordsSleepDuration: 10 * time.Millisecond, MaxRecordsPerQuery: 10, FailureDelay: time.Hour}
+	walFeeder, err := NewEmbeddedWALFeeder(akubraConfig, feederConfig)
+	require.NoError(t, err)
+	feed := walFeeder.CreateFeed()
+
+	emitted := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case entry := <-feed:
+			emitted[entry.Record.ObjectID] = entry.Record.ObjectVersion
+			require.NoError(t, entry.RecordProcessedHook(entry.Record, nil))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no entries emitted")
+		}
+	}
+	assert.Equal(t, map[string]int{"bucket/first": 20, "bucket/second": 15}, emitted)
+
+	select {
+	case entry := <-feed:
+		t.Fatalf("unexpected entry %v after compaction", entry.Record)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEmbeddedFeederShouldDelayFailedRecords(t *testing.T) {
+	akubraConfig, consistencyWatchdog, cleanup := createEmbeddedLog(t)
+	defer cleanup()
+
+	insertDueRecord(t, consistencyWatchdog, "1", "bucket/first", 10)
+
+	feederConfig := &WALFeederConfig{NoRecordsSleepDuration: 10 * time.Millisecond, MaxRecordsPerQuery: 10, FailureDelay: time.Hour}
+	walFeeder, err := NewEmbeddedWALFeeder(akubraConfig, feederConfig)
+	require.NoError(t, err)
+	feed := walFeeder.CreateFeed()
+
+	select {
+	case entry := <-feed:
+		require.NoError(t, entry.RecordProcessedHook(entry.Record, fmt.Errorf("storage unavailable")))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no entries emitted")
+	}
+
+	select {
+	case entry := <-feed:
+		t.Fatalf("unexpected entry %v, failed record should be delayed", entry.Record)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var failed []watchdog.SQLConsistencyRecord
+	require.NoError(t, walFeeder.(*EmbeddedWALFeeder).db.Table("consistency_record").Find(&failed).Error)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "storage unavailable", failed[0].Error)
+	assert.Equal(t, "3600", failed[0].ExecutionDelay)
+}
+
+func TestEmbeddedFeederShouldDeadLetterRecordsFailingTooManyTimes(t *testing.T) {
+	akubraConfig, consistencyWatchdog, cleanup := createEmbeddedLog(t)
+	defer cleanup()
+
+	insertDueRecord(t, consistencyWatchdog, "1", "bucket/first", 10)
+
+	feederConfig := &WALFeederConfig{NoRecordsSleepDuration: 10 * time.Millisecond, MaxRecordsPerQuery: 10, MaxAttempts: 2}
+	walFeeder, err := NewEmbeddedWALFeeder(akubraConfig, feederConfig)
+	require.NoError(t, err)
+	feed := walFeeder.CreateFeed()
+
+	storageErr := model.NewBackendError("http://storage:9000", &s3.Error{StatusCode: http.StatusForbidden, Message: "Access Denied"})
+	for attempt := 0; attempt < 2; attempt++ {
+		select {
+		case entry := <-feed:
+			assert.Equal(t, attempt, entry.Record.Attempts)
+			require.NoError(t, entry.RecordProcessedHook(entry.Record, storageErr))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no entry emitted for attempt %d", attempt)
+		}
+	}
+
+	db := walFeeder.(*EmbeddedWALFeeder).db
+	var remaining int
+	require.NoError(t, db.Table("consistency_record").Count(&remaining).Error)
+	assert.Equal(t, 0, remaining)
+	deadLetter, err := watchdog.NewDeadLetterQueue(db, &watchdog.SQLiteDialect{}).Get("1")
+	require.NoError(t, err)
+	require.NotNil(t, deadLetter)
+	assert.Equal(t, 2, deadLetter.Attempts)
+	assert.Equal(t, "forbidden", deadLetter.ErrorClass)
+	assert.Equal(t, "http://storage:9000", deadLetter.Backend)
+	assert.Equal(t, "http://storage:9000: Access Denied", deadLetter.Error)
+}
+
+func TestFailureDelayShouldGrowExponentiallyUpToTheCap(t *testing.T) {
+	feederConfig := &WALFeederConfig{FailureDelay: time.Minute, MaxFailureDelay: 10 * time.Minute}
+	var delays []time.Duration
+	for attempts := 1; attempts <= 6; attempts++ {
+		delays = append(delays, feederConfig.failureDelay(attempts))
+	}
+	assert.Equal(t, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}, delays)
+
+	uncapped := &WALFeederConfig{FailureDelay: 5 * time.Minute}
+	assert.Equal(t, 5*time.Minute, uncapped.failureDelay(10))
+}
@@ -0,0 +1,83 @@
+package feeder
+
+import (
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/jinzhu/gorm"
+)
+
+// fairnessColumns are the columns of the consistency log sharing the queries, by the fairness key
+var fairnessColumns = map[string]string{"domain": "domain", "access_key": "access_key"}
+
+// fairQuery shares the due records of every query equally between the domains or the access keys, when there
+// are more keys than records to query the keys take turns
+type fairQuery struct {
+	column string
+	// cursor is the last key queried, the next query starts after it
+	cursor string
+}
+
+// newFairQuery returns nil if the records should be queried in the log's order
+func newFairQuery(fairnessKey string) *fairQuery {
+	column, ok := fairnessColumns[fairnessKey]
+	if !ok {
+		return nil
+	}
+	return &fairQuery{column: column}
+}
+
+// dueRecords queries at most limit due records, shared by the fair query if it isn't nil
+func dueRecords(db *gorm.DB, dialect watchdog.Dialect, limit uint, fair *fairQuery) ([]watchdog.SQLConsistencyRecord, error) {
+	var consistencyRecords []watchdog.SQLConsistencyRecord
+	if fair == nil {
+		err := watchdog.DueRecords(db, dialect, limit).Find(&consistencyRecords).Error
+		return consistencyRecords, err
+	}
+	keys, err := fair.nextKeys(db, dialect, limit)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	share := limit / uint(len(keys))
+	if share == 0 {
+		share = 1
+	}
+	for _, key := range keys {
+		var keyRecords []watchdog.SQLConsistencyRecord
+		if err := watchdog.DueRecords(db.Where(fair.column+" = ?", key), dialect, share).Find(&keyRecords).Error; err != nil {
+			return nil, err
+		}
+		consistencyRecords = append(consistencyRecords, keyRecords...)
+	}
+	return consistencyRecords, nil
+}
+
+// nextKeys returns at most limit keys with due records, starting after the cursor
+func (fair *fairQuery) nextKeys(db *gorm.DB, dialect watchdog.Dialect, limit uint) ([]string, error) {
+	keys, err := fair.keys(db, dialect, fair.column+" > ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	if uint(len(keys)) < limit {
+		wrapped, err := fair.keys(db, dialect, fair.column+" <= ?", limit-uint(len(keys)))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, wrapped...)
+	}
+	if len(keys) > 0 {
+		fair.cursor = keys[len(keys)-1]
+	}
+	return keys, nil
+}
+
+func (fair *fairQuery) keys(db *gorm.DB, dialect watchdog.Dialect, condition string, limit uint) ([]string, error) {
+	var keys []string
+	err := db.
+		Model(&watchdog.SQLConsistencyRecord{}).
+		Where(dialect.DueCondition()).
+		Where(condition, fair.cursor).
+		Order(fair.column).
+		Limit(limit).
+		Pluck("DISTINCT "+fair.column, &keys).
+		Error
+	return keys, err
+}
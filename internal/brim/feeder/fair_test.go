@@ -0,0 +1,62 @@
+package feeder
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairQueryShouldShareQueriesBetweenDomainsAndRotateThem(t *testing.T) {
+	akubraConfig, consistencyWatchdog, cleanup := createEmbeddedLog(t)
+	defer cleanup()
+	for idx := 0; idx < 5; idx++ {
+		insertDomainRecord(t, consistencyWatchdog, "bulk.example.com", fmt.Sprintf("bulk/%d", idx), 100+idx)
+	}
+	insertDomainRecord(t, consistencyWatchdog, "a.example.com", "a/key", 1)
+	insertDomainRecord(t, consistencyWatchdog, "c.example.com", "c/key", 2)
+
+	db, err := watchdog.OpenEmbeddedDB(akubraConfig.Watchdog.Props[watchdog.EmbeddedPathProp])
+	require.NoError(t, err)
+	fair := newFairQuery("domain")
+
+	records, err := dueRecords(db, &watchdog.SQLiteDialect{}, 2, fair)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com", "bulk.example.com"}, domainsOf(records))
+
+	records, err = dueRecords(db, &watchdog.SQLiteDialect{}, 2, fair)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c.example.com", "a.example.com"}, domainsOf(records))
+
+	records, err = dueRecords(db, &watchdog.SQLiteDialect{}, 9, newFairQuery("domain"))
+	require.NoError(t, err)
+	assert.Len(t, records, 5)
+	assert.Equal(t, 104, records[1].ObjectVersion, "the newest records of every domain should be queried first")
+}
+
+func TestFairQueryShouldBeDisabledWithoutFairnessKey(t *testing.T) {
+	assert.Nil(t, newFairQuery(""))
+	assert.NotNil(t, newFairQuery("access_key"))
+}
+
+func insertDomainRecord(t *testing.T, consistencyWatchdog watchdog.ConsistencyWatchdog, domain, objectID string, version int) {
+	_, err := consistencyWatchdog.Insert(&watchdog.ConsistencyRecord{
+		RequestID:     domain + objectID,
+		ObjectID:      objectID,
+		Domain:        domain,
+		AccessKey:     "access",
+		Method:        watchdog.PUT,
+		ObjectVersion: version,
+	})
+	require.NoError(t, err)
+}
+
+func domainsOf(records []watchdog.SQLConsistencyRecord) []string {
+	var domains []string
+	for _, record := range records {
+		domains = append(domains, record.Domain)
+	}
+	return domains
+}
@@ -0,0 +1,373 @@
+package feeder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/httphandler"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/utils"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+)
+
+//ReplayRequestIDPrefix starts the request IDs of the records replayed from the access and sync logs
+const ReplayRequestIDPrefix = "replay-"
+
+const defaultReplayBatchSize = 1000
+
+var backendStatusPattern = regexp.MustCompile(`status: (\d{3})`)
+
+//LogReplayConfig configures the replay of akubra's access and sync logs
+type LogReplayConfig struct {
+	//Path is a log file or a directory of rotated log files, gzipped files are read too
+	Path string
+	//From and To bound the time of the replayed entries, zero values leave the window open
+	From time.Time
+	To   time.Time
+	//CheckpointFile keeps the offsets of the replayed files, an interrupted replay starts over if empty
+	CheckpointFile string
+	//Domain is the domain of the sync log entries, which don't name it
+	Domain string
+	//BatchSize is the number of entries fed before the offset is saved, 1000 by default
+	BatchSize int
+}
+
+//LogReplayWALFeeder is an implementation of WALFeeder that feeds the failed and partially successful PUT and DELETE
+//requests found in akubra's access and sync logs. The feed is closed after the last file is replayed
+type LogReplayWALFeeder struct {
+	WALFeeder
+	config      *LogReplayConfig
+	checkpoints *replayCheckpoints
+}
+
+//replayCheckpoints are the offsets of the log lines fed and processed, by the file path
+type replayCheckpoints struct {
+	Offsets map[string]int64 `json:"offsets"`
+	path    string
+}
+
+//NewLogReplayWALFeeder constructs an instance of LogReplayWALFeeder resuming the replay saved in the checkpoint file
+func NewLogReplayWALFeeder(config *LogReplayConfig) (WALFeeder, error) {
+	if _, err := os.Stat(config.Path); err != nil {
+		return nil, err
+	}
+	checkpoints, err := loadReplayCheckpoints(config.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+	return &LogReplayWALFeeder{config: config, checkpoints: checkpoints}, nil
+}
+
+//CreateFeed streams the replayed entries of the log files from the oldest one
+func (feeder *LogReplayWALFeeder) CreateFeed() <-chan *model.WALEntry {
+	walEntriesChannel := make(chan *model.WALEntry, feeder.batchSize())
+	go feeder.replay(walEntriesChannel)
+	return walEntriesChannel
+}
+
+func (feeder *LogReplayWALFeeder) replay(walEntriesChannel chan *model.WALEntry) {
+	defer close(walEntriesChannel)
+	files, err := logFiles(feeder.config.Path)
+	if err != nil {
+		log.Printf("Log replay failed on listing %s: %s", feeder.config.Path, err)
+		return
+	}
+	for _, file := range files {
+		if err := feeder.replayFile(file, walEntriesChannel); err != nil {
+			log.Printf("Log replay of %s stopped: %s", file, err)
+			return
+		}
+	}
+	log.Printf("Log replay of %s finished", feeder.config.Path)
+}
+
+func (feeder *LogReplayWALFeeder) replayFile(path string, walEntriesChannel chan *model.WALEntry) error {
+	offset := feeder.checkpoints.Offsets[path]
+	reader, closer, err := openAt(path, offset)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = closer.Close() }()
+	log.Printf("Replaying %s from offset %d", path, offset)
+
+	for {
+		entries, read, readErr := feeder.readBatch(reader)
+		// The next batch is read once the whole batch is processed, so the offset never skips unprocessed entries
+		wg := &sync.WaitGroup{}
+		wg.Add(len(entries))
+		for _, entry := range entries {
+			walEntriesChannel <- &model.WALEntry{Record: entry, RecordProcessedHook: replayedRecordHook(wg)}
+		}
+		wg.Wait()
+		offset += read
+		if err := feeder.checkpoints.save(path, offset); err != nil {
+			return err
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+//readBatch reads the lines until a batch of entries to replay is collected, it returns the number of bytes read
+func (feeder *LogReplayWALFeeder) readBatch(reader *bufio.Reader) ([]*watchdog.ConsistencyRecord, int64, error) {
+	var records []*watchdog.ConsistencyRecord
+	var read int64
+	for len(records) < feeder.batchSize() {
+		line, err := reader.ReadBytes('\n')
+		read += int64(len(line))
+		if len(line) > 0 {
+			record, parseErr := feeder.recordOf(line)
+			switch {
+			case parseErr != nil:
+				metrics.Mark("watchdog.replay.malformed")
+				log.Debugf("Skipping malformed log line: %s", parseErr)
+			case record != nil:
+				metrics.Mark("watchdog.replay.entries")
+				records = append(records, record)
+			}
+		}
+		if err != nil {
+			return records, read, err
+		}
+	}
+	return records, read, nil
+}
+
+//recordOf maps the access or sync log line to a record, nil if the entry shouldn't be replayed
+func (feeder *LogReplayWALFeeder) recordOf(line []byte) (*watchdog.ConsistencyRecord, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, err
+	}
+	if _, isAccessLog := fields["req_method"]; isAccessLog {
+		var message httphandler.AccessMessageData
+		if err := json.Unmarshal(line, &message); err != nil {
+			return nil, err
+		}
+		if !isFailedOrPartial(message) {
+			return nil, nil
+		}
+		return feeder.record(message.Method, hostDomain(message.Host), message.Path, message.AccessKey, message.ReqID, message.Time)
+	}
+	if _, isSyncLog := fields["failedhost"]; isSyncLog {
+		var message httphandler.SyncLogMessageData
+		if err := json.Unmarshal(line, &message); err != nil {
+			return nil, err
+		}
+		return feeder.record(message.Method, feeder.config.Domain, message.Path, message.AccessKey, message.ReqID, message.Time)
+	}
+	return nil, fmt.Errorf("neither an access nor a sync log entry: %s", line)
+}
+
+//record creates the record of the entry if it's a PUT or a DELETE of an object or a bucket in the time window. The
+//version is the time of the entry, it's the upper bound of the version written by the request
+func (feeder *LogReplayWALFeeder) record(method, domain, path, accessKey, requestID, timestamp string) (*watchdog.ConsistencyRecord, error) {
+	if method != string(watchdog.PUT) && method != string(watchdog.DELETE) {
+		return nil, nil
+	}
+	loggedAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if (!feeder.config.From.IsZero() && loggedAt.Before(feeder.config.From)) ||
+		(!feeder.config.To.IsZero() && !loggedAt.Before(feeder.config.To)) {
+		return nil, nil
+	}
+	if domain == "" {
+		metrics.Mark("watchdog.replay.nodomain")
+		return nil, nil
+	}
+	record := &watchdog.ConsistencyRecord{
+		RequestID:     ReplayRequestIDPrefix + requestID,
+		Method:        watchdog.Method(method),
+		Domain:        domain,
+		AccessKey:     accessKey,
+		ObjectVersion: int(loggedAt.UnixNano() / int64(time.Microsecond)),
+		Operation:     watchdog.ObjectOperation,
+	}
+	if utils.IsBucketPath(path) {
+		record.ObjectID = utils.ExtractBucketFrom(path)
+		record.Operation = watchdog.BucketOperation
+		return record, nil
+	}
+	bucket, key := utils.ExtractBucketAndKey(path)
+	if bucket == "" || key == "" {
+		return nil, nil
+	}
+	record.ObjectID = bucket + "/" + key
+	return record, nil
+}
+
+func (feeder *LogReplayWALFeeder) batchSize() int {
+	if feeder.config.BatchSize > 0 {
+		return feeder.config.BatchSize
+	}
+	return defaultReplayBatchSize
+}
+
+//IsReplay tells whether the record was fed by the log replay
+func IsReplay(record *watchdog.ConsistencyRecord) bool {
+	return strings.HasPrefix(record.RequestID, ReplayRequestIDPrefix)
+}
+
+//isFailedOrPartial tells if the request failed or any of the storages didn't succeed
+func isFailedOrPartial(message httphandler.AccessMessageData) bool {
+	if message.StatusCode >= 500 || message.RespErr != "" {
+		return true
+	}
+	if strings.Contains(message.BackendResponses, "err:") || strings.Contains(message.BackendResponses, "maintenance mode") {
+		return true
+	}
+	succeeded := 0
+	statuses := backendStatusPattern.FindAllStringSubmatch(message.BackendResponses, -1)
+	for _, status := range statuses {
+		code, _ := strconv.Atoi(status[1])
+		if code >= 500 {
+			return true
+		}
+		if code < 300 {
+			succeeded++
+		}
+	}
+	return succeeded > 0 && succeeded < len(statuses)
+}
+
+func replayedRecordHook(wg *sync.WaitGroup) model.Hook {
+	return func(record *watchdog.ConsistencyRecord, err error) error {
+		defer wg.Done()
+		if err != nil {
+			metrics.Mark("watchdog.replay.failure")
+			log.Printf("Replay of '%s' in domain '%s' for reqID = '%s' failed: %s",
+				record.ObjectID, record.Domain, record.RequestID, err)
+			return nil
+		}
+		metrics.Mark("watchdog.replay.success")
+		return nil
+	}
+}
+
+func hostDomain(host string) string {
+	domain, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+//logFiles lists the file or the files of the directory from the least recently modified one
+func logFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for _, fileInfo := range infos {
+		if fileInfo.Mode().IsRegular() {
+			files = append(files, fileInfo)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].Name() < files[j].Name()
+		}
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	paths := make([]string, len(files))
+	for idx, fileInfo := range files {
+		paths[idx] = filepath.Join(path, fileInfo.Name())
+	}
+	return paths, nil
+}
+
+//openAt opens the file at the offset, the offsets of gzipped files count the decompressed bytes
+func openAt(path string, offset int64) (*bufio.Reader, io.Closer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			_ = file.Close()
+			return nil, nil, err
+		}
+		return bufio.NewReader(file), file, nil
+	}
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, decompressed, offset); err != nil && err != io.EOF {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	return bufio.NewReader(decompressed), file, nil
+}
+
+func loadReplayCheckpoints(path string) (*replayCheckpoints, error) {
+	checkpoints := &replayCheckpoints{Offsets: make(map[string]int64), path: path}
+	if path == "" {
+		return checkpoints, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, checkpoints); err != nil {
+		return nil, fmt.Errorf("malformed replay checkpoint file %s: %s", path, err)
+	}
+	return checkpoints, nil
+}
+
+func (checkpoints *replayCheckpoints) save(file string, offset int64) error {
+	checkpoints.Offsets[file] = offset
+	if checkpoints.path == "" {
+		return nil
+	}
+	content, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(checkpoints.path), filepath.Base(checkpoints.path))
+	if err != nil {
+		return err
+	}
+	if _, err = temporary.Write(content); err != nil {
+		_ = temporary.Close()
+		_ = os.Remove(temporary.Name())
+		return err
+	}
+	if err = temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), checkpoints.path)
+}
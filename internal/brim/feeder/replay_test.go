@@ -0,0 +1,162 @@
+package feeder
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/httphandler"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var replayStart = time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func accessLogLine(t *testing.T, method, path string, status int, backendResponses string, at time.Duration) string {
+	line, err := json.Marshal(httphandler.AccessMessageData{Method: method, Host: "localhost:8080", Path: path,
+		StatusCode: status, ReqID: "req" + path, Time: replayStart.Add(at).Format(time.RFC3339Nano),
+		AccessKey: "access", BackendResponses: backendResponses})
+	require.NoError(t, err)
+	return string(line)
+}
+
+func writeLogFile(t *testing.T, path string, lines []string, modTime time.Time) {
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	if strings.HasSuffix(path, ".gz") {
+		file, err := os.Create(path)
+		require.NoError(t, err)
+		writer := gzip.NewWriter(file)
+		_, err = writer.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+		require.NoError(t, file.Close())
+	} else {
+		require.NoError(t, ioutil.WriteFile(path, content, 0644))
+	}
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func replayedObjects(t *testing.T, walFeeder WALFeeder) []string {
+	var objects []string
+	for entry := range walFeeder.CreateFeed() {
+		objects = append(objects, string(entry.Record.Method)+" "+entry.Record.Domain+"/"+entry.Record.ObjectID)
+		require.NoError(t, entry.RecordProcessedHook(entry.Record, nil))
+	}
+	return objects
+}
+
+func TestLogReplayFeederShouldFeedFailedWritesOfRotatedLogsInTheWindow(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(logDir) }()
+
+	syncLine, err := json.Marshal(httphandler.SyncLogMessageData{Method: "DELETE", FailedHost: "storage:80",
+		Path: "/bucket/synced", AccessKey: "access", ReqID: "sync", Time: replayStart.Add(time.Minute).Format(time.RFC3339Nano)})
+	require.NoError(t, err)
+	writeLogFile(t, filepath.Join(logDir, "access.log.1.gz"), []string{
+		accessLogLine(t, "PUT", "/bucket/early", 500, "", -time.Minute),
+		accessLogLine(t, "PUT", "/bucket/failed", 500, "", 0),
+		accessLogLine(t, "PUT", "/bucket/ok", 200, "storage1:80, status: 200, storage2:80, status: 200", time.Second),
+		"not a json line",
+	}, replayStart.Add(time.Hour))
+	writeLogFile(t, filepath.Join(logDir, "access.log"), []string{
+		accessLogLine(t, "DELETE", "/bucket/partial", 204, "storage1:80, status: 204, storage2:80, err: timeout", 2*time.Second),
+		accessLogLine(t, "GET", "/bucket/read", 500, "", 3*time.Second),
+		accessLogLine(t, "PUT", "/created", 200, "storage1:80, status: 200, storage2:80, status: 503", 4*time.Second),
+		string(syncLine),
+		accessLogLine(t, "PUT", "/bucket/late", 500, "", time.Hour),
+	}, replayStart.Add(2*time.Hour))
+
+	walFeeder, err := NewLogReplayWALFeeder(&LogReplayConfig{Path: logDir, From: replayStart,
+		To: replayStart.Add(time.Hour), Domain: "synced.domain"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"PUT localhost/bucket/failed",
+		"DELETE localhost/bucket/partial",
+		"PUT localhost/created",
+		"DELETE synced.domain/bucket/synced",
+	}, replayedObjects(t, walFeeder))
+}
+
+func TestLogReplayFeederShouldMapEntriesToRecords(t *testing.T) {
+	walFeeder := &LogReplayWALFeeder{config: &LogReplayConfig{}}
+
+	record, err := walFeeder.recordOf([]byte(accessLogLine(t, "PUT", "/bucket/some/key", 502, "", time.Second)))
+
+	require.NoError(t, err)
+	assert.Equal(t, &watchdog.ConsistencyRecord{
+		RequestID:     "replay-req/bucket/some/key",
+		Method:        watchdog.PUT,
+		Domain:        "localhost",
+		AccessKey:     "access",
+		ObjectID:      "bucket/some/key",
+		ObjectVersion: int(replayStart.Add(time.Second).UnixNano() / 1000),
+		Operation:     watchdog.ObjectOperation,
+	}, record)
+	assert.True(t, IsReplay(record))
+
+	record, err = walFeeder.recordOf([]byte(accessLogLine(t, "PUT", "/bucket", 500, "", 0)))
+	require.NoError(t, err)
+	assert.Equal(t, watchdog.BucketOperation, record.Operation)
+	assert.Equal(t, "bucket", record.ObjectID)
+
+	syncLine := `{"method":"PUT","failedhost":"storage:80","path":"/bucket/key","reqID":"sync","ts":"2020-03-01T12:00:00Z"}`
+	record, err = walFeeder.recordOf([]byte(syncLine))
+	require.NoError(t, err)
+	assert.Nil(t, record, "sync log entries are skipped without the configured domain")
+}
+
+func TestLogReplayFeederShouldResumeFromTheCheckpointedOffset(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "replay")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(logDir) }()
+	logFile := filepath.Join(logDir, "access.log")
+	checkpointFile := filepath.Join(logDir, "checkpoint.json")
+	writeLogFile(t, logFile, []string{
+		accessLogLine(t, "PUT", "/bucket/first", 500, "", 0),
+		accessLogLine(t, "PUT", "/bucket/second", 500, "", time.Second),
+		accessLogLine(t, "PUT", "/bucket/third", 500, "", 2*time.Second),
+	}, replayStart)
+	config := &LogReplayConfig{Path: logFile, CheckpointFile: checkpointFile, BatchSize: 1}
+
+	interrupted, err := NewLogReplayWALFeeder(config)
+	require.NoError(t, err)
+	feed := interrupted.CreateFeed()
+	first := <-feed
+	require.NoError(t, first.RecordProcessedHook(first.Record, errors.New("storage unavailable")))
+	second := <-feed
+	assert.Equal(t, "bucket/second", second.Record.ObjectID, "the next entry is fed once the previous one is processed")
+
+	resumed, err := NewLogReplayWALFeeder(config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PUT localhost/bucket/second", "PUT localhost/bucket/third"}, replayedObjects(t, resumed))
+
+	finished, err := NewLogReplayWALFeeder(config)
+	require.NoError(t, err)
+	assert.Empty(t, replayedObjects(t, finished))
+}
+
+func TestIsFailedOrPartialShouldCompareBackendResponses(t *testing.T) {
+	testCases := []struct {
+		message  httphandler.AccessMessageData
+		expected bool
+	}{
+		{httphandler.AccessMessageData{StatusCode: 200, BackendResponses: "a:80, status: 200, b:80, status: 200"}, false},
+		{httphandler.AccessMessageData{StatusCode: 404, BackendResponses: "a:80, status: 404, b:80, status: 404"}, false},
+		{httphandler.AccessMessageData{StatusCode: 200, BackendResponses: "a:80, status: 200, b:80, status: 404"}, true},
+		{httphandler.AccessMessageData{StatusCode: 200, BackendResponses: "a:80, status: 200, b:80 is in maintenance mode"}, true},
+		{httphandler.AccessMessageData{StatusCode: 200, RespErr: "broken pipe"}, true},
+		{httphandler.AccessMessageData{StatusCode: 503}, true},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, isFailedOrPartial(testCase.message), testCase.message.BackendResponses)
+	}
+}
@@ -0,0 +1,50 @@
+package feeder
+
+import (
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/jinzhu/gorm"
+)
+
+// failureDelay doubles FailureDelay after every failed attempt, up to MaxFailureDelay
+func (feederConfig *WALFeederConfig) failureDelay(attempts int) time.Duration {
+	maxDelay := feederConfig.MaxFailureDelay
+	if maxDelay < feederConfig.FailureDelay {
+		maxDelay = feederConfig.FailureDelay
+	}
+	delay := feederConfig.FailureDelay
+	for attempt := 1; attempt < attempts && delay < maxDelay; attempt++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func (feederConfig *WALFeederConfig) attemptsExhausted(attempts int) bool {
+	return feederConfig.MaxAttempts > 0 && attempts >= feederConfig.MaxAttempts
+}
+
+// handleFailure postpones the record, or moves it to the dead-letter table when it failed too many times
+func handleFailure(db *gorm.DB, dialect watchdog.Dialect, feederConfig *WALFeederConfig, record *watchdog.ConsistencyRecord, processingErr error) error {
+	attempts := record.Attempts + 1
+	if !feederConfig.attemptsExhausted(attempts) {
+		return postponeExecution(db, dialect, record, processingErr, feederConfig.failureDelay(attempts))
+	}
+	deadLetter := *record
+	deadLetter.Attempts = attempts
+	failure := watchdog.DeadLetterFailure{
+		Err:        processingErr,
+		ErrorClass: brimS3.ClassifyError(processingErr),
+		Backend:    brimS3.BackendOf(processingErr),
+	}
+	log.Printf("Moving record of requestID = '%s' to dead-letter after %d attempts, error class '%s'",
+		record.RequestID, attempts, failure.ErrorClass)
+	metrics.Mark("watchdog.feeder.deadletter." + failure.ErrorClass)
+	return watchdog.MoveToDeadLetter(db, &deadLetter, failure)
+}
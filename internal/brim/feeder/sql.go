@@ -13,7 +13,6 @@ import (
 	"github.com/allegro/akubra/internal/akubra/watchdog"
 	"github.com/allegro/akubra/internal/brim/model"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"github.com/pkg/errors"
 )
 
@@ -22,13 +21,24 @@ type WALFeederConfig struct {
 	NoRecordsSleepDuration time.Duration `yaml:"NoRecordsSleepDuration"`
 	MaxRecordsPerQuery     uint          `yaml:"MaxRecordsPerQuery"`
 	FailureDelay           time.Duration `yaml:"FailureDelay"`
+	// MaxFailureDelay caps FailureDelay doubled after every failed attempt, FailureDelay is used if lower
+	MaxFailureDelay time.Duration `yaml:"MaxFailureDelay"`
+	// MaxAttempts moves records failing that many times to the dead-letter table, zero retries forever
+	MaxAttempts int `yaml:"MaxAttempts"`
+	// FairnessKey shares every query equally between the 'domain' or 'access_key' values, the log's order is kept if empty
+	FairnessKey string `yaml:"FairnessKey"`
+	// MaxPendingBatches is the number of queried batches which records may be in progress at once, so the next batch
+	// is queried before the previous one is done. 1 by default, dialects without row locks process one batch at a time
+	MaxPendingBatches uint `yaml:"MaxPendingBatches"`
 }
 
 //SQLWALFeeder is an implementation of WALFeeder that creates a feed from a SQL DB
 type SQLWALFeeder struct {
 	WALFeeder
-	db     *gorm.DB
-	config *WALFeederConfig
+	db        *gorm.DB
+	dialect   watchdog.Dialect
+	config    *WALFeederConfig
+	fairQuery *fairQuery
 }
 
 //NewSQLWALFeeder construct an instance of SQLWALFeeder
@@ -38,13 +48,19 @@ func NewSQLWALFeeder(akubraConfig *config.Config,
 	if strings.ToLower(akubraConfig.Watchdog.Type) != "sql" {
 		return nil, errors.New("Can't create SQL feeder if no SQL watchdog is defined")
 	}
+	dialect, err := watchdog.DialectFor(akubraConfig.Watchdog.Props["dialect"])
+	if err != nil {
+		return nil, err
+	}
 	db, err := dbClientFactory.CreateConnection(akubraConfig.Watchdog.Props)
 	if err != nil {
 		return nil, err
 	}
 	return &SQLWALFeeder{
-		db:     db,
-		config: sqlFeederConfig,
+		db:        db,
+		dialect:   dialect,
+		config:    sqlFeederConfig,
+		fairQuery: newFairQuery(sqlFeederConfig.FairnessKey),
 	}, nil
 }
 
@@ -55,38 +71,34 @@ func (feeder *SQLWALFeeder) CreateFeed() <-chan *model.WALEntry {
 	return walEntriesChannel
 }
 
+// maxPendingBatches returns the number of batches in progress at once. Records of a pending batch are locked by its
+// transaction and skipped by the next queries, without row locks the next query would return them again
+func (feeder *SQLWALFeeder) maxPendingBatches() uint {
+	if feeder.config.MaxPendingBatches == 0 || feeder.dialect.LockClause() == "" {
+		return 1
+	}
+	return feeder.config.MaxPendingBatches
+}
+
 func (feeder *SQLWALFeeder) queryDB(walEntriesChannel chan *model.WALEntry) {
+	pendingBatches := make(chan struct{}, feeder.maxPendingBatches())
 	for {
+		pendingBatches <- struct{}{}
 
 		log.Debugf("Querying database for at most %d consistency records", feeder.config.MaxRecordsPerQuery)
 
-		consistencyRecords := make([]watchdog.SQLConsistencyRecord, feeder.config.MaxRecordsPerQuery)
-
 		startTime := time.Now()
 		tx := feeder.db.Begin()
 
-		res := tx.
-			Order("object_version DESC").
-			Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
-			Where("updated_at + execution_delay < NOW() AT TIME ZONE 'UTC'").
-			Limit(feeder.config.MaxRecordsPerQuery).
-			Find(&consistencyRecords)
+		consistencyRecords, err := dueRecords(tx, feeder.dialect, feeder.config.MaxRecordsPerQuery, feeder.fairQuery)
 
-		grouping := make(map[string]struct{})
-		distinctRecords := make([]*watchdog.SQLConsistencyRecord, 0)
+		distinctRecords := distinct(consistencyRecords)
 
-		for idx := range consistencyRecords {
-			obj := fmt.Sprintf("%s%s", consistencyRecords[idx].Domain, consistencyRecords[idx].ObjectID)
-			if _, seen := grouping[obj]; seen {
-				continue
-			}
-			grouping[obj] = struct{}{}
-			distinctRecords = append(distinctRecords, &consistencyRecords[idx])
-		}
-
-		if res.Error != nil {
-			log.Printf("Failed on querying database for tasks: %s", res.Error)
+		if err != nil {
+			log.Printf("Failed on querying database for tasks: %s", err)
 			metrics.UpdateSince("watchdog.feeder.select.err", startTime)
+			tx.Rollback()
+			<-pendingBatches
 			continue
 		}
 
@@ -95,7 +107,7 @@ func (feeder *SQLWALFeeder) queryDB(walEntriesChannel chan *model.WALEntry) {
 
 		wg := &sync.WaitGroup{}
 		wg.Add(len(distinctRecords))
-		go commitTransactionOnComplete(tx, wg)
+		go commitTransactionOnComplete(tx, wg, pendingBatches)
 
 		if len(distinctRecords) < 1 {
 			log.Printf("No entries in the log. Waiting %.2f seconds", feeder.config.NoRecordsSleepDuration.Seconds())
@@ -106,34 +118,37 @@ func (feeder *SQLWALFeeder) queryDB(walEntriesChannel chan *model.WALEntry) {
 			consistencyRecord := mapSQLToRecord(distinctRecords[idx])
 			walEntriesChannel <- &model.WALEntry{
 				Record:              consistencyRecord,
-				RecordProcessedHook: recordProcessedHook(tx, wg, feeder.config.FailureDelay, startTime),
+				RecordProcessedHook: recordProcessedHook(tx, feeder.dialect, wg, feeder.config, consistencyRecord, startTime),
 			}
 		}
-		wg.Wait()
 	}
 }
 
-func commitTransactionOnComplete(tx *gorm.DB, wg *sync.WaitGroup) {
+// commitTransactionOnComplete commits the transaction of the batch once all of its records are processed,
+// which frees the place of the batch in pendingBatches
+func commitTransactionOnComplete(tx *gorm.DB, wg *sync.WaitGroup, pendingBatches <-chan struct{}) {
 	wg.Wait()
+	defer func() { <-pendingBatches }()
 	if res := tx.Commit(); res.Error != nil {
 		log.Printf("Failed to commit transaction after records processing: %s", res.Error)
 		return
 	}
 }
 
-func recordProcessedHook(tx *gorm.DB, wg *sync.WaitGroup, failureDelay time.Duration, taskStartTime time.Time) func(record *watchdog.ConsistencyRecord, err error) error {
+// recordProcessedHook compacts the log or handles the failure of the fed record, tasks
+// may pass a modified copy of the record to the hook
+func recordProcessedHook(tx *gorm.DB, dialect watchdog.Dialect, wg *sync.WaitGroup, feederConfig *WALFeederConfig, fedRecord *watchdog.ConsistencyRecord, taskStartTime time.Time) func(record *watchdog.ConsistencyRecord, err error) error {
 	return func(record *watchdog.ConsistencyRecord, err error) error {
 		defer wg.Done()
 
 		if err != nil {
 			metrics.UpdateSince("watchdog.worker.failure", taskStartTime)
-			updateRecordError(tx, record, err)
 
 			log.Printf("Error during processing of task for requestID = '%s': %s", record.RequestID, err)
 
-			err := delayNextExecution(tx, record, failureDelay)
+			err := handleFailure(tx, dialect, feederConfig, fedRecord, err)
 			if err != nil {
-				log.Printf("Failed to extend execution delay for reqID = %s: %s", record.RequestID, err)
+				log.Printf("Failed to handle failure of reqID = %s: %s", record.RequestID, err)
 			}
 			return err
 		}
@@ -143,20 +158,11 @@ func recordProcessedHook(tx *gorm.DB, wg *sync.WaitGroup, failureDelay time.Dura
 	}
 }
 
-func updateRecordError(tx *gorm.DB, record *watchdog.ConsistencyRecord, err error) {
-	sqlRecord := &watchdog.SQLConsistencyRecord{RequestID: record.RequestID}
-	tx.
-		Model(sqlRecord).
-		Where("request_id = ?", sqlRecord.RequestID).
-		Update("error", err.Error())
-}
-
 func compactRecord(tx *gorm.DB, record *watchdog.ConsistencyRecord) error {
 	queryStartTime := time.Now()
 
-	deleteRes := tx.
-		Where("domain = ? AND object_id = ? AND object_version <= ?",
-			record.Domain, record.ObjectID, record.ObjectVersion).
+	deleteRes := watchdog.
+		SupersededRecords(tx, record).
 		Delete(watchdog.SQLConsistencyRecord{})
 
 	if deleteRes.Error != nil {
@@ -174,14 +180,11 @@ func compactRecord(tx *gorm.DB, record *watchdog.ConsistencyRecord) error {
 	return nil
 }
 
-func delayNextExecution(tx *gorm.DB, record *watchdog.ConsistencyRecord, delay time.Duration) error {
-	rows, err := tx.
-		Raw("UPDATE consistency_record SET execution_delay = NOW() - updated_at + INTERVAL '5 minutes' WHERE request_id = ?", record.RequestID).
-		Rows()
-	if err != nil {
-		return err
-	}
-	return rows.Close()
+// postponeExecution stores the processing error and makes the record due after the delay
+func postponeExecution(db *gorm.DB, dialect watchdog.Dialect, record *watchdog.ConsistencyRecord, processingErr error, delay time.Duration) error {
+	return db.
+		Exec(dialect.PostponeQuery(), processingErr.Error(), dialect.ExecutionDelay(delay), record.RequestID).
+		Error
 }
 
 func mapSQLToRecord(record *watchdog.SQLConsistencyRecord) *watchdog.ConsistencyRecord {
@@ -192,5 +195,8 @@ func mapSQLToRecord(record *watchdog.SQLConsistencyRecord) *watchdog.Consistency
 		Method:        watchdog.Method(record.Method),
 		AccessKey:     record.AccessKey,
 		ObjectVersion: record.ObjectVersion,
+		Attempts:      record.Attempts,
+		Operation:     watchdog.Operation(record.Operation),
+		SubResource:   watchdog.SubResource(record.SubResource),
 	}
 }
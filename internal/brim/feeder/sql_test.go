@@ -2,7 +2,6 @@ package feeder
 
 import (
 	"database/sql"
-	"database/sql/driver"
 	"github.com/allegro/akubra/internal/brim/model"
 	"testing"
 	"time"
@@ -17,20 +16,13 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 const (
 	logEntriesSelect = `SELECT\ \*\ FROM\ \"consistency_record\"\ WHERE\ .+`
 )
 
-type AnyTime struct{}
-
-// Match satisfies sqlmock.Argument interface
-func (a AnyTime) Match(v driver.Value) bool {
-	_, ok := v.(time.Time)
-	return ok
-}
-
 type dbClientFactoryMock struct {
 	mock.Mock
 }
@@ -64,6 +56,7 @@ type compaction struct {
 type failure struct {
 	requestID string
 	err       error
+	delay     time.Duration
 }
 
 func TestShouldEmitASingleWALEntryForAGivenObjectInParticularDomain(t *testing.T) {
@@ -121,7 +114,7 @@ func TestShouldCommitATransactionEvenWhenSomeOfTheTasksHaveFailed(t *testing.T)
 			Props: watchdogProps,
 		}}
 
-	feederConfig := WALFeederConfig{NoRecordsSleepDuration: 10 * time.Second, MaxRecordsPerQuery: 10}
+	feederConfig := WALFeederConfig{NoRecordsSleepDuration: 10 * time.Second, MaxRecordsPerQuery: 10, FailureDelay: 5 * time.Minute}
 
 	records := []watchdog.SQLConsistencyRecord{
 		{ObjectVersion: 1, RequestID: "1", ObjectID: "some/object1", Domain: "test1.qxlint", InsertedAt: time.Now().UTC(), ExecutionDelay: (5 * time.Minute).String()},
@@ -129,7 +122,7 @@ func TestShouldCommitATransactionEvenWhenSomeOfTheTasksHaveFailed(t *testing.T)
 	}
 
 	compactions := []compaction{{domain: records[0].Domain, objectID: records[0].ObjectID, objectVersion: records[0].ObjectVersion, rowsAffected: 1}}
-	failures := []failure{{requestID: records[1].RequestID, err: taskError}}
+	failures := []failure{{requestID: records[1].RequestID, err: taskError, delay: feederConfig.FailureDelay}}
 
 	dbFactoryMock, db, _ := createDBFactoryMock(watchdogProps, records, compactions, failures, t)
 	defer db.Close()
@@ -145,7 +138,7 @@ func TestShouldCommitATransactionEvenWhenSomeOfTheTasksHaveFailed(t *testing.T)
 		if len(emittedEntries) == 1 {
 			err = taskError
 		}
-		_ = entry.RecordProcessedHook(entry.Record, err)
+		assert.NoError(t, entry.RecordProcessedHook(entry.Record, err))
 		emittedEntries = append(emittedEntries, entry.Record.ObjectID)
 	}
 
@@ -155,6 +148,47 @@ func TestShouldCommitATransactionEvenWhenSomeOfTheTasksHaveFailed(t *testing.T)
 	assert.Contains(t, emittedEntries, "some/object2")
 }
 
+func TestShouldQueryTheNextBatchBeforeThePendingOneIsProcessed(t *testing.T) {
+	watchdogProps := make(map[string]string)
+	akubraConfig := config.YamlConfig{Watchdog: wc.WatchdogConfig{Type: "sql", Props: watchdogProps}}
+	feederConfig := WALFeederConfig{NoRecordsSleepDuration: 10 * time.Second, MaxRecordsPerQuery: 1, MaxPendingBatches: 2}
+
+	db, dbMock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	gormDB, err := gorm.Open("postgres", db)
+	require.NoError(t, err)
+	columns := []string{"request_id", "object_id", "domain", "object_version", "execution_delay"}
+	for _, requestID := range []string{"1", "2"} {
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(logEntriesSelect).WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(requestID, "some/object"+requestID, "test.qxlint", 1, "0s"))
+	}
+	dbFactoryMock := &dbClientFactoryMock{}
+	dbFactoryMock.On("CreateConnection", watchdogProps).Return(gormDB, nil)
+
+	sqlWALFeeder, err := NewSQLWALFeeder(&config.Config{YamlConfig: akubraConfig}, &feederConfig, dbFactoryMock)
+	require.NoError(t, err)
+	entriesFeed := sqlWALFeeder.CreateFeed()
+
+	var emittedEntries []string
+	for len(emittedEntries) < 2 {
+		select {
+		case entry := <-entriesFeed:
+			emittedEntries = append(emittedEntries, entry.Record.RequestID)
+		case <-time.After(time.Second):
+			t.Fatalf("next batch wasn't queried while %v are in progress", emittedEntries)
+		}
+	}
+	assert.Equal(t, []string{"1", "2"}, emittedEntries)
+	assert.NoError(t, dbMock.ExpectationsWereMet())
+	select {
+	case entry := <-entriesFeed:
+		t.Fatalf("batch of %s queried over the limit of pending batches", entry.Record.RequestID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
 func createDBFactoryMock(watchdogProps map[string]string, records []watchdog.SQLConsistencyRecord, deleteParams []compaction, failures []failure, t *testing.T) (*dbClientFactoryMock, *sql.DB, sqlmock.Sqlmock) {
 	dbFactoryMock := &dbClientFactoryMock{}
 	db, dbMock, err := sqlmock.New()
@@ -175,23 +209,17 @@ func createDBFactoryMock(watchdogProps map[string]string, records []watchdog.SQL
 
 	for idx := range deleteParams {
 		dbMock.
-			ExpectExec(`DELETE\ FROM\ \"consistency_record\"\ WHERE\ \(domain\ \=\ \$1\ AND\ object_id\ \=\ \$2\ AND\ object_version\ \<\=\ \$3\)`).
-			WithArgs(deleteParams[idx].domain, deleteParams[idx].objectID, deleteParams[idx].objectVersion).
+			ExpectExec(`DELETE\ FROM\ \"consistency_record\"\ WHERE\ \(domain\ \=\ \$1\ AND\ object_id\ \=\ \$2\ AND\ operation\ \=\ \$3\ AND\ object_version\ \<\=\ \$4\)`).
+			WithArgs(deleteParams[idx].domain, deleteParams[idx].objectID, watchdog.ObjectOperation, deleteParams[idx].objectVersion).
 			WillReturnResult(sqlmock.NewResult(1, deleteParams[idx].rowsAffected))
 	}
 
 	for idx := range failures {
 
 		dbMock.
-			ExpectExec(`UPDATE\ \"consistency_record\"\ SET\ \"error\"\ \=\ .+\,\ \"updated_at\"\ \=\ .+\ WHERE\ \(request_id\ \=\ .+\)`).
-			WithArgs(failures[idx].err.Error(), AnyTime{}, failures[idx].requestID).
+			ExpectExec(`UPDATE\ consistency_record\ SET\ error\ \=\ .+\,\ execution_delay\ \=\ .+\,\ updated_at\ \=\ .+\ WHERE\ request_id\ \=\ .+`).
+			WithArgs(failures[idx].err.Error(), failures[idx].delay.String(), failures[idx].requestID).
 			WillReturnResult(sqlmock.NewResult(1, 1))
-
-		dbMock.
-			ExpectQuery("UPDATE consistency_record SET execution_delay .+").
-			WithArgs(failures[idx].requestID).
-			WillReturnRows(dbMock.NewRows([]string{"x"}).AddRow("x")).
-			RowsWillBeClosed()
 	}
 
 	dbMock.ExpectCommit()
@@ -1,15 +1,20 @@
 package filter
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/AdRoll/goamz/s3"
 	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
 	"github.com/allegro/akubra/internal/akubra/sharding"
 	"github.com/allegro/akubra/internal/akubra/storages"
 	"github.com/allegro/akubra/internal/akubra/watchdog"
 	"github.com/allegro/akubra/internal/brim/auth"
+	"github.com/allegro/akubra/internal/brim/feeder"
 	"github.com/allegro/akubra/internal/brim/model"
 	brimS3 "github.com/allegro/akubra/internal/brim/s3"
 )
@@ -26,6 +31,9 @@ type DefaultWALFilter struct {
 	backendResolver auth.BackendResolver
 	rings           map[domain]sharding.ShardsRingAPI
 	versionFetcher  VersionFetcher
+	resourceFetcher ResourceFetcher
+	config          Config
+	cache           *versionCache
 }
 
 type storageEndpoint = string
@@ -50,59 +58,100 @@ type ringState struct {
 	oldStoragesWithObject []*s3.S3
 	targetShardSrcCli     *s3.S3
 	targetShardDstClis    []*s3.S3
+	objectSize            int64
 }
 
-var noopTask = ringState{nil, nil, nil}
+var noopTask = ringState{}
 
-//NewDefaultWALFilter constructs an instance of DefaultWALFeeder
-func NewDefaultWALFilter(resolver auth.BackendResolver, fetcher VersionFetcher) WALFilter {
+//NewDefaultWALFilter constructs an instance of DefaultWALFeeder with the default Config
+func NewDefaultWALFilter(resolver auth.BackendResolver, fetcher VersionFetcher, resourceFetcher ResourceFetcher) WALFilter {
+	return NewConfiguredWALFilter(resolver, fetcher, resourceFetcher, Config{})
+}
+
+//NewConfiguredWALFilter constructs an instance of DefaultWALFeeder
+func NewConfiguredWALFilter(resolver auth.BackendResolver, fetcher VersionFetcher, resourceFetcher ResourceFetcher, config Config) WALFilter {
+	config = config.withDefaults()
 	return &DefaultWALFilter{
 		backendResolver: resolver,
 		rings:           make(map[domain]sharding.ShardsRingAPI),
 		versionFetcher:  fetcher,
+		resourceFetcher: resourceFetcher,
+		config:          config,
+		cache:           newVersionCache(config.CacheSize, config.CacheTTL),
 	}
 }
 
-//Filter filters that rows acquired from the database and creates WALTasks for them
+//Filter filters that rows acquired from the database and creates WALTasks for them,
+//the tasks channel is closed once the entries channel is closed
 func (filter *DefaultWALFilter) Filter(walEntriesChannel <-chan *model.WALEntry) <-chan *model.WALTask {
-	tasksChannel := make(chan *model.WALTask, len(walEntriesChannel))
+	tasksChannel := make(chan *model.WALTask, cap(walEntriesChannel))
 	go func() {
+		defer close(tasksChannel)
 		for walEntry := range walEntriesChannel {
+			for _, entry := range coalesce(filter.nextBatch(walEntry, walEntriesChannel)) {
+				filter.filterEntry(entry, tasksChannel)
+			}
+		}
+	}()
+	return tasksChannel
+}
 
-			log.Debugf("Processing WALEntry for reqID = '%s' objID = '%s'",
-				walEntry.Record.RequestID, walEntry.Record.ObjectID)
+func (filter *DefaultWALFilter) filterEntry(walEntry *model.WALEntry, tasksChannel chan<- *model.WALTask) {
+	metrics.Mark("watchdog.filter.entries")
+	defer metrics.UpdateSince("watchdog.filter.entry", time.Now())
+	log.Debugf("Processing WALEntry for reqID = '%s' objID = '%s'",
+		walEntry.Record.RequestID, walEntry.Record.ObjectID)
 
-			ring, err := filter.determineRing(walEntry)
-			if err != nil {
-				finishWithError(walEntry, err)
-				continue
-			}
+	ring, err := filter.determineRing(walEntry)
+	if err != nil {
+		finishWithError(walEntry, err)
+		return
+	}
 
-			ringState, err := filter.determineStorages(walEntry.Record, ring)
-			if err != nil {
-				finishWithError(walEntry, err)
-				continue
-			}
+	if !walEntry.Record.IsObjectContent() {
+		task, err := filter.resourceTask(walEntry, ring)
+		if err != nil {
+			finishWithError(walEntry, err)
+			return
+		}
+		emit(tasksChannel, task)
+		return
+	}
 
-			//we're removing the hook from this task, because we need to run it only only after we've also deleted
-			// the object's versions from storages that used to be the object's storages
-			// (for example before a migration, or before weights were changed)
-			hook := noopHook
-			if len(ringState.oldStoragesWithObject) > 0 {
-				hook = walEntry.RecordProcessedHook
-				walEntry.RecordProcessedHook = noopHook
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), filter.config.LookupTimeout)
+	defer cancel()
+	ringState, err := filter.determineStorages(ctx, walEntry.Record, ring)
+	if err != nil {
+		finishWithError(walEntry, err)
+		return
+	}
 
-			tasksChannel <- &model.WALTask{
-				WALEntry:            walEntry,
-				SourceClient:        ringState.targetShardSrcCli,
-				DestinationsClients: ringState.targetShardDstClis,
-			}
+	//we're removing the hook from this task, because we need to run it only only after we've also deleted
+	// the object's versions from storages that used to be the object's storages
+	// (for example before a migration, or before weights were changed)
+	hook := noopHook
+	if len(ringState.oldStoragesWithObject) > 0 {
+		hook = walEntry.RecordProcessedHook
+		walEntry.RecordProcessedHook = noopHook
+	}
+	if len(ringState.targetShardDstClis) > 0 || len(ringState.oldStoragesWithObject) > 0 {
+		filter.cache.invalidate(walEntry.Record.ObjectID)
+	}
 
-			tasksChannel <- clearOldStoragesTask(walEntry.Record, hook, ringState.oldStoragesWithObject)
-		}
-	}()
-	return tasksChannel
+	emit(tasksChannel, &model.WALTask{
+		WALEntry:            walEntry,
+		SourceClient:        ringState.targetShardSrcCli,
+		DestinationsClients: ringState.targetShardDstClis,
+		Reason:              migrationReason(walEntry.Record, ringState.targetShardDstClis),
+		ObjectSize:          ringState.objectSize,
+	})
+
+	emit(tasksChannel, clearOldStoragesTask(walEntry.Record, hook, ringState.oldStoragesWithObject))
+}
+
+func emit(tasksChannel chan<- *model.WALTask, task *model.WALTask) {
+	metrics.Mark("watchdog.filter.tasks." + task.Reason)
+	tasksChannel <- task
 }
 
 func clearOldStoragesTask(record *watchdog.ConsistencyRecord, recordProcessedHook model.Hook, s3Clis []*s3.S3) *model.WALTask {
@@ -115,6 +164,18 @@ func clearOldStoragesTask(record *watchdog.ConsistencyRecord, recordProcessedHoo
 			Record:              &deleteRecord,
 			RecordProcessedHook: recordProcessedHook,
 		},
+		Reason: model.ReasonOldShardCopies,
+	}
+}
+
+func migrationReason(record *watchdog.ConsistencyRecord, dstClis []*s3.S3) string {
+	switch {
+	case len(dstClis) == 0:
+		return model.ReasonInSync
+	case record.Method == watchdog.DELETE:
+		return model.ReasonDeletedObject
+	default:
+		return model.ReasonOutdatedCopies
 	}
 }
 
@@ -125,33 +186,34 @@ func finishWithError(entry *model.WALEntry, err error) {
 	}
 }
 
-func (filter *DefaultWALFilter) determineStorages(record *watchdog.ConsistencyRecord, ring sharding.ShardsRingAPI) (*ringState, error) {
+func (filter *DefaultWALFilter) determineStorages(ctx context.Context, record *watchdog.ConsistencyRecord, ring sharding.ShardsRingAPI) (*ringState, error) {
 	pickedShard, err := ring.Pick(record.ObjectID)
 	if err != nil {
 		return nil, err
 	}
 
-	var pickedShardSrcCli *s3.S3
-	var pickedShardDstClis []*s3.S3
-	var oldStoragesWithObject []*s3.S3
+	// The picked shard goes first, the version of a replayed record is resolved there
+	pickedShardState, err := filter.fetchVersionsFromStorages(ctx, record, pickedShard)
+	if err != nil {
+		return nil, err
+	}
+	if feeder.IsReplay(record) && record.Method == watchdog.PUT {
+		record.ObjectVersion = replayedVersion(record.ObjectVersion, pickedShardState)
+	}
+	pickedShardSrcCli, pickedShardDstClis, objectSize, err := filter.prepareShardMigration(record, pickedShardState)
+	if pickedShardSrcCli == nil && pickedShardDstClis == nil && err == nil {
+		return &noopTask, nil
+	}
 
+	var oldStoragesWithObject []*s3.S3
 	for _, shardClient := range ring.GetShards() {
-
-		stateOnShard, err := filter.fetchVersionsFromStorages(record, shardClient)
-		if err != nil {
-			return nil, err
-		}
-
 		if shardClient == pickedShard {
-			srcCli, dstClis, err := filter.prepareShardMigration(record, stateOnShard)
-			if srcCli == nil && dstClis == nil && err == nil {
-				return &noopTask, nil
-			}
-			pickedShardSrcCli = srcCli
-			pickedShardDstClis = dstClis
 			continue
 		}
-
+		stateOnShard, err := filter.fetchVersionsFromStorages(ctx, record, shardClient)
+		if err != nil {
+			return nil, err
+		}
 		oldStoragesWithObject = append(
 			oldStoragesWithObject,
 			filter.getStoragesWithVersion(record.ObjectVersion, stateOnShard)...)
@@ -161,15 +223,31 @@ func (filter *DefaultWALFilter) determineStorages(record *watchdog.ConsistencyRe
 		oldStoragesWithObject: oldStoragesWithObject,
 		targetShardSrcCli:     pickedShardSrcCli,
 		targetShardDstClis:    pickedShardDstClis,
+		objectSize:            objectSize,
 	}, nil
 }
 
-func (filter *DefaultWALFilter) fetchVersionsFromStorages(record *watchdog.ConsistencyRecord, shardClient storages.NamedShardClient) (*objectState, error) {
+// replayedVersion is the newest version on the storages not newer than the time the replayed request was logged at,
+// the bound is kept if the storages have no such version
+func replayedVersion(bound int, state *objectState) int {
+	version := -1
+	for _, storage := range state.storagesWithObject {
+		if storage.version <= bound && storage.version > version {
+			version = storage.version
+		}
+	}
+	if version == -1 {
+		return bound
+	}
+	return version
+}
+
+func (filter *DefaultWALFilter) fetchVersionsFromStorages(ctx context.Context, record *watchdog.ConsistencyRecord, shardClient storages.NamedShardClient) (*objectState, error) {
 	storagesKeys, err := filter.resolveStoragesKeys(record, shardClient)
 	if err != nil {
 		return nil, err
 	}
-	storagesWithObject, storagesWithoutObject, err := filter.checkStoragesForObjectPresence(storagesKeys, record, shardClient)
+	storagesWithObject, storagesWithoutObject, err := filter.checkStoragesForObjectPresence(ctx, storagesKeys, record, shardClient)
 	if err != nil {
 		return nil, err
 	}
@@ -291,30 +369,57 @@ func (filter *DefaultWALFilter) resolveStoragesKeys(record *watchdog.Consistency
 	return storagesKeys, nil
 }
 
-func (filter *DefaultWALFilter) checkStoragesForObjectPresence(storagesKeys map[storageEndpoint]keys, record *watchdog.ConsistencyRecord, shardClient storages.NamedShardClient) ([]*StorageState, []*StorageState, error) {
+//checkStoragesForObjectPresence reads the object's versions on all the storages of the shard at once,
+//the requests are cancelled when the context is done
+func (filter *DefaultWALFilter) checkStoragesForObjectPresence(ctx context.Context, storagesKeys map[storageEndpoint]keys, record *watchdog.ConsistencyRecord, shardClient storages.NamedShardClient) ([]*StorageState, []*StorageState, error) {
 	bucketAndKey := strings.Split(record.ObjectID, "/")
 	if len(bucketAndKey) < 2 || bucketAndKey[0] == "" || bucketAndKey[1] == "" {
 		return nil, nil, fmt.Errorf("malformed object's path '%s", record.ObjectID)
 	}
 
-	var storagesWithObject, storagesWithoutObject []*StorageState
-
-	for _, storageClient := range shardClient.Backends() {
-
+	backends := shardClient.Backends()
+	states := make([]*StorageState, len(backends))
+	errs := make([]error, len(backends))
+	wg := sync.WaitGroup{}
+	for idx, storageClient := range backends {
 		clientAuth := &brimS3.MigrationAuth{
 			AccessKey: storagesKeys[storageClient.Endpoint.String()].access,
 			SecretKey: storagesKeys[storageClient.Endpoint.String()].secret,
 			Endpoint:  storageClient.Endpoint.String(),
 		}
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			states[idx], errs[idx] = filter.fetchVersion(ctx, clientAuth, record.ObjectID, bucketAndKey[0], bucketAndKey[1])
+		}(idx)
+	}
+	fetched := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(fetched)
+	}()
+	lookupStart := time.Now()
+	select {
+	case <-fetched:
+		metrics.UpdateSince("watchdog.filter.lookup", lookupStart)
+	case <-ctx.Done():
+		metrics.Mark("watchdog.filter.lookup.timeout")
+		return nil, nil, fmt.Errorf("couldn't determine object '%s' version on shard '%s' in %s",
+			record.ObjectID, shardClient.Name(), filter.config.LookupTimeout)
+	}
+
+	var storagesWithObject, storagesWithoutObject []*StorageState
+
+	for idx, storageClient := range backends {
 
-		objState, err := filter.versionFetcher.Fetch(clientAuth, bucketAndKey[0], bucketAndKey[1])
+		objState, err := states[idx], errs[idx]
 		if err != nil {
-			return nil, nil, fmt.Errorf("couldn't determine object '%s' version on storage '%s': %s",
-				record.ObjectID, storageClient.Endpoint.String(), err)
+			return nil, nil, model.NewBackendError(storageClient.Endpoint.String(),
+				fmt.Errorf("couldn't determine object '%s' version: %w", record.ObjectID, err))
 		}
 
 		if objState.objectNotFound {
-			log.Printf("Object '%s' is not present on storage '%s'", record.ObjectID, clientAuth.Endpoint)
+			log.Printf("Object '%s' is not present on storage '%s'", record.ObjectID, storageClient.Endpoint.String())
 			storagesWithoutObject = append(storagesWithoutObject, objState)
 			continue
 		}
@@ -341,19 +446,26 @@ func (filter *DefaultWALFilter) getStoragesWithVersion(version int, state *objec
 	return storagesWithObject
 }
 
-func (filter *DefaultWALFilter) prepareShardMigration(record *watchdog.ConsistencyRecord, state *objectState) (*s3.S3, []*s3.S3, error) {
+//prepareShardMigration picks the source and destinations on the object's shard, and the size of the source's copy
+func (filter *DefaultWALFilter) prepareShardMigration(record *watchdog.ConsistencyRecord, state *objectState) (*s3.S3, []*s3.S3, int64, error) {
 	storagesEndpoints, err := resolveVersions(record, state)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 	//In this the case there is a newer version of the object on at least
 	//one of the storages
 	if storagesEndpoints == nil && err == nil {
-		return nil, nil, nil
+		return nil, nil, 0, nil
 	}
 	var srcStorages []string
+	var objectSize int64
 	if storagesEndpoints.src != "" {
 		srcStorages = []string{storagesEndpoints.src}
+		for _, storage := range state.storagesWithObject {
+			if storage.storageEndpoint == storagesEndpoints.src {
+				objectSize = storage.contentLength
+			}
+		}
 	}
 
 	srcClients := filter.createS3Clients(srcStorages, state.storagesKeys)
@@ -362,12 +474,12 @@ func (filter *DefaultWALFilter) prepareShardMigration(record *watchdog.Consisten
 	var srcClient *s3.S3
 	if record.Method == watchdog.PUT {
 		if len(srcClients) == 0 {
-			return nil, nil, nil
+			return nil, nil, 0, nil
 		}
 		srcClient = srcClients[0]
 	}
 
-	return srcClient, dstClients, err
+	return srcClient, dstClients, objectSize, err
 }
 func noopHook(_ *watchdog.ConsistencyRecord, _ error) error {
 	return nil
@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"context"
 	"fmt"
 	"github.com/allegro/akubra/internal/akubra/types"
 	"github.com/allegro/akubra/internal/brim/model"
@@ -19,10 +20,12 @@ import (
 	transportConfig "github.com/allegro/akubra/internal/akubra/transport/config"
 	"github.com/allegro/akubra/internal/akubra/watchdog"
 	"github.com/allegro/akubra/internal/brim/auth"
+	"github.com/allegro/akubra/internal/brim/feeder"
 	brimS3 "github.com/allegro/akubra/internal/brim/s3"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type versionFetcherMock struct {
@@ -63,7 +66,7 @@ func (resolver *backendResolverMock) GetShardsRing(domain string) (sharding.Shar
 	return ring, args.Error(1)
 }
 
-func (fetcherMock *versionFetcherMock) Fetch(auth *brimS3.MigrationAuth, bucketName string, key string) (*StorageState, error) {
+func (fetcherMock *versionFetcherMock) Fetch(_ context.Context, auth *brimS3.MigrationAuth, bucketName string, key string) (*StorageState, error) {
 	args := fetcherMock.Called(auth, bucketName, key)
 	var state *StorageState
 	v := args.Get(0)
@@ -77,7 +80,7 @@ func TestShouldFailedWhenRingCanNotBeResolved(t *testing.T) {
 	resolver := &backendResolverMock{}
 	versionFetcher := &versionFetcherMock{}
 
-	filter := NewDefaultWALFilter(resolver, versionFetcher)
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
 
 	entryWG := sync.WaitGroup{}
 	entryWG.Add(1)
@@ -108,7 +111,7 @@ func TestShouldGenerateANoopTaskWhenThereIsANewerVersionOfTheObjectAlreadyUpload
 	resolver := &backendResolverMock{}
 	versionFetcher := &versionFetcherMock{}
 
-	filter := NewDefaultWALFilter(resolver, versionFetcher)
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
 
 	entryWG := sync.WaitGroup{}
 	entryWG.Add(1)
@@ -143,6 +146,7 @@ func TestShouldGenerateANoopTaskWhenThereIsANewerVersionOfTheObjectAlreadyUpload
 	entryWG.Wait()
 	assert.Nil(t, task.SourceClient)
 	assert.Empty(t, task.DestinationsClients)
+	assert.Equal(t, model.ReasonInSync, task.Reason)
 }
 
 func TestShouldGenerateMigrationsForStoragesWithoutObjectInProperVersion(t *testing.T) {
@@ -150,7 +154,7 @@ func TestShouldGenerateMigrationsForStoragesWithoutObjectInProperVersion(t *test
 	resolver := &backendResolverMock{}
 	versionFetcher := &versionFetcherMock{}
 
-	filter := NewDefaultWALFilter(resolver, versionFetcher)
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
 
 	entryWG := sync.WaitGroup{}
 	entryWG.Add(1)
@@ -178,7 +182,7 @@ func TestShouldGenerateMigrationsForStoragesWithoutObjectInProperVersion(t *test
 		"http://localhost:1000": {storageEndpoint: "http://localhost:1000", version: 1},
 		"http://localhost:1100": {storageEndpoint: "http://localhost:1100", objectNotFound: true},
 		"http://localhost:1200": {storageEndpoint: "http://localhost:1200", version: -1},
-		"http://localhost:1300": {storageEndpoint: "http://localhost:1300", version: latestVersion},
+		"http://localhost:1300": {storageEndpoint: "http://localhost:1300", version: latestVersion, contentLength: 42},
 	})
 
 	tasksChannel := filter.Filter(walEntriesChannel)
@@ -198,6 +202,19 @@ func TestShouldGenerateMigrationsForStoragesWithoutObjectInProperVersion(t *test
 	assert.Len(t, migrationTask.DestinationsClients, 3)
 	assert.Len(t, oldStoragesTask.DestinationsClients, 0)
 	assert.Contains(t, dstEndpoints, "http://localhost:1000", "http://localhost:1100", "http://localhost:1200")
+	assert.Equal(t, model.ReasonOutdatedCopies, migrationTask.Reason)
+	assert.Equal(t, int64(42), migrationTask.ObjectSize)
+	assert.Equal(t, model.ReasonOldShardCopies, oldStoragesTask.Reason)
+}
+
+func TestShouldCloseTasksChannelOnceEntriesChannelIsClosed(t *testing.T) {
+	filter := NewDefaultWALFilter(&backendResolverMock{}, &versionFetcherMock{}, &resourceFetcherMock{})
+	walEntriesChannel := make(chan *model.WALEntry)
+	close(walEntriesChannel)
+
+	_, open := <-filter.Filter(walEntriesChannel)
+
+	assert.False(t, open)
 }
 
 func TestShouldNotGenerateDeleteTasksIfTheObjectIsAlreadyAbsentOnAllStorages(t *testing.T) {
@@ -205,7 +222,7 @@ func TestShouldNotGenerateDeleteTasksIfTheObjectIsAlreadyAbsentOnAllStorages(t *
 	resolver := &backendResolverMock{}
 	versionFetcher := &versionFetcherMock{}
 
-	filter := NewDefaultWALFilter(resolver, versionFetcher)
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
 
 	entryWG := sync.WaitGroup{}
 	entryWG.Add(1)
@@ -250,7 +267,7 @@ func TestShouldDeleteObjectsFromStoragesThatSillContainThem(t *testing.T) {
 	resolver := &backendResolverMock{}
 	versionFetcher := &versionFetcherMock{}
 
-	filter := NewDefaultWALFilter(resolver, versionFetcher)
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
 
 	entryWG := sync.WaitGroup{}
 	entryWG.Add(1)
@@ -303,7 +320,7 @@ func TestShoulKeepTheVersionFromStoragesIfTheVersionHeaderIsMissingOnAllStorages
 	resolver := &backendResolverMock{}
 	versionFetcher := &versionFetcherMock{}
 
-	filter := NewDefaultWALFilter(resolver, versionFetcher)
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
 
 	entryWG := sync.WaitGroup{}
 	entryWG.Add(1)
@@ -347,7 +364,7 @@ func TestShouldClearOldShardsFromObjectVersions(t *testing.T) {
 	resolver := &backendResolverMock{}
 	versionFetcher := &versionFetcherMock{}
 
-	filter := NewDefaultWALFilter(resolver, versionFetcher)
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
 
 	entryWG := sync.WaitGroup{}
 	entryWG.Add(1)
@@ -465,3 +482,34 @@ func generateAkubraConfig(numberOfShards int, numberOfStoragesPerShard int) *con
 
 	return akubraConfig
 }
+
+func TestShouldMigrateTheNewestVersionLoggedBeforeTheReplayedRequest(t *testing.T) {
+	akubraConfig := generateAkubraConfig(1, 3)
+	resolver := &backendResolverMock{}
+	versionFetcher := &versionFetcherMock{}
+	shardsRing, _, _ := auth.Ring(akubraConfig, "test")
+	resolver.On("GetShardsRing", "localhost").Return(shardsRing, nil)
+	prepareMocksForStorages(resolver, akubraConfig.Storages, "123", "321", "some/key1")
+	prepareVersionMocks("some", "key1", "123", "321", versionFetcher, map[string]*StorageState{
+		"http://localhost:1000": {storageEndpoint: "http://localhost:1000", version: 1},
+		"http://localhost:1100": {storageEndpoint: "http://localhost:1100", version: 5},
+		"http://localhost:1200": {storageEndpoint: "http://localhost:1200", objectNotFound: true},
+	})
+
+	walEntriesChannel := make(chan *model.WALEntry, 1)
+	walEntriesChannel <- &model.WALEntry{Record: &watchdog.ConsistencyRecord{
+		RequestID:     feeder.ReplayRequestIDPrefix + "123",
+		Method:        watchdog.PUT,
+		Domain:        "localhost",
+		ObjectID:      "some/key1",
+		AccessKey:     "123",
+		ObjectVersion: 7},
+		RecordProcessedHook: noopHook}
+	migrationTask := <-NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{}).Filter(walEntriesChannel)
+
+	require.NotNil(t, migrationTask.SourceClient)
+	assert.Equal(t, "http://localhost:1100", migrationTask.SourceClient.S3Endpoint)
+	assert.Equal(t, 5, migrationTask.WALEntry.Record.ObjectVersion)
+	assert.Len(t, migrationTask.DestinationsClients, 2)
+	assert.Equal(t, model.ReasonOutdatedCopies, migrationTask.Reason)
+}
@@ -0,0 +1,204 @@
+package filter
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+)
+
+const (
+	defaultLookupTimeout = 30 * time.Second
+	defaultCacheSize     = 1000
+	defaultCacheTTL      = 5 * time.Second
+	defaultBatchSize     = 100
+)
+
+//Config tunes the version lookups of the filter, zero values are replaced with the defaults
+type Config struct {
+	//LookupTimeout bounds the version lookups of a single entry, 30s by default
+	LookupTimeout time.Duration
+	//CacheSize is the number of objects which versions are cached, 1000 by default, negative disables the cache
+	CacheSize int
+	//CacheTTL is the time the versions are cached for, 5s by default
+	CacheTTL time.Duration
+	//BatchSize is the number of queued entries taken at once, entries of the same object in a batch are coalesced
+	BatchSize int
+}
+
+func (config Config) withDefaults() Config {
+	if config.LookupTimeout <= 0 {
+		config.LookupTimeout = defaultLookupTimeout
+	}
+	if config.CacheSize == 0 {
+		config.CacheSize = defaultCacheSize
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = defaultCacheTTL
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	return config
+}
+
+//versionCache is a LRU of the object versions found on the storages, nil caches nothing
+type versionCache struct {
+	size    int
+	ttl     time.Duration
+	objects map[string]*list.Element
+	lru     *list.List
+	mx      sync.Mutex
+}
+
+type cachedObject struct {
+	objectID string
+	states   map[storageEndpoint]cachedState
+}
+
+type cachedState struct {
+	state     StorageState
+	fetchedAt time.Time
+}
+
+func newVersionCache(size int, ttl time.Duration) *versionCache {
+	if size < 0 {
+		return nil
+	}
+	return &versionCache{size: size, ttl: ttl, objects: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (cache *versionCache) get(endpoint, objectID string) (*StorageState, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	element, ok := cache.objects[objectID]
+	if !ok {
+		return nil, false
+	}
+	cached, ok := element.Value.(*cachedObject).states[endpoint]
+	if !ok || time.Since(cached.fetchedAt) > cache.ttl {
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	state := cached.state
+	return &state, true
+}
+
+func (cache *versionCache) put(endpoint, objectID string, state *StorageState) {
+	if cache == nil {
+		return
+	}
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	element, ok := cache.objects[objectID]
+	if !ok {
+		element = cache.lru.PushFront(&cachedObject{objectID: objectID, states: make(map[storageEndpoint]cachedState)})
+		cache.objects[objectID] = element
+	}
+	cache.lru.MoveToFront(element)
+	element.Value.(*cachedObject).states[endpoint] = cachedState{state: *state, fetchedAt: time.Now()}
+	for cache.lru.Len() > cache.size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.objects, oldest.Value.(*cachedObject).objectID)
+	}
+}
+
+//invalidate drops the versions of the object, tasks are about to change them
+func (cache *versionCache) invalidate(objectID string) {
+	if cache == nil {
+		return
+	}
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	if element, ok := cache.objects[objectID]; ok {
+		cache.lru.Remove(element)
+		delete(cache.objects, objectID)
+	}
+}
+
+//fetchVersion reads the object's version on the storage or takes it from the cache
+func (filter *DefaultWALFilter) fetchVersion(ctx context.Context, clientAuth *brimS3.MigrationAuth, objectID, bucket, key string) (*StorageState, error) {
+	if state, ok := filter.cache.get(clientAuth.Endpoint, objectID); ok {
+		metrics.Mark("watchdog.filter.cache.hit")
+		return state, nil
+	}
+	metrics.Mark("watchdog.filter.cache.miss")
+	state, err := filter.versionFetcher.Fetch(ctx, clientAuth, bucket, key)
+	if err == nil {
+		filter.cache.put(clientAuth.Endpoint, objectID, state)
+	}
+	return state, err
+}
+
+//nextBatch takes the entry and the ones already queued after it, at most BatchSize in total
+func (filter *DefaultWALFilter) nextBatch(first *model.WALEntry, walEntriesChannel <-chan *model.WALEntry) []*model.WALEntry {
+	batch := []*model.WALEntry{first}
+	for len(batch) < filter.config.BatchSize {
+		select {
+		case entry, open := <-walEntriesChannel:
+			if !open {
+				return batch
+			}
+			batch = append(batch, entry)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+//coalesce keeps the newest entry of every object, bucket and sub-resource of the batch,
+//the hooks of the dropped entries are called along with the hook of the kept one
+func coalesce(batch []*model.WALEntry) []*model.WALEntry {
+	newest := make(map[string]int)
+	dropped := make(map[string][]model.Hook)
+	var coalesced []*model.WALEntry
+	for _, entry := range batch {
+		id := entryID(entry.Record)
+		idx, seen := newest[id]
+		if !seen {
+			newest[id] = len(coalesced)
+			coalesced = append(coalesced, entry)
+			continue
+		}
+		metrics.Mark("watchdog.filter.coalesced")
+		if entry.Record.ObjectVersion > coalesced[idx].Record.ObjectVersion {
+			dropped[id] = append(dropped[id], coalesced[idx].RecordProcessedHook)
+			coalesced[idx] = entry
+		} else {
+			dropped[id] = append(dropped[id], entry.RecordProcessedHook)
+		}
+	}
+	for idx, entry := range coalesced {
+		if hooks := dropped[entryID(entry.Record)]; len(hooks) > 0 {
+			coalesced[idx] = &model.WALEntry{Record: entry.Record, RecordProcessedHook: chainHooks(entry.RecordProcessedHook, hooks)}
+		}
+	}
+	return coalesced
+}
+
+func chainHooks(kept model.Hook, dropped []model.Hook) model.Hook {
+	return func(record *watchdog.ConsistencyRecord, err error) error {
+		hookErr := kept(record, err)
+		for _, hook := range dropped {
+			if droppedErr := hook(record, err); hookErr == nil {
+				hookErr = droppedErr
+			}
+		}
+		return hookErr
+	}
+}
+
+func entryID(record *watchdog.ConsistencyRecord) string {
+	return fmt.Sprintf("%s%s:%s:%s", record.Domain, record.ObjectID, record.OperationOrDefault(), record.SubResource)
+}
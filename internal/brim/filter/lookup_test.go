@@ -0,0 +1,153 @@
+package filter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/auth"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type slowVersionFetcher struct {
+	delay     time.Duration
+	cancelled int32
+}
+
+func (fetcher *slowVersionFetcher) Fetch(ctx context.Context, auth *brimS3.MigrationAuth, _ string, _ string) (*StorageState, error) {
+	select {
+	case <-time.After(fetcher.delay):
+		return &StorageState{storageEndpoint: auth.Endpoint, version: 1}, nil
+	case <-ctx.Done():
+		atomic.AddInt32(&fetcher.cancelled, 1)
+		return nil, ctx.Err()
+	}
+}
+
+func TestVersionCacheShouldExpireEvictAndInvalidateVersions(t *testing.T) {
+	cache := newVersionCache(2, 50*time.Millisecond)
+	cache.put("http://localhost:1000", "bucket/first", &StorageState{storageEndpoint: "http://localhost:1000", version: 1})
+	cache.put("http://localhost:1000", "bucket/second", &StorageState{storageEndpoint: "http://localhost:1000", version: 2})
+
+	state, ok := cache.get("http://localhost:1000", "bucket/first")
+	require.True(t, ok)
+	assert.Equal(t, 1, state.version)
+	_, ok = cache.get("http://localhost:1100", "bucket/first")
+	assert.False(t, ok)
+
+	cache.put("http://localhost:1000", "bucket/third", &StorageState{storageEndpoint: "http://localhost:1000", version: 3})
+	_, ok = cache.get("http://localhost:1000", "bucket/second")
+	assert.False(t, ok, "the least recently used object should be evicted")
+
+	cache.invalidate("bucket/third")
+	_, ok = cache.get("http://localhost:1000", "bucket/third")
+	assert.False(t, ok)
+
+	time.Sleep(60 * time.Millisecond)
+	_, ok = cache.get("http://localhost:1000", "bucket/first")
+	assert.False(t, ok, "the version should expire")
+
+	disabled := newVersionCache(-1, time.Second)
+	disabled.put("http://localhost:1000", "bucket/first", &StorageState{})
+	_, ok = disabled.get("http://localhost:1000", "bucket/first")
+	assert.False(t, ok)
+}
+
+func TestCoalesceShouldKeepTheNewestEntryOfAnObjectAndCallAllTheHooks(t *testing.T) {
+	var called []int
+	entry := func(objectID string, version int) *model.WALEntry {
+		return &model.WALEntry{
+			Record: &watchdog.ConsistencyRecord{Domain: "localhost", ObjectID: objectID, Method: watchdog.PUT, ObjectVersion: version},
+			RecordProcessedHook: func(_ *watchdog.ConsistencyRecord, _ error) error {
+				called = append(called, version)
+				return nil
+			}}
+	}
+
+	coalesced := coalesce([]*model.WALEntry{entry("some/key", 1), entry("other/key", 5), entry("some/key", 3), entry("some/key", 2)})
+
+	require.Len(t, coalesced, 2)
+	assert.Equal(t, 3, coalesced[0].Record.ObjectVersion)
+	assert.Equal(t, "other/key", coalesced[1].Record.ObjectID)
+	require.NoError(t, coalesced[0].RecordProcessedHook(coalesced[0].Record, nil))
+	assert.ElementsMatch(t, []int{1, 2, 3}, called)
+}
+
+func TestShouldFailTheEntryWhenVersionLookupsTimeOut(t *testing.T) {
+	akubraConfig := generateAkubraConfig(1, 3)
+	resolver := &backendResolverMock{}
+	shardsRing, _, _ := auth.Ring(akubraConfig, "test")
+	resolver.On("GetShardsRing", "localhost").Return(shardsRing, nil)
+	prepareMocksForStorages(resolver, akubraConfig.Storages, "123", "321", "some/key1")
+
+	fetcher := &slowVersionFetcher{delay: time.Second}
+	filter := NewConfiguredWALFilter(resolver, fetcher, &resourceFetcherMock{},
+		Config{LookupTimeout: 50 * time.Millisecond})
+
+	errs := make(chan error, 1)
+	walEntriesChannel := make(chan *model.WALEntry, 1)
+	walEntriesChannel <- &model.WALEntry{Record: &watchdog.ConsistencyRecord{
+		Method:        watchdog.PUT,
+		Domain:        "localhost",
+		ObjectID:      "some/key1",
+		AccessKey:     "123",
+		ObjectVersion: 1},
+		RecordProcessedHook: func(_ *watchdog.ConsistencyRecord, err error) error { errs <- err; return nil }}
+
+	start := time.Now()
+	filter.Filter(walEntriesChannel)
+	err := <-errs
+
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "couldn't determine object 'some/key1' version"), err.Error())
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "the storages should be asked at once and not awaited")
+	for deadline := time.Now().Add(500 * time.Millisecond); atomic.LoadInt32(&fetcher.cancelled) < 3 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetcher.cancelled), "the abandoned lookups should be cancelled")
+}
+
+func TestShouldNotFetchVersionsAgainForRepeatedEntriesOfAnObjectInSync(t *testing.T) {
+	akubraConfig := generateAkubraConfig(1, 3)
+	resolver := &backendResolverMock{}
+	versionFetcher := &versionFetcherMock{}
+	shardsRing, _, _ := auth.Ring(akubraConfig, "test")
+	resolver.On("GetShardsRing", "localhost").Return(shardsRing, nil)
+	prepareMocksForStorages(resolver, akubraConfig.Storages, "123", "321", "some/key1")
+	prepareVersionMocks("some", "key1", "123", "321", versionFetcher, map[string]*StorageState{
+		"http://localhost:1000": {storageEndpoint: "http://localhost:1000", version: 2},
+		"http://localhost:1100": {storageEndpoint: "http://localhost:1100", version: 2},
+		"http://localhost:1200": {storageEndpoint: "http://localhost:1200", version: 2},
+	})
+
+	filter := NewDefaultWALFilter(resolver, versionFetcher, &resourceFetcherMock{})
+	entryWG := sync.WaitGroup{}
+	walEntriesChannel := make(chan *model.WALEntry)
+	tasksChannel := filter.Filter(walEntriesChannel)
+
+	for version := 1; version <= 2; version++ {
+		entryWG.Add(1)
+		walEntriesChannel <- &model.WALEntry{Record: &watchdog.ConsistencyRecord{
+			Method:        watchdog.PUT,
+			Domain:        "localhost",
+			ObjectID:      "some/key1",
+			AccessKey:     "123",
+			ObjectVersion: version},
+			RecordProcessedHook: func(_ *watchdog.ConsistencyRecord, err error) error { entryWG.Done(); assert.Nil(t, err); return nil }}
+		task := <-tasksChannel
+		assert.Equal(t, model.ReasonInSync, task.Reason)
+		_ = task.WALEntry.RecordProcessedHook(task.WALEntry.Record, nil)
+		<-tasksChannel
+	}
+	close(walEntriesChannel)
+
+	entryWG.Wait()
+	versionFetcher.AssertNumberOfCalls(t, "Fetch", 3)
+}
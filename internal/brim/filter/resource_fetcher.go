@@ -0,0 +1,28 @@
+package filter
+
+import (
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/s3"
+)
+
+// ResourceFetcher fetches the state of buckets and sub-resources
+type ResourceFetcher interface {
+	//BucketExists should check if the bucket is present on the storage
+	BucketExists(auth *s3.MigrationAuth, bucketName string) (bool, error)
+	//FetchSubResource should fetch the sub-resource document of a bucket or an object (key is not empty),
+	//nil if it's not set
+	FetchSubResource(auth *s3.MigrationAuth, bucketName, key string, subResource watchdog.SubResource) ([]byte, error)
+}
+
+// S3ResourceFetcher is an implementation of ResourceFetcher that uses an S3 client
+type S3ResourceFetcher struct{}
+
+// BucketExists checks if the bucket is present on the storage
+func (*S3ResourceFetcher) BucketExists(auth *s3.MigrationAuth, bucketName string) (bool, error) {
+	return s3.BucketExists(s3.GetS3Client(auth), bucketName)
+}
+
+// FetchSubResource fetches the sub-resource document using s3 client
+func (*S3ResourceFetcher) FetchSubResource(auth *s3.MigrationAuth, bucketName, key string, subResource watchdog.SubResource) ([]byte, error) {
+	return s3.GetSubResource(s3.GetS3Client(auth), bucketName, key, string(subResource))
+}
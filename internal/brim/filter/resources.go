@@ -0,0 +1,205 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/sharding"
+	"github.com/allegro/akubra/internal/akubra/storages"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/util"
+)
+
+type subResourceState struct {
+	storageEndpoint string
+	document        []byte
+}
+
+// resourceTask creates a task syncing a bucket or a sub-resource. Buckets and their sub-resources
+// are synced on the storages of all shards, object's sub-resources only on the object's shard
+func (filter *DefaultWALFilter) resourceTask(walEntry *model.WALEntry, ring sharding.ShardsRingAPI) (*model.WALTask, error) {
+	record := walEntry.Record
+	storagesKeys, err := filter.resourceStoragesKeys(record, ring)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for endpoint := range storagesKeys {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	var src string
+	var destinations []string
+	if record.SubResource == "" {
+		src, destinations, err = filter.resolveBucketStorages(record, endpoints, storagesKeys)
+	} else {
+		src, destinations, err = filter.resolveSubResourceStorages(record, endpoints, storagesKeys)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	task := &model.WALTask{WALEntry: walEntry, Reason: model.ReasonInSync}
+	if src != "" {
+		task.SourceClient = filter.createS3Clients([]string{src}, storagesKeys)[0]
+	}
+	if len(destinations) > 0 {
+		task.DestinationsClients = filter.createS3Clients(destinations, storagesKeys)
+		task.Reason = model.ReasonResourceChange
+	}
+	return task, nil
+}
+
+func (filter *DefaultWALFilter) resourceStoragesKeys(record *watchdog.ConsistencyRecord, ring sharding.ShardsRingAPI) (map[storageEndpoint]keys, error) {
+	var shards []storages.NamedShardClient
+	if record.Operation == watchdog.BucketOperation {
+		for _, shardClient := range ring.GetShards() {
+			shards = append(shards, shardClient)
+		}
+	} else {
+		pickedShard, err := ring.Pick(record.ObjectID)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, pickedShard)
+	}
+	storagesKeys := make(map[storageEndpoint]keys)
+	for _, shardClient := range shards {
+		shardKeys, err := filter.resolveStoragesKeys(record, shardClient)
+		if err != nil {
+			return nil, err
+		}
+		for endpoint, endpointKeys := range shardKeys {
+			storagesKeys[endpoint] = endpointKeys
+		}
+	}
+	return storagesKeys, nil
+}
+
+func (filter *DefaultWALFilter) resolveBucketStorages(record *watchdog.ConsistencyRecord, endpoints []string, storagesKeys map[storageEndpoint]keys) (string, []string, error) {
+	var storagesWithBucket, storagesWithoutBucket []string
+	for _, endpoint := range endpoints {
+		exists, err := filter.resourceFetcher.BucketExists(migrationAuth(endpoint, storagesKeys), record.ObjectID)
+		if err != nil {
+			return "", nil, model.NewBackendError(endpoint, fmt.Errorf("couldn't determine if bucket '%s' exists: %w", record.ObjectID, err))
+		}
+		if exists {
+			storagesWithBucket = append(storagesWithBucket, endpoint)
+		} else {
+			storagesWithoutBucket = append(storagesWithoutBucket, endpoint)
+		}
+	}
+	if record.Method == watchdog.DELETE {
+		return "", storagesWithBucket, nil
+	}
+	if len(storagesWithBucket) == 0 {
+		log.Printf("bucket '%s' in domain '%s' is not present on any storage", record.ObjectID, record.Domain)
+		return "", nil, nil
+	}
+	if len(storagesWithoutBucket) == 0 {
+		return "", nil, nil
+	}
+	return storagesWithBucket[0], storagesWithoutBucket, nil
+}
+
+// resolveSubResourceStorages compares the sub-resource documents. Sub-resources aren't versioned, so
+// the document present on most of the storages is assumed to be the desired one
+func (filter *DefaultWALFilter) resolveSubResourceStorages(record *watchdog.ConsistencyRecord, endpoints []string, storagesKeys map[storageEndpoint]keys) (string, []string, error) {
+	if record.Method == watchdog.DELETE && record.SubResource == watchdog.ACLSubResource {
+		return "", nil, nil
+	}
+	states, err := filter.fetchSubResources(record, endpoints, storagesKeys)
+	if err != nil {
+		return "", nil, err
+	}
+	var destinations []string
+	if record.Method == watchdog.DELETE {
+		for _, state := range states {
+			if state.document != nil {
+				destinations = append(destinations, state.storageEndpoint)
+			}
+		}
+		return "", destinations, nil
+	}
+	src := majorityDocument(states)
+	if src == nil {
+		log.Printf("%s of '%s' in domain '%s' is not set on any storage", record.SubResource, record.ObjectID, record.Domain)
+		return "", nil, nil
+	}
+	for _, state := range states {
+		if !bytes.Equal(state.document, src.document) {
+			destinations = append(destinations, state.storageEndpoint)
+		}
+	}
+	if len(destinations) == 0 {
+		return "", nil, nil
+	}
+	return src.storageEndpoint, destinations, nil
+}
+
+// fetchSubResources skips the storages without the bucket and, for object's ACLs, without the object.
+// Missing buckets and objects are synced by their own records
+func (filter *DefaultWALFilter) fetchSubResources(record *watchdog.ConsistencyRecord, endpoints []string, storagesKeys map[storageEndpoint]keys) ([]*subResourceState, error) {
+	bucketName, key := record.ObjectID, ""
+	if record.Operation != watchdog.BucketOperation {
+		var err error
+		if bucketName, key, err = util.SplitKeyIntoBucketKey(record.ObjectID); err != nil {
+			return nil, err
+		}
+	}
+	var states []*subResourceState
+	for _, endpoint := range endpoints {
+		clientAuth := migrationAuth(endpoint, storagesKeys)
+		if key == "" {
+			exists, err := filter.resourceFetcher.BucketExists(clientAuth, bucketName)
+			if err != nil {
+				return nil, model.NewBackendError(endpoint, fmt.Errorf("couldn't determine if bucket '%s' exists: %w", bucketName, err))
+			}
+			if !exists {
+				continue
+			}
+		}
+		document, err := filter.resourceFetcher.FetchSubResource(clientAuth, bucketName, key, record.SubResource)
+		if err != nil {
+			return nil, model.NewBackendError(endpoint, fmt.Errorf("couldn't fetch %s of '%s': %w", record.SubResource, record.ObjectID, err))
+		}
+		if key != "" && document == nil {
+			continue
+		}
+		states = append(states, &subResourceState{storageEndpoint: endpoint, document: document})
+	}
+	return states, nil
+}
+
+func majorityDocument(states []*subResourceState) *subResourceState {
+	var majority *subResourceState
+	majorityCount := 0
+	for _, candidate := range states {
+		if candidate.document == nil {
+			continue
+		}
+		count := 0
+		for _, state := range states {
+			if bytes.Equal(state.document, candidate.document) {
+				count++
+			}
+		}
+		if count > majorityCount {
+			majority, majorityCount = candidate, count
+		}
+	}
+	return majority
+}
+
+func migrationAuth(endpoint string, storagesKeys map[storageEndpoint]keys) *brimS3.MigrationAuth {
+	return &brimS3.MigrationAuth{
+		AccessKey: storagesKeys[endpoint].access,
+		SecretKey: storagesKeys[endpoint].secret,
+		Endpoint:  endpoint,
+	}
+}
@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/auth"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type resourceFetcherMock struct {
+	mock.Mock
+}
+
+func (fetcherMock *resourceFetcherMock) BucketExists(auth *brimS3.MigrationAuth, bucketName string) (bool, error) {
+	args := fetcherMock.Called(auth.Endpoint, bucketName)
+	return args.Bool(0), args.Error(1)
+}
+
+func (fetcherMock *resourceFetcherMock) FetchSubResource(auth *brimS3.MigrationAuth, bucketName, key string, subResource watchdog.SubResource) ([]byte, error) {
+	args := fetcherMock.Called(auth.Endpoint, bucketName, key, subResource)
+	var document []byte
+	if v := args.Get(0); v != nil {
+		document = v.([]byte)
+	}
+	return document, args.Error(1)
+}
+
+func filterResourceRecord(t *testing.T, numberOfShards, numberOfStoragesPerShard int, fetcher *resourceFetcherMock, record *watchdog.ConsistencyRecord) *model.WALTask {
+	akubraConfig := generateAkubraConfig(numberOfShards, numberOfStoragesPerShard)
+	resolver := &backendResolverMock{}
+	shardsRing, _, err := auth.Ring(akubraConfig, "test")
+	require.NoError(t, err)
+	resolver.On("GetShardsRing", "localhost").Return(shardsRing, nil)
+	prepareMocksForStorages(resolver, akubraConfig.Storages, "123", "321", record.ObjectID)
+
+	record.Domain = "localhost"
+	record.AccessKey = "123"
+	walEntriesChannel := make(chan *model.WALEntry, 1)
+	walEntriesChannel <- &model.WALEntry{Record: record, RecordProcessedHook: func(_ *watchdog.ConsistencyRecord, err error) error {
+		assert.NoError(t, err)
+		return nil
+	}}
+	close(walEntriesChannel)
+
+	tasks := NewDefaultWALFilter(resolver, &versionFetcherMock{}, fetcher).Filter(walEntriesChannel)
+	task := <-tasks
+	require.NotNil(t, task)
+	return task
+}
+
+func endpointsOf(task *model.WALTask) []string {
+	var endpoints []string
+	for _, client := range task.DestinationsClients {
+		endpoints = append(endpoints, client.S3Endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+func TestShouldCreateBucketOnStoragesOfAllShardsWithoutIt(t *testing.T) {
+	fetcher := &resourceFetcherMock{}
+	fetcher.On("BucketExists", "http://localhost:1000", "bucket").Return(false, nil)
+	fetcher.On("BucketExists", "http://localhost:1100", "bucket").Return(true, nil)
+	fetcher.On("BucketExists", "http://localhost:2000", "bucket").Return(true, nil)
+	fetcher.On("BucketExists", "http://localhost:2100", "bucket").Return(false, nil)
+
+	task := filterResourceRecord(t, 2, 2, fetcher, &watchdog.ConsistencyRecord{
+		ObjectID: "bucket", Method: watchdog.PUT, Operation: watchdog.BucketOperation})
+
+	assert.Equal(t, "http://localhost:1100", task.SourceClient.S3Endpoint)
+	assert.Equal(t, []string{"http://localhost:1000", "http://localhost:2100"}, endpointsOf(task))
+}
+
+func TestShouldDeleteBucketFromStoragesWithIt(t *testing.T) {
+	fetcher := &resourceFetcherMock{}
+	fetcher.On("BucketExists", "http://localhost:1000", "bucket").Return(true, nil)
+	fetcher.On("BucketExists", "http://localhost:1100", "bucket").Return(false, nil)
+
+	task := filterResourceRecord(t, 1, 2, fetcher, &watchdog.ConsistencyRecord{
+		ObjectID: "bucket", Method: watchdog.DELETE, Operation: watchdog.BucketOperation})
+
+	assert.Nil(t, task.SourceClient)
+	assert.Equal(t, []string{"http://localhost:1000"}, endpointsOf(task))
+}
+
+func TestShouldCopyBucketSubResourceDocumentPresentOnMostOfTheStorages(t *testing.T) {
+	fetcher := &resourceFetcherMock{}
+	for _, endpoint := range []string{"http://localhost:1000", "http://localhost:1100", "http://localhost:1200"} {
+		fetcher.On("BucketExists", endpoint, "bucket").Return(true, nil)
+	}
+	fetcher.On("BucketExists", "http://localhost:1300", "bucket").Return(false, nil)
+	fetcher.On("FetchSubResource", "http://localhost:1000", "bucket", "", watchdog.CORSSubResource).Return([]byte("old"), nil)
+	fetcher.On("FetchSubResource", "http://localhost:1100", "bucket", "", watchdog.CORSSubResource).Return([]byte("new"), nil)
+	fetcher.On("FetchSubResource", "http://localhost:1200", "bucket", "", watchdog.CORSSubResource).Return([]byte("new"), nil)
+
+	task := filterResourceRecord(t, 1, 4, fetcher, &watchdog.ConsistencyRecord{
+		ObjectID: "bucket", Method: watchdog.PUT, Operation: watchdog.BucketOperation, SubResource: watchdog.CORSSubResource})
+
+	assert.Equal(t, "http://localhost:1100", task.SourceClient.S3Endpoint)
+	assert.Equal(t, []string{"http://localhost:1000"}, endpointsOf(task))
+	fetcher.AssertNotCalled(t, "FetchSubResource", "http://localhost:1300", "bucket", "", watchdog.CORSSubResource)
+}
+
+func TestShouldDeleteBucketSubResourceFromStoragesWhereItIsSet(t *testing.T) {
+	fetcher := &resourceFetcherMock{}
+	fetcher.On("BucketExists", "http://localhost:1000", "bucket").Return(true, nil)
+	fetcher.On("BucketExists", "http://localhost:1100", "bucket").Return(true, nil)
+	fetcher.On("FetchSubResource", "http://localhost:1000", "bucket", "", watchdog.PolicySubResource).Return(nil, nil)
+	fetcher.On("FetchSubResource", "http://localhost:1100", "bucket", "", watchdog.PolicySubResource).Return([]byte("policy"), nil)
+
+	task := filterResourceRecord(t, 1, 2, fetcher, &watchdog.ConsistencyRecord{
+		ObjectID: "bucket", Method: watchdog.DELETE, Operation: watchdog.BucketOperation, SubResource: watchdog.PolicySubResource})
+
+	assert.Nil(t, task.SourceClient)
+	assert.Equal(t, []string{"http://localhost:1100"}, endpointsOf(task))
+}
+
+func TestShouldCopyObjectACLOnlyToStoragesWithTheObject(t *testing.T) {
+	fetcher := &resourceFetcherMock{}
+	fetcher.On("FetchSubResource", "http://localhost:1000", "bucket", "key", watchdog.ACLSubResource).Return([]byte("public-read"), nil)
+	fetcher.On("FetchSubResource", "http://localhost:1100", "bucket", "key", watchdog.ACLSubResource).Return([]byte("private"), nil)
+	fetcher.On("FetchSubResource", "http://localhost:1200", "bucket", "key", watchdog.ACLSubResource).Return(nil, nil)
+
+	task := filterResourceRecord(t, 1, 3, fetcher, &watchdog.ConsistencyRecord{
+		ObjectID: "bucket/key", Method: watchdog.PUT, Operation: watchdog.ObjectOperation, SubResource: watchdog.ACLSubResource})
+
+	assert.Equal(t, "http://localhost:1000", task.SourceClient.S3Endpoint)
+	assert.Equal(t, []string{"http://localhost:1100"}, endpointsOf(task))
+	fetcher.AssertNotCalled(t, "BucketExists", mock.Anything, mock.Anything)
+}
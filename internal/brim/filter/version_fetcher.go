@@ -1,16 +1,17 @@
 package filter
 
 import (
-	"fmt"
+	"context"
 	"strconv"
 
 	"github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/store"
 )
 
 //VersionFetcher fetches object's version
 type VersionFetcher interface {
-	//Fetch should fetch object's version
-	Fetch(auth *s3.MigrationAuth, bucketName string, key string) (*StorageState, error)
+	//Fetch should fetch object's version, giving up when the context is done
+	Fetch(ctx context.Context, auth *s3.MigrationAuth, bucketName string, key string) (*StorageState, error)
 }
 
 //S3VersionFetcher is an implementation of VersionFetcher that uses an S3 client
@@ -23,28 +24,28 @@ type StorageState struct {
 	storageEndpoint string
 	version         int
 	objectNotFound  bool
+	contentLength   int64
+	etag            string
 }
 
 //Fetch fetches the object's version using s3 client
-func (s3VersionFetcher *S3VersionFetcher) Fetch(auth *s3.MigrationAuth, bucketName string, key string) (*StorageState, error) {
-	s3Client := s3.GetS3Client(auth)
-	bucket := s3Client.Bucket(bucketName)
-	headResponse, err := bucket.Head(key, nil)
+func (s3VersionFetcher *S3VersionFetcher) Fetch(ctx context.Context, auth *s3.MigrationAuth, bucketName string, key string) (*StorageState, error) {
+	storage, err := store.ForClient(s3.GetS3Client(auth))
 	if err != nil {
-		if err.Error() == "404 Not Found" {
-			return &StorageState{
-				objectNotFound:  true,
-				version:         -1,
-				storageEndpoint: s3Client.S3Endpoint,
-			}, nil
-		}
 		return nil, err
 	}
-	if headResponse.StatusCode != 200 {
-		return nil, fmt.Errorf("bad response, status code = %d, message = %s",
-			headResponse.StatusCode, headResponse.Status)
+	info, err := store.HeadWithContext(ctx, storage, bucketName, key)
+	if store.IsNotFound(err) {
+		return &StorageState{
+			objectNotFound:  true,
+			version:         -1,
+			storageEndpoint: auth.Endpoint,
+		}, nil
 	}
-	objectVersionHeader := headResponse.Header.Get(s3VersionFetcher.VersionHeaderName)
+	if err != nil {
+		return nil, err
+	}
+	objectVersionHeader := info.Header.Get(s3VersionFetcher.VersionHeaderName)
 	objectVersion, err := strconv.ParseInt(objectVersionHeader, 10, 64)
 	if err != nil {
 		return nil, err
@@ -52,6 +53,28 @@ func (s3VersionFetcher *S3VersionFetcher) Fetch(auth *s3.MigrationAuth, bucketNa
 	return &StorageState{
 		objectNotFound:  false,
 		version:         int(objectVersion),
-		storageEndpoint: s3Client.S3Endpoint,
+		storageEndpoint: auth.Endpoint,
+		contentLength:   info.Size,
+		etag:            info.ETag,
 	}, nil
 }
+
+//ObjectNotFound tells if the storage lacks the object
+func (state *StorageState) ObjectNotFound() bool {
+	return state.objectNotFound
+}
+
+//Version returns the akubra version of the object, -1 if the object is missing
+func (state *StorageState) Version() int {
+	return state.version
+}
+
+//ContentLength returns the size of the object
+func (state *StorageState) ContentLength() int64 {
+	return state.contentLength
+}
+
+//ETag returns the ETag of the object
+func (state *StorageState) ETag() string {
+	return state.etag
+}
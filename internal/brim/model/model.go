@@ -1,21 +1,74 @@
 package model
 
 import (
+	"fmt"
+
 	"github.com/AdRoll/goamz/s3"
 	"github.com/allegro/akubra/internal/akubra/watchdog"
 )
 
 type Hook = func(record *watchdog.ConsistencyRecord, err error) error
 
-//WALEntry is an entry of the log that describes the object's lifecycle
+// WALEntry is an entry of the log that describes the object's lifecycle
 type WALEntry struct {
 	Record              *watchdog.ConsistencyRecord
 	RecordProcessedHook Hook
 }
 
-//WALTask represents a migration that has to be performed in order for the object to be in sync
+// Reasons of the tasks given by the filter
+const (
+	// ReasonInSync marks tasks of records already reflected by the storages, they have no destinations
+	ReasonInSync = "in-sync"
+	// ReasonOutdatedCopies marks copying an object to the storages lacking its version
+	ReasonOutdatedCopies = "outdated-copies"
+	// ReasonDeletedObject marks deleting an object from the storages still keeping it
+	ReasonDeletedObject = "deleted-object"
+	// ReasonOldShardCopies marks deleting the copies left on the storages of shards the object no longer belongs to,
+	// the task has no destinations if there are no such copies
+	ReasonOldShardCopies = "old-shard-copies"
+	// ReasonResourceChange marks syncing a bucket or a sub-resource differing on the storages
+	ReasonResourceChange = "resource-change"
+)
+
+// WALTask represents a migration that has to be performed in order for the object to be in sync
 type WALTask struct {
 	SourceClient        *s3.S3
 	DestinationsClients []*s3.S3
 	WALEntry            *WALEntry
+	// Reason tells why the filter created the task
+	Reason string
+	// ObjectSize is the size of the copied object as listed by the source storage
+	ObjectSize int64
+}
+
+// BackendError is a failure of a storage involved in a task
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+func (backendErr *BackendError) Error() string {
+	return fmt.Sprintf("%s: %s", backendErr.Backend, backendErr.Err)
+}
+
+//Unwrap returns the storage's error
+func (backendErr *BackendError) Unwrap() error {
+	return backendErr.Err
+}
+
+// VerificationError tells that the destination copy of a migrated object differs from the source
+type VerificationError struct {
+	Reason string
+}
+
+func (verificationErr *VerificationError) Error() string {
+	return "verification failed: " + verificationErr.Reason
+}
+
+// NewBackendError wraps the error with the storage endpoint, nil stays nil
+func NewBackendError(backend string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &BackendError{Backend: backend, Err: err}
 }
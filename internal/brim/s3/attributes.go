@@ -0,0 +1,201 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/brim/store"
+)
+
+const (
+	taggingSubResource = "tagging"
+	// taggingHeader is the name under which the object tags are subject to the MetadataFilter
+	taggingHeader = "x-amz-tagging"
+)
+
+// preservedHeaders are reproduced on the destination next to the user metadata
+var preservedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Expires",
+	"X-Amz-Website-Redirect-Location",
+	"X-Amz-Storage-Class",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+}
+
+// MetadataFilter selects the object attributes reproduced on destination storages,
+// patterns (as in path.Match) are matched against lower case header names
+type MetadataFilter struct {
+	// Allow limits the attributes to the matching ones, all of them are copied if empty
+	Allow []string
+	// Deny excludes the matching attributes
+	Deny []string
+}
+
+// Preserves checks if the attribute sent in the header should be copied
+func (filter MetadataFilter) Preserves(header string) bool {
+	header = strings.ToLower(header)
+	if matchesAny(filter.Deny, header) {
+		return false
+	}
+	return len(filter.Allow) == 0 || matchesAny(filter.Allow, header)
+}
+
+func matchesAny(patterns []string, header string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), header); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// objectAttributes picks the headers of the source object to be sent on upload
+func objectAttributes(headers http.Header, filter MetadataFilter) http.Header {
+	attributes := http.Header{}
+	for name, values := range headers {
+		if strings.HasPrefix(strings.ToLower(name), AmzMetadataPrefix) && filter.Preserves(name) {
+			attributes[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	for _, name := range preservedHeaders {
+		if values, ok := headers[name]; ok && filter.Preserves(name) {
+			attributes[name] = append([]string(nil), values...)
+		}
+	}
+	return attributes
+}
+
+type objectTagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []struct {
+		Key   string
+		Value string
+	} `xml:"TagSet>Tag"`
+}
+
+// getGrants fetches the access control policy of the bucket (key is empty) or the object
+func getGrants(storage store.Storage, bucketName, key string) (*s3.AccessControlList, error) {
+	document, err := storage.GetSubResource(bucketName, key, aclSubResource)
+	if err != nil {
+		return nil, err
+	}
+	acl := &s3.AccessControlList{}
+	if err = xml.Unmarshal(document, acl); err != nil {
+		return nil, fmt.Errorf("malformed acl of %s/%s on %s: %s", bucketName, key, storage.Endpoint(), err)
+	}
+	return acl, nil
+}
+
+// putObjectGrants sets the grants of the source object on the destination one, the canonical
+// user IDs of the source storage are unknown to the destination, so the source owner is replaced
+// by the owner of the destination object and grants of other users are skipped
+func putObjectGrants(bucket storageBucket, key string, sourceACL *s3.AccessControlList) error {
+	destinationACL, err := getGrants(bucket, bucket.Name, key)
+	if err != nil {
+		return err
+	}
+	document, err := xml.Marshal(destinationPolicy(sourceACL, destinationACL.Owner, bucket, key))
+	if err != nil {
+		return err
+	}
+	return bucket.PutSubResource(bucket.Name, key, aclSubResource, document)
+}
+
+type accessControlPolicy struct {
+	XMLName xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ AccessControlPolicy"`
+	Owner   s3.AclOwner   `xml:"Owner"`
+	Grants  []policyGrant `xml:"AccessControlList>Grant"`
+}
+
+type policyGrant struct {
+	Grantee    policyGrantee `xml:"Grantee"`
+	Permission string        `xml:"Permission"`
+}
+
+type policyGrantee struct {
+	XMLNS       string `xml:"xmlns:xsi,attr"`
+	Type        string `xml:"xsi:type,attr"`
+	ID          string `xml:"ID,omitempty"`
+	DisplayName string `xml:"DisplayName,omitempty"`
+	URI         string `xml:"URI,omitempty"`
+}
+
+// destinationPolicy rewrites the source access control list for the destination owner
+func destinationPolicy(sourceACL *s3.AccessControlList, owner s3.AclOwner, bucket storageBucket, key string) accessControlPolicy {
+	policy := accessControlPolicy{Owner: owner}
+	for _, grant := range sourceACL.Grants.Grant {
+		for _, grantee := range grant.Grantee {
+			converted := policyGrantee{XMLNS: "http://www.w3.org/2001/XMLSchema-instance", Type: grantee.Type}
+			switch grantee.Type {
+			case "CanonicalUser":
+				if grantee.ID != sourceACL.Owner.ID {
+					log.Printf("Skipping %s grant of user %s to %s/%s on %s, the user is unknown to the destination",
+						grant.Permission, grantee.ID, bucket.Name, key, bucket.Endpoint())
+					continue
+				}
+				converted.ID, converted.DisplayName = owner.ID, owner.DisplayName
+			case "Group":
+				converted.URI = grantee.URI
+			default:
+				log.Printf("Skipping %s grant of unsupported grantee type %s to %s/%s on %s",
+					grant.Permission, grantee.Type, bucket.Name, key, bucket.Endpoint())
+				continue
+			}
+			policy.Grants = append(policy.Grants, policyGrant{Grantee: converted, Permission: grant.Permission})
+		}
+	}
+	return policy
+}
+
+// getObjectTagging fetches the tagging document of the object, nil is returned if the object has no tags
+// or the storage doesn't support tagging
+func getObjectTagging(bucket storageBucket, key string) ([]byte, error) {
+	document, err := bucket.GetSubResource(bucket.Name, key, taggingSubResource)
+	if err != nil {
+		if store.IsNotFound(err) {
+			return nil, nil
+		}
+		if GetHTTPStatusCodeFromError(err) == http.StatusNotImplemented {
+			log.Debugf("Tagging not supported by %s", bucket.Endpoint())
+			return nil, nil
+		}
+		return nil, err
+	}
+	tagging := objectTagging{}
+	if err = xml.Unmarshal(document, &tagging); err != nil {
+		return nil, fmt.Errorf("malformed tagging of %s/%s on %s: %s", bucket.Name, key, bucket.Endpoint(), err)
+	}
+	if len(tagging.Tags) == 0 {
+		return nil, nil
+	}
+	return document, nil
+}
+
+// putObjectWithAttributes uploads the object in a single request carrying all its attributes
+func putObjectWithAttributes(bucket storageBucket, key string, object s3Object, acl s3.ACL) error {
+	return bucket.Put(bucket.Name, key, object.data, object.contentLength, uploadHeaders(object, acl))
+}
+
+// initMultiWithAttributes initiates a multipart upload of the object carrying all its attributes
+func initMultiWithAttributes(bucket storageBucket, key string, object s3Object, acl s3.ACL) (string, error) {
+	return bucket.InitiateMultipart(bucket.Name, key, uploadHeaders(object, acl))
+}
+
+func uploadHeaders(object s3Object, acl s3.ACL) http.Header {
+	headers := http.Header{}
+	for name, values := range object.attributes {
+		headers[name] = values
+	}
+	headers.Set("Content-Type", object.contentType)
+	headers.Set("x-amz-acl", string(acl))
+	return headers
+}
@@ -0,0 +1,192 @@
+package s3
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testGrants = `<?xml version="1.0" encoding="UTF-8"?>
+<AccessControlPolicy xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Owner><ID>owner</ID><DisplayName>owner</DisplayName></Owner>` +
+		`<AccessControlList><Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>owner</ID></Grantee>` +
+		`<Permission>FULL_CONTROL</Permission></Grant><Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser">` +
+		`<ID>reader</ID></Grantee><Permission>READ</Permission></Grant></AccessControlList></AccessControlPolicy>`
+	destinationGrants = `<AccessControlPolicy xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Owner><ID>destination-owner</ID><DisplayName>destination</DisplayName></Owner>` +
+		`<AccessControlList><Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>destination-owner</ID>` +
+		`<DisplayName>destination</DisplayName></Grantee><Permission>FULL_CONTROL</Permission></Grant></AccessControlList></AccessControlPolicy>`
+	testTagging = `<Tagging><TagSet><Tag><Key>project</Key><Value>akubra</Value></Tag></TagSet></Tagging>`
+)
+
+var sourceAttributes = http.Header{
+	"Cache-Control":                   {"public, max-age=600"},
+	"Content-Disposition":             {`attachment; filename="report.txt"`},
+	"Content-Encoding":                {"gzip"},
+	"Content-Language":                {"pl-PL"},
+	"Expires":                         {"Thu, 01 Dec 2094 16:00:00 GMT"},
+	"X-Amz-Website-Redirect-Location": {"/other/key"},
+	"X-Amz-Storage-Class":             {"STANDARD_IA"},
+	"X-Amz-Server-Side-Encryption":    {"AES256"},
+	"X-Amz-Meta-Version":              {"7"},
+	"X-Amz-Meta-Author":               {"Zażółć gęślą jaźń"},
+}
+
+type attributedStorage struct {
+	content     string
+	headers     http.Header
+	grants      string
+	tagging     string
+	received    http.Header
+	receivedACL string
+	receivedTag string
+	mx          sync.Mutex
+}
+
+func (storage *attributedStorage) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	storage.mx.Lock()
+	defer storage.mx.Unlock()
+	query := req.URL.Query()
+	_, acl := query["acl"]
+	_, tagging := query["tagging"]
+	body, _ := ioutil.ReadAll(req.Body)
+	switch {
+	case req.Method == http.MethodGet && acl:
+		_, _ = rw.Write([]byte(storage.grants))
+	case req.Method == http.MethodGet && tagging:
+		if storage.tagging == "" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = rw.Write([]byte(storage.tagging))
+	case req.Method == http.MethodPut && acl:
+		storage.receivedACL = string(body)
+	case req.Method == http.MethodPut && tagging:
+		storage.receivedTag = string(body)
+	case req.Method == http.MethodPut, req.Method == http.MethodPost:
+		storage.received = req.Header
+		if req.Method == http.MethodPost {
+			_, _ = rw.Write([]byte("<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>"))
+		}
+	default:
+		for name, values := range storage.headers {
+			rw.Header()[name] = values
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(storage.content)))
+		if req.Method == http.MethodGet {
+			_, _ = rw.Write([]byte(storage.content))
+		}
+	}
+}
+
+func migrateBetween(t *testing.T, src, dst *attributedStorage, multipart bool, filter MetadataFilter) {
+	srcServer := httptest.NewServer(src)
+	defer srcServer.Close()
+	dstServer := httptest.NewServer(dst)
+	defer dstServer.Close()
+	auth := aws.Auth{AccessKey: "123", SecretKey: "321"}
+	migrator := TaskMigrator{
+		SrcS3Client:    s3.New(auth, aws.Region{Name: "generic", S3Endpoint: srcServer.URL}),
+		DstS3Client:    s3.New(auth, aws.Region{Name: "generic", S3Endpoint: dstServer.URL}),
+		Task:           NewMigrationTaskData("copy", model.ACLCopyFromSource, srcServer.URL, dstServer.URL, "bucket", "key", "bucket", "key"),
+		Multipart:      multipart,
+		MetadataFilter: filter,
+	}
+	srcError, dstError := migrator.prepareBucketInstances()
+	require.NoError(t, srcError)
+	require.NoError(t, dstError)
+	object, err := migrator.getObjectFromSource()
+	require.NoError(t, err)
+	defer func() { _ = object.cleanUp() }()
+	if multipart {
+		// parts are covered by the multipart tests, only the initiation carries the attributes
+		uploadID, err := initMultiWithAttributes(migrator.dstBucket, "key", object, migrator.determineACL(object))
+		require.NoError(t, err)
+		assert.Equal(t, "upload", uploadID)
+		require.NoError(t, migrator.putSubResources(object))
+		return
+	}
+	srcError, dstError = migrator.putObject(object)
+	require.NoError(t, srcError)
+	require.NoError(t, dstError)
+}
+
+func TestShouldReproduceSourceAttributesOnDestination(t *testing.T) {
+	for _, multipart := range []bool{false, true} {
+		src := &attributedStorage{content: "content", headers: sourceAttributes, grants: testGrants, tagging: testTagging}
+		dst := &attributedStorage{grants: destinationGrants}
+
+		migrateBetween(t, src, dst, multipart, MetadataFilter{})
+
+		for name, values := range sourceAttributes {
+			assert.Equal(t, values, dst.received[name], name)
+		}
+		assert.Equal(t, "text/plain", dst.received.Get("Content-Type"))
+		assert.Equal(t, "private", dst.received.Get("X-Amz-Acl"))
+		assert.Equal(t, destinationGrants, dst.receivedACL)
+		assert.Equal(t, testTagging, dst.receivedTag)
+	}
+}
+
+func TestShouldCopyOnlyAttributesPassingTheFilter(t *testing.T) {
+	src := &attributedStorage{content: "content", headers: sourceAttributes, grants: testGrants, tagging: testTagging}
+	dst := &attributedStorage{grants: destinationGrants}
+
+	migrateBetween(t, src, dst, false, MetadataFilter{
+		Allow: []string{"x-amz-meta-*", "content-*"},
+		Deny:  []string{"x-amz-meta-author", "Content-Language"}})
+
+	assert.Equal(t, "7", dst.received.Get("X-Amz-Meta-Version"))
+	assert.Equal(t, "gzip", dst.received.Get("Content-Encoding"))
+	for _, name := range []string{"X-Amz-Meta-Author", "Content-Language", "Expires", "X-Amz-Storage-Class"} {
+		assert.NotContains(t, dst.received, name)
+	}
+	assert.Empty(t, dst.receivedTag)
+	assert.Equal(t, destinationGrants, dst.receivedACL)
+}
+
+func TestShouldSkipMissingTagging(t *testing.T) {
+	for _, tagging := range []string{"", "<Tagging><TagSet></TagSet></Tagging>"} {
+		src := &attributedStorage{content: "content", headers: http.Header{}, grants: testGrants, tagging: tagging}
+		dst := &attributedStorage{grants: destinationGrants}
+
+		migrateBetween(t, src, dst, false, MetadataFilter{})
+
+		assert.Empty(t, dst.receivedTag, tagging)
+	}
+}
+
+func TestShouldRewriteSourceOwnerInGrantsForDestination(t *testing.T) {
+	sourceACL, err := s3.ParseAclFromXml(`<AccessControlPolicy><Owner><ID>owner</ID></Owner><AccessControlList>` +
+		`<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>owner</ID></Grantee><Permission>WRITE_ACP</Permission></Grant>` +
+		`<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="Group"><URI>http://acs.amazonaws.com/groups/global/AllUsers</URI></Grantee>` +
+		`<Permission>READ</Permission></Grant></AccessControlList></AccessControlPolicy>`)
+	require.NoError(t, err)
+
+	policy := destinationPolicy(&sourceACL, s3.AclOwner{ID: "destination-owner"}, testBucket("http://storage"), "key")
+
+	assert.Equal(t, "destination-owner", policy.Owner.ID)
+	require.Len(t, policy.Grants, 2)
+	assert.Equal(t, "destination-owner", policy.Grants[0].Grantee.ID)
+	assert.Equal(t, "WRITE_ACP", policy.Grants[0].Permission)
+	assert.Equal(t, "Group", policy.Grants[1].Grantee.Type)
+	assert.Equal(t, "http://acs.amazonaws.com/groups/global/AllUsers", policy.Grants[1].Grantee.URI)
+}
+
+func TestShouldMatchMetadataFilterPatternsCaseInsensitively(t *testing.T) {
+	filter := MetadataFilter{Allow: []string{"X-Amz-Meta-*"}, Deny: []string{"x-amz-meta-secret-*"}}
+	assert.True(t, filter.Preserves("X-Amz-Meta-Version"))
+	assert.False(t, filter.Preserves("X-Amz-Meta-Secret-Token"))
+	assert.False(t, filter.Preserves("Content-Language"))
+	assert.True(t, MetadataFilter{}.Preserves(strings.ToUpper(taggingHeader)))
+}
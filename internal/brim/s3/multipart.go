@@ -0,0 +1,247 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/brim/store"
+)
+
+const (
+	mebibyte                = 1024 * 1024
+	minPartSize             = 5 * mebibyte
+	maxPartCount            = 10000
+	defaultPartSize         = 64 * mebibyte
+	defaultMaxInFlightParts = 4
+	defaultMemoryBudget     = 4 * defaultPartSize
+)
+
+// multipartETagPattern matches ETags of objects uploaded in parts, suffixed with the number of parts
+var multipartETagPattern = regexp.MustCompile(`^"?[0-9a-fA-F]{32}-(\d+)"?$`)
+
+// MultipartConfig bounds the resources used by a streamed multipart migration
+type MultipartConfig struct {
+	// PartSize is used when the part layout of the source object can't be detected
+	PartSize int64
+	// MaxInFlightParts is the number of parts downloaded and uploaded at once
+	MaxInFlightParts int
+	// MemoryBudget bounds the memory taken by parts of a single migration
+	MemoryBudget int64
+}
+
+type partRange struct {
+	number       int
+	offset, size int64
+}
+
+func (config MultipartConfig) withDefaults() MultipartConfig {
+	if config.PartSize <= 0 {
+		config.PartSize = defaultPartSize
+	}
+	if config.MaxInFlightParts <= 0 {
+		config.MaxInFlightParts = defaultMaxInFlightParts
+	}
+	if config.MemoryBudget <= 0 {
+		config.MemoryBudget = defaultMemoryBudget
+	}
+	return config
+}
+
+// partSizeFor picks the part size of an object, the source layout is kept when detected
+// and fits the memory budget
+func (config MultipartConfig) partSizeFor(etag string, contentLength int64) int64 {
+	partSize := sourcePartSize(etag, contentLength)
+	if partSize == 0 || partSize > config.MemoryBudget {
+		partSize = config.PartSize
+	}
+	if partSize > config.MemoryBudget {
+		partSize = config.MemoryBudget
+	}
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if smallest := ceilDiv(contentLength, maxPartCount); partSize < smallest {
+		partSize = smallest
+	}
+	return partSize
+}
+
+// inFlightParts is the number of parts fitting both the limit and the memory budget
+func (config MultipartConfig) inFlightParts(partSize int64) int {
+	inFlight := config.MaxInFlightParts
+	if fitting := int(config.MemoryBudget / partSize); fitting < inFlight {
+		inFlight = fitting
+	}
+	if inFlight < 1 {
+		inFlight = 1
+	}
+	return inFlight
+}
+
+// sourcePartSize guesses the part size from the number of parts in the ETag,
+// clients upload parts of whole mebibytes, so such a size is preferred
+func sourcePartSize(etag string, contentLength int64) int64 {
+	match := multipartETagPattern.FindStringSubmatch(etag)
+	if match == nil {
+		return 0
+	}
+	partCount, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || partCount < 1 {
+		return 0
+	}
+	partSize := ceilDiv(contentLength, partCount)
+	if aligned := ceilDiv(partSize, mebibyte) * mebibyte; ceilDiv(contentLength, aligned) == partCount {
+		return aligned
+	}
+	return partSize
+}
+
+// ETagsMatch compares ETags of single part objects and part counts of multipart ones,
+// ETags of a single part and a multipart object can't be compared
+func ETagsMatch(srcETag, dstETag string) bool {
+	srcETag, dstETag = strings.Trim(srcETag, `"`), strings.Trim(dstETag, `"`)
+	if srcETag == "" || dstETag == "" {
+		return true
+	}
+	srcParts, dstParts := partCount(srcETag), partCount(dstETag)
+	switch {
+	case srcParts == "" && dstParts == "":
+		return strings.EqualFold(srcETag, dstETag)
+	case srcParts != "" && dstParts != "":
+		return srcParts == dstParts
+	}
+	return true
+}
+
+func partCount(etag string) string {
+	if separator := strings.LastIndex(etag, "-"); separator >= 0 {
+		return etag[separator+1:]
+	}
+	return ""
+}
+
+func ceilDiv(dividend, divisor int64) int64 {
+	return (dividend + divisor - 1) / divisor
+}
+
+func splitIntoParts(contentLength, partSize int64) []partRange {
+	var parts []partRange
+	for offset := int64(0); offset < contentLength; offset += partSize {
+		size := partSize
+		if offset+size > contentLength {
+			size = contentLength - offset
+		}
+		parts = append(parts, partRange{number: len(parts) + 1, offset: offset, size: size})
+	}
+	return parts
+}
+
+// streamMultipart copies the object with ranged GETs piped into parts of a multipart upload,
+// the upload is aborted on failure. The ETag of every range is compared with the source ETag, so
+// an object overwritten during the copy fails the migration instead of mixing both versions
+func streamMultipart(srcBucket storageBucket, srcKey string, dstBucket storageBucket, dstKey string,
+	object s3Object, acl s3.ACL, config MultipartConfig) (srcError, dstError error) {
+	config = config.withDefaults()
+	etag := object.headers.Get("ETag")
+	partSize := config.partSizeFor(etag, object.contentLength)
+	uploadID, dstError := initMultiWithAttributes(dstBucket, dstKey, object, acl)
+	if dstError != nil {
+		return nil, dstError
+	}
+	var parts []store.Part
+	parts, srcError, dstError = copyParts(srcBucket, srcKey, etag, dstBucket, dstKey, uploadID,
+		splitIntoParts(object.contentLength, partSize), config.inFlightParts(partSize))
+	if srcError == nil && dstError == nil {
+		dstError = dstBucket.CompleteMultipart(dstBucket.Name, dstKey, uploadID, parts)
+	}
+	if srcError != nil || dstError != nil {
+		if abortErr := dstBucket.AbortMultipart(dstBucket.Name, dstKey, uploadID); abortErr != nil {
+			log.Printf("Could not abort multipart upload of %s/%s on %s: %s", dstBucket.Name, dstKey, dstBucket.Endpoint(), abortErr)
+		}
+	}
+	return srcError, dstError
+}
+
+// copyParts copies the parts with inFlight workers, each reusing a single part buffer
+func copyParts(srcBucket storageBucket, srcKey, etag string, dstBucket storageBucket, dstKey, uploadID string,
+	ranges []partRange, inFlight int) (parts []store.Part, srcError, dstError error) {
+	rangesChan := make(chan partRange)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var mx sync.Mutex
+	fail := func(src, dst error) {
+		failOnce.Do(func() {
+			srcError, dstError = src, dst
+			close(failed)
+		})
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < inFlight && i < len(ranges); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, ranges[0].size)
+			for part := range rangesChan {
+				data := buffer[:part.size]
+				if err := getRange(srcBucket, srcKey, etag, part, data); err != nil {
+					fail(err, nil)
+					return
+				}
+				uploaded, err := dstBucket.UploadPart(dstBucket.Name, dstKey, uploadID, part.number,
+					bytes.NewReader(data), part.size)
+				if err != nil {
+					fail(nil, err)
+					return
+				}
+				mx.Lock()
+				parts = append(parts, uploaded)
+				mx.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, part := range ranges {
+		select {
+		case rangesChan <- part:
+		case <-failed:
+			break feed
+		}
+	}
+	close(rangesChan)
+	wg.Wait()
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, srcError, dstError
+}
+
+func getRange(bucket storageBucket, key, etag string, part partRange, data []byte) error {
+	body, info, err := bucket.Get(bucket.Name, key, part.offset, part.size)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := body.Close(); closeErr != nil {
+			log.Debugf("Part %d body close error %s/%s: %s", part.number, bucket.Name, key, closeErr)
+		}
+	}()
+	if etag != "" && info.ETag != etag {
+		log.Printf("Object %s/%s changed during the migration, part %d doesn't match ETag %s", bucket.Name, key, part.number, etag)
+		return &s3.Error{
+			StatusCode: http.StatusPreconditionFailed,
+			BucketName: bucket.Name,
+			Message:    fmt.Sprintf("ETag %s of %s/%s on %s differs from %s", info.ETag, bucket.Name, key, bucket.Endpoint(), etag),
+		}
+	}
+	_, err = io.ReadFull(body, data)
+	return err
+}
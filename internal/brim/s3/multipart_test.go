@@ -0,0 +1,171 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/brim/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type multipartStorage struct {
+	parts     map[int][]byte
+	completed []byte
+	aborted   bool
+	mx        sync.Mutex
+}
+
+func (storage *multipartStorage) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	storage.mx.Lock()
+	defer storage.mx.Unlock()
+	query := req.URL.Query()
+	switch {
+	case req.Method == http.MethodPost && query.Get("uploadId") == "":
+		_, _ = rw.Write([]byte("<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>"))
+	case req.Method == http.MethodPut:
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		storage.parts[partNumber], _ = ioutil.ReadAll(req.Body)
+		rw.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, partNumber))
+	case req.Method == http.MethodPost:
+		var numbers []int
+		for number := range storage.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		for _, number := range numbers {
+			storage.completed = append(storage.completed, storage.parts[number]...)
+		}
+		_, _ = rw.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case req.Method == http.MethodDelete:
+		storage.aborted = true
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func sourceStorage(content []byte, failedOffset int64) *httptest.Server {
+	return sourceStorageWithETag(content, failedOffset, "")
+}
+
+func sourceStorageWithETag(content []byte, failedOffset int64, etag string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if etag != "" {
+			rw.Header().Set("ETag", etag)
+		}
+		if failedOffset > 0 && req.Header.Get("Range") == fmt.Sprintf("bytes=%d-%d", failedOffset, len(content)-1) {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func testBucket(endpoint string) storageBucket {
+	client := s3.New(aws.Auth{AccessKey: "123", SecretKey: "321"}, aws.Region{Name: "generic", S3Endpoint: endpoint})
+	return storageBucket{Storage: store.NewS3Store(client), Name: "bucket"}
+}
+
+func TestShouldStreamObjectInPartsOfSourceLayout(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789abcdef", 12*mebibyte/16) + "X")
+	src := sourceStorageWithETag(content, 0, `"d41d8cd98f00b204e9800998ecf8427e-2"`)
+	defer src.Close()
+	dstStorage := &multipartStorage{parts: make(map[int][]byte)}
+	dst := httptest.NewServer(dstStorage)
+	defer dst.Close()
+	object := s3Object{contentLength: int64(len(content)), contentType: "text/plain",
+		headers: http.Header{"Etag": {`"d41d8cd98f00b204e9800998ecf8427e-2"`}}}
+
+	srcError, dstError := streamMultipart(testBucket(src.URL), "key", testBucket(dst.URL), "key", object, s3.Private, MultipartConfig{})
+
+	require.NoError(t, srcError)
+	require.NoError(t, dstError)
+	assert.Len(t, dstStorage.parts, 2)
+	assert.Len(t, dstStorage.parts[1], 7*mebibyte)
+	assert.True(t, bytes.Equal(content, dstStorage.completed))
+	assert.False(t, dstStorage.aborted)
+}
+
+func TestShouldAbortUploadWhenSourceRangeFails(t *testing.T) {
+	content := []byte(strings.Repeat("X", 11*mebibyte))
+	src := sourceStorage(content, 10*mebibyte)
+	defer src.Close()
+	dstStorage := &multipartStorage{parts: make(map[int][]byte)}
+	dst := httptest.NewServer(dstStorage)
+	defer dst.Close()
+	object := s3Object{contentLength: int64(len(content)), contentType: "text/plain", headers: http.Header{}}
+
+	srcError, dstError := streamMultipart(testBucket(src.URL), "key", testBucket(dst.URL), "key", object, s3.Private,
+		MultipartConfig{PartSize: 5 * mebibyte, MaxInFlightParts: 1})
+
+	assert.Error(t, srcError)
+	assert.NoError(t, dstError)
+	assert.Equal(t, http.StatusForbidden, GetHTTPStatusCodeFromError(srcError))
+	assert.Nil(t, dstStorage.completed)
+	assert.True(t, dstStorage.aborted)
+}
+
+func TestShouldAbortUploadWhenSourceObjectChanges(t *testing.T) {
+	content := []byte(strings.Repeat("X", 11*mebibyte))
+	src := sourceStorageWithETag(content, 0, `"0cc175b9c0f1b6a831c399e269772661"`)
+	defer src.Close()
+	dstStorage := &multipartStorage{parts: make(map[int][]byte)}
+	dst := httptest.NewServer(dstStorage)
+	defer dst.Close()
+	object := s3Object{contentLength: int64(len(content)), contentType: "text/plain",
+		headers: http.Header{"Etag": {`"d41d8cd98f00b204e9800998ecf8427e"`}}}
+
+	srcError, dstError := streamMultipart(testBucket(src.URL), "key", testBucket(dst.URL), "key", object, s3.Private,
+		MultipartConfig{PartSize: 5 * mebibyte, MaxInFlightParts: 1})
+
+	assert.Equal(t, http.StatusPreconditionFailed, GetHTTPStatusCodeFromError(srcError))
+	assert.NoError(t, dstError)
+	assert.Nil(t, dstStorage.completed)
+	assert.True(t, dstStorage.aborted)
+}
+
+func TestShouldDetectSourcePartSize(t *testing.T) {
+	for _, scenario := range []struct {
+		etag          string
+		contentLength int64
+		expected      int64
+	}{
+		{etag: `"d41d8cd98f00b204e9800998ecf8427e"`, contentLength: 100 * mebibyte, expected: 0},
+		{etag: `"d41d8cd98f00b204e9800998ecf8427e-4"`, contentLength: 30 * mebibyte, expected: 8 * mebibyte},
+		{etag: `"d41d8cd98f00b204e9800998ecf8427e-2"`, contentLength: 16 * mebibyte, expected: 8 * mebibyte},
+		{etag: "d41d8cd98f00b204e9800998ecf8427e-3", contentLength: 15*mebibyte + 3, expected: 6 * mebibyte},
+	} {
+		assert.Equal(t, scenario.expected, sourcePartSize(scenario.etag, scenario.contentLength), scenario.etag)
+	}
+}
+
+func TestShouldBoundInFlightPartsByMemoryBudget(t *testing.T) {
+	config := MultipartConfig{PartSize: 10 * mebibyte, MaxInFlightParts: 8, MemoryBudget: 35 * mebibyte}
+	assert.Equal(t, 3, config.inFlightParts(10*mebibyte))
+	assert.Equal(t, 1, config.inFlightParts(50*mebibyte))
+	assert.Equal(t, 7, config.inFlightParts(minPartSize))
+	assert.Equal(t, int64(10*mebibyte), config.partSizeFor("", 100*mebibyte))
+	assert.Equal(t, int64(minPartSize), MultipartConfig{PartSize: mebibyte}.partSizeFor("", 100*mebibyte))
+	assert.Equal(t, int64(10*mebibyte), MultipartConfig{PartSize: minPartSize}.partSizeFor("", maxPartCount*10*mebibyte))
+	assert.Equal(t, int64(10*mebibyte), config.partSizeFor(`"d41d8cd98f00b204e9800998ecf8427e-2"`, 100*mebibyte))
+	assert.Equal(t, int64(35*mebibyte), MultipartConfig{PartSize: 64 * mebibyte, MemoryBudget: 35 * mebibyte}.partSizeFor("", 100*mebibyte))
+}
+
+func TestShouldCompareETagsOfMultipartObjectsByPartCount(t *testing.T) {
+	assert.True(t, ETagsMatch(`"abc"`, `"ABC"`))
+	assert.False(t, ETagsMatch(`"abc"`, `"abd"`))
+	assert.True(t, ETagsMatch(`"abc-3"`, `"def-3"`))
+	assert.False(t, ETagsMatch(`"abc-3"`, `"abc-4"`))
+	assert.True(t, ETagsMatch(`"abc"`, `"def-3"`))
+	assert.True(t, ETagsMatch("", `"def"`))
+}
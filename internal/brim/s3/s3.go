@@ -1,16 +1,16 @@
 package s3
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/allegro/akubra/internal/brim/store"
 
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
@@ -41,7 +41,9 @@ type s3Object struct {
 	headers       http.Header
 	contentType   string
 	perm          s3.ACL
-	options       s3.Options
+	attributes    http.Header
+	grants        *s3.AccessControlList
+	tagging       []byte
 }
 
 func (obj s3Object) cleanUp() error {
@@ -58,13 +60,19 @@ func (obj s3Object) cleanUp() error {
 	return err
 }
 
-// GetS3Client returns s3 client for given MigrationAuth
+// GetS3Client returns s3 client for given MigrationAuth, store.ForClient gives the storage it points to
 func GetS3Client(s3Auth *MigrationAuth) *s3.S3 {
 	cli := s3.New(aws.Auth{AccessKey: s3Auth.AccessKey, SecretKey: s3Auth.SecretKey},
 		aws.Region{Name: "generic", S3Endpoint: s3Auth.Endpoint})
 	return cli
 }
 
+// storageBucket is a bucket of the storage objects are migrated from or to
+type storageBucket struct {
+	store.Storage
+	Name string
+}
+
 func extractContentTypeAndLength(headers http.Header, multipart bool) (contentType string, contentLength int64, err error) {
 	contentLengthValue := headers.Get("Content-Length")
 	if contentLengthValue == "" {
@@ -122,6 +130,10 @@ func (mtr *MigrationTaskResult) MarkRetry(errType model.ErrorType, err error) {
 		mtr.Retryable = false
 		return
 	}
+	if store.IsNotFound(err) {
+		mtr.Retryable = false
+		return
+	}
 	s3Err, ok := err.(*s3.Error)
 	if ok {
 		if s3Err.StatusCode == http.StatusNotFound {
@@ -173,12 +185,16 @@ type TaskMigrator struct {
 	Task                     MigrationTaskData
 	SrcS3Client, DstS3Client *s3.S3
 	Multipart                bool
-	srcBucket, dstBucket     *s3.Bucket
+	MultipartConfig          MultipartConfig
+	MetadataFilter           MetadataFilter
+	srcBucket, dstBucket     storageBucket
 }
 
 // Run performs task migration actions
 func (migrator *TaskMigrator) Run() (srcError, dstError error) {
-	migrator.prepareBucketInstances()
+	if srcError, dstError = migrator.prepareBucketInstances(); srcError != nil || dstError != nil {
+		return srcError, dstError
+	}
 
 	getStart := time.Now()
 	object, srcError := migrator.getObjectFromSource()
@@ -206,17 +222,26 @@ func (migrator *TaskMigrator) Run() (srcError, dstError error) {
 	return srcError, dstError
 }
 
-func (migrator *TaskMigrator) prepareBucketInstances() {
-	migrator.srcBucket = migrator.SrcS3Client.Bucket(migrator.Task.srcBucketName)
-	migrator.dstBucket = migrator.DstS3Client.Bucket(migrator.Task.dstBucketName)
+func (migrator *TaskMigrator) prepareBucketInstances() (srcError, dstError error) {
+	srcStorage, srcError := store.ForClient(migrator.SrcS3Client)
+	if srcError != nil {
+		return srcError, nil
+	}
+	dstStorage, dstError := store.ForClient(migrator.DstS3Client)
+	if dstError != nil {
+		return nil, dstError
+	}
+	migrator.srcBucket = storageBucket{Storage: srcStorage, Name: migrator.Task.srcBucketName}
+	migrator.dstBucket = storageBucket{Storage: dstStorage, Name: migrator.Task.dstBucketName}
+	return nil, nil
 }
 
 func (migrator *TaskMigrator) getObjectFromSource() (s3Object, error) {
-	return s3ObjectData(migrator.Task.srcKey, migrator.srcBucket, migrator.Multipart)
+	return s3ObjectData(migrator.Task.srcKey, migrator.srcBucket, migrator.Multipart, migrator.MetadataFilter)
 }
 
 func (migrator *TaskMigrator) ensureDestinationBucketExistence() (srcError, dstError error) {
-	bucketExists, err := migrator.dstBucket.Exists("")
+	bucketExists, err := migrator.dstBucket.BucketExists(migrator.dstBucket.Name)
 	if err != nil {
 		log.Printf("Couldn't determine destination bucket %s existence: %s", migrator.dstBucket.Name, err)
 		return nil, dstError
@@ -243,19 +268,22 @@ func (migrator *TaskMigrator) putObject(object s3Object) (srcError, dstError err
 		srcError, dstError,
 	)
 
+	objectACL := migrator.determineACL(object)
 	if migrator.Multipart {
-		return nil, multipartUpload(migrator.dstBucket, migrator.Task.dstKey, object)
+		srcError, dstError = streamMultipart(migrator.srcBucket, migrator.Task.srcKey, migrator.dstBucket,
+			migrator.Task.dstKey, object, objectACL, migrator.MultipartConfig)
+	} else {
+		dstError = putObjectWithAttributes(migrator.dstBucket, migrator.Task.dstKey, object, objectACL)
 	}
-
-	objectACL := migrator.determineACL(object)
-	dstError = migrator.dstBucket.PutReader(migrator.Task.dstKey, object.data, object.contentLength,
-		object.contentType, objectACL, object.options)
-	if dstError != nil {
+	if srcError != nil || dstError != nil {
+		return srcError, dstError
+	}
+	if dstError = migrator.putSubResources(object); dstError != nil {
 		return nil, dstError
 	}
 	if migrator.Task.action == model.ActionMove {
 		deleteStart := time.Now()
-		srcError = DeleteObject(migrator.srcBucket, migrator.Task.srcKey)
+		srcError = DeleteObject(migrator.srcBucket, migrator.srcBucket.Name, migrator.Task.srcKey)
 		if srcError == nil {
 			log.Printf("Removed object %s/%s", migrator.srcBucket.Name, migrator.Task.srcKey)
 		}
@@ -265,6 +293,21 @@ func (migrator *TaskMigrator) putObject(object s3Object) (srcError, dstError err
 	return
 }
 
+// putSubResources reproduces the ACL grants and tags of the source object, the canned ACL
+// sent on upload may not express all the grants
+func (migrator *TaskMigrator) putSubResources(object s3Object) error {
+	if object.grants != nil && model.ACLCopyFromSource == migrator.Task.aclMode {
+		if err := putObjectGrants(migrator.dstBucket, migrator.Task.dstKey, object.grants); err != nil {
+			return err
+		}
+	}
+	if object.tagging != nil {
+		return migrator.dstBucket.PutSubResource(migrator.dstBucket.Name, migrator.Task.dstKey,
+			taggingSubResource, object.tagging)
+	}
+	return nil
+}
+
 func (migrator *TaskMigrator) determineACL(object s3Object) s3.ACL {
 	if model.ACLCopyFromSource == migrator.Task.aclMode {
 		return object.perm
@@ -273,11 +316,11 @@ func (migrator *TaskMigrator) determineACL(object s3Object) s3.ACL {
 }
 
 // DeleteObject deletes object from cluster
-func DeleteObject(bucket *s3.Bucket, object string) error {
-	err := bucket.Del(object)
+func DeleteObject(storage store.Storage, bucketName, object string) error {
+	err := storage.Delete(bucketName, object)
 	if err != nil {
-		if strings.Contains(err.Error(), ErrMsgNotFound) {
-			log.Printf("Object %s/%s/%s not found", bucket.S3Endpoint, bucket.Name, object)
+		if store.IsNotFound(err) || strings.Contains(err.Error(), ErrMsgNotFound) {
+			log.Printf("Object %s/%s/%s not found", storage.Endpoint(), bucketName, object)
 		} else {
 			return err
 		}
@@ -287,22 +330,28 @@ func DeleteObject(bucket *s3.Bucket, object string) error {
 
 // CopyBucket creates copy of source bucket on destination cluster
 func CopyBucket(srcBucketName, dstBucketName string, srcS3Client *s3.S3, dstS3Client *s3.S3, shouldUseSrcBucketACL bool) (srcError, dstError error) {
-	srcBucket := srcS3Client.Bucket(srcBucketName)
+	srcStorage, srcError := store.ForClient(srcS3Client)
+	if srcError != nil {
+		return srcError, nil
+	}
 	bucketACL := s3.Private
 	if shouldUseSrcBucketACL {
-		bucketACL, srcError = getBucketACL(srcBucket)
+		bucketACL, srcError = getBucketACL(srcStorage, srcBucketName)
 		if srcError != nil {
 			log.Printf("Bucket %s on %s ACL retrieval fail: %s", srcBucketName, srcS3Client.S3Endpoint, srcError)
 			return srcError, nil
 		}
 	}
 
-	dstBucket := dstS3Client.Bucket(dstBucketName)
-	exists, dstError := dstBucket.Exists("")
+	dstStorage, dstError := store.ForClient(dstS3Client)
+	if dstError != nil {
+		return nil, dstError
+	}
+	exists, dstError := dstStorage.BucketExists(dstBucketName)
 	if exists && dstError != nil {
 		return nil, nil
 	}
-	dstError = dstBucket.PutBucket(bucketACL)
+	dstError = dstStorage.CreateBucket(dstBucketName, http.Header{"X-Amz-Acl": {string(bucketACL)}})
 	if dstError != nil {
 		log.Printf("Bucket %s creation on destination %s failed: %s", dstBucketName, dstS3Client.S3Endpoint, dstError)
 		return
@@ -311,13 +360,16 @@ func CopyBucket(srcBucketName, dstBucketName string, srcS3Client *s3.S3, dstS3Cl
 	return nil, nil
 }
 
-func getBucketACL(bucket *s3.Bucket) (acl s3.ACL, err error) {
-	_, err = bucket.Get("")
+func getBucketACL(storage store.Storage, bucketName string) (acl s3.ACL, err error) {
+	exists, err := storage.BucketExists(bucketName)
 	if err != nil {
 		return acl, err
 	}
+	if !exists {
+		return acl, store.ErrNotFound
+	}
 
-	bucketACL, err := bucket.GetACL("")
+	bucketACL, err := getGrants(storage, bucketName, "")
 	if err != nil {
 		return acl, err
 	}
@@ -328,66 +380,66 @@ func getBucketACL(bucket *s3.Bucket) (acl s3.ACL, err error) {
 
 const objectSizeLimit = 100 * 1024 * 1024
 
-func s3ObjectData(path string, bucket *s3.Bucket, multipart bool) (result s3Object, err error) {
-	resp, err := bucket.GetResponseWithHeaders(path,
-		map[string][]string{
-			"X-Akubra-No-Regression-On-Failure": {"1"},
-			"Accept-Encoding":                   {"*"}})
+func s3ObjectData(path string, bucket storageBucket, multipart bool, filter MetadataFilter) (result s3Object, err error) {
+	var info store.ObjectInfo
+	if multipart {
+		// multipart objects are streamed with ranged GETs, only the headers are needed
+		info, err = bucket.Head(bucket.Name, path)
+	} else {
+		result.data, info, err = bucket.Get(bucket.Name, path, 0, -1)
+	}
 
 	if err != nil {
-		log.Printf("Object %s/%s/%s headers could not be fetched: %s", bucket.S3Endpoint, bucket.Name, path, err)
+		log.Printf("Object %s/%s/%s headers could not be fetched: %s", bucket.Endpoint(), bucket.Name, path, err)
 		return result, err
 	}
-
-	result.data = resp.Body
-	result.headers = resp.Header
+	result.headers = objectHeaders(info)
 
 	log.Printf("Object %s/%s is %s bytes\n", bucket.Name, path, result.headers.Get("content-length"))
 
-	result = prepareMetadataAndHeaders(result)
+	result = prepareMetadataAndHeaders(result, filter)
 	result.contentType, result.contentLength, err = extractContentTypeAndLength(result.headers, multipart)
 	if err != nil {
 		return result, err
 	}
-	if result.headers.Get("Content-Encoding") != "" {
-		result.options.ContentEncoding = result.headers.Get("Content-Encoding")
-	}
-	log.Debugf("Get bucket acl %s/%s", bucket.S3Endpoint, bucket.Name)
-	objACL, err := bucket.GetACL(path)
+	log.Debugf("Get object acl %s/%s/%s", bucket.Endpoint(), bucket.Name, path)
+	objACL, err := getGrants(bucket, bucket.Name, path)
 	if err != nil {
-		log.Debugf("Cannot get bucket acl %s/%s", bucket.S3Endpoint, bucket.Name)
+		log.Debugf("Cannot get object acl %s/%s/%s", bucket.Endpoint(), bucket.Name, path)
 		return result, err
 	}
-	log.Debugf("Got bucket acl %s/%s", bucket.S3Endpoint, bucket.Name)
-
-	objCannedPolicy := s3.GetCannedPolicyByAcl(*objACL)
-	result.perm = objCannedPolicy
+	result.grants = objACL
+	result.perm = s3.GetCannedPolicyByAcl(*objACL)
+	if filter.Preserves(taggingHeader) {
+		if result.tagging, err = getObjectTagging(bucket, path); err != nil {
+			log.Debugf("Cannot get object tagging %s/%s/%s", bucket.Endpoint(), bucket.Name, path)
+			return result, err
+		}
+	}
 	return result, nil
 }
 
-func prepareMetadataAndHeaders(inputS3Obj s3Object) (outputS3Obj s3Object) {
-	outputS3Obj.options.Meta = make(map[string][]string)
+// objectHeaders are the headers of the object, with its size and ETag if the store keeps them apart
+func objectHeaders(info store.ObjectInfo) http.Header {
+	headers := http.Header{}
+	for name, values := range info.Header {
+		headers[name] = values
+	}
+	if headers.Get("Content-Length") == "" && info.Size >= 0 {
+		headers.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if headers.Get("ETag") == "" && info.ETag != "" {
+		headers.Set("ETag", info.ETag)
+	}
+	return headers
+}
+
+func prepareMetadataAndHeaders(inputS3Obj s3Object, filter MetadataFilter) (outputS3Obj s3Object) {
+	outputS3Obj.attributes = objectAttributes(inputS3Obj.headers, filter)
 	outputS3Obj.headers = make(map[string][]string)
 	outputS3Obj.data = inputS3Obj.data
 	for name, value := range inputS3Obj.headers {
 		key := strings.ToLower(name)
-		if strings.HasPrefix(key, AmzMetadataPrefix) {
-			keyWithoutMeta := strings.ToLower(strings.Replace(key, AmzMetadataPrefix, "", 1))
-			outputS3Obj.options.Meta[keyWithoutMeta] = []string{value[0]}
-		}
-		if key == "content-encoding" {
-			outputS3Obj.options.ContentEncoding = value[0]
-		}
-		if key == "cache-control" {
-			outputS3Obj.options.CacheControl = value[0]
-		}
-		if key == "redirect-location" {
-			outputS3Obj.options.RedirectLocation = value[0]
-		}
-		if key == "content-disposition" {
-			outputS3Obj.options.ContentDisposition = value[0]
-		}
-
 		if key == "date" {
 			outputS3Obj.headers.Add("Date", value[0])
 		}
@@ -397,41 +449,18 @@ func prepareMetadataAndHeaders(inputS3Obj s3Object) (outputS3Obj s3Object) {
 		if key == "content-type" {
 			outputS3Obj.headers.Add("Content-Type", value[0])
 		}
-	}
-	return outputS3Obj
-}
-
-func multipartUpload(bucket *s3.Bucket, objectPath string, srcObj s3Object) error {
-	f, err := ioutil.TempFile(os.TempDir(), "")
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(f, srcObj.data)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if rmErr := os.Remove(path.Join(os.TempDir(), f.Name())); rmErr != nil {
-			log.Debugf("Warning! did not removed file after multipart upload, reason %s", rmErr)
+		if key == "etag" {
+			outputS3Obj.headers.Add("ETag", value[0])
 		}
-	}()
-	multipart, err := bucket.InitMulti(objectPath, srcObj.contentType, srcObj.perm, srcObj.options)
-	if err != nil {
-		return err
-	}
-
-	if _, seekErr := f.Seek(0, 0); seekErr != nil {
-		return seekErr
 	}
-	parts, err := multipart.PutAll(f, 50*1024*1024-2)
-	if err != nil {
-		return err
-	}
-	return multipart.Complete(parts)
+	return outputS3Obj
 }
 
-// GetHTTPStatusCodeFromError extracts http code from s3.Error value
+// GetHTTPStatusCodeFromError extracts http code from s3.Error value, missing resources of any store are 404
 func GetHTTPStatusCodeFromError(err error) int {
+	if errors.Is(err, store.ErrNotFound) {
+		return http.StatusNotFound
+	}
 	s3Err, ok := err.(*s3.Error)
 	if ok {
 		return s3Err.StatusCode
@@ -1,6 +1,15 @@
 package s3
 
-import "errors"
+import (
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/brim/model"
+)
 
 // TextErr is an error that also implements the TextMarshaller interface for
 // serializing out to various plain text encodings. Packages creating their
@@ -30,3 +39,57 @@ var (
 	// ErrDatabaseIntegrity is the error returned for all abnormal database cases
 	ErrDatabaseIntegrity = TextErr{errors.New("Database integrity error")}
 )
+
+// Error classes of failed consistency record syncs
+const (
+	ForbiddenErrorClass = "forbidden"
+	NotFoundErrorClass  = "not_found"
+	ClientErrorClass    = "client_error"
+	ServerErrorClass    = "server_error"
+	NetworkErrorClass   = "network"
+	UnknownErrorClass   = "unknown"
+	// VerificationErrorClass groups migrations which destination copy differs from the source
+	VerificationErrorClass = "verification"
+)
+
+var statusLinePattern = regexp.MustCompile(`^\d{3} `)
+
+// ClassifyError groups storage errors, so operators can handle similar failures together
+func ClassifyError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return NetworkErrorClass
+	}
+	var verificationErr *model.VerificationError
+	if errors.As(err, &verificationErr) {
+		return VerificationErrorClass
+	}
+	statusCode := 0
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		statusCode = s3Err.StatusCode
+	} else if err != nil && statusLinePattern.MatchString(err.Error()) {
+		// goamz reports failed HEAD requests with the status line only
+		statusCode, _ = strconv.Atoi(err.Error()[:3])
+	}
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ForbiddenErrorClass
+	case statusCode == http.StatusNotFound:
+		return NotFoundErrorClass
+	case statusCode >= 400 && statusCode < 500:
+		return ClientErrorClass
+	case statusCode >= 500:
+		return ServerErrorClass
+	}
+	return UnknownErrorClass
+}
+
+// BackendOf returns the storage involved in the failure, if known
+func BackendOf(err error) string {
+	var backendErr *model.BackendError
+	if errors.As(err, &backendErr) {
+		return backendErr.Backend
+	}
+	return ""
+}
@@ -3,6 +3,7 @@ package s3
 import (
 	"bytes"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"testing"
 
@@ -41,16 +42,14 @@ func TestShouldPrepareMetadataAndHeadersFromXAMZHeaders(t *testing.T) {
 		"Content-Length":      {"124"},
 		"X-Amz-Meta-Md5-Hash": {"e6e3b9f6f7803e6e09a47ee53064f2c5"},
 	}
-	expectedMeta := s3.Options{
-		Meta: map[string][]string{
-			"md5-hash": {"e6e3b9f6f7803e6e09a47ee53064f2c5"},
-		},
+	expectedAttributes := http.Header{
+		"X-Amz-Meta-Md5-Hash": {"e6e3b9f6f7803e6e09a47ee53064f2c5"},
 	}
 	inputObject := s3Object{headers: headers}
 
-	outputObject := prepareMetadataAndHeaders(inputObject)
+	outputObject := prepareMetadataAndHeaders(inputObject, MetadataFilter{})
 
-	assert.Equal(t, expectedMeta.Meta, outputObject.options.Meta)
+	assert.Equal(t, expectedAttributes, outputObject.attributes)
 }
 
 func TestShouldPrepareMetadataAndHeadersWithRequiredHeaders(t *testing.T) {
@@ -63,6 +62,7 @@ func TestShouldPrepareMetadataAndHeadersWithRequiredHeaders(t *testing.T) {
 		"Date":           {"Fri, 18 Aug 2017 13:03:33 GMT"},
 	}
 	expectedHeaders := http.Header{
+		"Etag":           {"413343bafea650838e4b7b8da31f960c"},
 		"Content-Type":   {"image/jpeg"},
 		"Content-Length": {"12345"},
 		"Date":           {"Fri, 18 Aug 2017 13:03:33 GMT"},
@@ -70,7 +70,7 @@ func TestShouldPrepareMetadataAndHeadersWithRequiredHeaders(t *testing.T) {
 
 	inputObject := s3Object{headers: headers}
 
-	outputObject := prepareMetadataAndHeaders(inputObject)
+	outputObject := prepareMetadataAndHeaders(inputObject, MetadataFilter{})
 
 	assert.Equal(t, len(expectedHeaders), len(outputObject.headers))
 
@@ -88,7 +88,7 @@ func TestPrepareMetadataAndHeadersWithBody(t *testing.T) {
 	}
 	inputObject := s3Object{headers: headers, data: ioutil.NopCloser(bytes.NewBuffer(expectedPayload))}
 
-	outputObject := prepareMetadataAndHeaders(inputObject)
+	outputObject := prepareMetadataAndHeaders(inputObject, MetadataFilter{})
 	outputObjectPayload, err := ioutil.ReadAll(outputObject.data)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedPayload, outputObjectPayload)
@@ -155,3 +155,22 @@ func TestShouldSetACLAccordingToTheACLModeSpecifiedInTheTask(t *testing.T) {
 		assert.Equal(t, taskMigrator.determineACL(object), testCase.ExpectedObjectACL)
 	}
 }
+
+func TestShouldClassifyStorageErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		err           error
+		expectedClass string
+	}{
+		{&s3.Error{StatusCode: http.StatusForbidden}, ForbiddenErrorClass},
+		{model.NewBackendError("http://storage", &s3.Error{StatusCode: http.StatusNotFound}), NotFoundErrorClass},
+		{model.NewBackendError("http://storage", fmt.Errorf("version: %w", &s3.Error{StatusCode: http.StatusConflict})), ClientErrorClass},
+		{&s3.Error{StatusCode: http.StatusServiceUnavailable}, ServerErrorClass},
+		{fmt.Errorf("500 Internal Server Error"), ServerErrorClass},
+		{&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, NetworkErrorClass},
+		{model.NewBackendError("http://storage", &model.VerificationError{Reason: "size differs"}), VerificationErrorClass},
+		{fmt.Errorf("malformed object's path"), UnknownErrorClass},
+	} {
+		assert.Equal(t, testCase.expectedClass, ClassifyError(testCase.err), testCase.err.Error())
+	}
+	assert.Equal(t, "http://storage", BackendOf(fmt.Errorf("task: %w", model.NewBackendError("http://storage", fmt.Errorf("failed")))))
+}
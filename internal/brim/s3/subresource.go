@@ -0,0 +1,75 @@
+package s3
+
+import (
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/brim/store"
+)
+
+const aclSubResource = "acl"
+
+// BucketExists checks if the bucket is present on the storage
+func BucketExists(client *s3.S3, bucketName string) (bool, error) {
+	storage, err := store.ForClient(client)
+	if err != nil {
+		return false, err
+	}
+	return storage.BucketExists(bucketName)
+}
+
+// DeleteBucket removes the bucket from the storage
+func DeleteBucket(client *s3.S3, bucketName string) error {
+	storage, err := store.ForClient(client)
+	if err != nil {
+		return err
+	}
+	return storage.DeleteBucket(bucketName)
+}
+
+// GetSubResource fetches the sub-resource document of a bucket (key is empty) or an object,
+// nil is returned if the sub-resource is not set. ACLs are returned as canned ACL names,
+// because the grantees' ids differ between storages
+func GetSubResource(client *s3.S3, bucketName, key, subResource string) ([]byte, error) {
+	storage, err := store.ForClient(client)
+	if err != nil {
+		return nil, err
+	}
+	if subResource == aclSubResource {
+		acl, err := getGrants(storage, bucketName, key)
+		if err != nil {
+			if store.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return []byte(s3.GetCannedPolicyByAcl(*acl)), nil
+	}
+	document, err := storage.GetSubResource(bucketName, key, subResource)
+	if store.IsNotFound(err) {
+		return nil, nil
+	}
+	return document, err
+}
+
+// PutSubResource sets the sub-resource document fetched by GetSubResource
+func PutSubResource(client *s3.S3, bucketName, key, subResource string, document []byte) error {
+	storage, err := store.ForClient(client)
+	if err != nil {
+		return err
+	}
+	if subResource == aclSubResource {
+		return storage.PutCannedACL(bucketName, key, string(document))
+	}
+	return storage.PutSubResource(bucketName, key, subResource, document)
+}
+
+// DeleteSubResource removes the sub-resource of a bucket
+func DeleteSubResource(client *s3.S3, bucketName, subResource string) error {
+	storage, err := store.ForClient(client)
+	if err != nil {
+		return err
+	}
+	if err = storage.DeleteSubResource(bucketName, "", subResource); store.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func subResourceStorage(handler http.HandlerFunc) (*httptest.Server, *s3.S3) {
+	server := httptest.NewServer(handler)
+	return server, s3.New(aws.Auth{AccessKey: "123", SecretKey: "321"}, aws.Region{Name: "generic", S3Endpoint: server.URL})
+}
+
+func TestShouldReturnNoDocumentIfSubResourceIsNotSet(t *testing.T) {
+	server, client := subResourceStorage(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/bucket", req.URL.Path)
+		assert.Equal(t, "policy", req.URL.RawQuery)
+		rw.WriteHeader(http.StatusNotFound)
+	})
+	defer server.Close()
+
+	document, err := GetSubResource(client, "bucket", "", "policy")
+	require.NoError(t, err)
+	assert.Nil(t, document)
+}
+
+func TestShouldPutSignedSubResourceDocumentWithDigest(t *testing.T) {
+	document := []byte("<LifecycleConfiguration/>")
+	digest := md5.Sum(document)
+	server, client := subResourceStorage(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.MethodPut, req.Method)
+		assert.Equal(t, "lifecycle", req.URL.RawQuery)
+		assert.Equal(t, document, body)
+		assert.Equal(t, base64.StdEncoding.EncodeToString(digest[:]), req.Header.Get("Content-MD5"))
+		assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"), "AWS 123:"))
+	})
+	defer server.Close()
+
+	assert.NoError(t, PutSubResource(client, "bucket", "", "lifecycle", document))
+}
+
+func TestShouldPutObjectACLAsCannedACLHeader(t *testing.T) {
+	server, client := subResourceStorage(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/bucket/some/key", req.URL.Path)
+		assert.Equal(t, "acl", req.URL.RawQuery)
+		assert.Equal(t, "public-read", req.Header.Get("x-amz-acl"))
+	})
+	defer server.Close()
+
+	assert.NoError(t, PutSubResource(client, "bucket", "some/key", "acl", []byte("public-read")))
+}
+
+func TestShouldFailIfStorageRejectsSubResourceDeletion(t *testing.T) {
+	server, client := subResourceStorage(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+	})
+	defer server.Close()
+
+	assert.Error(t, DeleteSubResource(client, "bucket", "cors"))
+}
@@ -0,0 +1,373 @@
+package scanner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/storages"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/auth"
+	"github.com/allegro/akubra/internal/brim/config"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/store"
+	"github.com/gofrs/uuid"
+)
+
+// RepairRequestIDPrefix starts the request ids of the repair records
+const RepairRequestIDPrefix = "scanner-"
+
+const (
+	defaultInterval     = 24 * time.Hour
+	defaultListPageSize = 1000
+	// noVersion marks copies without the version header
+	noVersion = -1
+)
+
+// Scanner compares the listings of all the storages of every shard and feeds repair
+// records of the divergent objects to the filter, like records of the consistency log
+type Scanner struct {
+	resolver          auth.BackendResolver
+	config            config.ScannerConf
+	versionHeaderName string
+	state             *State
+	listLimiter       *rateLimiter
+	repairLimiter     *rateLimiter
+}
+
+// NewScanner creates a Scanner resuming the scans saved in the checkpoint file
+func NewScanner(resolver auth.BackendResolver, scannerConf config.ScannerConf, versionHeaderName string) (*Scanner, error) {
+	state, err := LoadState(scannerConf.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+	if scannerConf.Interval == 0 {
+		scannerConf.Interval = defaultInterval
+	}
+	if scannerConf.ListPageSize == 0 {
+		scannerConf.ListPageSize = defaultListPageSize
+	}
+	return &Scanner{
+		resolver:          resolver,
+		config:            scannerConf,
+		versionHeaderName: versionHeaderName,
+		state:             state,
+		listLimiter:       newRateLimiter(scannerConf.ListRequestsPerSecond),
+		repairLimiter:     newRateLimiter(scannerConf.RepairsPerSecond),
+	}, nil
+}
+
+// State returns the checkpoints and reports of the scanner
+func (scanner *Scanner) State() *State {
+	return scanner.state
+}
+
+// CreateFeed scans the buckets every Interval and feeds the repairs
+func (scanner *Scanner) CreateFeed() <-chan *model.WALEntry {
+	feed := make(chan *model.WALEntry)
+	go func() {
+		for {
+			scanner.ScanAll(feed)
+			time.Sleep(scanner.config.Interval)
+		}
+	}()
+	return feed
+}
+
+// ScanAll scans the configured buckets one by one
+func (scanner *Scanner) ScanAll(feed chan<- *model.WALEntry) {
+	for _, bucket := range scanner.config.Buckets {
+		if err := scanner.ScanBucket(bucket, feed); err != nil {
+			log.Printf("Scan of bucket '%s' in domain '%s' failed: %s", bucket.Bucket, bucket.Domain, err)
+		}
+	}
+}
+
+// ScanBucket compares the storages of all the shards of the bucket's domain in parallel
+func (scanner *Scanner) ScanBucket(bucket config.ScannedBucket, feed chan<- *model.WALEntry) error {
+	ring, err := scanner.resolver.GetShardsRing(bucket.Domain)
+	if err != nil {
+		return err
+	}
+	report := scanner.state.startReport(bucket, time.Now())
+	shards := ring.GetShards()
+	errs := make(chan error, len(shards))
+	wg := sync.WaitGroup{}
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard storages.NamedShardClient) {
+			defer wg.Done()
+			if err := scanner.scanShard(bucket, shard, report, feed); err != nil {
+				errs <- fmt.Errorf("shard '%s': %s", shard.Name(), err)
+			}
+		}(shard)
+	}
+	wg.Wait()
+	close(errs)
+	err = <-errs
+	if err == nil {
+		scanner.state.finishReport(report, time.Now())
+		log.Printf("Scan of bucket '%s' in domain '%s' finished: %d objects, divergent %v, %d unrepairable, %d errors",
+			bucket.Bucket, bucket.Domain, report.Scanned, report.Divergent, report.Unrepairable, report.Errors)
+	}
+	if saveErr := scanner.state.save(); saveErr != nil {
+		log.Printf("Could not save scanner checkpoints: %s", saveErr)
+	}
+	return err
+}
+
+func (scanner *Scanner) scanShard(bucket config.ScannedBucket, shard storages.NamedShardClient,
+	report *BucketReport, feed chan<- *model.WALEntry) error {
+	checkpoint := checkpointName(bucket, shard.Name())
+	marker := scanner.state.checkpoint(checkpoint)
+	var listings []*listing
+	for _, backend := range shard.Backends() {
+		client, err := scanner.resolver.ResolveClientForBackend(backend.Name, backend.Endpoint.String(), bucket.AccessKey)
+		if err != nil {
+			return fmt.Errorf("failed to resolve credentials for %s: %s", backend.Name, err)
+		}
+		storage, err := store.ForClient(client)
+		if err != nil {
+			return fmt.Errorf("failed to open storage of %s: %s", backend.Name, err)
+		}
+		listings = append(listings, &listing{store: storage, endpoint: client.S3Endpoint,
+			bucket: bucket.Bucket, marker: marker, truncated: true})
+	}
+
+	for compared := 1; ; compared++ {
+		if err := scanner.fill(listings); err != nil {
+			return err
+		}
+		key, objects := nextKey(listings)
+		if objects == nil {
+			break
+		}
+		scanner.compare(bucket, key, listings, objects, report, feed)
+		if compared%scanner.config.ListPageSize == 0 {
+			scanner.state.setCheckpoint(checkpoint, key)
+			if err := scanner.state.save(); err != nil {
+				log.Printf("Could not save scanner checkpoints: %s", err)
+			}
+		}
+	}
+	scanner.state.setCheckpoint(checkpoint, "")
+	return nil
+}
+
+// fill lists the next pages of the storages which ran out of listed keys in parallel
+func (scanner *Scanner) fill(listings []*listing) error {
+	errs := make(chan error, len(listings))
+	wg := sync.WaitGroup{}
+	for _, storageListing := range listings {
+		if len(storageListing.keys) > 0 || !storageListing.truncated {
+			continue
+		}
+		wg.Add(1)
+		go func(storageListing *listing) {
+			defer wg.Done()
+			scanner.listLimiter.wait()
+			if err := storageListing.next(scanner.config.ListPageSize); err != nil {
+				errs <- model.NewBackendError(storageListing.endpoint, err)
+			}
+		}(storageListing)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// compare reads the versions of copies differing in the listings (or of all of them if CompareVersions is set)
+// and emits a repair of the highest version found
+func (scanner *Scanner) compare(bucket config.ScannedBucket, key string, listings []*listing, objects []*store.ObjectInfo,
+	report *BucketReport, feed chan<- *model.WALEntry) {
+	divergence := divergenceOf(objects)
+	if divergence == "" && !scanner.config.CompareVersions {
+		scanner.state.update(report, func(report *BucketReport) { report.Scanned++ })
+		return
+	}
+	versions, err := scanner.versions(listings, objects, key)
+	if err != nil {
+		log.Printf("Scanner could not read versions of '%s/%s' in domain '%s': %s", bucket.Bucket, key, bucket.Domain, err)
+		scanner.state.update(report, func(report *BucketReport) { report.Scanned++; report.Errors++ })
+		return
+	}
+	maxVersion := noVersion
+	for _, version := range versions {
+		if divergence == "" && version != versions[0] {
+			divergence = VersionMismatch
+		}
+		if version > maxVersion {
+			maxVersion = version
+		}
+	}
+	scanner.state.update(report, func(report *BucketReport) {
+		report.Scanned++
+		if divergence != "" {
+			report.Divergent[divergence]++
+		}
+		if divergence != "" && maxVersion == noVersion {
+			report.Unrepairable++
+		}
+	})
+	if divergence == "" || maxVersion == noVersion {
+		return
+	}
+	log.Debugf("Object '%s/%s' in domain '%s' diverged (%s), repairing version %d",
+		bucket.Bucket, key, bucket.Domain, divergence, maxVersion)
+	scanner.repairLimiter.wait()
+	metrics.Mark(fmt.Sprintf("scanner.%s.%s.repairs", metrics.Clean(bucket.Domain), metrics.Clean(bucket.Bucket)))
+	feed <- scanner.repairEntry(bucket, key, maxVersion, report)
+}
+
+// versions reads the version headers of the copies present on the storages
+func (scanner *Scanner) versions(listings []*listing, objects []*store.ObjectInfo, key string) ([]int, error) {
+	var versions []int
+	for idx, object := range objects {
+		if object == nil {
+			continue
+		}
+		scanner.listLimiter.wait()
+		info, err := listings[idx].store.Head(listings[idx].bucket, key)
+		if err != nil {
+			return nil, model.NewBackendError(listings[idx].endpoint, err)
+		}
+		version, err := strconv.Atoi(info.Header.Get(scanner.versionHeaderName))
+		if err != nil {
+			version = noVersion
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// IsRepair tells whether the record was fed by the scanner
+func IsRepair(record *watchdog.ConsistencyRecord) bool {
+	return strings.HasPrefix(record.RequestID, RepairRequestIDPrefix)
+}
+
+func (scanner *Scanner) repairEntry(bucket config.ScannedBucket, key string, version int, report *BucketReport) *model.WALEntry {
+	return &model.WALEntry{
+		Record: &watchdog.ConsistencyRecord{
+			RequestID:     RepairRequestIDPrefix + uuid.Must(uuid.NewV4()).String(),
+			ObjectID:      bucket.Bucket + "/" + key,
+			Method:        watchdog.PUT,
+			Domain:        bucket.Domain,
+			AccessKey:     bucket.AccessKey,
+			ObjectVersion: version,
+			Operation:     watchdog.ObjectOperation,
+		},
+		RecordProcessedHook: func(record *watchdog.ConsistencyRecord, err error) error {
+			if err != nil {
+				log.Printf("Scanner repair of '%s' in domain '%s' failed: %s", record.ObjectID, record.Domain, err)
+			}
+			scanner.state.update(report, func(report *BucketReport) {
+				report.Repairs++
+				if err != nil {
+					report.FailedRepairs++
+				}
+			})
+			return nil
+		},
+	}
+}
+
+// divergenceOf compares the listed copies, nil stands for a missing copy
+func divergenceOf(objects []*store.ObjectInfo) string {
+	for _, object := range objects {
+		if object == nil {
+			return MissingObject
+		}
+	}
+	for _, object := range objects[1:] {
+		if object.Size != objects[0].Size {
+			return SizeMismatch
+		}
+		if !brimS3.ETagsMatch(objects[0].ETag, object.ETag) {
+			return ETagMismatch
+		}
+	}
+	return ""
+}
+
+// listing pages through the keys of a bucket on a single storage
+type listing struct {
+	store     store.ObjectStore
+	endpoint  string
+	bucket    string
+	marker    string
+	keys      []store.ObjectInfo
+	truncated bool
+}
+
+func (storageListing *listing) next(pageSize int) error {
+	result, err := storageListing.store.List(storageListing.bucket, storageListing.marker, pageSize)
+	if err != nil {
+		if store.IsNotFound(err) {
+			// a missing bucket lacks all the objects, it's created by the first repair
+			storageListing.truncated = false
+			return nil
+		}
+		return err
+	}
+	storageListing.keys = result.Objects
+	storageListing.truncated = result.Truncated && len(result.Objects) > 0
+	if len(result.Objects) > 0 {
+		storageListing.marker = result.Objects[len(result.Objects)-1].Key
+	}
+	return nil
+}
+
+// nextKey takes the lowest key listed by the storages, objects are nil if all the listings are exhausted
+func nextKey(listings []*listing) (string, []*store.ObjectInfo) {
+	var key string
+	found := false
+	for _, storageListing := range listings {
+		if len(storageListing.keys) > 0 && (!found || storageListing.keys[0].Key < key) {
+			key, found = storageListing.keys[0].Key, true
+		}
+	}
+	if !found {
+		return "", nil
+	}
+	objects := make([]*store.ObjectInfo, len(listings))
+	for idx, storageListing := range listings {
+		if len(storageListing.keys) > 0 && storageListing.keys[0].Key == key {
+			objects[idx] = &storageListing.keys[0]
+			storageListing.keys = storageListing.keys[1:]
+		}
+	}
+	return key, objects
+}
+
+// rateLimiter spaces out the calls evenly, nil doesn't limit them
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	mx       sync.Mutex
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+func (limiter *rateLimiter) wait() {
+	if limiter == nil {
+		return
+	}
+	limiter.mx.Lock()
+	defer limiter.mx.Unlock()
+	now := time.Now()
+	if limiter.next.After(now) {
+		time.Sleep(limiter.next.Sub(now))
+		now = limiter.next
+	}
+	limiter.next = now.Add(limiter.interval)
+}
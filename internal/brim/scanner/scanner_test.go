@@ -0,0 +1,232 @@
+package scanner
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/sharding"
+	"github.com/allegro/akubra/internal/akubra/storages"
+	"github.com/allegro/akubra/internal/brim/config"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type storedObject struct {
+	size    int64
+	etag    string
+	version int
+}
+
+type listedStorage struct {
+	objects map[string]storedObject
+	markers []string
+	mx      sync.Mutex
+}
+
+func (storage *listedStorage) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	storage.mx.Lock()
+	defer storage.mx.Unlock()
+	key := strings.TrimPrefix(req.URL.Path, "/bucket/")
+	if req.Method == http.MethodHead {
+		if object := storage.objects[key]; object.version != noVersion {
+			rw.Header().Set("x-amz-meta-version", strconv.Itoa(object.version))
+		}
+		return
+	}
+	marker := req.URL.Query().Get("marker")
+	maxKeys, _ := strconv.Atoi(req.URL.Query().Get("max-keys"))
+	storage.markers = append(storage.markers, marker)
+	var keys []string
+	for key := range storage.objects {
+		if key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := s3.ListResp{IsTruncated: len(keys) > maxKeys}
+	if result.IsTruncated {
+		keys = keys[:maxKeys]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, s3.Key{Key: key, Size: storage.objects[key].size, ETag: storage.objects[key].etag})
+	}
+	_ = xml.NewEncoder(rw).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3.ListResp
+	}{ListResp: result})
+}
+
+type testShard struct {
+	storages.NamedShardClient
+	name     string
+	backends []*storages.StorageClient
+}
+
+func (shard *testShard) Name() string                        { return shard.name }
+func (shard *testShard) Backends() []*storages.StorageClient { return shard.backends }
+
+type testRing struct {
+	sharding.ShardsRingAPI
+	shards map[string]storages.NamedShardClient
+}
+
+func (ring *testRing) GetShards() map[string]storages.NamedShardClient { return ring.shards }
+
+type testResolver struct {
+	ring *testRing
+}
+
+func (resolver *testResolver) ResolveClientForHost(hostURL, key, access string) (*s3.S3, error) {
+	return resolver.ResolveClientForBackend("", hostURL, access)
+}
+
+func (resolver *testResolver) ResolveClientForBackend(backendName, hostURL, access string) (*s3.S3, error) {
+	return s3.New(aws.Auth{AccessKey: access, SecretKey: "secret"}, aws.Region{Name: "generic", S3Endpoint: hostURL}), nil
+}
+
+func (resolver *testResolver) GetShardsRing(domain string) (sharding.ShardsRingAPI, error) {
+	return resolver.ring, nil
+}
+
+func shardOf(t *testing.T, name string, storedOn ...*listedStorage) (*testShard, func()) {
+	shard := &testShard{name: name}
+	var servers []*httptest.Server
+	for idx, storage := range storedOn {
+		server := httptest.NewServer(storage)
+		servers = append(servers, server)
+		endpoint, err := url.Parse(server.URL)
+		require.NoError(t, err)
+		shard.backends = append(shard.backends, &storages.StorageClient{Name: name + "-" + strconv.Itoa(idx), Endpoint: *endpoint})
+	}
+	return shard, func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+}
+
+func scan(t *testing.T, scannerConf config.ScannerConf, shards ...*testShard) []*model.WALEntry {
+	ring := &testRing{shards: make(map[string]storages.NamedShardClient)}
+	for _, shard := range shards {
+		ring.shards[shard.name] = shard
+	}
+	scanner, err := NewScanner(&testResolver{ring: ring}, scannerConf, "x-amz-meta-version")
+	require.NoError(t, err)
+	feed := make(chan *model.WALEntry, 100)
+	scanner.ScanAll(feed)
+	close(feed)
+	var entries []*model.WALEntry
+	for entry := range feed {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Record.ObjectID < entries[j].Record.ObjectID })
+	return entries
+}
+
+func checkpointPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "scanner")
+	require.NoError(t, err)
+	return filepath.Join(dir, "checkpoints.json"), func() { _ = os.RemoveAll(dir) }
+}
+
+var scannedBucket = config.ScannedBucket{Domain: "example.com", Bucket: "bucket", AccessKey: "access"}
+
+func TestShouldEmitRepairsOfDivergentObjects(t *testing.T) {
+	first := &listedStorage{objects: map[string]storedObject{
+		"a": {size: 1, etag: `"a"`, version: 1},
+		"b": {size: 2, etag: `"b"`, version: 2},
+		"c": {size: 3, etag: `"c"`, version: 3},
+		"d": {size: 4, etag: `"d"`, version: noVersion},
+		"e": {size: 5, etag: `"e"`, version: 5},
+	}}
+	second := &listedStorage{objects: map[string]storedObject{
+		"a": {size: 1, etag: `"a"`, version: 1},
+		"c": {size: 30, etag: `"c"`, version: 4},
+		"d": {size: 4, etag: `"dd"`, version: noVersion},
+		"e": {size: 5, etag: `"e"`, version: 5},
+		"f": {size: 6, etag: `"f"`, version: 6},
+	}}
+	shard, closeShard := shardOf(t, "shard", first, second)
+	defer closeShard()
+	checkpointFile, removeCheckpoints := checkpointPath(t)
+	defer removeCheckpoints()
+
+	entries := scan(t, config.ScannerConf{Buckets: []config.ScannedBucket{scannedBucket}, ListPageSize: 2,
+		CheckpointFile: checkpointFile}, shard)
+
+	require.Len(t, entries, 3)
+	for idx, expected := range []struct {
+		objectID string
+		version  int
+	}{{"bucket/b", 2}, {"bucket/c", 4}, {"bucket/f", 6}} {
+		assert.Equal(t, expected.objectID, entries[idx].Record.ObjectID)
+		assert.Equal(t, expected.version, entries[idx].Record.ObjectVersion)
+		assert.Equal(t, "example.com", entries[idx].Record.Domain)
+		assert.Equal(t, "access", entries[idx].Record.AccessKey)
+	}
+	assert.Equal(t, []string{"", "b", "d"}, first.markers)
+
+	assert.NoError(t, entries[0].RecordProcessedHook(entries[0].Record, nil))
+	state, err := LoadState(checkpointFile)
+	require.NoError(t, err)
+	assert.Empty(t, state.Checkpoints)
+	assert.Empty(t, state.Running)
+	report := state.Finished["example.com/bucket"]
+	require.NotNil(t, report)
+	assert.Equal(t, int64(6), report.Scanned)
+	assert.Equal(t, map[string]int64{MissingObject: 2, SizeMismatch: 1, ETagMismatch: 1}, report.Divergent)
+	assert.Equal(t, int64(1), report.Unrepairable)
+	assert.False(t, report.FinishedAt.IsZero())
+}
+
+func TestShouldCompareVersionsOfMatchingListings(t *testing.T) {
+	first := &listedStorage{objects: map[string]storedObject{"a": {size: 1, etag: `"a"`, version: 1}}}
+	second := &listedStorage{objects: map[string]storedObject{"a": {size: 1, etag: `"a"`, version: 2}}}
+	shard, closeShard := shardOf(t, "shard", first, second)
+	defer closeShard()
+	scannerConf := config.ScannerConf{Buckets: []config.ScannedBucket{scannedBucket}}
+
+	assert.Empty(t, scan(t, scannerConf, shard))
+
+	scannerConf.CompareVersions = true
+	entries := scan(t, scannerConf, shard)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 2, entries[0].Record.ObjectVersion)
+}
+
+func TestShouldResumeScanFromCheckpoint(t *testing.T) {
+	storage := &listedStorage{objects: map[string]storedObject{"a": {size: 1, version: 1}, "b": {size: 2, version: 2}}}
+	empty := &listedStorage{objects: map[string]storedObject{}}
+	shard, closeShard := shardOf(t, "shard", storage, empty)
+	defer closeShard()
+	otherStorage := &listedStorage{objects: map[string]storedObject{"z": {size: 1, version: 1}}}
+	otherShard, closeOtherShard := shardOf(t, "other", otherStorage)
+	defer closeOtherShard()
+	checkpointFile, removeCheckpoints := checkpointPath(t)
+	defer removeCheckpoints()
+	state, err := LoadState(checkpointFile)
+	require.NoError(t, err)
+	state.setCheckpoint(checkpointName(scannedBucket, "shard"), "a")
+	require.NoError(t, state.save())
+
+	entries := scan(t, config.ScannerConf{Buckets: []config.ScannedBucket{scannedBucket}, CheckpointFile: checkpointFile},
+		shard, otherShard)
+
+	require.Len(t, entries, 1)
+	assert.Equal(t, "bucket/b", entries[0].Record.ObjectID)
+	assert.Equal(t, []string{"a"}, storage.markers)
+	assert.Equal(t, []string{""}, otherStorage.markers)
+}
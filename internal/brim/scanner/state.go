@@ -0,0 +1,171 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/brim/config"
+)
+
+// Kinds of divergence between the copies of an object
+const (
+	MissingObject   = "missing"
+	SizeMismatch    = "size"
+	ETagMismatch    = "etag"
+	VersionMismatch = "version"
+)
+
+// BucketReport sums up the divergence of a bucket found by a scan
+type BucketReport struct {
+	Domain    string    `json:"domain"`
+	Bucket    string    `json:"bucket"`
+	StartedAt time.Time `json:"started_at"`
+	// FinishedAt is zero until all the shards are scanned
+	FinishedAt time.Time `json:"finished_at"`
+	Scanned    int64     `json:"scanned"`
+	// Divergent counts the objects by the kind of divergence
+	Divergent map[string]int64 `json:"divergent"`
+	// Unrepairable objects have no version header on any storage, so the filter can't pick the source
+	Unrepairable  int64 `json:"unrepairable"`
+	Errors        int64 `json:"errors"`
+	Repairs       int64 `json:"repairs"`
+	FailedRepairs int64 `json:"failed_repairs"`
+}
+
+// State keeps the checkpoints and reports of scans, it's saved in a file to resume interrupted scans
+type State struct {
+	// Checkpoints are the last keys compared on the shards of the buckets being scanned
+	Checkpoints map[string]string `json:"checkpoints"`
+	// Running are the reports of the scans in progress
+	Running map[string]*BucketReport `json:"running"`
+	// Finished are the reports of the last complete scans
+	Finished map[string]*BucketReport `json:"finished"`
+	path     string
+	mx       sync.Mutex
+}
+
+// LoadState reads the state saved in the file, the state isn't saved if the path is empty
+func LoadState(path string) (*State, error) {
+	state := &State{
+		Checkpoints: make(map[string]string),
+		Running:     make(map[string]*BucketReport),
+		Finished:    make(map[string]*BucketReport),
+		path:        path,
+	}
+	if path == "" {
+		return state, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("malformed scanner checkpoint file %s: %s", path, err)
+	}
+	return state, nil
+}
+
+// Reports returns copies of the last finished reports
+func (state *State) Reports() []BucketReport {
+	state.mx.Lock()
+	defer state.mx.Unlock()
+	reports := make([]BucketReport, 0, len(state.Finished))
+	for _, report := range state.Finished {
+		reports = append(reports, *report)
+	}
+	return reports
+}
+
+func (state *State) save() error {
+	if state.path == "" {
+		return nil
+	}
+	state.mx.Lock()
+	content, err := json.Marshal(state)
+	state.mx.Unlock()
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(state.path), filepath.Base(state.path))
+	if err != nil {
+		return err
+	}
+	if _, err = temporary.Write(content); err != nil {
+		_ = temporary.Close()
+		_ = os.Remove(temporary.Name())
+		return err
+	}
+	if err = temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), state.path)
+}
+
+func (state *State) checkpoint(name string) string {
+	state.mx.Lock()
+	defer state.mx.Unlock()
+	return state.Checkpoints[name]
+}
+
+func (state *State) setCheckpoint(name, key string) {
+	state.mx.Lock()
+	defer state.mx.Unlock()
+	if key == "" {
+		delete(state.Checkpoints, name)
+		return
+	}
+	state.Checkpoints[name] = key
+}
+
+// startReport resumes the report of an interrupted scan of the bucket or starts a new one
+func (state *State) startReport(bucket config.ScannedBucket, now time.Time) *BucketReport {
+	state.mx.Lock()
+	defer state.mx.Unlock()
+	name := bucketName(bucket)
+	if report, ok := state.Running[name]; ok {
+		return report
+	}
+	report := &BucketReport{Domain: bucket.Domain, Bucket: bucket.Bucket, StartedAt: now, Divergent: make(map[string]int64)}
+	state.Running[name] = report
+	return report
+}
+
+func (state *State) finishReport(report *BucketReport, now time.Time) {
+	state.mx.Lock()
+	defer state.mx.Unlock()
+	name := bucketName(config.ScannedBucket{Domain: report.Domain, Bucket: report.Bucket})
+	report.FinishedAt = now
+	delete(state.Running, name)
+	state.Finished[name] = report
+
+	prefix := fmt.Sprintf("scanner.%s.%s", metrics.Clean(report.Domain), metrics.Clean(report.Bucket))
+	metrics.UpdateGauge(prefix+".scanned", report.Scanned)
+	for _, kind := range []string{MissingObject, SizeMismatch, ETagMismatch, VersionMismatch} {
+		metrics.UpdateGauge(fmt.Sprintf("%s.divergent.%s", prefix, kind), report.Divergent[kind])
+	}
+	metrics.UpdateGauge(prefix+".unrepairable", report.Unrepairable)
+}
+
+// update changes the report under the state's lock, as shards are scanned in parallel
+func (state *State) update(report *BucketReport, change func(report *BucketReport)) {
+	state.mx.Lock()
+	defer state.mx.Unlock()
+	change(report)
+}
+
+func bucketName(bucket config.ScannedBucket) string {
+	return bucket.Domain + "/" + bucket.Bucket
+}
+
+func checkpointName(bucket config.ScannedBucket, shard string) string {
+	return bucketName(bucket) + "/" + shard
+}
@@ -0,0 +1,257 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/config"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/allegro/akubra/internal/brim/scanner"
+)
+
+// DefaultClass holds the records matching none of the configured classes
+const DefaultClass = "default"
+
+const (
+	defaultMaxWait  = time.Minute
+	defaultCapacity = 1000
+	// anyKey names the queue of a class when the records aren't shared by a fairness key
+	anyKey = "all"
+)
+
+// QueueStatus is the state of a queue of the scheduler
+type QueueStatus struct {
+	Class string `json:"class"`
+	Key   string `json:"key"`
+	Depth int    `json:"depth"`
+	// OldestWait is the time the first record of the queue has been waiting
+	OldestWait string `json:"oldest_wait"`
+}
+
+// Scheduler queues the fed records by their priority class and fairness key. The classes are served in their order
+// and the queues of a class take turns, but a queue which first record waited longer than MaxWait is served first.
+// The consistency log feeders hand over the next batch once the records of the pending ones are processed, so
+// the scheduler orders records of at most WAL.FeederMaxPendingBatches batches (one with SQLite or the embedded log)
+type Scheduler struct {
+	config   config.SchedulerConf
+	classes  []*class
+	queued   int
+	closed   bool
+	changed  *sync.Cond
+	mx       sync.Mutex
+	maxWait  time.Duration
+	capacity int
+}
+
+type class struct {
+	config.PriorityClass
+	queues map[string]*keyQueue
+	// turns are the keys of the queues in the order they are served
+	turns []string
+	next  int
+}
+
+type keyQueue struct {
+	class, key string
+	items      []queuedItem
+}
+
+type queuedItem struct {
+	item     interface{}
+	queuedAt time.Time
+}
+
+// NewScheduler creates a Scheduler of the configured classes followed by the DefaultClass
+func NewScheduler(schedulerConf config.SchedulerConf) *Scheduler {
+	scheduler := &Scheduler{config: schedulerConf, maxWait: schedulerConf.MaxWait, capacity: schedulerConf.Capacity}
+	if scheduler.maxWait == 0 {
+		scheduler.maxWait = defaultMaxWait
+	}
+	if scheduler.capacity == 0 {
+		scheduler.capacity = defaultCapacity
+	}
+	priorityClasses := append(append([]config.PriorityClass{}, schedulerConf.Classes...), config.PriorityClass{Name: DefaultClass})
+	for _, priorityClass := range priorityClasses {
+		scheduler.classes = append(scheduler.classes, &class{PriorityClass: priorityClass, queues: make(map[string]*keyQueue)})
+	}
+	scheduler.changed = sync.NewCond(&scheduler.mx)
+	return scheduler
+}
+
+// Schedule queues the items of the feed and emits them in the scheduled order,
+// the returned channel is closed once the feed is closed and the queues are empty
+func (scheduler *Scheduler) Schedule(feed <-chan interface{}) <-chan interface{} {
+	scheduled := make(chan interface{})
+	go func() {
+		for item := range feed {
+			scheduler.enqueue(item)
+		}
+		scheduler.mx.Lock()
+		scheduler.closed = true
+		scheduler.changed.Broadcast()
+		scheduler.mx.Unlock()
+	}()
+	go func() {
+		defer close(scheduled)
+		for {
+			item, ok := scheduler.dequeue()
+			if !ok {
+				return
+			}
+			scheduled <- item
+		}
+	}()
+	return scheduled
+}
+
+// Queues returns the state of the non empty queues
+func (scheduler *Scheduler) Queues() []QueueStatus {
+	scheduler.mx.Lock()
+	defer scheduler.mx.Unlock()
+	statuses := make([]QueueStatus, 0)
+	now := time.Now()
+	for _, class := range scheduler.classes {
+		keys := append([]string{}, class.turns...)
+		sort.Strings(keys)
+		for _, key := range keys {
+			queue := class.queues[key]
+			statuses = append(statuses, QueueStatus{Class: queue.class, Key: queue.key, Depth: len(queue.items),
+				OldestWait: now.Sub(queue.items[0].queuedAt).String()})
+		}
+	}
+	return statuses
+}
+
+func (scheduler *Scheduler) enqueue(item interface{}) {
+	scheduler.mx.Lock()
+	defer scheduler.mx.Unlock()
+	for scheduler.queued >= scheduler.capacity {
+		scheduler.changed.Wait()
+	}
+	class, key := scheduler.classify(item)
+	queue, ok := class.queues[key]
+	if !ok {
+		queue = &keyQueue{class: class.Name, key: key}
+		class.queues[key] = queue
+		class.turns = append(class.turns, key)
+	}
+	queue.items = append(queue.items, queuedItem{item: item, queuedAt: time.Now()})
+	scheduler.queued++
+	metrics.UpdateGauge(queue.metricName("depth"), int64(len(queue.items)))
+	scheduler.changed.Broadcast()
+}
+
+func (scheduler *Scheduler) dequeue() (interface{}, bool) {
+	scheduler.mx.Lock()
+	defer scheduler.mx.Unlock()
+	for scheduler.queued == 0 && !scheduler.closed {
+		scheduler.changed.Wait()
+	}
+	if scheduler.queued == 0 {
+		return nil, false
+	}
+	class, queue := scheduler.nextQueue(time.Now())
+	next := queue.items[0]
+	queue.items = queue.items[1:]
+	if len(queue.items) == 0 {
+		class.remove(queue.key)
+	}
+	scheduler.queued--
+	metrics.UpdateGauge(queue.metricName("depth"), int64(len(queue.items)))
+	metrics.UpdateSince(queue.metricName("wait"), next.queuedAt)
+	scheduler.changed.Broadcast()
+	return next.item, true
+}
+
+// nextQueue picks the queue waiting longer than MaxWait or else the next queue of the first non empty class
+func (scheduler *Scheduler) nextQueue(now time.Time) (*class, *keyQueue) {
+	var oldestClass *class
+	var oldest *keyQueue
+	for _, class := range scheduler.classes {
+		for _, queue := range class.queues {
+			if oldest == nil || queue.items[0].queuedAt.Before(oldest.items[0].queuedAt) {
+				oldestClass, oldest = class, queue
+			}
+		}
+	}
+	if now.Sub(oldest.items[0].queuedAt) >= scheduler.maxWait {
+		metrics.Mark("watchdog.scheduler.starved")
+		return oldestClass, oldest
+	}
+	for _, class := range scheduler.classes {
+		if len(class.turns) > 0 {
+			class.next %= len(class.turns)
+			queue := class.queues[class.turns[class.next]]
+			class.next++
+			return class, queue
+		}
+	}
+	return oldestClass, oldest
+}
+
+func (scheduler *Scheduler) classify(item interface{}) (*class, string) {
+	defaultClass := scheduler.classes[len(scheduler.classes)-1]
+	entry, ok := item.(*model.WALEntry)
+	if !ok {
+		return defaultClass, anyKey
+	}
+	key := anyKey
+	switch scheduler.config.FairnessKey {
+	case config.DomainFairnessKey:
+		key = entry.Record.Domain
+	case config.AccessKeyFairnessKey:
+		key = entry.Record.AccessKey
+	}
+	if key == "" {
+		key = anyKey
+	}
+	for _, class := range scheduler.classes {
+		if class.matches(entry.Record) {
+			return class, key
+		}
+	}
+	return defaultClass, key
+}
+
+func (class *class) matches(record *watchdog.ConsistencyRecord) bool {
+	if class.Repairs && !scanner.IsRepair(record) {
+		return false
+	}
+	return matchesAny(class.Methods, string(record.Method)) &&
+		matchesAny(class.Operations, string(record.OperationOrDefault()))
+}
+
+// remove drops the empty queue, the queue after it takes the turn
+func (class *class) remove(key string) {
+	delete(class.queues, key)
+	for idx := range class.turns {
+		if class.turns[idx] != key {
+			continue
+		}
+		class.turns = append(class.turns[:idx], class.turns[idx+1:]...)
+		if idx < class.next {
+			class.next--
+		}
+		return
+	}
+}
+
+func (queue *keyQueue) metricName(metric string) string {
+	return fmt.Sprintf("watchdog.scheduler.%s.%s.%s", metrics.Clean(queue.class), metrics.Clean(queue.key), metric)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	akubraConfig "github.com/allegro/akubra/internal/akubra/config"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	wc "github.com/allegro/akubra/internal/akubra/watchdog/config"
+	"github.com/allegro/akubra/internal/brim/config"
+	"github.com/allegro/akubra/internal/brim/feeder"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/allegro/akubra/internal/brim/scanner"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var priorityClasses = []config.PriorityClass{
+	{Name: "repairs", Repairs: true},
+	{Name: "deletes", Methods: []string{"DELETE"}},
+}
+
+func scheduledEntry(requestID, domain string, method watchdog.Method) *model.WALEntry {
+	return &model.WALEntry{Record: &watchdog.ConsistencyRecord{RequestID: requestID, Domain: domain, Method: method,
+		ObjectID: "bucket/" + requestID}}
+}
+
+func dequeueAll(t *testing.T, scheduler *Scheduler) []string {
+	var requestIDs []string
+	for len(scheduler.Queues()) > 0 {
+		item, ok := scheduler.dequeue()
+		require.True(t, ok)
+		requestIDs = append(requestIDs, item.(*model.WALEntry).Record.RequestID)
+	}
+	return requestIDs
+}
+
+func TestSchedulerShouldServeClassesInTheirOrder(t *testing.T) {
+	scheduler := NewScheduler(config.SchedulerConf{Classes: priorityClasses})
+	scheduler.enqueue(scheduledEntry("put", "example.com", watchdog.PUT))
+	scheduler.enqueue(scheduledEntry("delete", "example.com", watchdog.DELETE))
+	scheduler.enqueue(scheduledEntry(scanner.RepairRequestIDPrefix+"repair", "example.com", watchdog.PUT))
+
+	assert.Equal(t, []string{scanner.RepairRequestIDPrefix + "repair", "delete", "put"}, dequeueAll(t, scheduler))
+}
+
+func TestSchedulerShouldShareClassesFairlyBetweenDomains(t *testing.T) {
+	scheduler := NewScheduler(config.SchedulerConf{FairnessKey: config.DomainFairnessKey})
+	for _, requestID := range []string{"bulk-1", "bulk-2", "bulk-3"} {
+		scheduler.enqueue(scheduledEntry(requestID, "bulk.example.com", watchdog.PUT))
+	}
+	scheduler.enqueue(scheduledEntry("other-1", "other.example.com", watchdog.PUT))
+	scheduler.enqueue(scheduledEntry("other-2", "other.example.com", watchdog.PUT))
+
+	queues := scheduler.Queues()
+	require.Len(t, queues, 2)
+	assert.Equal(t, DefaultClass, queues[0].Class)
+	assert.Equal(t, "bulk.example.com", queues[0].Key)
+	assert.Equal(t, 3, queues[0].Depth)
+	assert.Equal(t, []string{"bulk-1", "other-1", "bulk-2", "other-2", "bulk-3"}, dequeueAll(t, scheduler))
+}
+
+func TestSchedulerShouldServeRecordsWaitingLongerThanMaxWaitFirst(t *testing.T) {
+	scheduler := NewScheduler(config.SchedulerConf{Classes: priorityClasses, MaxWait: 20 * time.Millisecond})
+	scheduler.enqueue(scheduledEntry("put", "example.com", watchdog.PUT))
+	time.Sleep(30 * time.Millisecond)
+	scheduler.enqueue(scheduledEntry("delete", "example.com", watchdog.DELETE))
+
+	assert.Equal(t, []string{"put", "delete"}, dequeueAll(t, scheduler))
+}
+
+func TestSchedulerShouldEmitAllItemsAndCloseOnceTheFeedIsClosed(t *testing.T) {
+	scheduler := NewScheduler(config.SchedulerConf{Capacity: 1})
+	feed := make(chan interface{}, 3)
+	for _, requestID := range []string{"1", "2", "3"} {
+		feed <- scheduledEntry(requestID, "example.com", watchdog.PUT)
+	}
+	close(feed)
+
+	var requestIDs []string
+	for item := range scheduler.Schedule(feed) {
+		requestIDs = append(requestIDs, item.(*model.WALEntry).Record.RequestID)
+	}
+
+	assert.Equal(t, []string{"1", "2", "3"}, requestIDs)
+	assert.Empty(t, scheduler.Queues())
+}
+
+type dbClientFactoryStub struct {
+	db *gorm.DB
+}
+
+func (factory dbClientFactoryStub) CreateConnection(map[string]string) (*gorm.DB, error) {
+	return factory.db, nil
+}
+
+// enqueueTwoBatches queues the records of two consistency log batches, the first batch is still in progress
+// when the second one is queried
+func enqueueTwoBatches(t *testing.T, scheduler *Scheduler) {
+	db, dbMock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	gormDB, err := gorm.Open("postgres", db)
+	require.NoError(t, err)
+	columns := []string{"request_id", "object_id", "domain", "object_version", "execution_delay", "method"}
+	dbMock.ExpectBegin()
+	dbMock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow("put-1", "bucket/put-1", "example.com", 1, "0s", "PUT").
+		AddRow("put-2", "bucket/put-2", "example.com", 1, "0s", "PUT"))
+	dbMock.ExpectBegin()
+	dbMock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow("delete", "bucket/delete", "example.com", 1, "0s", "DELETE"))
+
+	walFeeder, err := feeder.NewSQLWALFeeder(&akubraConfig.Config{YamlConfig: akubraConfig.YamlConfig{
+		Watchdog: wc.WatchdogConfig{Type: "sql"}}},
+		&feeder.WALFeederConfig{MaxRecordsPerQuery: 2, MaxPendingBatches: 2}, dbClientFactoryStub{db: gormDB})
+	require.NoError(t, err)
+	feed := walFeeder.CreateFeed()
+	for queued := 0; queued < 3; queued++ {
+		select {
+		case entry := <-feed:
+			scheduler.enqueue(entry)
+		case <-time.After(time.Second):
+			t.Fatalf("second batch wasn't fed while the first one is in progress")
+		}
+	}
+}
+
+func TestSchedulerShouldOrderRecordsOfSeveralBatches(t *testing.T) {
+	scheduler := NewScheduler(config.SchedulerConf{Classes: priorityClasses})
+	enqueueTwoBatches(t, scheduler)
+
+	assert.Equal(t, []string{"delete", "put-1", "put-2"}, dequeueAll(t, scheduler))
+}
+
+func TestSchedulerShouldServeStarvedRecordsOfPendingBatchBeforeNextBatch(t *testing.T) {
+	scheduler := NewScheduler(config.SchedulerConf{Classes: priorityClasses, MaxWait: 20 * time.Millisecond})
+	enqueueTwoBatches(t, scheduler)
+	time.Sleep(30 * time.Millisecond)
+
+	assert.Equal(t, []string{"put-1", "put-2", "delete"}, dequeueAll(t, scheduler))
+}
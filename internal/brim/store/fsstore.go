@@ -0,0 +1,597 @@
+package store
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	metadataPrefix  = "x-amz-meta-"
+	temporaryPrefix = ".tmp-"
+	aclSubResource  = "acl"
+	localOwnerID    = "brim"
+	xmlNamespace    = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+const (
+	userGrant = `<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser">` +
+		`<ID>%s</ID></Grantee><Permission>%s</Permission></Grant>`
+	groupGrant = `<Grant><Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="Group">` +
+		`<URI>http://acs.amazonaws.com/groups/global/%s</URI></Grantee><Permission>%s</Permission></Grant>`
+)
+
+// storedHeaders are the headers of uploads kept with the objects, besides user metadata
+var storedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+	"X-Amz-Acl",
+	"X-Amz-Website-Redirect-Location",
+	"X-Amz-Storage-Class",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+}
+
+// FSStore keeps objects in a directory:
+//
+//	<root>/objects/<bucket>/<escaped key>   content of the objects
+//	<root>/metadata/<bucket>/<escaped key>  size, ETag, headers and sub-resources of the objects as JSON
+//	<root>/buckets/<bucket>/<sub-resource>  sub-resource documents of the buckets
+//	<root>/uploads/<upload id>/             parts of multipart uploads in progress
+//
+// Keys are path escaped, so the objects of a bucket are files of a single directory. The grants of buckets
+// and objects are owned by the 'brim' user
+type FSStore struct {
+	root string
+}
+
+type fsMetadata struct {
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"last_modified"`
+	Header       http.Header       `json:"header"`
+	SubResources map[string][]byte `json:"sub_resources,omitempty"`
+}
+
+type fsUpload struct {
+	Bucket string      `json:"bucket"`
+	Key    string      `json:"key"`
+	Header http.Header `json:"header"`
+}
+
+// NewFSStore creates a FSStore in the root directory
+func NewFSStore(root string) (*FSStore, error) {
+	for _, dir := range []string{"objects", "metadata", "buckets", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &FSStore{root: root}, nil
+}
+
+// Endpoint returns the 'file' URL of the root directory
+func (store *FSStore) Endpoint() string {
+	return (&url.URL{Scheme: LocalScheme, Path: store.root}).String()
+}
+
+// Head reads the metadata of the object
+func (store *FSStore) Head(bucket, key string) (ObjectInfo, error) {
+	metadata, err := store.metadata(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return metadata.objectInfo(key), nil
+}
+
+// Get opens the object or its range
+func (store *FSStore) Get(bucket, key string, offset, length int64) (io.ReadCloser, ObjectInfo, error) {
+	metadata, err := store.metadata(bucket, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if offset < 0 || offset > metadata.Size {
+		return nil, ObjectInfo{}, fmt.Errorf("range from %d is out of the object of %d bytes", offset, metadata.Size)
+	}
+	if length < 0 || offset+length > metadata.Size {
+		length = metadata.Size - offset
+	}
+	file, err := os.Open(store.objectPath(bucket, key))
+	if err != nil {
+		return nil, ObjectInfo{}, notFound(err)
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return limitedFile{Reader: io.LimitReader(file, length), Closer: file}, metadata.objectInfo(key), nil
+}
+
+// Put stores the object replacing its previous content, sub-resources and headers
+func (store *FSStore) Put(bucket, key string, body io.Reader, size int64, header http.Header) error {
+	if err := store.checkBucket(bucket); err != nil {
+		return err
+	}
+	objectPath, err := store.checkedObjectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	checksum := md5.New()
+	written, err := writeFile(objectPath, io.TeeReader(body, checksum))
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		_ = os.Remove(objectPath)
+		return fmt.Errorf("object body has %d bytes instead of %d", written, size)
+	}
+	return store.saveMetadata(bucket, key, &fsMetadata{
+		Size:         written,
+		ETag:         `"` + hex.EncodeToString(checksum.Sum(nil)) + `"`,
+		LastModified: time.Now().UTC(),
+		Header:       keptHeaders(header),
+	})
+}
+
+// Delete removes the object, missing objects are ignored like by S3
+func (store *FSStore) Delete(bucket, key string) error {
+	if err := store.checkBucket(bucket); err != nil {
+		return err
+	}
+	objectPath, err := store.checkedObjectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{store.metadataPath(bucket, key), objectPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List lists a page of objects
+func (store *FSStore) List(bucket, marker string, limit int) (ListResult, error) {
+	if err := store.checkBucket(bucket); err != nil {
+		return ListResult{}, err
+	}
+	files, err := ioutil.ReadDir(filepath.Join(store.root, "objects", bucket))
+	if err != nil {
+		return ListResult{}, notFound(err)
+	}
+	var keys []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), temporaryPrefix) {
+			continue
+		}
+		if key, err := url.PathUnescape(file.Name()); err == nil && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := ListResult{Truncated: len(keys) > limit}
+	if result.Truncated {
+		keys = keys[:limit]
+	}
+	for _, key := range keys {
+		metadata, err := store.metadata(bucket, key)
+		if IsNotFound(err) {
+			// the object was removed in the meantime
+			continue
+		}
+		if err != nil {
+			return ListResult{}, err
+		}
+		info := metadata.objectInfo(key)
+		info.Header = nil
+		result.Objects = append(result.Objects, info)
+	}
+	return result, nil
+}
+
+// CreateBucket creates the directories of the bucket
+func (store *FSStore) CreateBucket(bucket string, header http.Header) error {
+	if !validBucket(bucket) {
+		return fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	for _, dir := range []string{"objects", "metadata", "buckets"} {
+		if err := os.MkdirAll(filepath.Join(store.root, dir, bucket), 0755); err != nil {
+			return err
+		}
+	}
+	if acl := header.Get("X-Amz-Acl"); acl != "" {
+		return store.PutCannedACL(bucket, "", acl)
+	}
+	return nil
+}
+
+// BucketExists checks if the bucket was created
+func (store *FSStore) BucketExists(bucket string) (bool, error) {
+	err := store.checkBucket(bucket)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteBucket removes an empty bucket
+func (store *FSStore) DeleteBucket(bucket string) error {
+	result, err := store.List(bucket, "", 1)
+	if err != nil {
+		return err
+	}
+	if len(result.Objects) > 0 {
+		return errors.New("bucket is not empty")
+	}
+	for _, dir := range []string{"objects", "metadata", "buckets"} {
+		if err := os.RemoveAll(filepath.Join(store.root, dir, bucket)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitiateMultipart creates the directory of the upload's parts
+func (store *FSStore) InitiateMultipart(bucket, key string, header http.Header) (string, error) {
+	if err := store.checkBucket(bucket); err != nil {
+		return "", err
+	}
+	if _, err := store.checkedObjectPath(bucket, key); err != nil {
+		return "", err
+	}
+	uploadID := uuid.Must(uuid.NewV4()).String()
+	uploadPath, err := store.uploadPath(uploadID)
+	if err != nil {
+		return "", err
+	}
+	if err = os.Mkdir(uploadPath, 0755); err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(fsUpload{Bucket: bucket, Key: key, Header: keptHeaders(header)})
+	if err != nil {
+		return "", err
+	}
+	if _, err = writeFile(filepath.Join(uploadPath, "upload.json"), strings.NewReader(string(content))); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// UploadPart stores the part of the upload
+func (store *FSStore) UploadPart(bucket, key, uploadID string, number int, body io.Reader, size int64) (Part, error) {
+	uploadPath, err := store.uploadPath(uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	if _, err = store.upload(bucket, key, uploadID); err != nil {
+		return Part{}, err
+	}
+	checksum := md5.New()
+	written, err := writeFile(partPath(uploadPath, number), io.TeeReader(body, checksum))
+	if err != nil {
+		return Part{}, err
+	}
+	if size >= 0 && written != size {
+		return Part{}, fmt.Errorf("part %d has %d bytes instead of %d", number, written, size)
+	}
+	return Part{Number: number, ETag: `"` + hex.EncodeToString(checksum.Sum(nil)) + `"`, Size: written}, nil
+}
+
+// CompleteMultipart joins the parts into the object, the ETag follows S3: MD5 of the parts' MD5s and their count
+func (store *FSStore) CompleteMultipart(bucket, key, uploadID string, parts []Part) error {
+	uploadPath, err := store.uploadPath(uploadID)
+	if err != nil {
+		return err
+	}
+	upload, err := store.upload(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	var readers []io.Reader
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+	checksums := md5.New()
+	for _, part := range parts {
+		content, err := os.Open(partPath(uploadPath, part.Number))
+		if err != nil {
+			return fmt.Errorf("part %d of upload %s: %s", part.Number, uploadID, notFound(err))
+		}
+		files = append(files, content)
+		partChecksum, err := hex.DecodeString(strings.Trim(part.ETag, `"`))
+		if err != nil {
+			return fmt.Errorf("malformed ETag of part %d: %s", part.Number, part.ETag)
+		}
+		checksums.Write(partChecksum)
+		readers = append(readers, content)
+	}
+	written, err := writeFile(store.objectPath(bucket, key), io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	err = store.saveMetadata(bucket, key, &fsMetadata{
+		Size:         written,
+		ETag:         fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(checksums.Sum(nil)), len(parts)),
+		LastModified: time.Now().UTC(),
+		Header:       upload.Header,
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(uploadPath)
+}
+
+// AbortMultipart removes the parts of the upload
+func (store *FSStore) AbortMultipart(bucket, key, uploadID string) error {
+	uploadPath, err := store.uploadPath(uploadID)
+	if err != nil {
+		return err
+	}
+	if _, err = store.upload(bucket, key, uploadID); err != nil {
+		return err
+	}
+	return os.RemoveAll(uploadPath)
+}
+
+// GetSubResource reads the sub-resource document of the bucket or the object, buckets without an acl set
+// are private and objects have the policy of the canned ACL they were uploaded with
+func (store *FSStore) GetSubResource(bucket, key, name string) ([]byte, error) {
+	if key == "" {
+		if err := store.checkBucket(bucket); err != nil {
+			return nil, err
+		}
+		document, err := ioutil.ReadFile(store.bucketSubResourcePath(bucket, name))
+		if os.IsNotExist(err) && name == aclSubResource {
+			return cannedPolicy("private"), nil
+		}
+		return document, notFound(err)
+	}
+	metadata, err := store.metadata(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	document, ok := metadata.SubResources[name]
+	if !ok && name == aclSubResource {
+		return cannedPolicy(metadata.Header.Get("X-Amz-Acl")), nil
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return document, nil
+}
+
+// PutCannedACL sets the policy of the canned ACL as the acl of the bucket or the object
+func (store *FSStore) PutCannedACL(bucket, key, acl string) error {
+	return store.PutSubResource(bucket, key, aclSubResource, cannedPolicy(acl))
+}
+
+// PutSubResource sets the sub-resource document of the bucket or the object
+func (store *FSStore) PutSubResource(bucket, key, name string, document []byte) error {
+	if key == "" {
+		if err := store.checkBucket(bucket); err != nil {
+			return err
+		}
+		_, err := writeFile(store.bucketSubResourcePath(bucket, name), strings.NewReader(string(document)))
+		return err
+	}
+	return store.updateSubResources(bucket, key, func(subResources map[string][]byte) {
+		subResources[name] = document
+	})
+}
+
+// DeleteSubResource removes the sub-resource document of the bucket or the object
+func (store *FSStore) DeleteSubResource(bucket, key, name string) error {
+	if key == "" {
+		if err := store.checkBucket(bucket); err != nil {
+			return err
+		}
+		if err := os.Remove(store.bucketSubResourcePath(bucket, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return store.updateSubResources(bucket, key, func(subResources map[string][]byte) {
+		delete(subResources, name)
+	})
+}
+
+func (store *FSStore) updateSubResources(bucket, key string, update func(map[string][]byte)) error {
+	metadata, err := store.metadata(bucket, key)
+	if err != nil {
+		return err
+	}
+	if metadata.SubResources == nil {
+		metadata.SubResources = make(map[string][]byte)
+	}
+	update(metadata.SubResources)
+	return store.saveMetadata(bucket, key, metadata)
+}
+
+func (store *FSStore) metadata(bucket, key string) (*fsMetadata, error) {
+	if err := store.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	if _, err := store.checkedObjectPath(bucket, key); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(store.metadataPath(bucket, key))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	metadata := &fsMetadata{}
+	if err = json.Unmarshal(content, metadata); err != nil {
+		return nil, fmt.Errorf("malformed metadata of %s/%s: %s", bucket, key, err)
+	}
+	return metadata, nil
+}
+
+func (store *FSStore) saveMetadata(bucket, key string, metadata *fsMetadata) error {
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = writeFile(store.metadataPath(bucket, key), strings.NewReader(string(content)))
+	return err
+}
+
+func (store *FSStore) upload(bucket, key, uploadID string) (*fsUpload, error) {
+	uploadPath, err := store.uploadPath(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(uploadPath, "upload.json"))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	upload := &fsUpload{}
+	if err = json.Unmarshal(content, upload); err != nil {
+		return nil, fmt.Errorf("malformed upload %s: %s", uploadID, err)
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return nil, ErrNotFound
+	}
+	return upload, nil
+}
+
+func (store *FSStore) checkBucket(bucket string) error {
+	if !validBucket(bucket) {
+		return ErrNotFound
+	}
+	if _, err := os.Stat(filepath.Join(store.root, "objects", bucket)); err != nil {
+		return notFound(err)
+	}
+	return nil
+}
+
+func (store *FSStore) checkedObjectPath(bucket, key string) (string, error) {
+	if key == "" {
+		return "", errors.New("empty object key")
+	}
+	return store.objectPath(bucket, key), nil
+}
+
+func (store *FSStore) objectPath(bucket, key string) string {
+	return filepath.Join(store.root, "objects", bucket, escapeKey(key))
+}
+
+func (store *FSStore) metadataPath(bucket, key string) string {
+	return filepath.Join(store.root, "metadata", bucket, escapeKey(key))
+}
+
+func (store *FSStore) bucketSubResourcePath(bucket, name string) string {
+	return filepath.Join(store.root, "buckets", bucket, url.PathEscape(name))
+}
+
+// uploadPath is the directory of the upload's parts, upload IDs are UUIDs given by InitiateMultipart,
+// so other IDs (like paths) are reported as missing uploads
+func (store *FSStore) uploadPath(uploadID string) (string, error) {
+	parsed, err := uuid.FromString(uploadID)
+	if err != nil || parsed.String() != uploadID {
+		return "", ErrNotFound
+	}
+	return filepath.Join(store.root, "uploads", uploadID), nil
+}
+
+func partPath(uploadPath string, number int) string {
+	return filepath.Join(uploadPath, strconv.Itoa(number))
+}
+
+// escapeKey makes the key a file name, leading dots are escaped to keep '.', '..' and temporary files apart
+func escapeKey(key string) string {
+	escaped := url.PathEscape(key)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+func validBucket(bucket string) bool {
+	return bucket != "" && bucket != "." && bucket != ".." && !strings.ContainsAny(bucket, `/\`)
+}
+
+// writeFile writes the content to a temporary file renamed to the path, so readers never see partial files
+func writeFile(path string, content io.Reader) (int64, error) {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), temporaryPrefix)
+	if err != nil {
+		return 0, notFound(err)
+	}
+	written, err := io.Copy(temporary, content)
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporary.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(temporary.Name())
+		return 0, err
+	}
+	return written, nil
+}
+
+func keptHeaders(header http.Header) http.Header {
+	kept := make(http.Header)
+	for _, name := range storedHeaders {
+		if value := header.Get(name); value != "" {
+			kept.Set(name, value)
+		}
+	}
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), metadataPrefix) {
+			kept[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return kept
+}
+
+// cannedPolicy is the access control policy of the canned ACL, private if the ACL isn't known
+func cannedPolicy(acl string) []byte {
+	grants := fmt.Sprintf(userGrant, localOwnerID, "FULL_CONTROL")
+	switch acl {
+	case "public-read":
+		grants += fmt.Sprintf(groupGrant, "AllUsers", "READ")
+	case "public-read-write":
+		grants += fmt.Sprintf(groupGrant, "AllUsers", "READ") + fmt.Sprintf(groupGrant, "AllUsers", "WRITE")
+	case "authenticated-read":
+		grants += fmt.Sprintf(groupGrant, "AuthenticatedUsers", "READ")
+	}
+	return []byte(fmt.Sprintf(`<AccessControlPolicy xmlns="%s"><Owner><ID>%s</ID><DisplayName>%s</DisplayName></Owner>`+
+		`<AccessControlList>%s</AccessControlList></AccessControlPolicy>`, xmlNamespace, localOwnerID, localOwnerID, grants))
+}
+
+func notFound(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (metadata *fsMetadata) objectInfo(key string) ObjectInfo {
+	return ObjectInfo{Key: key, Size: metadata.Size, ETag: metadata.ETag, LastModified: metadata.LastModified,
+		Header: metadata.Header}
+}
+
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFSStore(t *testing.T) (*FSStore, func()) {
+	root, err := ioutil.TempDir("", "fsstore")
+	require.NoError(t, err)
+	fsStore, err := NewFSStore(root)
+	require.NoError(t, err)
+	require.NoError(t, fsStore.CreateBucket("bucket", http.Header{}))
+	return fsStore, func() { _ = os.RemoveAll(root) }
+}
+
+func readObject(t *testing.T, objectStore ObjectStore, bucket, key string, offset, length int64) string {
+	body, _, err := objectStore.Get(bucket, key, offset, length)
+	require.NoError(t, err)
+	defer func() { _ = body.Close() }()
+	content, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestFSStoreShouldKeepObjectsWithTheirHeaders(t *testing.T) {
+	fsStore, cleanUp := newTestFSStore(t)
+	defer cleanUp()
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("X-Amz-Meta-Version", "3")
+	header.Set("Authorization", "AWS access:signature")
+
+	require.NoError(t, fsStore.Put("bucket", "dir/object", strings.NewReader("content"), 7, header))
+
+	info, err := fsStore.Head("bucket", "dir/object")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+	assert.Equal(t, `"9a0364b9e99bb480dd25e1f0284c8555"`, info.ETag)
+	assert.Equal(t, "text/plain", info.Header.Get("Content-Type"))
+	assert.Equal(t, "3", info.Header.Get("X-Amz-Meta-Version"))
+	assert.Empty(t, info.Header.Get("Authorization"))
+	assert.Equal(t, "content", readObject(t, fsStore, "bucket", "dir/object", 0, -1))
+	assert.Equal(t, "nte", readObject(t, fsStore, "bucket", "dir/object", 2, 3))
+	assert.Equal(t, "ent", readObject(t, fsStore, "bucket", "dir/object", 4, -1))
+}
+
+func TestFSStoreShouldReportMissingResources(t *testing.T) {
+	fsStore, cleanUp := newTestFSStore(t)
+	defer cleanUp()
+
+	_, err := fsStore.Head("bucket", "missing")
+	assert.True(t, IsNotFound(err))
+	_, err = fsStore.List("missing", "", 10)
+	assert.True(t, IsNotFound(err))
+	_, err = fsStore.GetSubResource("bucket", "", "policy")
+	assert.True(t, IsNotFound(err))
+	_, err = fsStore.UploadPart("bucket", "object", "../../objects/bucket", 1, strings.NewReader("part"), 4)
+	assert.True(t, IsNotFound(err))
+	assert.True(t, IsNotFound(fsStore.AbortMultipart("bucket", "object", "..")))
+	assert.NoError(t, fsStore.Delete("bucket", "missing"))
+	exists, err := fsStore.BucketExists("missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestFSStoreShouldListObjectsInPagesAfterTheMarker(t *testing.T) {
+	fsStore, cleanUp := newTestFSStore(t)
+	defer cleanUp()
+	for _, key := range []string{"c", "a/b", ".hidden", "..", "b"} {
+		require.NoError(t, fsStore.Put("bucket", key, strings.NewReader(key), int64(len(key)), http.Header{}))
+	}
+
+	first, err := fsStore.List("bucket", "", 3)
+	require.NoError(t, err)
+	second, err := fsStore.List("bucket", first.Objects[2].Key, 3)
+	require.NoError(t, err)
+
+	assert.True(t, first.Truncated)
+	assert.False(t, second.Truncated)
+	var keys []string
+	for _, object := range append(first.Objects, second.Objects...) {
+		keys = append(keys, object.Key)
+		assert.Equal(t, int64(len(object.Key)), object.Size)
+	}
+	assert.Equal(t, []string{"..", ".hidden", "a/b", "b", "c"}, keys)
+}
+
+func TestFSStoreShouldAssembleMultipartUploads(t *testing.T) {
+	fsStore, cleanUp := newTestFSStore(t)
+	defer cleanUp()
+	header := http.Header{}
+	header.Set("X-Amz-Meta-Version", "5")
+	uploadID, err := fsStore.InitiateMultipart("bucket", "object", header)
+	require.NoError(t, err)
+
+	second, err := fsStore.UploadPart("bucket", "object", uploadID, 2, strings.NewReader("world"), 5)
+	require.NoError(t, err)
+	first, err := fsStore.UploadPart("bucket", "object", uploadID, 1, strings.NewReader("hello "), 6)
+	require.NoError(t, err)
+	require.NoError(t, fsStore.CompleteMultipart("bucket", "object", uploadID, []Part{first, second}))
+
+	info, err := fsStore.Head("bucket", "object")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", readObject(t, fsStore, "bucket", "object", 0, -1))
+	assert.True(t, strings.HasSuffix(info.ETag, `-2"`))
+	assert.Equal(t, "5", info.Header.Get("X-Amz-Meta-Version"))
+	assert.True(t, IsNotFound(fsStore.AbortMultipart("bucket", "object", uploadID)))
+}
+
+func TestFSStoreShouldKeepSubResourcesOfObjectsAndBuckets(t *testing.T) {
+	fsStore, cleanUp := newTestFSStore(t)
+	defer cleanUp()
+	require.NoError(t, fsStore.Put("bucket", "object", strings.NewReader(""), 0, http.Header{}))
+
+	require.NoError(t, fsStore.PutSubResource("bucket", "", "acl", []byte("bucket acl")))
+	require.NoError(t, fsStore.PutSubResource("bucket", "object", "tagging", []byte("object tagging")))
+
+	bucketACL, err := fsStore.GetSubResource("bucket", "", "acl")
+	require.NoError(t, err)
+	objectTagging, err := fsStore.GetSubResource("bucket", "object", "tagging")
+	require.NoError(t, err)
+	assert.Equal(t, "bucket acl", string(bucketACL))
+	assert.Equal(t, "object tagging", string(objectTagging))
+
+	require.NoError(t, fsStore.DeleteSubResource("bucket", "object", "tagging"))
+	_, err = fsStore.GetSubResource("bucket", "object", "tagging")
+	assert.True(t, IsNotFound(err))
+}
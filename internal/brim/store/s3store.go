@@ -0,0 +1,342 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/external/miniotweak/s3signer"
+)
+
+// brimHeaders are sent with the reads of objects, so akubra doesn't regress them on failures
+var brimHeaders = map[string][]string{
+	"X-Akubra-No-Regression-On-Failure": {"1"},
+	"Accept-Encoding":                   {"*"}}
+
+var (
+	// subResourceClient is used for requests without object content
+	subResourceClient = &http.Client{Timeout: 30 * time.Second}
+	// objectClient has no overall timeout, as objects of any size are streamed through it
+	objectClient = &http.Client{}
+)
+
+// S3Store is the ObjectStore of an S3 compatible storage
+type S3Store struct {
+	client *s3.S3
+}
+
+// NewS3Store creates an S3Store using the client
+func NewS3Store(client *s3.S3) *S3Store {
+	return &S3Store{client: client}
+}
+
+// Endpoint returns the endpoint of the storage
+func (store *S3Store) Endpoint() string {
+	return store.client.S3Endpoint
+}
+
+// Head reads the headers of the object
+func (store *S3Store) Head(bucket, key string) (ObjectInfo, error) {
+	return store.HeadWithContext(context.Background(), bucket, key)
+}
+
+// HeadWithContext reads the headers of the object, the request is cancelled along with the context
+func (store *S3Store) HeadWithContext(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	resp, err := store.do(ctx, subResourceClient, http.MethodHead, bucket, key, "", brimHeaders, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer discardBody(resp)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ObjectInfo{}, ErrNotFound
+	case resp.StatusCode >= 300:
+		return ObjectInfo{}, store.objectError(http.MethodHead, bucket, key, resp)
+	}
+	return objectInfoOf(key, resp), nil
+}
+
+// Get reads the object or its range
+func (store *S3Store) Get(bucket, key string, offset, length int64) (io.ReadCloser, ObjectInfo, error) {
+	headers := map[string][]string{}
+	for name, values := range brimHeaders {
+		headers[name] = values
+	}
+	ranged := offset > 0 || length >= 0
+	if ranged {
+		byteRange := fmt.Sprintf("bytes=%d-", offset)
+		if length >= 0 {
+			byteRange += fmt.Sprint(offset + length - 1)
+		}
+		headers["Range"] = []string{byteRange}
+	}
+	resp, err := store.client.Bucket(bucket).GetResponseWithHeaders(key, headers)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if ranged && resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, ObjectInfo{}, errors.New("storage ignored the range request")
+	}
+	return resp.Body, objectInfoOf(key, resp), nil
+}
+
+// Put uploads the object with all the headers, the 'x-amz-acl' header sets its canned ACL
+func (store *S3Store) Put(bucket, key string, body io.Reader, size int64, header http.Header) error {
+	resp, err := store.do(context.Background(), objectClient, http.MethodPut, bucket, key, "", header, body, size)
+	if err != nil {
+		return err
+	}
+	defer discardBody(resp)
+	if resp.StatusCode >= 300 {
+		return store.objectError(http.MethodPut, bucket, key, resp)
+	}
+	return nil
+}
+
+// Delete removes the object
+func (store *S3Store) Delete(bucket, key string) error {
+	return store.client.Bucket(bucket).Del(key)
+}
+
+// List lists a page of objects
+func (store *S3Store) List(bucket, marker string, limit int) (ListResult, error) {
+	resp, err := store.client.Bucket(bucket).List("", "", marker, limit)
+	if err != nil {
+		return ListResult{}, err
+	}
+	result := ListResult{Truncated: resp.IsTruncated}
+	for _, key := range resp.Contents {
+		lastModified, _ := time.Parse(time.RFC3339, key.LastModified)
+		result.Objects = append(result.Objects, ObjectInfo{Key: key.Key, Size: key.Size, ETag: key.ETag,
+			LastModified: lastModified})
+	}
+	return result, nil
+}
+
+// CreateBucket creates the bucket, private unless the 'x-amz-acl' header is set
+func (store *S3Store) CreateBucket(bucket string, header http.Header) error {
+	return store.client.Bucket(bucket).PutBucket(cannedACL(header))
+}
+
+// BucketExists checks if the bucket exists
+func (store *S3Store) BucketExists(bucket string) (bool, error) {
+	resp, err := store.do(context.Background(), subResourceClient, http.MethodHead, bucket, "", "", nil, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	defer discardBody(resp)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 300:
+		return false, &s3.Error{
+			StatusCode: resp.StatusCode,
+			BucketName: bucket,
+			Message:    fmt.Sprintf("bucket '%s' head on '%s' failed with status %d", bucket, store.Endpoint(), resp.StatusCode),
+		}
+	}
+	return true, nil
+}
+
+// DeleteBucket removes the bucket
+func (store *S3Store) DeleteBucket(bucket string) error {
+	return store.client.Bucket(bucket).DelBucket()
+}
+
+// InitiateMultipart starts a multipart upload of the object with all the headers
+func (store *S3Store) InitiateMultipart(bucket, key string, header http.Header) (string, error) {
+	resp, err := store.do(context.Background(), subResourceClient, http.MethodPost, bucket, key, "uploads", header, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer discardBody(resp)
+	if resp.StatusCode >= 300 {
+		return "", store.objectError(http.MethodPost, bucket, key, resp)
+	}
+	result := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("no upload id of %s/%s returned by %s: %v", bucket, key, store.Endpoint(), err)
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart uploads a part, bodies which can't seek are buffered to compute the part's checksum
+func (store *S3Store) UploadPart(bucket, key, uploadID string, number int, body io.Reader, size int64) (Part, error) {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		content, err := ioutil.ReadAll(io.LimitReader(body, size))
+		if err != nil {
+			return Part{}, err
+		}
+		seeker = bytes.NewReader(content)
+	}
+	part, err := store.multi(bucket, key, uploadID).PutPart(number, seeker)
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{Number: part.N, ETag: part.ETag, Size: part.Size}, nil
+}
+
+// CompleteMultipart assembles the object from the parts
+func (store *S3Store) CompleteMultipart(bucket, key, uploadID string, parts []Part) error {
+	s3Parts := make([]s3.Part, 0, len(parts))
+	for _, part := range parts {
+		s3Parts = append(s3Parts, s3.Part{N: part.Number, ETag: part.ETag, Size: part.Size})
+	}
+	return store.multi(bucket, key, uploadID).Complete(s3Parts)
+}
+
+// AbortMultipart drops the upload and its parts
+func (store *S3Store) AbortMultipart(bucket, key, uploadID string) error {
+	return store.multi(bucket, key, uploadID).Abort()
+}
+
+// GetSubResource fetches the sub-resource document of the bucket (key is empty) or the object
+func (store *S3Store) GetSubResource(bucket, key, name string) ([]byte, error) {
+	resp, err := store.do(context.Background(), subResourceClient, http.MethodGet, bucket, key, name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer discardBody(resp)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, store.subResourceError(http.MethodGet, bucket, name, resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// PutSubResource sets the sub-resource document of the bucket or the object
+func (store *S3Store) PutSubResource(bucket, key, name string, document []byte) error {
+	digest := md5.Sum(document)
+	headers := http.Header{"Content-MD5": {base64.StdEncoding.EncodeToString(digest[:])}}
+	if name == aclSubResource {
+		headers.Set("Content-Type", "application/xml")
+	}
+	return store.putSubResource(bucket, key, name, headers, document)
+}
+
+// PutCannedACL sets the canned ACL of the bucket or the object
+func (store *S3Store) PutCannedACL(bucket, key, acl string) error {
+	return store.putSubResource(bucket, key, aclSubResource, http.Header{"X-Amz-Acl": {acl}}, nil)
+}
+
+// DeleteSubResource removes the sub-resource of the bucket or the object, missing ones are ignored
+func (store *S3Store) DeleteSubResource(bucket, key, name string) error {
+	resp, err := store.do(context.Background(), subResourceClient, http.MethodDelete, bucket, key, name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer discardBody(resp)
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return store.subResourceError(http.MethodDelete, bucket, name, resp)
+	}
+	return nil
+}
+
+func (store *S3Store) putSubResource(bucket, key, name string, headers http.Header, document []byte) error {
+	resp, err := store.do(context.Background(), subResourceClient, http.MethodPut, bucket, key, name, headers,
+		bytes.NewReader(document), int64(len(document)))
+	if err != nil {
+		return err
+	}
+	defer discardBody(resp)
+	if resp.StatusCode >= 300 {
+		return store.subResourceError(http.MethodPut, bucket, name, resp)
+	}
+	return nil
+}
+
+func (store *S3Store) multi(bucket, key, uploadID string) *s3.Multi {
+	return &s3.Multi{Bucket: store.client.Bucket(bucket), Key: key, UploadId: uploadID}
+}
+
+// do sends a request signed with the credentials of the client, goamz doesn't pass all the headers
+// of uploads nor reads sub-resources other than the acl
+func (store *S3Store) do(ctx context.Context, httpClient *http.Client, method, bucket, key, subResource string,
+	headers http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	resourceURL, err := url.Parse(store.client.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	resourceURL.Path = path.Join("/", bucket, key)
+	resourceURL.RawQuery = subResource
+	if body == nil {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, resourceURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.ContentLength = contentLength
+	req.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	req = s3signer.SignV2(req, store.client.Auth.AccessKey, store.client.Auth.SecretKey, nil)
+	return httpClient.Do(req)
+}
+
+func (store *S3Store) objectError(method, bucket, key string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	s3Err := &s3.Error{}
+	if xml.Unmarshal(body, s3Err) != nil || s3Err.Message == "" {
+		s3Err.Message = fmt.Sprintf("%s of '%s' of bucket '%s' on '%s' failed with status %d: %s",
+			method, key, bucket, store.Endpoint(), resp.StatusCode, body)
+	}
+	s3Err.StatusCode = resp.StatusCode
+	s3Err.BucketName = bucket
+	return s3Err
+}
+
+func (store *S3Store) subResourceError(method, bucket, subResource string, resp *http.Response) error {
+	message, _ := ioutil.ReadAll(resp.Body)
+	return &s3.Error{
+		StatusCode: resp.StatusCode,
+		BucketName: bucket,
+		Message: fmt.Sprintf("%s of '%s' of bucket '%s' on '%s' failed with status %d: %s",
+			method, subResource, bucket, store.Endpoint(), resp.StatusCode, message),
+	}
+}
+
+func discardBody(resp *http.Response) {
+	_, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+}
+
+// objectInfoOf reads the object's headers, the size of ranged responses is the size of the whole object
+func objectInfoOf(key string, resp *http.Response) ObjectInfo {
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	size := resp.ContentLength
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		if total, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64); err == nil {
+			size = total
+		}
+	}
+	return ObjectInfo{Key: key, Size: size, ETag: resp.Header.Get("ETag"),
+		LastModified: lastModified, Header: resp.Header}
+}
+
+func cannedACL(header http.Header) s3.ACL {
+	if acl := header.Get("x-amz-acl"); acl != "" {
+		return s3.ACL(acl)
+	}
+	return s3.Private
+}
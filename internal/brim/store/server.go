@@ -0,0 +1,333 @@
+package store
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+)
+
+const defaultListLimit = 1000
+
+// subResources are the query parameters naming sub-resources of buckets and objects
+var subResources = map[string]bool{
+	"acl": true, "cors": true, "lifecycle": true, "logging": true, "notification": true, "policy": true,
+	"replication": true, "requestPayment": true, "tagging": true, "versioning": true, "website": true,
+}
+
+var rangePattern = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// Handler serves an ObjectStore with the part of the S3 API used by brim, path style only.
+// Requests aren't authenticated, so it must listen on a loopback interface only
+type Handler struct {
+	store Storage
+}
+
+// NewHandler creates a Handler of the store
+func NewHandler(store Storage) *Handler {
+	return &Handler{store: store}
+}
+
+// ServeHTTP dispatches the S3 requests
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if separator := strings.Index(path, "/"); separator >= 0 {
+		bucket, key = path[:separator], path[separator+1:]
+	}
+	query := r.URL.Query()
+	if bucket == "" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "listing buckets isn't supported")
+		return
+	}
+	if subResource := subResourceOf(query); subResource != "" {
+		handler.serveSubResource(w, r, bucket, key, subResource)
+		return
+	}
+	if key == "" {
+		handler.serveBucket(w, r, bucket)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		handler.initiateMultipart(w, r, bucket, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		handler.uploadPart(w, r, bucket, key)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		handler.completeMultipart(w, r, bucket, key)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		handler.respond(w, http.StatusNoContent, handler.store.AbortMultipart(bucket, key, query.Get("uploadId")))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "copying objects isn't supported")
+	case r.Method == http.MethodPut:
+		handler.respond(w, http.StatusOK, handler.store.Put(bucket, key, r.Body, r.ContentLength, r.Header))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		handler.getObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		handler.respond(w, http.StatusNoContent, handler.store.Delete(bucket, key))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" isn't allowed")
+	}
+}
+
+func (handler *Handler) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodHead:
+		exists, err := handler.store.BucketExists(bucket)
+		if err == nil && !exists {
+			err = ErrNotFound
+		}
+		handler.respond(w, http.StatusOK, err)
+	case http.MethodPut:
+		handler.respond(w, http.StatusOK, handler.store.CreateBucket(bucket, r.Header))
+	case http.MethodDelete:
+		handler.respond(w, http.StatusNoContent, handler.store.DeleteBucket(bucket))
+	case http.MethodGet:
+		handler.list(w, r, bucket)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" isn't allowed")
+	}
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name     `xml:"ListBucketResult"`
+	Xmlns       string       `xml:"xmlns,attr"`
+	Name        string       `xml:"Name"`
+	Marker      string       `xml:"Marker"`
+	MaxKeys     int          `xml:"MaxKeys"`
+	IsTruncated bool         `xml:"IsTruncated"`
+	Contents    []listedItem `xml:"Contents"`
+}
+
+type listedItem struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+func (handler *Handler) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	if query.Get("prefix") != "" || query.Get("delimiter") != "" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "prefixes and delimiters aren't supported")
+		return
+	}
+	limit := defaultListLimit
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys > 0 && maxKeys < limit {
+		limit = maxKeys
+	}
+	result, err := handler.store.List(bucket, query.Get("marker"), limit)
+	if err != nil {
+		handler.respond(w, http.StatusOK, err)
+		return
+	}
+	listing := listBucketResult{Xmlns: xmlNamespace, Name: bucket, Marker: query.Get("marker"), MaxKeys: limit,
+		IsTruncated: result.Truncated}
+	for _, object := range result.Objects {
+		listing.Contents = append(listing.Contents, listedItem{Key: object.Key, ETag: object.ETag, Size: object.Size,
+			LastModified: object.LastModified.UTC().Format(time.RFC3339)})
+	}
+	writeXML(w, http.StatusOK, listing)
+}
+
+func (handler *Handler) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	offset, length := int64(0), int64(-1)
+	ranged := false
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		match := rangePattern.FindStringSubmatch(byteRange)
+		if match == nil {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "only single byte ranges are supported")
+			return
+		}
+		offset, _ = strconv.ParseInt(match[1], 10, 64)
+		if match[2] != "" {
+			last, _ := strconv.ParseInt(match[2], 10, 64)
+			length = last - offset + 1
+		}
+		ranged = true
+	}
+	if r.Method == http.MethodHead {
+		info, err := handler.store.Head(bucket, key)
+		if err != nil {
+			handler.respond(w, http.StatusOK, err)
+			return
+		}
+		writeObjectHeaders(w, info)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	body, info, err := handler.store.Get(bucket, key, offset, length)
+	if err != nil {
+		handler.respond(w, http.StatusOK, err)
+		return
+	}
+	defer func() {
+		if closeErr := body.Close(); closeErr != nil {
+			log.Debugf("Could not close %s/%s: %s", bucket, key, closeErr)
+		}
+	}()
+	writeObjectHeaders(w, info)
+	status, size := http.StatusOK, info.Size
+	if ranged {
+		if length < 0 || offset+length > info.Size {
+			length = info.Size - offset
+		}
+		status, size = http.StatusPartialContent, length
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, body); err != nil {
+		log.Debugf("Could not send %s/%s: %s", bucket, key, err)
+	}
+}
+
+func (handler *Handler) initiateMultipart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	uploadID, err := handler.store.InitiateMultipart(bucket, key, r.Header)
+	if err != nil {
+		handler.respond(w, http.StatusOK, err)
+		return
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: xmlNamespace, Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func (handler *Handler) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "partNumber has to be a positive number")
+		return
+	}
+	part, err := handler.store.UploadPart(bucket, key, r.URL.Query().Get("uploadId"), number, r.Body, r.ContentLength)
+	if err != nil {
+		handler.respond(w, http.StatusOK, err)
+		return
+	}
+	w.Header().Set("ETag", part.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (handler *Handler) completeMultipart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	var request struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	parts := make([]Part, 0, len(request.Parts))
+	for _, part := range request.Parts {
+		parts = append(parts, Part{Number: part.PartNumber, ETag: part.ETag})
+	}
+	if err := handler.store.CompleteMultipart(bucket, key, r.URL.Query().Get("uploadId"), parts); err != nil {
+		handler.respond(w, http.StatusOK, err)
+		return
+	}
+	info, err := handler.store.Head(bucket, key)
+	if err != nil {
+		handler.respond(w, http.StatusOK, err)
+		return
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Xmlns: xmlNamespace, Bucket: bucket, Key: key, ETag: info.ETag})
+}
+
+func (handler *Handler) serveSubResource(w http.ResponseWriter, r *http.Request, bucket, key, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		document, err := handler.store.GetSubResource(bucket, key, name)
+		if err != nil {
+			handler.respond(w, http.StatusOK, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(document)
+	case http.MethodPut:
+		if name == aclSubResource && r.ContentLength == 0 {
+			acl := r.Header.Get("X-Amz-Acl")
+			if acl == "" {
+				acl = "private"
+			}
+			handler.respond(w, http.StatusOK, handler.store.PutCannedACL(bucket, key, acl))
+			return
+		}
+		document, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = handler.store.PutSubResource(bucket, key, name, document)
+		}
+		handler.respond(w, http.StatusOK, err)
+	case http.MethodDelete:
+		handler.respond(w, http.StatusNoContent, handler.store.DeleteSubResource(bucket, key, name))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" isn't allowed")
+	}
+}
+
+// respond writes the status or the error, missing resources are reported as S3 does
+func (handler *Handler) respond(w http.ResponseWriter, status int, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(status)
+	case IsNotFound(err):
+		writeError(w, http.StatusNotFound, "NoSuchKey", "the resource doesn't exist")
+	default:
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+func subResourceOf(query url.Values) string {
+	for name := range query {
+		if subResources[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+func writeObjectHeaders(w http.ResponseWriter, info ObjectInfo) {
+	for name, values := range info.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("ETag", info.ETag)
+	w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+func writeXML(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if err := xml.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newServedS3Store(t *testing.T) (*S3Store, func()) {
+	fsStore, cleanUp := newTestFSStore(t)
+	server := httptest.NewServer(NewHandler(fsStore))
+	client := s3.New(aws.Auth{AccessKey: "access", SecretKey: "secret"},
+		aws.Region{Name: "generic", S3Endpoint: server.URL})
+	return NewS3Store(client), func() {
+		server.Close()
+		cleanUp()
+	}
+}
+
+func TestS3StoreShouldPutAndGetObjectsOfServedStore(t *testing.T) {
+	s3Store, cleanUp := newServedS3Store(t)
+	defer cleanUp()
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Amz-Meta-Version", "7")
+
+	require.NoError(t, s3Store.Put("bucket", "dir/object", strings.NewReader("content"), 7, header))
+
+	info, err := s3Store.Head("bucket", "dir/object")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+	assert.Equal(t, "text/plain", info.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", info.Header.Get("Cache-Control"))
+	assert.Equal(t, "7", info.Header.Get("X-Amz-Meta-Version"))
+	assert.Equal(t, "content", readObject(t, s3Store, "bucket", "dir/object", 0, -1))
+	assert.Equal(t, "nte", readObject(t, s3Store, "bucket", "dir/object", 2, 3))
+
+	require.NoError(t, s3Store.Delete("bucket", "dir/object"))
+	_, err = s3Store.Head("bucket", "dir/object")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestS3StoreShouldListAndManageBucketsOfServedStore(t *testing.T) {
+	s3Store, cleanUp := newServedS3Store(t)
+	defer cleanUp()
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, s3Store.Put("bucket", key, strings.NewReader(key), 1, http.Header{}))
+	}
+
+	result, err := s3Store.List("bucket", "a", 1)
+	require.NoError(t, err)
+	assert.True(t, result.Truncated)
+	require.Len(t, result.Objects, 1)
+	assert.Equal(t, "b", result.Objects[0].Key)
+
+	_, err = s3Store.List("missing", "", 10)
+	assert.True(t, IsNotFound(err))
+	require.NoError(t, s3Store.CreateBucket("other", http.Header{}))
+	exists, err := s3Store.BucketExists("other")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	require.NoError(t, s3Store.DeleteBucket("other"))
+	exists, err = s3Store.BucketExists("other")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestS3StoreShouldUploadMultipartObjectsToServedStore(t *testing.T) {
+	s3Store, cleanUp := newServedS3Store(t)
+	defer cleanUp()
+	uploadID, err := s3Store.InitiateMultipart("bucket", "object", http.Header{})
+	require.NoError(t, err)
+
+	first, err := s3Store.UploadPart("bucket", "object", uploadID, 1, strings.NewReader("hello "), 6)
+	require.NoError(t, err)
+	second, err := s3Store.UploadPart("bucket", "object", uploadID, 2, ioutil.NopCloser(strings.NewReader("world")), 5)
+	require.NoError(t, err)
+	require.NoError(t, s3Store.CompleteMultipart("bucket", "object", uploadID, []Part{first, second}))
+
+	assert.Equal(t, "hello world", readObject(t, s3Store, "bucket", "object", 0, -1))
+}
+
+func TestHandlerShouldServeDefaultACLOfCannedACL(t *testing.T) {
+	s3Store, cleanUp := newServedS3Store(t)
+	defer cleanUp()
+	header := http.Header{}
+	header.Set("X-Amz-Acl", string(s3.PublicRead))
+	require.NoError(t, s3Store.Put("bucket", "object", strings.NewReader(""), 0, header))
+
+	resp, err := http.Get(s3Store.Endpoint() + "/bucket/object?acl")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	policy, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(policy), "http://acs.amazonaws.com/groups/global/AllUsers")
+}
+
+func TestHandlerShouldSetCannedACLOfBuckets(t *testing.T) {
+	s3Store, cleanUp := newServedS3Store(t)
+	defer cleanUp()
+	header := http.Header{}
+	header.Set("X-Amz-Acl", string(s3.PublicRead))
+	require.NoError(t, s3Store.CreateBucket("public", header))
+
+	policy, err := s3Store.GetSubResource("public", "", "acl")
+	require.NoError(t, err)
+	assert.Contains(t, string(policy), "http://acs.amazonaws.com/groups/global/AllUsers")
+
+	require.NoError(t, s3Store.PutCannedACL("public", "", string(s3.Private)))
+	policy, err = s3Store.GetSubResource("public", "", "acl")
+	require.NoError(t, err)
+	assert.NotContains(t, string(policy), "http://acs.amazonaws.com/groups/global/AllUsers")
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+)
+
+// LocalScheme marks endpoints of storages kept in local directories
+const LocalScheme = "file"
+
+// ErrNotFound is returned by stores for missing buckets, objects, uploads and sub-resources
+var ErrNotFound = errors.New("not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	// Header holds the content and metadata headers of the object, it's empty in listings
+	Header http.Header
+}
+
+// ListResult is a page of objects ordered by key
+type ListResult struct {
+	Objects   []ObjectInfo
+	Truncated bool
+}
+
+// Part is an uploaded part of a multipart upload
+type Part struct {
+	Number int
+	ETag   string
+	Size   int64
+}
+
+// ObjectStore is a storage of objects brim migrates from and to
+type ObjectStore interface {
+	Head(bucket, key string) (ObjectInfo, error)
+	// Get reads length bytes of the object from the offset, the rest of the object if length is negative
+	Get(bucket, key string, offset, length int64) (io.ReadCloser, ObjectInfo, error)
+	// Put stores the object with the content and metadata headers
+	Put(bucket, key string, body io.Reader, size int64, header http.Header) error
+	Delete(bucket, key string) error
+	// List returns at most limit objects with keys greater than the marker
+	List(bucket, marker string, limit int) (ListResult, error)
+	// CreateBucket creates the bucket, the 'x-amz-acl' header sets its canned ACL
+	CreateBucket(bucket string, header http.Header) error
+	BucketExists(bucket string) (bool, error)
+	// DeleteBucket removes an empty bucket
+	DeleteBucket(bucket string) error
+	InitiateMultipart(bucket, key string, header http.Header) (uploadID string, err error)
+	UploadPart(bucket, key, uploadID string, number int, body io.Reader, size int64) (Part, error)
+	CompleteMultipart(bucket, key, uploadID string, parts []Part) error
+	AbortMultipart(bucket, key, uploadID string) error
+}
+
+// SubResourceStore keeps sub-resource documents (like acl or tagging) of buckets and objects,
+// bucket documents are kept under an empty key
+type SubResourceStore interface {
+	// GetSubResource reads the document, the acl of resources without grants set is the policy of their canned ACL
+	GetSubResource(bucket, key, name string) ([]byte, error)
+	PutSubResource(bucket, key, name string, document []byte) error
+	DeleteSubResource(bucket, key, name string) error
+}
+
+// Storage is a store brim migrates objects and their sub-resources between
+type Storage interface {
+	ObjectStore
+	SubResourceStore
+	// PutCannedACL replaces the grants of the bucket (key is empty) or the object with the canned ACL
+	PutCannedACL(bucket, key, acl string) error
+	// Endpoint identifies the storage in logs and errors
+	Endpoint() string
+}
+
+// contextHeadStore is implemented by the stores which can give up reading the headers of an object
+type contextHeadStore interface {
+	HeadWithContext(ctx context.Context, bucket, key string) (ObjectInfo, error)
+}
+
+// HeadWithContext reads the headers of the object, the request is cancelled along with the context
+// if the store supports it
+func HeadWithContext(ctx context.Context, store ObjectStore, bucket, key string) (ObjectInfo, error) {
+	if contextStore, ok := store.(contextHeadStore); ok {
+		return contextStore.HeadWithContext(ctx, bucket, key)
+	}
+	return store.Head(bucket, key)
+}
+
+var (
+	localStores   = make(map[string]*FSStore)
+	localStoresMx sync.Mutex
+)
+
+// ForClient returns the storage the client points to, 'file' endpoints are FSStores of the local
+// directories, any other endpoint is an S3Store of the client
+func ForClient(client *s3.S3) (Storage, error) {
+	endpoint, err := url.Parse(client.S3Endpoint)
+	if err != nil || endpoint.Scheme != LocalScheme {
+		return NewS3Store(client), nil
+	}
+	localStoresMx.Lock()
+	defer localStoresMx.Unlock()
+	if fsStore, ok := localStores[endpoint.Path]; ok {
+		return fsStore, nil
+	}
+	fsStore, err := NewFSStore(endpoint.Path)
+	if err != nil {
+		return nil, fmt.Errorf("local storage %s: %s", client.S3Endpoint, err)
+	}
+	localStores[endpoint.Path] = fsStore
+	return fsStore, nil
+}
+
+// IsNotFound tells if the error reports a missing resource, by any of the stores
+func IsNotFound(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode == http.StatusNotFound
+	}
+	return err != nil && strings.HasPrefix(err.Error(), "404 ")
+}
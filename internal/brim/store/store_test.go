@@ -0,0 +1,32 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForClientShouldReturnStoresOfLocalDirectories(t *testing.T) {
+	root, err := ioutil.TempDir("", "localstore")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(root) }()
+	auth := aws.Auth{AccessKey: "access"}
+
+	first, err := ForClient(s3.New(auth, aws.Region{Name: "generic", S3Endpoint: "file://" + root}))
+	require.NoError(t, err)
+	second, err := ForClient(s3.New(auth, aws.Region{Name: "generic", S3Endpoint: "file://" + root}))
+	require.NoError(t, err)
+	remote, err := ForClient(s3.New(auth, aws.Region{Name: "generic", S3Endpoint: "http://storage:8080"}))
+	require.NoError(t, err)
+
+	assert.IsType(t, &FSStore{}, first)
+	assert.True(t, first == second)
+	assert.Equal(t, "file://"+root, first.Endpoint())
+	assert.IsType(t, &S3Store{}, remote)
+	assert.Equal(t, "http://storage:8080", remote.Endpoint())
+}
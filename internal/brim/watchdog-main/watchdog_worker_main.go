@@ -1,62 +1,260 @@
 package watchdog
 
 import (
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/allegro/akubra/internal/akubra/config"
 	"github.com/allegro/akubra/internal/akubra/database"
 	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	akubraWatchdog "github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/admin"
 	"github.com/allegro/akubra/internal/brim/auth"
 	bConf "github.com/allegro/akubra/internal/brim/config"
+	"github.com/allegro/akubra/internal/brim/control"
 	"github.com/allegro/akubra/internal/brim/feeder"
 	"github.com/allegro/akubra/internal/brim/filter"
 	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/scanner"
+	"github.com/allegro/akubra/internal/brim/scheduler"
 	"github.com/allegro/akubra/internal/brim/worker"
 	feederUtils "github.com/allegro/akubra/pkg/brim/feeder"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
-func RunWatchdogWorker(akubraConf *config.Config, brimConf *bConf.BrimConf) {
+const (
+	defaultDrainTimeout = 30 * time.Second
+	defaultWorkerCount  = 2
+)
 
-	sqlFeeder, err := feeder.NewSQLWALFeeder(
-		akubraConf,
-		&feeder.WALFeederConfig{MaxRecordsPerQuery: uint(brimConf.WALConf.MaxRecordsPerQuery),
-			NoRecordsSleepDuration: brimConf.WALConf.NoRecordsSleepDuration,
-			FailureDelay:           brimConf.WALConf.FeederTaskFailureDelay},
-		database.NewDBClientFactory(
-			akubraConf.Watchdog.Props["dialect"],
-			"sslmode=disable dbname=:dbname: user=:user: password=:password: host=:host: port=:port: connect_timeout=:conntimeout:",
-			[]string{"user", "password", "dbname", "host", "port", "conntimeout"},
-		))
+func RunWatchdogWorker(akubraConf *config.Config, brimConf *bConf.BrimConf) {
+	if err := metrics.Init(brimConf.Metrics); err != nil {
+		log.Printf("Metrics initialization error: %s", err)
+	}
+	if _, err := akubraWatchdog.StartLagReporter(&akubraConf.Watchdog); err != nil {
+		log.Printf("Replication lag metrics are disabled, failed to open the consistency log: %s", err)
+	}
 
+	if err := bConf.SchedulerConfValidator(brimConf.Scheduler, "Scheduler"); err != nil {
+		log.Fatalf("Improperly configured %s", err)
+	}
+	walFeeder, err := createWALFeeder(akubraConf, brimConf)
 	if err != nil {
 		log.Fatalf("Failed to configure WAL: %s", err)
 	}
 
-	sqlRecordsFeed := sqlFeeder.CreateFeed()
+	pipeline := control.NewPipeline()
 	feedProxyChannel := make(chan interface{})
-
-	go func() {
-		for e := range sqlRecordsFeed {
-			feedProxyChannel <- e
-		}
-	}()
+	go pipeline.Forward(walFeeder.CreateFeed(), feedProxyChannel)
 
 	backendResolver := auth.NewConfigBasedBackendResolver(akubraConf, brimConf)
-	throtteledFeedChannel := feederUtils.Throttle(feedProxyChannel, &feederUtils.ThrottledPublisherConfig{
+	if len(brimConf.Scanner.Buckets) > 0 {
+		startScanner(backendResolver, brimConf.Scanner, akubraConf.Watchdog.ObjectVersionHeaderName, pipeline, feedProxyChannel)
+	}
+	throttler := feederUtils.NewThrottler(feederUtils.ThrottledPublisherConfig{
 		BurstEnabled:         brimConf.WALConf.BurstFeeder,
 		TaskEmissionDuration: brimConf.WALConf.TaskEmissionDuration,
 		MaxEmittedTasksCount: uint64(brimConf.WALConf.MaxEmittedTasksCount)})
+	recordsScheduler := scheduler.NewScheduler(brimConf.Scheduler)
+	pipeline.WatchScheduler(recordsScheduler)
+	throtteledFeedChannel := throttler.Throttle(recordsScheduler.Schedule(feedProxyChannel))
 
-	walFilter := filter.NewDefaultWALFilter(backendResolver, &filter.S3VersionFetcher{VersionHeaderName: akubraConf.Watchdog.ObjectVersionHeaderName})
-	walWorker := worker.NewTaskMigratorWALWorker(2)
+	versionFetcher := &filter.S3VersionFetcher{VersionHeaderName: akubraConf.Watchdog.ObjectVersionHeaderName}
+	walFilter := createWALFilter(backendResolver, versionFetcher, brimConf.WALConf.Filter)
+	walWorker := createWALWorker(brimConf)
+	walWorker.SetMultiPartThresholdInBytes(int(brimConf.WALConf.MultipartThreshold.SizeInBytes))
+	walWorker.SetMigrationVerifier(worker.NewMigrationVerifier(versionFetcher, worker.VerificationConfig{
+		Checksum:            brimConf.WALConf.VerifyChecksums,
+		DeleteInvalidCopies: brimConf.WALConf.DeleteInvalidCopies}))
+	walWorker.SetMultipartConfig(s3.MultipartConfig{
+		PartSize:         brimConf.WALConf.MultipartPartSize.SizeInBytes,
+		MaxInFlightParts: brimConf.WALConf.MultipartMaxInFlightParts,
+		MemoryBudget:     brimConf.WALConf.MultipartMemoryBudget.SizeInBytes})
+	walWorker.SetMetadataFilter(s3.MetadataFilter{
+		Allow: brimConf.WALConf.MetadataAllowList,
+		Deny:  brimConf.WALConf.MetadataDenyList})
 
-	walEntries := make(chan *model.WALEntry)
+	walEntries := make(chan *model.WALEntry, control.QueueCapacity)
 	walTasks := walFilter.Filter(walEntries)
+	pipeline.WatchQueues(walEntries, walTasks)
 	walWorker.Process(walTasks)
 
+	if brimConf.TechnicalEndpointListen != "" {
+		controlHandler := control.NewHandler(pipeline, throttler, walWorker, control.EndpointPath)
+		startTechnicalEndpoint(akubraConf, brimConf.TechnicalEndpointListen, controlHandler)
+	}
+	go drainOnShutdown(pipeline, brimConf.DrainTimeout)
+
 	for item := range throtteledFeedChannel {
 		switch it := item.(type) {
 		case *model.WALEntry:
-			walEntries <- it
+			walEntries <- pipeline.Track(it)
 		}
 	}
 }
+
+// RunDryRun plans the tasks of the records due in the consistency log once, without changing the log or the storages,
+// the planned tasks are written to the output as JSON lines and their summary is logged at the end
+func RunDryRun(akubraConf *config.Config, brimConf *bConf.BrimConf, output io.Writer) error {
+	dryRunFeeder, err := createDryRunFeeder(akubraConf, brimConf)
+	if err != nil {
+		return err
+	}
+	backendResolver := auth.NewConfigBasedBackendResolver(akubraConf, brimConf)
+	versionFetcher := &filter.S3VersionFetcher{VersionHeaderName: akubraConf.Watchdog.ObjectVersionHeaderName}
+	walFilter := createWALFilter(backendResolver, versionFetcher, brimConf.WALConf.Filter)
+	planner := worker.NewTaskPlanner(output)
+
+	summary, err := planner.Plan(walFilter.Filter(planner.Track(dryRunFeeder.CreateFeed())))
+	if err != nil {
+		return err
+	}
+	log.Printf("Dry run planned %d tasks: %d copies of %d bytes, %d deletes (by reason %v), %d records in sync, %d records failed",
+		summary.Tasks, summary.Copies, summary.Bytes, summary.Deletes, summary.ByReason, summary.InSync, summary.Failed)
+	return nil
+}
+
+// RunOwnershipSync compares the users, access keys and bucket owners of the clusters of every region of the admins
+// configuration and writes the differences to the output as JSON lines, they are fixed only if confirmed
+func RunOwnershipSync(brimConf *bConf.BrimConf, output io.Writer, confirmed bool) error {
+	summary, err := admin.NewOwnershipSync(brimConf.Admins).Run(output, confirmed)
+	if err != nil {
+		return err
+	}
+	log.Printf("Ownership sync found %d differences, %d fixed, %d failed to fix",
+		summary.Differences, summary.Fixed, summary.Failed)
+	return nil
+}
+
+func createWALFilter(backendResolver auth.BackendResolver, versionFetcher filter.VersionFetcher, filterConf bConf.FilterConf) filter.WALFilter {
+	return filter.NewConfiguredWALFilter(backendResolver, versionFetcher, &filter.S3ResourceFetcher{}, filter.Config{
+		LookupTimeout: filterConf.LookupTimeout,
+		CacheSize:     filterConf.CacheSize,
+		CacheTTL:      filterConf.CacheTTL,
+		BatchSize:     filterConf.BatchSize})
+}
+
+func createWALWorker(brimConf *bConf.BrimConf) worker.WALWorker {
+	workerCount := brimConf.WorkerCount
+	if workerCount < 1 {
+		workerCount = defaultWorkerCount
+	}
+	walWorker := worker.NewTaskMigratorWALWorker(workerCount)
+	adaptiveConf := brimConf.WALConf.AdaptiveConcurrency
+	if adaptiveConf.Enabled {
+		maxPerBackend := adaptiveConf.MaxPerBackend
+		if maxPerBackend == 0 {
+			maxPerBackend = workerCount
+		}
+		walWorker.SetAdaptiveConcurrency(worker.AdaptiveConcurrencyConfig{
+			MinPerBackend:      adaptiveConf.MinPerBackend,
+			MaxPerBackend:      maxPerBackend,
+			Window:             adaptiveConf.Window,
+			LatencyThreshold:   adaptiveConf.LatencyThreshold,
+			ErrorRateThreshold: adaptiveConf.ErrorRateThreshold,
+			DecreaseFactor:     adaptiveConf.DecreaseFactor})
+	}
+	return walWorker
+}
+
+// drainOnShutdown lets the records taken from the feeds finish before brim exits
+func drainOnShutdown(pipeline *control.Pipeline, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	<-shutdown
+	log.Printf("Draining brim before shutdown, at most %s", timeout)
+	if !pipeline.Drain(timeout) {
+		log.Printf("Brim shut down before all the records in progress were processed")
+	}
+	os.Exit(0)
+}
+
+func createWALFeeder(akubraConf *config.Config, brimConf *bConf.BrimConf) (feeder.WALFeeder, error) {
+	if brimConf.Replay.Path != "" {
+		return createReplayFeeder(brimConf)
+	}
+	feederConfig := &feeder.WALFeederConfig{MaxRecordsPerQuery: uint(brimConf.WALConf.MaxRecordsPerQuery),
+		NoRecordsSleepDuration: brimConf.WALConf.NoRecordsSleepDuration,
+		FailureDelay:           brimConf.WALConf.FeederTaskFailureDelay,
+		MaxFailureDelay:        brimConf.WALConf.FeederTaskMaxFailureDelay,
+		MaxAttempts:            brimConf.WALConf.FeederTaskMaxAttempts,
+		FairnessKey:            brimConf.Scheduler.FairnessKey,
+		MaxPendingBatches:      uint(brimConf.WALConf.FeederMaxPendingBatches)}
+
+	if strings.ToLower(akubraConf.Watchdog.Type) == akubraWatchdog.EmbeddedWatchdogType {
+		return feeder.NewEmbeddedWALFeeder(akubraConf, feederConfig)
+	}
+	dialect, err := akubraWatchdog.DialectFor(akubraConf.Watchdog.Props["dialect"])
+	if err != nil {
+		return nil, err
+	}
+	return feeder.NewSQLWALFeeder(
+		akubraConf,
+		feederConfig,
+		database.NewDBClientFactory(dialect.Name(), dialect.ConnectionStringFormat(), dialect.ConnectionStringArgs()))
+}
+
+// createReplayFeeder feeds the failed requests found in akubra's logs instead of the consistency log
+func createReplayFeeder(brimConf *bConf.BrimConf) (feeder.WALFeeder, error) {
+	if err := bConf.ReplayConfValidator(brimConf.Replay, "Replay"); err != nil {
+		return nil, err
+	}
+	return feeder.NewLogReplayWALFeeder(&feeder.LogReplayConfig{
+		Path:           brimConf.Replay.Path,
+		From:           brimConf.Replay.From,
+		To:             brimConf.Replay.To,
+		CheckpointFile: brimConf.Replay.CheckpointFile,
+		Domain:         brimConf.Replay.Domain,
+		BatchSize:      brimConf.WALConf.MaxRecordsPerQuery})
+}
+
+func createDryRunFeeder(akubraConf *config.Config, brimConf *bConf.BrimConf) (feeder.WALFeeder, error) {
+	feederConfig := &feeder.WALFeederConfig{MaxRecordsPerQuery: uint(brimConf.WALConf.MaxRecordsPerQuery)}
+	if strings.ToLower(akubraConf.Watchdog.Type) == akubraWatchdog.EmbeddedWatchdogType {
+		return feeder.NewDryRunWALFeeder(akubraConf, feederConfig, nil)
+	}
+	dialect, err := akubraWatchdog.DialectFor(akubraConf.Watchdog.Props["dialect"])
+	if err != nil {
+		return nil, err
+	}
+	return feeder.NewDryRunWALFeeder(akubraConf, feederConfig,
+		database.NewDBClientFactory(dialect.Name(), dialect.ConnectionStringFormat(), dialect.ConnectionStringArgs()))
+}
+
+func startScanner(resolver auth.BackendResolver, scannerConf bConf.ScannerConf, versionHeaderName string,
+	pipeline *control.Pipeline, feedChannel chan<- interface{}) {
+	if err := bConf.ScannerConfValidator(scannerConf, "Scanner"); err != nil {
+		log.Fatalf("Improperly configured %s", err)
+	}
+	bucketScanner, err := scanner.NewScanner(resolver, scannerConf, versionHeaderName)
+	if err != nil {
+		log.Fatalf("Failed to start the scanner: %s", err)
+	}
+	go pipeline.Forward(bucketScanner.CreateFeed(), feedChannel)
+}
+
+func startTechnicalEndpoint(akubraConf *config.Config, listen string, controlHandler *control.Handler) {
+	deadLetterQueue, err := akubraWatchdog.OpenDeadLetterQueue(&akubraConf.Watchdog)
+	if err != nil {
+		log.Fatalf("Failed to open dead-letter queue: %s", err)
+	}
+	serveMux := http.NewServeMux()
+	deadLetterHandler := akubraWatchdog.NewDeadLetterHandler(deadLetterQueue, akubraWatchdog.DeadLetterEndpointPath)
+	serveMux.Handle(akubraWatchdog.DeadLetterEndpointPath, deadLetterHandler)
+	serveMux.Handle(akubraWatchdog.DeadLetterEndpointPath+"/", deadLetterHandler)
+	serveMux.Handle(control.EndpointPath+"/", controlHandler)
+	go func() {
+		log.Printf("Starting technical HTTP endpoint on %s", listen)
+		log.Fatal(http.ListenAndServe(listen, serveMux))
+	}()
+}
@@ -0,0 +1,156 @@
+package worker
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/brim/s3"
+)
+
+const (
+	defaultAdaptiveWindow         = 10
+	defaultAdaptiveDecreaseFactor = 0.5
+	defaultAdaptiveErrorRate      = 0.1
+	// latencyUnit is the amount of data whose transfer time is compared to LatencyThreshold
+	latencyUnit = 1024 * 1024
+)
+
+// AdaptiveConcurrencyConfig tunes the limits of concurrent operations on every destination storage,
+// raised by one after a healthy window of operations and cut by DecreaseFactor after an unhealthy one
+type AdaptiveConcurrencyConfig struct {
+	MinPerBackend int
+	MaxPerBackend int
+	// Window is the number of operations after which the limit is adjusted
+	Window int
+	// LatencyThreshold is the highest healthy mean duration of moving a mebibyte, operations on
+	// smaller objects and deletes count as a mebibyte, zero ignores the latency
+	LatencyThreshold time.Duration
+	// ErrorRateThreshold is the highest healthy share of server and network errors
+	ErrorRateThreshold float64
+	DecreaseFactor     float64
+}
+
+// backendLimits keeps an adaptive limit of every destination storage
+type backendLimits struct {
+	config AdaptiveConcurrencyConfig
+	limits map[string]*adaptiveLimit
+	mx     sync.Mutex
+}
+
+func newBackendLimits(config AdaptiveConcurrencyConfig) *backendLimits {
+	if config.MinPerBackend < 1 {
+		config.MinPerBackend = 1
+	}
+	if config.MaxPerBackend < config.MinPerBackend {
+		config.MaxPerBackend = config.MinPerBackend
+	}
+	if config.Window < 1 {
+		config.Window = defaultAdaptiveWindow
+	}
+	if config.ErrorRateThreshold <= 0 {
+		config.ErrorRateThreshold = defaultAdaptiveErrorRate
+	}
+	if config.DecreaseFactor <= 0 || config.DecreaseFactor >= 1 {
+		config.DecreaseFactor = defaultAdaptiveDecreaseFactor
+	}
+	return &backendLimits{config: config, limits: make(map[string]*adaptiveLimit)}
+}
+
+// limitOf returns the limit of the storage, nil if the limits aren't adaptive
+func (limits *backendLimits) limitOf(endpoint string) *adaptiveLimit {
+	if limits == nil {
+		return nil
+	}
+	limits.mx.Lock()
+	defer limits.mx.Unlock()
+	if limit, ok := limits.limits[endpoint]; ok {
+		return limit
+	}
+	limit := &adaptiveLimit{
+		concurrencyLimit: newConcurrencyLimit(limits.config.MaxPerBackend),
+		config:           limits.config,
+		endpoint:         endpoint,
+		metricName:       fmt.Sprintf("watchdog.concurrency.%s.limit", backendMetricName(endpoint)),
+	}
+	metrics.UpdateGauge(limit.metricName, int64(limits.config.MaxPerBackend))
+	limits.limits[endpoint] = limit
+	return limit
+}
+
+// adaptiveLimit is the concurrency limit of a storage adjusted by the outcomes of the operations
+type adaptiveLimit struct {
+	*concurrencyLimit
+	config     AdaptiveConcurrencyConfig
+	endpoint   string
+	metricName string
+	operations int
+	failures   int
+	latency    time.Duration
+	// units is the number of mebibytes moved in the window, see latencyUnit
+	units    float64
+	windowMx sync.Mutex
+}
+
+// record adds the outcome of an operation moving the bytes to the window and adjusts the limit
+// when the window is full, the latency is normalised by the bytes so large objects don't look slow
+func (limit *adaptiveLimit) record(latency time.Duration, bytes int64, err error) {
+	if limit == nil {
+		return
+	}
+	limit.windowMx.Lock()
+	defer limit.windowMx.Unlock()
+	limit.operations++
+	limit.latency += latency
+	limit.units += math.Max(float64(bytes)/latencyUnit, 1)
+	if err != nil {
+		if class := s3.ClassifyError(err); class == s3.ServerErrorClass || class == s3.NetworkErrorClass {
+			limit.failures++
+		}
+	}
+	if limit.operations < limit.config.Window {
+		return
+	}
+	errorRate := float64(limit.failures) / float64(limit.operations)
+	meanLatency := time.Duration(float64(limit.latency) / limit.units)
+	limit.operations, limit.failures, limit.latency, limit.units = 0, 0, 0, 0
+
+	current, _ := limit.state()
+	adjusted := current + 1
+	if errorRate > limit.config.ErrorRateThreshold ||
+		(limit.config.LatencyThreshold > 0 && meanLatency > limit.config.LatencyThreshold) {
+		adjusted = int(float64(current) * limit.config.DecreaseFactor)
+		log.Printf("Storage '%s' is unhealthy (error rate %.2f, mean latency %s per MiB), limiting it to %d concurrent operations",
+			limit.endpoint, errorRate, meanLatency, maxInt(adjusted, limit.config.MinPerBackend))
+	}
+	adjusted = maxInt(minInt(adjusted, limit.config.MaxPerBackend), limit.config.MinPerBackend)
+	if adjusted != current {
+		limit.setLimit(adjusted)
+		metrics.UpdateGauge(limit.metricName, int64(adjusted))
+	}
+}
+
+func backendMetricName(endpoint string) string {
+	if parsed, err := url.Parse(endpoint); err == nil && parsed.Host != "" {
+		endpoint = parsed.Host
+	}
+	return metrics.Clean(endpoint)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
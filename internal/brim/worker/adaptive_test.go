@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldAdjustBackendLimitAdditivelyAndMultiplicatively(t *testing.T) {
+	limits := newBackendLimits(AdaptiveConcurrencyConfig{MinPerBackend: 1, MaxPerBackend: 8, Window: 2,
+		LatencyThreshold: time.Second})
+	limit := limits.limitOf("http://slow.example.com:8080")
+	assert.Equal(t, "watchdog.concurrency.slow_example_com_8080.limit", limit.metricName)
+
+	serverErr := &s3.Error{StatusCode: http.StatusServiceUnavailable}
+	limit.record(time.Millisecond, 0, serverErr)
+	limit.record(time.Millisecond, 0, nil)
+	current, _ := limit.state()
+	assert.Equal(t, 4, current)
+
+	limit.record(2*time.Second, 0, nil)
+	limit.record(2*time.Second, 0, nil)
+	current, _ = limit.state()
+	assert.Equal(t, 2, current)
+
+	for i := 0; i < 6; i++ {
+		limit.record(time.Millisecond, 0, serverErr)
+	}
+	current, _ = limit.state()
+	assert.Equal(t, 1, current)
+
+	for i := 0; i < 20; i++ {
+		limit.record(time.Millisecond, 0, &s3.Error{StatusCode: http.StatusNotFound})
+	}
+	current, _ = limit.state()
+	assert.Equal(t, 8, current)
+}
+
+func TestShouldNormaliseLatencyByMovedBytes(t *testing.T) {
+	limits := newBackendLimits(AdaptiveConcurrencyConfig{MinPerBackend: 1, MaxPerBackend: 8, Window: 2,
+		LatencyThreshold: time.Second})
+	limit := limits.limitOf("http://storage")
+	limit.setLimit(4)
+
+	limit.record(10*time.Second, 100*1024*1024, nil)
+	limit.record(10*time.Second, 100*1024*1024, nil)
+	current, _ := limit.state()
+	assert.Equal(t, 5, current)
+
+	limit.record(10*time.Second, 1024*1024, nil)
+	limit.record(10*time.Second, 1024*1024, nil)
+	current, _ = limit.state()
+	assert.Equal(t, 2, current)
+}
+
+func TestShouldNotStarveHealthyBackendsWhenOneIsSaturated(t *testing.T) {
+	walWorker := NewTaskMigratorWALWorker(2).(*TaskMigratorWALWorker)
+	walWorker.SetAdaptiveConcurrency(AdaptiveConcurrencyConfig{MaxPerBackend: 1})
+	unblock := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			_ = walWorker.onDestination("http://slow", 0, func() error {
+				<-unblock
+				return nil
+			})
+		}()
+	}
+	defer close(unblock)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, inUse := walWorker.Concurrency()
+		if inUse == 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "operation on the slow storage didn't start")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = walWorker.onDestination("http://healthy", 0, func() error { return nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("operation on a healthy storage waited for the saturated one")
+	}
+}
+
+func TestShouldHonourMultipartThreshold(t *testing.T) {
+	walWorker := NewTaskMigratorWALWorker(1).(*TaskMigratorWALWorker)
+	walWorker.SetMultiPartThresholdInBytes(10 * 1024 * 1024)
+	assert.Equal(t, 10*1024*1024, walWorker.minMultiPartObjectSize)
+
+	walWorker.SetMultiPartThresholdInBytes(0)
+	assert.Equal(t, oneHundredMB, walWorker.minMultiPartObjectSize)
+
+	walWorker.SetMultiPartThresholdInBytes(1024)
+	assert.Equal(t, minMultipartThreshold, walWorker.minMultiPartObjectSize)
+}
@@ -0,0 +1,47 @@
+package worker
+
+import "sync"
+
+// concurrencyLimit is a semaphore which limit can be changed at runtime
+type concurrencyLimit struct {
+	limit int
+	inUse int
+	mx    sync.Mutex
+	freed *sync.Cond
+}
+
+func newConcurrencyLimit(limit int) *concurrencyLimit {
+	concurrency := &concurrencyLimit{limit: limit}
+	concurrency.freed = sync.NewCond(&concurrency.mx)
+	return concurrency
+}
+
+func (concurrency *concurrencyLimit) acquire() {
+	concurrency.mx.Lock()
+	defer concurrency.mx.Unlock()
+	for concurrency.inUse >= concurrency.limit {
+		concurrency.freed.Wait()
+	}
+	concurrency.inUse++
+}
+
+func (concurrency *concurrencyLimit) release() {
+	concurrency.mx.Lock()
+	defer concurrency.mx.Unlock()
+	concurrency.inUse--
+	concurrency.freed.Signal()
+}
+
+// setLimit changes the limit, operations above a lowered limit finish undisturbed
+func (concurrency *concurrencyLimit) setLimit(limit int) {
+	concurrency.mx.Lock()
+	defer concurrency.mx.Unlock()
+	concurrency.limit = limit
+	concurrency.freed.Broadcast()
+}
+
+func (concurrency *concurrencyLimit) state() (limit, inUse int) {
+	concurrency.mx.Lock()
+	defer concurrency.mx.Unlock()
+	return concurrency.limit, concurrency.inUse
+}
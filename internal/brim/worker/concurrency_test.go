@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldAdmitMoreOperationsWhenConcurrencyLimitIsRaised(t *testing.T) {
+	concurrency := newConcurrencyLimit(1)
+	concurrency.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		concurrency.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("operation admitted above the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	concurrency.setLimit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("operation not admitted after the limit was raised")
+	}
+	limit, inUse := concurrency.state()
+	assert.Equal(t, 2, limit)
+	assert.Equal(t, 2, inUse)
+
+	concurrency.setLimit(1)
+	concurrency.release()
+	concurrency.release()
+	_, inUse = concurrency.state()
+	assert.Equal(t, 0, inUse)
+}
@@ -0,0 +1,140 @@
+package worker
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+)
+
+// Planned actions
+const (
+	CopyAction   = "copy"
+	DeleteAction = "delete"
+)
+
+// PlannedTask is a task the worker would perform
+type PlannedTask struct {
+	Domain        string   `json:"domain"`
+	ObjectID      string   `json:"objectId"`
+	ObjectVersion int      `json:"objectVersion"`
+	Operation     string   `json:"operation"`
+	SubResource   string   `json:"subResource,omitempty"`
+	Action        string   `json:"action"`
+	Source        string   `json:"source,omitempty"`
+	Destinations  []string `json:"destinations"`
+	ObjectSize    int64    `json:"objectSize"`
+	Reason        string   `json:"reason"`
+}
+
+// PlanSummary aggregates the planned tasks
+type PlanSummary struct {
+	Tasks   int `json:"tasks"`
+	Copies  int `json:"copies"`
+	Deletes int `json:"deletes"`
+	// Bytes is the size of all the copies to make, an object copied to two storages counts twice
+	Bytes int64 `json:"bytes"`
+	// InSync counts the records already reflected by the storages
+	InSync int `json:"inSync"`
+	// Failed counts the records the filter couldn't plan, e.g. because of unavailable storages
+	Failed   int            `json:"failed"`
+	ByReason map[string]int `json:"byReason"`
+}
+
+// TaskPlanner replaces the worker in dry runs, it writes the tasks as JSON lines instead of performing them
+// and never calls the hooks of the fed records
+type TaskPlanner struct {
+	encoder *json.Encoder
+	summary PlanSummary
+	mx      sync.Mutex
+}
+
+// NewTaskPlanner creates a TaskPlanner writing to the output
+func NewTaskPlanner(output io.Writer) *TaskPlanner {
+	return &TaskPlanner{encoder: json.NewEncoder(output), summary: PlanSummary{ByReason: make(map[string]int)}}
+}
+
+// Track replaces the hooks of the entries, so the failures to plan them are counted and the records are left untouched
+func (planner *TaskPlanner) Track(feed <-chan *model.WALEntry) <-chan *model.WALEntry {
+	tracked := make(chan *model.WALEntry, cap(feed))
+	go func() {
+		defer close(tracked)
+		for entry := range feed {
+			entry.RecordProcessedHook = planner.recordProcessed
+			tracked <- entry
+		}
+	}()
+	return tracked
+}
+
+func (planner *TaskPlanner) recordProcessed(_ *watchdog.ConsistencyRecord, err error) error {
+	if err != nil {
+		planner.mx.Lock()
+		planner.summary.Failed++
+		planner.mx.Unlock()
+	}
+	return nil
+}
+
+// Plan writes the tasks until the channel is closed and returns their summary
+func (planner *TaskPlanner) Plan(walTasksChan <-chan *model.WALTask) (PlanSummary, error) {
+	for task := range walTasksChan {
+		if err := planner.plan(task); err != nil {
+			return planner.Summary(), err
+		}
+	}
+	return planner.Summary(), nil
+}
+
+func (planner *TaskPlanner) plan(task *model.WALTask) error {
+	planner.mx.Lock()
+	defer planner.mx.Unlock()
+	if len(task.DestinationsClients) == 0 {
+		// tasks clearing the old shards have no destinations unless the object was moved between shards
+		if task.Reason == model.ReasonInSync {
+			planner.summary.InSync++
+		}
+		return nil
+	}
+	record := task.WALEntry.Record
+	planned := PlannedTask{
+		Domain:        record.Domain,
+		ObjectID:      record.ObjectID,
+		ObjectVersion: record.ObjectVersion,
+		Operation:     string(record.OperationOrDefault()),
+		SubResource:   string(record.SubResource),
+		Action:        CopyAction,
+		ObjectSize:    task.ObjectSize,
+		Reason:        task.Reason,
+	}
+	if task.SourceClient != nil {
+		planned.Source = task.SourceClient.S3Endpoint
+	}
+	for _, dstClient := range task.DestinationsClients {
+		planned.Destinations = append(planned.Destinations, dstClient.S3Endpoint)
+	}
+	planner.summary.Tasks++
+	planner.summary.ByReason[task.Reason]++
+	if record.Method == watchdog.DELETE {
+		planned.Action = DeleteAction
+		planner.summary.Deletes++
+	} else {
+		planner.summary.Copies++
+		planner.summary.Bytes += task.ObjectSize * int64(len(task.DestinationsClients))
+	}
+	return planner.encoder.Encode(planned)
+}
+
+// Summary returns the summary of the tasks planned so far
+func (planner *TaskPlanner) Summary() PlanSummary {
+	planner.mx.Lock()
+	defer planner.mx.Unlock()
+	summary := planner.summary
+	summary.ByReason = make(map[string]int, len(planner.summary.ByReason))
+	for reason, count := range planner.summary.ByReason {
+		summary.ByReason[reason] = count
+	}
+	return summary
+}
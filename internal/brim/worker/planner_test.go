@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func plannedClient(endpoint string) *s3.S3 {
+	return s3.New(aws.Auth{}, aws.Region{Name: "generic", S3Endpoint: endpoint})
+}
+
+func plannedTask(method watchdog.Method, reason string, size int64, src *s3.S3, dsts ...*s3.S3) *model.WALTask {
+	return &model.WALTask{
+		SourceClient:        src,
+		DestinationsClients: dsts,
+		WALEntry: &model.WALEntry{
+			Record: &watchdog.ConsistencyRecord{Domain: "example.com", ObjectID: "bucket/key", Method: method, ObjectVersion: 7},
+			RecordProcessedHook: func(_ *watchdog.ConsistencyRecord, _ error) error {
+				panic("planned records must be left untouched")
+			}},
+		Reason:     reason,
+		ObjectSize: size,
+	}
+}
+
+func TestTaskPlannerShouldWritePlannedTasksAndSummarizeThem(t *testing.T) {
+	output := &bytes.Buffer{}
+	planner := NewTaskPlanner(output)
+	tasks := make(chan *model.WALTask, 4)
+	tasks <- plannedTask(watchdog.PUT, model.ReasonOutdatedCopies, 100, plannedClient("http://src:9000"),
+		plannedClient("http://dst1:9000"), plannedClient("http://dst2:9000"))
+	tasks <- plannedTask(watchdog.DELETE, model.ReasonOldShardCopies, 0, nil, plannedClient("http://old:9000"))
+	tasks <- plannedTask(watchdog.PUT, model.ReasonInSync, 0, nil)
+	tasks <- plannedTask(watchdog.DELETE, model.ReasonOldShardCopies, 0, nil)
+	close(tasks)
+
+	summary, err := planner.Plan(tasks)
+
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 2)
+	var copyTask, deleteTask PlannedTask
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &copyTask))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &deleteTask))
+	assert.Equal(t, PlannedTask{Domain: "example.com", ObjectID: "bucket/key", ObjectVersion: 7, Operation: "object",
+		Action: CopyAction, Source: "http://src:9000", Destinations: []string{"http://dst1:9000", "http://dst2:9000"},
+		ObjectSize: 100, Reason: model.ReasonOutdatedCopies}, copyTask)
+	assert.Equal(t, DeleteAction, deleteTask.Action)
+	assert.Equal(t, []string{"http://old:9000"}, deleteTask.Destinations)
+	assert.Equal(t, PlanSummary{Tasks: 2, Copies: 1, Deletes: 1, Bytes: 200, InSync: 1,
+		ByReason: map[string]int{model.ReasonOutdatedCopies: 1, model.ReasonOldShardCopies: 1}}, summary)
+}
+
+func TestTaskPlannerShouldCountRecordsFailedInTheFilter(t *testing.T) {
+	planner := NewTaskPlanner(&bytes.Buffer{})
+	feed := make(chan *model.WALEntry, 1)
+	feed <- plannedTask(watchdog.PUT, "", 0, nil).WALEntry
+	close(feed)
+
+	for entry := range planner.Track(feed) {
+		assert.NoError(t, entry.RecordProcessedHook(entry.Record, errors.New("storage unavailable")))
+	}
+
+	assert.Equal(t, 1, planner.Summary().Failed)
+}
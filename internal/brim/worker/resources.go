@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"fmt"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/util"
+	"github.com/pkg/errors"
+)
+
+// performResourceSync replays a bucket or sub-resource change on the destinations
+func (walWorker *TaskMigratorWALWorker) performResourceSync(task *model.WALTask) error {
+	record := task.WALEntry.Record
+	if record.Method == watchdog.PUT && task.SourceClient == nil {
+		return fmt.Errorf("no source storage to sync %s of '%s' from", record.OperationOrDefault(), record.ObjectID)
+	}
+	bucketName, key := record.ObjectID, ""
+	if record.Operation != watchdog.BucketOperation {
+		var err error
+		if bucketName, key, err = util.SplitKeyIntoBucketKey(record.ObjectID); err != nil {
+			return err
+		}
+	}
+
+	var document []byte
+	if record.SubResource != "" && record.Method == watchdog.PUT {
+		var err error
+		walWorker.concurrency.acquire()
+		document, err = brimS3.GetSubResource(task.SourceClient, bucketName, key, string(record.SubResource))
+		walWorker.concurrency.release()
+		if err != nil {
+			return model.NewBackendError(task.SourceClient.S3Endpoint, err)
+		}
+		if document == nil {
+			return fmt.Errorf("%s of '%s' is no longer set on source '%s'", record.SubResource, record.ObjectID, task.SourceClient.S3Endpoint)
+		}
+	}
+
+	for _, dstClient := range task.DestinationsClients {
+		err := walWorker.onDestination(dstClient.S3Endpoint, 0, func() error {
+			return syncResource(record, task.SourceClient, dstClient, bucketName, key, document)
+		})
+		if err != nil {
+			return model.NewBackendError(dstClient.S3Endpoint, err)
+		}
+		log.Printf("Synced %s %s of '%s' in domain '%s' on '%s'",
+			record.OperationOrDefault(), record.SubResource, record.ObjectID, record.Domain, dstClient.S3Endpoint)
+	}
+	return nil
+}
+
+func syncResource(record *watchdog.ConsistencyRecord, srcClient, dstClient *s3.S3, bucketName, key string, document []byte) error {
+	switch {
+	case record.SubResource == "" && record.Method == watchdog.PUT:
+		srcErr, dstErr := brimS3.CopyBucket(bucketName, bucketName, srcClient, dstClient, true)
+		if srcErr != nil {
+			return srcErr
+		}
+		return dstErr
+	case record.SubResource == "" && record.Method == watchdog.DELETE:
+		return brimS3.DeleteBucket(dstClient, bucketName)
+	case record.Method == watchdog.PUT:
+		return brimS3.PutSubResource(dstClient, bucketName, key, string(record.SubResource), document)
+	case record.Method == watchdog.DELETE:
+		return brimS3.DeleteSubResource(dstClient, bucketName, string(record.SubResource))
+	}
+	return errors.New("unsupported method")
+}
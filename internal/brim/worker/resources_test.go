@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/watchdog"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedRequest struct {
+	method string
+	path   string
+	query  string
+	body   string
+}
+
+func recordingStorage(t *testing.T, responseBody string, requests *[]recordedRequest, mutex *sync.Mutex) (*httptest.Server, *s3.S3) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(t, err)
+		mutex.Lock()
+		*requests = append(*requests, recordedRequest{req.Method, req.URL.Path, req.URL.RawQuery, string(body)})
+		mutex.Unlock()
+		if req.Method == http.MethodDelete {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = rw.Write([]byte(responseBody))
+	}))
+	client := s3.New(aws.Auth{AccessKey: "123", SecretKey: "321"}, aws.Region{Name: "generic", S3Endpoint: server.URL})
+	return server, client
+}
+
+func processResourceTask(t *testing.T, task *model.WALTask) error {
+	taskChannel := make(chan *model.WALTask, 1)
+	tasksWG := sync.WaitGroup{}
+	tasksWG.Add(1)
+	var taskErr error
+	task.WALEntry.RecordProcessedHook = func(_ *watchdog.ConsistencyRecord, err error) error {
+		defer tasksWG.Done()
+		taskErr = err
+		return nil
+	}
+	taskChannel <- task
+	NewTaskMigratorWALWorker(1).Process(taskChannel)
+	tasksWG.Wait()
+	return taskErr
+}
+
+func TestShouldCopyBucketSubResourceDocumentToDestinations(t *testing.T) {
+	mutex := &sync.Mutex{}
+	var srcRequests, dstRequests []recordedRequest
+	srcStorage, srcClient := recordingStorage(t, "<CORSConfiguration/>", &srcRequests, mutex)
+	defer srcStorage.Close()
+	dstStorage, dstClient := recordingStorage(t, "", &dstRequests, mutex)
+	defer dstStorage.Close()
+
+	err := processResourceTask(t, &model.WALTask{
+		SourceClient:        srcClient,
+		DestinationsClients: []*s3.S3{dstClient},
+		WALEntry: &model.WALEntry{Record: &watchdog.ConsistencyRecord{
+			ObjectID: "bucket", Method: watchdog.PUT, Operation: watchdog.BucketOperation, SubResource: watchdog.CORSSubResource}},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, []recordedRequest{{http.MethodGet, "/bucket", "cors", ""}}, srcRequests)
+	assert.Equal(t, []recordedRequest{{http.MethodPut, "/bucket", "cors", "<CORSConfiguration/>"}}, dstRequests)
+}
+
+func TestShouldDeleteBucketsAndSubResourcesFromDestinations(t *testing.T) {
+	for _, testCase := range []struct {
+		subResource   watchdog.SubResource
+		expectedQuery string
+	}{
+		{"", ""},
+		{watchdog.LifecycleSubResource, "lifecycle"},
+	} {
+		mutex := &sync.Mutex{}
+		var dstRequests []recordedRequest
+		dstStorage, dstClient := recordingStorage(t, "", &dstRequests, mutex)
+
+		err := processResourceTask(t, &model.WALTask{
+			DestinationsClients: []*s3.S3{dstClient},
+			WALEntry: &model.WALEntry{Record: &watchdog.ConsistencyRecord{
+				ObjectID: "bucket", Method: watchdog.DELETE, Operation: watchdog.BucketOperation, SubResource: testCase.subResource}},
+		})
+		dstStorage.Close()
+
+		require.NoError(t, err)
+		require.Len(t, dstRequests, 1)
+		assert.Equal(t, http.MethodDelete, dstRequests[0].method)
+		assert.Equal(t, testCase.expectedQuery, dstRequests[0].query)
+	}
+}
@@ -0,0 +1,130 @@
+package worker
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/akubra/log"
+	"github.com/allegro/akubra/internal/akubra/metrics"
+	"github.com/allegro/akubra/internal/brim/filter"
+	"github.com/allegro/akubra/internal/brim/model"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/store"
+)
+
+// VerificationConfig tells how thoroughly migrated objects are verified
+type VerificationConfig struct {
+	// Checksum compares MD5 of the whole content of the source and the destination
+	Checksum bool
+	// DeleteInvalidCopies removes destination copies which failed the verification
+	DeleteInvalidCopies bool
+}
+
+// MigrationVerifier compares migrated objects with their source
+type MigrationVerifier struct {
+	versionFetcher filter.VersionFetcher
+	config         VerificationConfig
+}
+
+// NewMigrationVerifier creates a MigrationVerifier reading objects' state with the version fetcher
+func NewMigrationVerifier(versionFetcher filter.VersionFetcher, config VerificationConfig) *MigrationVerifier {
+	return &MigrationVerifier{versionFetcher: versionFetcher, config: config}
+}
+
+// Verify checks size, ETag, version and optionally the checksum of the destination copy
+func (verifier *MigrationVerifier) Verify(src, dst *s3.S3, domain, bucketName, key string) error {
+	srcState, err := verifier.versionFetcher.Fetch(context.Background(), migrationAuth(src), bucketName, key)
+	if err != nil {
+		return model.NewBackendError(src.S3Endpoint, err)
+	}
+	dstState, err := verifier.versionFetcher.Fetch(context.Background(), migrationAuth(dst), bucketName, key)
+	if err != nil {
+		return model.NewBackendError(dst.S3Endpoint, err)
+	}
+	reason := compareStates(srcState, dstState)
+	if reason == "" && verifier.config.Checksum {
+		reason, err = compareChecksums(src, dst, bucketName, key)
+		if err != nil {
+			return err
+		}
+	}
+	normalizedDomain := metrics.Clean(domain)
+	if reason == "" {
+		metrics.Mark(fmt.Sprintf("watchdog.verification.%s.success", normalizedDomain))
+		return nil
+	}
+	metrics.Mark(fmt.Sprintf("watchdog.verification.%s.failure", normalizedDomain))
+	log.Printf("Verification of object '%s/%s' copied from %s to %s failed: %s", bucketName, key, src.S3Endpoint, dst.S3Endpoint, reason)
+	if verifier.config.DeleteInvalidCopies && !dstState.ObjectNotFound() {
+		if err := deleteObject(dst, bucketName, key); err != nil {
+			log.Printf("Could not delete invalid copy of '%s/%s' from %s: %s", bucketName, key, dst.S3Endpoint, err)
+		}
+	}
+	return model.NewBackendError(dst.S3Endpoint, &model.VerificationError{Reason: reason})
+}
+
+func compareStates(srcState, dstState *filter.StorageState) string {
+	switch {
+	case dstState.ObjectNotFound():
+		return "object is missing"
+	case srcState.ContentLength() != dstState.ContentLength():
+		return fmt.Sprintf("size %d differs from source size %d", dstState.ContentLength(), srcState.ContentLength())
+	case srcState.Version() != dstState.Version():
+		return fmt.Sprintf("version %d differs from source version %d", dstState.Version(), srcState.Version())
+	case !brimS3.ETagsMatch(srcState.ETag(), dstState.ETag()):
+		return fmt.Sprintf("ETag %s differs from source ETag %s", dstState.ETag(), srcState.ETag())
+	}
+	return ""
+}
+
+func compareChecksums(src, dst *s3.S3, bucketName, key string) (string, error) {
+	srcChecksum, err := contentChecksum(src, bucketName, key)
+	if err != nil {
+		return "", model.NewBackendError(src.S3Endpoint, err)
+	}
+	dstChecksum, err := contentChecksum(dst, bucketName, key)
+	if err != nil {
+		return "", model.NewBackendError(dst.S3Endpoint, err)
+	}
+	if srcChecksum != dstChecksum {
+		return fmt.Sprintf("checksum %s differs from source checksum %s", dstChecksum, srcChecksum), nil
+	}
+	return "", nil
+}
+
+func contentChecksum(client *s3.S3, bucketName, key string) (string, error) {
+	storage, err := store.ForClient(client)
+	if err != nil {
+		return "", err
+	}
+	body, _, err := storage.Get(bucketName, key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if closeErr := body.Close(); closeErr != nil {
+			log.Debugf("Object body close error %s/%s: %s", bucketName, key, closeErr)
+		}
+	}()
+	hash := md5.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func deleteObject(client *s3.S3, bucketName, key string) error {
+	storage, err := store.ForClient(client)
+	if err != nil {
+		return err
+	}
+	return brimS3.DeleteObject(storage, bucketName, key)
+}
+
+func migrationAuth(client *s3.S3) *brimS3.MigrationAuth {
+	return &brimS3.MigrationAuth{Endpoint: client.S3Endpoint, AccessKey: client.Auth.AccessKey, SecretKey: client.Auth.SecretKey}
+}
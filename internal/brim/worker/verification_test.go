@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/allegro/akubra/internal/brim/filter"
+	"github.com/allegro/akubra/internal/brim/model"
+	"github.com/stretchr/testify/assert"
+)
+
+type verifiedStorage struct {
+	content string
+	etag    string
+	version int
+	deleted bool
+}
+
+func (storage *verifiedStorage) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodDelete:
+		storage.deleted = true
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodHead:
+		rw.Header().Set("Content-Length", strconv.Itoa(len(storage.content)))
+	}
+	rw.Header().Set("ETag", storage.etag)
+	rw.Header().Set("x-amz-meta-version", strconv.Itoa(storage.version))
+	if req.Method == http.MethodGet {
+		_, _ = rw.Write([]byte(storage.content))
+	}
+}
+
+func verifiedClient(storage *verifiedStorage) (*s3.S3, func()) {
+	server := httptest.NewServer(storage)
+	return s3.New(aws.Auth{AccessKey: "123", SecretKey: "321"}, aws.Region{Name: "generic", S3Endpoint: server.URL}), server.Close
+}
+
+func TestShouldVerifyMigratedCopies(t *testing.T) {
+	for _, scenario := range []struct {
+		name          string
+		srcETag       string
+		dst           verifiedStorage
+		config        VerificationConfig
+		expectFailure bool
+	}{
+		{name: "identical copy", dst: verifiedStorage{content: "content", etag: `"abc"`, version: 7}},
+		{name: "truncated copy", dst: verifiedStorage{content: "cont", etag: `"abc"`, version: 7}, expectFailure: true},
+		{name: "stale version", dst: verifiedStorage{content: "content", etag: `"abc"`, version: 6}, expectFailure: true},
+		{name: "different ETag", dst: verifiedStorage{content: "content", etag: `"abd"`, version: 7}, expectFailure: true},
+		{name: "multipart copy", dst: verifiedStorage{content: "content", etag: `"def-2"`, version: 7}},
+		{name: "multipart copy of the same part count", srcETag: `"abc-3"`, dst: verifiedStorage{content: "content", etag: `"def-3"`, version: 7}},
+		{name: "multipart copy of another part count", srcETag: `"abc-3"`, dst: verifiedStorage{content: "content", etag: `"abc-4"`, version: 7},
+			expectFailure: true},
+		{name: "corrupted content without checksums", dst: verifiedStorage{content: "CONTENT", etag: `"abc"`, version: 7}},
+		{name: "corrupted content", dst: verifiedStorage{content: "CONTENT", etag: `"abc"`, version: 7},
+			config: VerificationConfig{Checksum: true, DeleteInvalidCopies: true}, expectFailure: true},
+	} {
+		srcETag := scenario.srcETag
+		if srcETag == "" {
+			srcETag = `"abc"`
+		}
+		src, closeSrc := verifiedClient(&verifiedStorage{content: "content", etag: srcETag, version: 7})
+		dst, closeDst := verifiedClient(&scenario.dst)
+		verifier := NewMigrationVerifier(&filter.S3VersionFetcher{VersionHeaderName: "x-amz-meta-version"}, scenario.config)
+
+		err := verifier.Verify(src, dst, "domain", "bucket", "key")
+
+		var verificationErr *model.VerificationError
+		assert.Equal(t, scenario.expectFailure, errors.As(err, &verificationErr), scenario.name)
+		assert.Equal(t, scenario.expectFailure && scenario.config.DeleteInvalidCopies, scenario.dst.deleted, scenario.name)
+		closeSrc()
+		closeDst()
+	}
+}
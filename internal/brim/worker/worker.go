@@ -2,7 +2,7 @@ package worker
 
 import (
 	"fmt"
-	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/allegro/akubra/internal/akubra/log"
@@ -11,40 +11,120 @@ import (
 	"github.com/allegro/akubra/internal/brim/model"
 	model2 "github.com/allegro/akubra/internal/brim/model"
 	"github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/store"
 	"github.com/allegro/akubra/internal/brim/util"
 	"github.com/pkg/errors"
 )
 
-const oneHundredMB = 100000000
+const (
+	oneHundredMB = 100000000
+	// minMultipartThreshold is the smallest part allowed by S3, smaller objects can't be split into parts
+	minMultipartThreshold = 5 * 1024 * 1024
+)
 
 //WALWorker performs the migrations
 type WALWorker interface {
 	Process(walTasksChan <-chan *model.WALTask)
 	SetMultiPartThresholdInBytes(numOfBytes int)
+	SetMultipartConfig(config s3.MultipartConfig)
+	SetMigrationVerifier(verifier *MigrationVerifier)
+	SetMetadataFilter(filter s3.MetadataFilter)
+	SetAdaptiveConcurrency(config AdaptiveConcurrencyConfig)
+	SetConcurrency(maxConcurrentMigrations int)
+	Concurrency() (limit, inUse int)
+	InFlightTasks() int
 }
 
 //TaskMigratorWALWorker uses TaskMigrator for migrations
 type TaskMigratorWALWorker struct {
-	semaphore              chan struct{}
+	concurrency            *concurrencyLimit
+	backendLimits          *backendLimits
+	inFlightTasks          int64
 	minMultiPartObjectSize int
+	multipartConfig        s3.MultipartConfig
+	verifier               *MigrationVerifier
+	metadataFilter         s3.MetadataFilter
 }
 
+//SetMultiPartThresholdInBytes sets the size from which objects are migrated with multipart uploads,
+//thresholds below the minimal part size are raised to it
 func (walWorker *TaskMigratorWALWorker) SetMultiPartThresholdInBytes(numOfBytes int) {
-	walWorker.minMultiPartObjectSize = oneHundredMB
+	if numOfBytes <= 0 {
+		numOfBytes = oneHundredMB
+	}
+	if numOfBytes < minMultipartThreshold {
+		log.Printf("Multipart threshold of %d bytes is below the minimal part size, using %d bytes", numOfBytes, minMultipartThreshold)
+		numOfBytes = minMultipartThreshold
+	}
+	walWorker.minMultiPartObjectSize = numOfBytes
+}
+
+//SetMultipartConfig sets the limits of streamed multipart migrations
+func (walWorker *TaskMigratorWALWorker) SetMultipartConfig(config s3.MultipartConfig) {
+	walWorker.multipartConfig = config
+}
+
+//SetMigrationVerifier makes the worker verify every migrated copy, nil disables verification
+func (walWorker *TaskMigratorWALWorker) SetMigrationVerifier(verifier *MigrationVerifier) {
+	walWorker.verifier = verifier
+}
+
+//SetMetadataFilter selects the object attributes copied by migrations
+func (walWorker *TaskMigratorWALWorker) SetMetadataFilter(filter s3.MetadataFilter) {
+	walWorker.metadataFilter = filter
+}
+
+//SetAdaptiveConcurrency limits the operations on every destination storage separately,
+//the limits follow the latency and error rate of the storages
+func (walWorker *TaskMigratorWALWorker) SetAdaptiveConcurrency(config AdaptiveConcurrencyConfig) {
+	walWorker.backendLimits = newBackendLimits(config)
+}
+
+//SetConcurrency changes the number of storage operations performed at once
+func (walWorker *TaskMigratorWALWorker) SetConcurrency(maxConcurrentMigrations int) {
+	walWorker.concurrency.setLimit(maxConcurrentMigrations)
+}
+
+//Concurrency returns the limit and the number of storage operations in progress
+func (walWorker *TaskMigratorWALWorker) Concurrency() (limit, inUse int) {
+	return walWorker.concurrency.state()
+}
+
+//InFlightTasks returns the number of tasks being processed
+func (walWorker *TaskMigratorWALWorker) InFlightTasks() int {
+	return int(atomic.LoadInt64(&walWorker.inFlightTasks))
+}
+
+//onDestination performs the operation moving the bytes within the limits of the destination storage and the worker,
+//the destination limit is taken first so operations on a slow storage don't hold the worker's limit
+func (walWorker *TaskMigratorWALWorker) onDestination(endpoint string, bytes int64, operation func() error) error {
+	backendLimit := walWorker.backendLimits.limitOf(endpoint)
+	if backendLimit != nil {
+		backendLimit.acquire()
+		defer backendLimit.release()
+	}
+	walWorker.concurrency.acquire()
+	since := time.Now()
+	err := operation()
+	walWorker.concurrency.release()
+	backendLimit.record(time.Since(since), bytes, err)
+	return err
 }
 
 //NewTaskMigratorWALWorker creates an instance of TaskMigratorWALWorker
 func NewTaskMigratorWALWorker(maxConcurrentMigrations int) WALWorker {
 	return &TaskMigratorWALWorker{
-		semaphore:              make(chan struct{}, maxConcurrentMigrations),
+		concurrency:            newConcurrencyLimit(maxConcurrentMigrations),
 		minMultiPartObjectSize: oneHundredMB}
 }
 
 //Process processes the channel of tasks and performs the migrations themselves
 func (walWorker *TaskMigratorWALWorker) Process(walTasksChan <-chan *model.WALTask) {
-	go func(walTasksChan <-chan *model.WALTask, semaphore chan struct{}) {
+	go func(walTasksChan <-chan *model.WALTask) {
 		for walTask := range walTasksChan {
+			atomic.AddInt64(&walWorker.inFlightTasks, 1)
 			go func(task *model.WALTask) {
+				defer atomic.AddInt64(&walWorker.inFlightTasks, -1)
 
 				record := task.WALEntry.Record
 				if task.SourceClient == nil && len(task.DestinationsClients) == 0 {
@@ -60,7 +140,7 @@ func (walWorker *TaskMigratorWALWorker) Process(walTasksChan <-chan *model.WALTa
 
 			}(walTask)
 		}
-	}(walTasksChan, walWorker.semaphore)
+	}(walTasksChan)
 }
 
 func (walWorker *TaskMigratorWALWorker) processTask(walTask *model.WALTask) error {
@@ -70,15 +150,24 @@ func (walWorker *TaskMigratorWALWorker) processTask(walTask *model.WALTask) erro
 	}
 
 	var err error
+	var copiedBytes int64
 	since := time.Now()
 	operation := "migration"
-	switch walTask.WALEntry.Record.Method {
-	case watchdog.PUT:
+	switch record := walTask.WALEntry.Record; {
+	case !record.IsObjectContent():
+		operation = "bucket"
+		if record.SubResource != "" {
+			operation = "subresource"
+		}
+		log.Debugf("Syncing %s %s of '%s' in domain %s to destinations %s",
+			record.OperationOrDefault(), record.SubResource, record.ObjectID, record.Domain, dstEndpoints)
+		err = walWorker.performResourceSync(walTask)
+	case record.Method == watchdog.PUT:
 		log.Debugf("Performing migration of object %s in domain %s to version %s. Source %s -> destinations %s",
 			walTask.WALEntry.Record.ObjectID, walTask.WALEntry.Record.Domain, walTask.WALEntry.Record.ObjectVersion,
 			walTask.SourceClient.S3Endpoint, dstEndpoints)
-		err = walWorker.performMigration(walTask)
-	case watchdog.DELETE:
+		copiedBytes, err = walWorker.performMigration(walTask)
+	case record.Method == watchdog.DELETE:
 		operation = "delete"
 		log.Debugf("Deleting object %s in domain %s from storages %s",
 			walTask.WALEntry.Record.ObjectID, walTask.WALEntry.Record.Domain, dstEndpoints)
@@ -87,50 +176,77 @@ func (walWorker *TaskMigratorWALWorker) processTask(walTask *model.WALTask) erro
 		return errors.New("unsupported method")
 	}
 
-	normalizedDomain := metrics.Clean(walTask.WALEntry.Record.Domain)
+	reportTask(operation, walTask.WALEntry.Record.Domain, since, copiedBytes, err)
+	return err
+}
+
+// reportTask exports the duration, outcome and bytes copied of a task
+func reportTask(operation, domain string, since time.Time, copiedBytes int64, err error) {
+	normalizedDomain := metrics.Clean(domain)
+	outcome := "success"
 	if err == nil {
 		metrics.UpdateSince(fmt.Sprintf("watchdog.%s.%s.success", operation, normalizedDomain), since)
 	} else {
 		metrics.UpdateSince(fmt.Sprintf("watchdog.%s.%s.failure", operation, normalizedDomain), since)
+		outcome = s3.ClassifyError(err)
+	}
+	metrics.Mark(fmt.Sprintf("watchdog.%s.%s.outcome.%s", operation, normalizedDomain, outcome))
+	if copiedBytes > 0 {
+		metrics.UpdateHistogram(fmt.Sprintf("watchdog.%s.%s.bytes", operation, normalizedDomain), copiedBytes)
 	}
-	return err
 }
 
-func (walWorker *TaskMigratorWALWorker) performMigration(task *model.WALTask) error {
+func (walWorker *TaskMigratorWALWorker) performMigration(task *model.WALTask) (int64, error) {
 	bucketName, key, err := util.SplitKeyIntoBucketKey(task.WALEntry.Record.ObjectID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	srcBucket := task.SourceClient.Bucket(bucketName)
-
-	resp, err := srcBucket.Head(key, http.Header{})
+	srcStorage, err := store.ForClient(task.SourceClient)
+	if err != nil {
+		return 0, model.NewBackendError(task.SourceClient.S3Endpoint, err)
+	}
+	info, err := srcStorage.Head(bucketName, key)
 	if err != nil {
-		return err
+		return 0, model.NewBackendError(task.SourceClient.S3Endpoint, err)
 	}
 
+	var copiedBytes int64
 	for _, dstClient := range task.DestinationsClients {
 		migrator := s3.TaskMigrator{
-			SrcS3Client: task.SourceClient,
-			DstS3Client: dstClient,
-			Task:        copyObjectTask(srcBucket.S3Endpoint, dstClient.S3Endpoint, bucketName, key),
-			Multipart:   resp.ContentLength >= oneHundredMB,
+			SrcS3Client:     task.SourceClient,
+			DstS3Client:     dstClient,
+			Task:            copyObjectTask(task.SourceClient.S3Endpoint, dstClient.S3Endpoint, bucketName, key),
+			Multipart:       info.Size >= int64(walWorker.minMultiPartObjectSize),
+			MultipartConfig: walWorker.multipartConfig,
+			MetadataFilter:  walWorker.metadataFilter,
 		}
 
-		walWorker.semaphore <- struct{}{}
-		srcError, dstError := migrator.Run()
-		<-walWorker.semaphore
+		var srcError error
+		dstError := walWorker.onDestination(dstClient.S3Endpoint, info.Size, func() error {
+			var dstError error
+			srcError, dstError = migrator.Run()
+			return dstError
+		})
 
 		if srcError != nil {
-			return srcError
+			return copiedBytes, model.NewBackendError(task.SourceClient.S3Endpoint, srcError)
 		} else if dstError != nil {
-			return dstError
+			return copiedBytes, model.NewBackendError(dstClient.S3Endpoint, dstError)
+		}
+		copiedBytes += info.Size
+
+		if walWorker.verifier != nil {
+			err := walWorker.verifier.Verify(task.SourceClient, dstClient, task.WALEntry.Record.Domain, bucketName, key)
+			if err != nil {
+				return copiedBytes, err
+			}
 		}
 	}
 
 	log.Debugf("Synchronization of object '%s' in domain '%s' successful",
 		task.WALEntry.Record.ObjectID, task.WALEntry.Record.Domain)
-	return nil
+	return copiedBytes, nil
 }
 func copyObjectTask(srcEndpoint string, dstEndpoint string, bucket string, key string) s3.MigrationTaskData {
 	return s3.NewMigrationTaskData("copy", model2.ACLCopyFromSource,
@@ -146,12 +262,15 @@ func (walWorker *TaskMigratorWALWorker) performDelete(task *model.WALTask) error
 			return err
 		}
 		log.Debugf("Deleting object '%s/%s' from '%s'", bucketName, key, client.S3Endpoint)
-		walWorker.semaphore <- struct{}{}
-		bucket := client.Bucket(bucketName)
-		err = bucket.Del(key)
-		<-walWorker.semaphore
+		err = walWorker.onDestination(client.S3Endpoint, 0, func() error {
+			storage, err := store.ForClient(client)
+			if err != nil {
+				return err
+			}
+			return storage.Delete(bucketName, key)
+		})
 		if err != nil {
-			return err
+			return model.NewBackendError(client.S3Endpoint, err)
 		}
 		deletesPerformed++
 		log.Printf("Deleted object '%s/%s' from '%s'", bucketName, key, client.S3Endpoint)
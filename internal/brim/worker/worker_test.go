@@ -6,14 +6,20 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
 	"github.com/allegro/akubra/internal/akubra/watchdog"
+	brimS3 "github.com/allegro/akubra/internal/brim/s3"
+	"github.com/allegro/akubra/internal/brim/store"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestShouldPerformNoMigrationIfThereAreNoDestClientsDefined(t *testing.T) {
@@ -120,7 +126,8 @@ func TestMigrations(t *testing.T) {
 				}}}
 
 		worker := NewTaskMigratorWALWorker(1)
-		worker.SetMultiPartThresholdInBytes(10)
+		// below the minimal part size accepted by SetMultiPartThresholdInBytes, to keep the objects small
+		worker.(*TaskMigratorWALWorker).minMultiPartObjectSize = 10
 		worker.Process(taskChannel)
 
 		taskChannel <- migration
@@ -141,18 +148,30 @@ func prepareDstServer(expectedMethod string, objSize int, expectMultiPart bool,
 		body, err := ioutil.ReadAll(req.Body)
 		assert.NoError(t, err)
 
+		if _, isACL := req.URL.Query()["acl"]; isACL {
+			if req.Method == http.MethodGet {
+				_, _ = rw.Write([]byte(bucketACLResponse))
+				return
+			}
+			assert.Equal(t, http.MethodPut, req.Method)
+			acl, err := s3.ParseAclFromXml(string(body))
+			assert.NoError(t, err)
+			assert.Equal(t, "*** Owner-Canonical-User-ID ***", acl.Owner.ID)
+			return
+		}
+
 		if expectedMethod == "PUT" {
 			assert.Equal(t, body, []byte(strings.Repeat("X", objSize)))
 			if !expectMultiPart {
 				assert.Equal(t, req.Method, expectedMethod)
 				assert.Equal(t, req.URL.Path, "/bucket/key")
-				assert.Equal(t, req.Header.Get("x-amz-meta-obj-version"), string(expectedVersion))
+				assert.Equal(t, req.Header.Get("x-amz-meta-obj-version"), string(rune(expectedVersion)))
 
 			}
 		}
 
 		if expectMultiPart {
-			assert.True(t, (req.Method == http.MethodPost && req.Header.Get("x-amz-meta-obj-version") == string(expectedVersion)) ||
+			assert.True(t, (req.Method == http.MethodPost && req.Header.Get("x-amz-meta-obj-version") == string(rune(expectedVersion))) ||
 				req.Method == http.MethodPut ||
 				req.Method == http.MethodHead)
 
@@ -176,10 +195,13 @@ func prepareSrcServer(objVersion int, objSize int, t *testing.T) *httptest.Serve
 		assert.True(t, http.MethodGet == req.Method || http.MethodHead == req.Method)
 		assert.True(t, strings.HasPrefix(req.URL.Path, "/bucket/key"))
 		assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"), "AWS 123:"))
-		if req.URL.RawQuery == "acl=" {
+		query := req.URL.Query()
+		if _, isACL := query["acl"]; isACL {
 			_, _ = rw.Write([]byte(bucketACLResponse))
+		} else if _, isTagging := query["tagging"]; isTagging {
+			rw.WriteHeader(http.StatusNotFound)
 		} else {
-			rw.Header().Set("x-amz-meta-obj-version", string(objVersion))
+			rw.Header().Set("x-amz-meta-obj-version", string(rune(objVersion)))
 			rw.WriteHeader(200)
 			if http.MethodGet == req.Method {
 				rw.Header().Set("Content-Length", fmt.Sprintf("%d", objSize))
@@ -213,3 +235,81 @@ const (
 </AccessControlPolicy>
 `
 )
+
+func TestShouldReportTaskOutcomeAndCopiedBytes(t *testing.T) {
+	reportTask("migration", "reported.qxlint", time.Now(), 20, nil)
+	reportTask("migration", "reported.qxlint", time.Now(), 0, &s3.Error{StatusCode: http.StatusForbidden})
+
+	success, _ := metrics.Get("watchdog.migration.reported_qxlint.outcome.success").(metrics.Meter)
+	forbidden, _ := metrics.Get("watchdog.migration.reported_qxlint.outcome.forbidden").(metrics.Meter)
+	copiedBytes, _ := metrics.Get("watchdog.migration.reported_qxlint.bytes").(metrics.Histogram)
+	assert.Equal(t, int64(1), success.Count())
+	assert.Equal(t, int64(1), forbidden.Count())
+	assert.Equal(t, int64(1), copiedBytes.Count())
+	assert.Equal(t, int64(20), copiedBytes.Max())
+}
+
+func TestShouldMigrateObjectsBetweenLocalDirectories(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "brim-src")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(srcDir) }()
+	dstDir, err := ioutil.TempDir("", "brim-dst")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dstDir) }()
+
+	srcStore, err := store.NewFSStore(srcDir)
+	require.NoError(t, err)
+	require.NoError(t, srcStore.CreateBucket("bucket", http.Header{}))
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("X-Amz-Acl", string(s3.PublicRead))
+	header.Set("X-Amz-Meta-Obj-Version", "3")
+	for key, content := range map[string]string{"small": "data", "large": strings.Repeat("X", 20)} {
+		require.NoError(t, srcStore.Put("bucket", key, strings.NewReader(content), int64(len(content)), header))
+	}
+	require.NoError(t, srcStore.PutSubResource("bucket", "large", "tagging", []byte(
+		`<Tagging><TagSet><Tag><Key>tier</Key><Value>cold</Value></Tag></TagSet></Tagging>`)))
+
+	dstStore, err := store.NewFSStore(dstDir)
+	require.NoError(t, err)
+	require.NoError(t, dstStore.CreateBucket("bucket", http.Header{}))
+
+	srcClient := brimS3.GetS3Client(&brimS3.MigrationAuth{Endpoint: "file://" + srcDir, AccessKey: "access"})
+	dstClient := brimS3.GetS3Client(&brimS3.MigrationAuth{Endpoint: "file://" + dstDir, AccessKey: "access"})
+	taskChannel := make(chan *model.WALTask)
+	worker := NewTaskMigratorWALWorker(1)
+	worker.(*TaskMigratorWALWorker).minMultiPartObjectSize = 10
+	worker.Process(taskChannel)
+
+	for _, key := range []string{"small", "large"} {
+		errs := make(chan error, 1)
+		taskChannel <- &model.WALTask{
+			SourceClient:        srcClient,
+			DestinationsClients: []*s3.S3{dstClient},
+			WALEntry: &model.WALEntry{
+				Record: &watchdog.ConsistencyRecord{Method: watchdog.PUT, AccessKey: "access",
+					ObjectID: "bucket/" + key, ObjectVersion: 3},
+				RecordProcessedHook: func(_ *watchdog.ConsistencyRecord, err error) error {
+					errs <- err
+					return nil
+				}}}
+		require.NoError(t, <-errs)
+	}
+
+	for key, content := range map[string]string{"small": "data", "large": strings.Repeat("X", 20)} {
+		info, err := dstStore.Head("bucket", key)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), info.Size)
+		assert.Equal(t, "text/plain", info.Header.Get("Content-Type"))
+		assert.Equal(t, "3", info.Header.Get("X-Amz-Meta-Obj-Version"))
+	}
+	multipart, err := dstStore.Head("bucket", "large")
+	require.NoError(t, err)
+	assert.Contains(t, multipart.ETag, "-")
+	tagging, err := dstStore.GetSubResource("bucket", "large", "tagging")
+	require.NoError(t, err)
+	assert.Contains(t, string(tagging), "cold")
+	acl, err := dstStore.GetSubResource("bucket", "small", "acl")
+	require.NoError(t, err)
+	assert.Contains(t, string(acl), "AllUsers")
+}
@@ -1,6 +1,7 @@
 package feeder
 
 import (
+	"sync"
 	"time"
 )
 
@@ -11,8 +12,38 @@ type ThrottledPublisherConfig struct {
 	BurstEnabled         bool
 }
 
+//Throttler throttles a channel with a configuration which can be changed at runtime
+type Throttler struct {
+	config ThrottledPublisherConfig
+	mx     sync.Mutex
+}
+
+//NewThrottler creates a Throttler with the initial configuration
+func NewThrottler(config ThrottledPublisherConfig) *Throttler {
+	return &Throttler{config: config}
+}
+
+//Config returns the current configuration
+func (throttler *Throttler) Config() ThrottledPublisherConfig {
+	throttler.mx.Lock()
+	defer throttler.mx.Unlock()
+	return throttler.config
+}
+
+//SetConfig changes the configuration, it applies from the next emitted item
+func (throttler *Throttler) SetConfig(config ThrottledPublisherConfig) {
+	throttler.mx.Lock()
+	defer throttler.mx.Unlock()
+	throttler.config = config
+}
+
 //Throttle throttles the channel according to the configuration
 func Throttle(publisherChannel <-chan interface{}, config *ThrottledPublisherConfig) <-chan interface{} {
+	return NewThrottler(*config).Throttle(publisherChannel)
+}
+
+//Throttle throttles the channel according to the current configuration
+func (throttler *Throttler) Throttle(publisherChannel <-chan interface{}) <-chan interface{} {
 
 	throttledChannel := make(chan interface{})
 
@@ -20,10 +51,10 @@ func Throttle(publisherChannel <-chan interface{}, config *ThrottledPublisherCon
 
 		emissionStart := time.Now()
 		emittedItemsCount := uint64(0)
-		emissionDelay := time.Duration(config.TaskEmissionDuration.Nanoseconds() / int64(config.MaxEmittedTasksCount))
 
 		for {
 			next := <-publisherChannel
+			config := throttler.Config()
 
 			if config.BurstEnabled && emittedItemsCount+1 >= config.MaxEmittedTasksCount {
 				nextEmissionDelay := time.Until(emissionStart.Add(config.TaskEmissionDuration))
@@ -33,7 +64,7 @@ func Throttle(publisherChannel <-chan interface{}, config *ThrottledPublisherCon
 			}
 
 			if !config.BurstEnabled {
-				time.Sleep(emissionDelay)
+				time.Sleep(time.Duration(config.TaskEmissionDuration.Nanoseconds() / int64(config.MaxEmittedTasksCount)))
 			}
 
 			throttledChannel <- next
@@ -0,0 +1,23 @@
+package feeder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldApplyChangedThrottlerConfig(t *testing.T) {
+	throttler := NewThrottler(ThrottledPublisherConfig{MaxEmittedTasksCount: 1, TaskEmissionDuration: time.Hour})
+	published := make(chan interface{}, 1)
+	throttled := throttler.Throttle(published)
+	throttler.SetConfig(ThrottledPublisherConfig{MaxEmittedTasksCount: 1000, TaskEmissionDuration: time.Second})
+
+	published <- "item"
+	select {
+	case item := <-throttled:
+		assert.Equal(t, "item", item)
+	case <-time.After(time.Second):
+		t.Fatal("item throttled with the initial configuration")
+	}
+}